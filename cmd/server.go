@@ -6,8 +6,12 @@ import (
 	"fmt"
 	"os"
 	"os/signal"
+	"strings"
 	"sync"
+	"syscall"
 
+	"github.com/pleimer/ci-server-go/pkg/agent"
+	"github.com/pleimer/ci-server-go/pkg/logging"
 	"github.com/pleimer/ci-server-go/pkg/server"
 )
 
@@ -15,6 +19,7 @@ var configPath string
 
 func init() {
 	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "usage: %s [options] [replay <delivery-id> | drain | agent [agent options]]\n", os.Args[0])
 		flag.PrintDefaults()
 	}
 
@@ -23,10 +28,15 @@ func init() {
 }
 
 func main() {
+	if args := flag.Args(); len(args) > 0 {
+		os.Exit(command(args))
+	}
+
 	ctx, cancel := context.WithCancel(context.Background())
 
+	// SIGTERM drains the server, letting running jobs finish. SIGINT stops it right away
 	c := make(chan os.Signal, 1)
-	signal.Notify(c, os.Interrupt)
+	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
 	defer func() {
 		signal.Stop(c)
 		cancel()
@@ -35,10 +45,18 @@ func main() {
 	var wg sync.WaitGroup
 	wg.Add(1)
 	go func() {
-		select {
-		case <-c:
-			cancel()
-		case <-ctx.Done():
+		for {
+			select {
+			case sig := <-c:
+				if sig == syscall.SIGTERM {
+					server.Drain()
+					continue
+				}
+				cancel()
+				return
+			case <-ctx.Done():
+				return
+			}
 		}
 	}()
 
@@ -52,3 +70,76 @@ func main() {
 	server.Run(ctx, &wg)
 	wg.Wait()
 }
+
+// command runs subcommand args against the running server
+func command(args []string) int {
+	switch {
+	case args[0] == "replay" && len(args) == 2:
+		if err := server.Replay(configPath, args[1]); err != nil {
+			fmt.Println(err)
+			return 1
+		}
+		fmt.Printf("replaying delivery %s\n", args[1])
+		return 0
+	case args[0] == "agent":
+		return runAgent(args[1:])
+	case args[0] == "drain" && len(args) == 1:
+		if err := server.RequestDrain(configPath); err != nil {
+			fmt.Println(err)
+			return 1
+		}
+		fmt.Println("draining server")
+		return 0
+	default:
+		flag.Usage()
+		return 2
+	}
+}
+
+// runAgent runs a remote agent executing jobs of the server, until interrupted
+func runAgent(args []string) int {
+	hostname, _ := os.Hostname()
+	flags := flag.NewFlagSet("agent", flag.ExitOnError)
+	coordinator := flags.String("coordinator", "http://localhost:3000", "address of the server")
+	token := flags.String("token", "", "agents.token of the server. Default: $CI_AGENT_TOKEN")
+	name := flags.String("name", hostname, "name of the agent")
+	labels := flags.String("labels", "", "comma separated labels of the agent, matched against runs_on in ci.yml")
+	workDir := flags.String("workdir", "", "directory the workspaces of jobs are created in. Default: temporary directory")
+	level := flags.String("log", "INFO", "DEBUG,INFO,WARN,ERROR,NONE")
+	flags.Parse(args)
+	// read after parsing rather than as the flag default, which usage output would print
+	if *token == "" {
+		*token = os.Getenv("CI_AGENT_TOKEN")
+	}
+
+	log, err := logging.NewLogger(logging.FromString(*level), "console")
+	if err != nil {
+		fmt.Println(err)
+		return 1
+	}
+	log.Timestamp = true
+
+	a := &agent.Agent{
+		URL:     *coordinator,
+		Token:   *token,
+		Name:    *name,
+		WorkDir: *workDir,
+		Log:     log,
+	}
+	for _, label := range strings.Split(*labels, ",") {
+		if label = strings.TrimSpace(label); label != "" {
+			a.Labels = append(a.Labels, label)
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-c
+		cancel()
+	}()
+
+	a.Run(ctx)
+	return 0
+}
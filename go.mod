@@ -7,7 +7,6 @@ require (
 	github.com/go-playground/universal-translator v0.17.0 // indirect
 	github.com/golang-collections/go-datastructures v0.0.0-20150211160725-59788d5eb259
 	github.com/leodido/go-urn v1.2.0 // indirect
-	github.com/orcaman/concurrent-map v0.0.0-20190826125027-8c72a8bb44f6
 	github.com/pkg/errors v0.9.1
 	github.com/stretchr/testify v1.6.0 // indirect
 	gopkg.in/go-playground/validator.v9 v9.31.0
@@ -0,0 +1,88 @@
+// Package agent runs the scripts of jobs on remote machines. Agents register with the coordinator,
+// the server, under a set of labels and long-poll it for tasks. For each task, an agent downloads
+// the workspace of the job, runs the script, streams its output back and reports the result.
+//
+// Endpoints of the coordinator, all requiring an "Authorization: Bearer <token>" header:
+//
+//	POST /agents/register                   register an agent, returns its ID
+//	GET  /agents/<agent>/task               wait for a task, 204 No Content if none arrived in time
+//	GET  /agents/tasks/<task>/workspace     gzipped tar archive of the workspace of a task
+//	POST /agents/tasks/<task>/output        append output lines, 410 Gone if the task was cancelled
+//	POST /agents/tasks/<task>/result        report the outcome of a task
+package agent
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+)
+
+var (
+	//ErrNoAgents occurs when no registered agent carries the labels of a task
+	ErrNoAgents = errors.New("no agent registered with the requested labels")
+
+	//ErrAgentLost occurs when an agent stops reporting on the task it runs
+	ErrAgentLost = errors.New("agent stopped responding")
+
+	//ErrUnknownAgent occurs when an agent polls without being registered
+	ErrUnknownAgent = errors.New("agent not registered")
+
+	//ErrTaskGone occurs when the coordinator no longer waits for the result of a task
+	ErrTaskGone = errors.New("task cancelled")
+)
+
+// Registration of an agent
+type Registration struct {
+	Name   string   `json:"name"`
+	Labels []string `json:"labels"`
+}
+
+// Task script to run on an agent carrying all of Labels
+type Task struct {
+	ID     string   `json:"id"`
+	Labels []string `json:"labels"`
+	Script string   `json:"script"` // bash script
+	Env    []string `json:"env"`    // in the form key=value, added to the environment of the agent
+
+	Workspace string `json:"-"` // directory on the coordinator the script runs in
+}
+
+// Result outcome of a task
+type Result struct {
+	Error string `json:"error,omitempty"` // empty if the script succeeded
+}
+
+// ScriptError failure of a script reported by an agent
+type ScriptError struct {
+	Agent string
+	Err   string
+}
+
+func (e *ScriptError) Error() string {
+	return e.Err
+}
+
+// carries reports whether labels include all of required
+func carries(labels, required []string) bool {
+	for _, r := range required {
+		found := false
+		for _, l := range labels {
+			if l == r {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+func newID() (string, error) {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
@@ -0,0 +1,188 @@
+package agent
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pleimer/ci-server-go/pkg/assert"
+	"github.com/pleimer/ci-server-go/pkg/logging"
+)
+
+func TestCoordinator(t *testing.T) {
+	log, err := logging.NewLogger(logging.NONE, "console")
+	assert.Ok(t, err)
+
+	coordinator := NewCoordinator("secret", log)
+	coordinator.PollTimeout = 200 * time.Millisecond
+	coordinator.LostTimeout = 2 * time.Second // agents report at least every second
+	server := httptest.NewServer(coordinator)
+	defer server.Close()
+
+	workspace, err := ioutil.TempDir("", "workspace")
+	assert.Ok(t, err)
+	defer os.RemoveAll(workspace)
+	assert.Ok(t, os.MkdirAll(filepath.Join(workspace, "scripts"), 0755))
+	assert.Ok(t, ioutil.WriteFile(filepath.Join(workspace, "scripts", "test.sh"), []byte("echo testing $1\n"), 0755))
+
+	// several agents on one machine
+	ctx, cancel := context.WithCancel(context.Background())
+	var wg sync.WaitGroup
+	for _, a := range []*Agent{
+		{Name: "small", Labels: []string{"ocp"}},
+		{Name: "large", Labels: []string{"ocp", "large"}},
+	} {
+		a.URL = server.URL
+		a.Token = "secret"
+		a.Log = log
+		wg.Add(1)
+		go func(a *Agent) {
+			defer wg.Done()
+			a.Run(ctx)
+		}(a)
+	}
+	defer func() {
+		cancel()
+		wg.Wait()
+	}()
+	for len(coordinator.Agents()) < 2 {
+		time.Sleep(10 * time.Millisecond)
+	}
+	agents := coordinator.Agents()
+	assert.Equals(t, "large", agents[0].Name)
+	assert.Equals(t, []string{"ocp", "large"}, agents[0].Labels)
+	assert.Equals(t, "small", agents[1].Name)
+
+	run := func(ctx context.Context, task Task) ([]string, error) {
+		var lock sync.Mutex
+		output := []string{}
+		err := coordinator.Dispatch(ctx, task, func(line string) {
+			lock.Lock()
+			defer lock.Unlock()
+			output = append(output, line)
+		})
+		return output, err
+	}
+
+	t.Run("labels", func(t *testing.T) {
+		output, err := run(context.Background(), Task{
+			Labels:    []string{"large"},
+			Script:    "scripts/test.sh $SUITE;echo $CI_AGENT_NAME",
+			Env:       []string{"SUITE=smoke"},
+			Workspace: workspace,
+		})
+		assert.Ok(t, err)
+		assert.Equals(t, []string{"testing smoke", "large"}, output)
+	})
+
+	t.Run("script failure", func(t *testing.T) {
+		output, err := run(context.Background(), Task{Labels: []string{"ocp"}, Script: "echo failing;exit 3", Workspace: workspace})
+		assert.Equals(t, []string{"failing"}, output)
+		scriptErr, ok := err.(*ScriptError)
+		assert.Assert(t, ok, "expected script error, got %v", err)
+		assert.Equals(t, "exit status 3", scriptErr.Err)
+	})
+
+	t.Run("no agents", func(t *testing.T) {
+		_, err := run(context.Background(), Task{Labels: []string{"gpu"}, Script: "true", Workspace: workspace})
+		assert.Equals(t, ErrNoAgents, err)
+	})
+
+	t.Run("parallel", func(t *testing.T) {
+		start := time.Now()
+		var tasks sync.WaitGroup
+		names := make([][]string, 2)
+		for i := range names {
+			tasks.Add(1)
+			go func(i int) {
+				defer tasks.Done()
+				output, err := run(context.Background(), Task{Labels: []string{"ocp"}, Script: "sleep 1;echo $CI_AGENT_NAME", Workspace: workspace})
+				assert.Ok(t, err)
+				names[i] = output
+			}(i)
+		}
+		tasks.Wait()
+		assert.Assert(t, time.Since(start) < 1900*time.Millisecond, "tasks should run on both agents at once")
+		assert.Assert(t, names[0][0] != names[1][0], "tasks should run on different agents, ran on %v", names)
+	})
+
+	t.Run("cancel", func(t *testing.T) {
+		marker := filepath.Join(workspace, "cancelled")
+		ctx, cancel := context.WithTimeout(context.Background(), 300*time.Millisecond)
+		defer cancel()
+		_, err := run(ctx, Task{Labels: []string{"large"}, Script: "sleep 3;touch " + marker, Workspace: workspace})
+		assert.Equals(t, context.DeadlineExceeded, err)
+
+		// the agent stops the script and takes the next task
+		output, err := run(context.Background(), Task{Labels: []string{"large"}, Script: "echo next", Workspace: workspace})
+		assert.Ok(t, err)
+		assert.Equals(t, []string{"next"}, output)
+		time.Sleep(3 * time.Second)
+		_, err = os.Stat(marker)
+		assert.Assert(t, os.IsNotExist(err), "cancelled script should have been stopped")
+	})
+
+	request := func(method, path string, body interface{}) *http.Response {
+		data, _ := json.Marshal(body)
+		req, err := http.NewRequest(method, server.URL+path, bytes.NewReader(data))
+		assert.Ok(t, err)
+		req.Header.Set("Authorization", "Bearer secret")
+		resp, err := http.DefaultClient.Do(req)
+		assert.Ok(t, err)
+		return resp
+	}
+
+	t.Run("agent lost", func(t *testing.T) {
+		// agent that takes a task and disappears
+		resp := request(http.MethodPost, "/agents/register", Registration{Name: "flaky", Labels: []string{"flaky"}})
+		reg := map[string]string{}
+		assert.Ok(t, json.NewDecoder(resp.Body).Decode(&reg))
+		resp.Body.Close()
+
+		taken := make(chan Task)
+		go func() {
+			resp := request(http.MethodGet, "/agents/"+reg["id"]+"/task", nil)
+			defer resp.Body.Close()
+			task := Task{}
+			json.NewDecoder(resp.Body).Decode(&task)
+			taken <- task
+		}()
+
+		_, err := run(context.Background(), Task{Labels: []string{"flaky"}, Script: "true", Workspace: workspace})
+		assert.Equals(t, ErrAgentLost, err)
+
+		// late reports are turned down
+		task := <-taken
+		resp = request(http.MethodPost, "/agents/tasks/"+task.ID+"/result", Result{})
+		resp.Body.Close()
+		assert.Equals(t, http.StatusGone, resp.StatusCode)
+	})
+
+	t.Run("agent gone before polling", func(t *testing.T) {
+		// agent that registers and never polls
+		resp := request(http.MethodPost, "/agents/register", Registration{Name: "ghost", Labels: []string{"ghost"}})
+		resp.Body.Close()
+		assert.Equals(t, http.StatusOK, resp.StatusCode)
+
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		_, err := run(ctx, Task{Labels: []string{"ghost"}, Script: "true", Workspace: workspace})
+		assert.Equals(t, ErrNoAgents, err)
+	})
+
+	t.Run("unauthorized", func(t *testing.T) {
+		resp, err := http.Post(server.URL+"/agents/register", "application/json", strings.NewReader(`{"name": "intruder"}`))
+		assert.Ok(t, err)
+		resp.Body.Close()
+		assert.Equals(t, http.StatusUnauthorized, resp.StatusCode)
+	})
+}
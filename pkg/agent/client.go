@@ -0,0 +1,320 @@
+package agent
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/pleimer/ci-server-go/pkg/ghclient"
+	"github.com/pleimer/ci-server-go/pkg/logging"
+)
+
+// intervals of the agent
+const (
+	outputInterval = time.Second     // output is sent at most this often, and also serves as heartbeat
+	retryInterval  = 5 * time.Second // wait before contacting an unreachable coordinator again
+)
+
+// Agent runs the tasks of the coordinator at URL
+type Agent struct {
+	URL     string // address of the server, such as http://ci.example.com:3000
+	Token   string
+	Name    string
+	Labels  []string
+	WorkDir string // workspaces of tasks are created under WorkDir, the temporary directory if empty
+	Client  *http.Client
+	Log     *logging.Logger
+
+	id string
+}
+
+// Run registers the agent and runs tasks until ctx is cancelled
+func (a *Agent) Run(ctx context.Context) error {
+	if a.Client == nil {
+		a.Client = &http.Client{}
+	}
+
+	for ctx.Err() == nil {
+		if a.id == "" {
+			if err := a.register(ctx); err != nil {
+				a.Log.Metadata(map[string]interface{}{"module": "agent", "coordinator": a.URL, "error": err})
+				a.Log.Warn("failed registering with coordinator")
+				a.wait(ctx, retryInterval)
+				continue
+			}
+			a.Log.Metadata(map[string]interface{}{"module": "agent", "coordinator": a.URL, "labels": strings.Join(a.Labels, ",")})
+			a.Log.Info("registered with coordinator")
+		}
+
+		t, err := a.poll(ctx)
+		switch {
+		case err == ErrUnknownAgent:
+			// the coordinator restarted or forgot about the agent
+			a.id = ""
+		case err != nil:
+			if ctx.Err() == nil {
+				a.Log.Metadata(map[string]interface{}{"module": "agent", "coordinator": a.URL, "error": err})
+				a.Log.Warn("failed polling coordinator for tasks")
+				a.wait(ctx, retryInterval)
+			}
+		case t != nil:
+			a.run(ctx, *t)
+		}
+	}
+	return ctx.Err()
+}
+
+func (a *Agent) register(ctx context.Context) error {
+	resp, err := a.do(ctx, http.MethodPost, "/agents/register", Registration{Name: a.Name, Labels: a.Labels})
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return responseError(resp)
+	}
+
+	reg := map[string]string{}
+	if err := json.NewDecoder(resp.Body).Decode(&reg); err != nil {
+		return err
+	}
+	a.id = reg["id"]
+	return nil
+}
+
+// poll waits for a task. Returns nil if none arrived
+func (a *Agent) poll(ctx context.Context) (*Task, error) {
+	resp, err := a.do(ctx, http.MethodGet, "/agents/"+a.id+"/task", nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		t := Task{}
+		if err := json.NewDecoder(resp.Body).Decode(&t); err != nil {
+			return nil, err
+		}
+		return &t, nil
+	case http.StatusNoContent:
+		return nil, nil
+	case http.StatusNotFound:
+		return nil, ErrUnknownAgent
+	}
+	return nil, responseError(resp)
+}
+
+// run runs t and reports its output and result. Tasks cancelled by the coordinator are not reported
+func (a *Agent) run(ctx context.Context, t Task) {
+	a.Log.Metadata(map[string]interface{}{"module": "agent", "task": t.ID})
+	a.Log.Info("running task")
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	out := &outputBuffer{done: make(chan struct{})}
+	sent := make(chan struct{})
+	go func() {
+		defer close(sent)
+		a.sendOutput(ctx, t.ID, out, cancel)
+	}()
+
+	err := a.execute(ctx, t, out)
+	out.Close()
+	<-sent
+	if ctx.Err() != nil {
+		a.Log.Metadata(map[string]interface{}{"module": "agent", "task": t.ID})
+		a.Log.Info("task cancelled")
+		return
+	}
+
+	res := Result{}
+	if err != nil {
+		res.Error = err.Error()
+	}
+	resp, err := a.do(ctx, http.MethodPost, "/agents/tasks/"+t.ID+"/result", res)
+	if err == nil {
+		resp.Body.Close()
+	}
+	if err != nil || resp.StatusCode != http.StatusNoContent {
+		if err == nil {
+			err = responseError(resp)
+		}
+		a.Log.Metadata(map[string]interface{}{"module": "agent", "task": t.ID, "error": err})
+		a.Log.Error("failed reporting result of task")
+		return
+	}
+	a.Log.Metadata(map[string]interface{}{"module": "agent", "task": t.ID, "error": res.Error})
+	a.Log.Info("task finished")
+}
+
+// execute downloads the workspace of t and runs its script there
+func (a *Agent) execute(ctx context.Context, t Task, out *outputBuffer) error {
+	dir, err := ioutil.TempDir(a.WorkDir, "task-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+
+	resp, err := a.do(ctx, http.MethodGet, "/agents/tasks/"+t.ID+"/workspace", nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return responseError(resp)
+	}
+	if err := ghclient.ExtractTarball(resp.Body, dir); err != nil {
+		return fmt.Errorf("failed extracting workspace: %s", err)
+	}
+
+	cmd := exec.Command("bash", "-ce", t.Script)
+	cmd.Dir = dir
+	// the script runs in its own process group, so that cancelling it stops the processes it started
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	cmd.Env = append(append(os.Environ(), t.Env...), "CI_AGENT_NAME="+a.Name)
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	cmd.Stderr = cmd.Stdout
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	exited := make(chan struct{})
+	defer close(exited)
+	go func() {
+		select {
+		case <-ctx.Done():
+			syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+		case <-exited:
+		}
+	}()
+
+	scanner := bufio.NewScanner(stdout)
+	for scanner.Scan() {
+		out.Write(scanner.Text())
+	}
+	if err := cmd.Wait(); err != nil {
+		return err
+	}
+	return scanner.Err()
+}
+
+// sendOutput sends the output of task ID as it is written to out, until out is closed. The task is
+// cancelled if the coordinator no longer expects it
+func (a *Agent) sendOutput(ctx context.Context, ID string, out *outputBuffer, cancel func()) {
+	ticker := time.NewTicker(outputInterval)
+	defer ticker.Stop()
+	for {
+		closed := false
+		select {
+		case <-ticker.C:
+		case <-out.Done():
+			closed = true
+		}
+
+		lines := out.Take()
+		resp, err := a.do(ctx, http.MethodPost, "/agents/tasks/"+ID+"/output", lines)
+		if err == nil {
+			resp.Body.Close()
+			if resp.StatusCode == http.StatusGone {
+				cancel()
+				return
+			}
+		}
+		if err != nil && ctx.Err() == nil {
+			a.Log.Metadata(map[string]interface{}{"module": "agent", "task": ID, "error": err})
+			a.Log.Warn("failed sending output of task")
+			out.Restore(lines)
+		}
+		if closed || ctx.Err() != nil {
+			return
+		}
+	}
+}
+
+func (a *Agent) do(ctx context.Context, method, path string, body interface{}) (*http.Response, error) {
+	var data []byte
+	if body != nil {
+		var err error
+		if data, err = json.Marshal(body); err != nil {
+			return nil, err
+		}
+	}
+	req, err := http.NewRequest(method, strings.TrimSuffix(a.URL, "/")+path, bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Authorization", "Bearer "+a.Token)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	return a.Client.Do(req)
+}
+
+func (a *Agent) wait(ctx context.Context, d time.Duration) {
+	select {
+	case <-ctx.Done():
+	case <-time.After(d):
+	}
+}
+
+func responseError(resp *http.Response) error {
+	msg, _ := ioutil.ReadAll(resp.Body)
+	return fmt.Errorf("coordinator responded %s: %s", resp.Status, strings.TrimSpace(string(msg)))
+}
+
+// outputBuffer lines of output waiting to be sent
+type outputBuffer struct {
+	lock  sync.Mutex
+	lines []string
+	done  chan struct{}
+	once  sync.Once
+}
+
+func (b *outputBuffer) Write(line string) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.lines = append(b.lines, line)
+}
+
+// Take removes and returns the buffered lines
+func (b *outputBuffer) Take() []string {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	lines := b.lines
+	b.lines = nil
+	if lines == nil {
+		lines = []string{}
+	}
+	return lines
+}
+
+// Restore puts back lines that could not be sent
+func (b *outputBuffer) Restore(lines []string) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.lines = append(lines, b.lines...)
+}
+
+// Close marks the end of the output
+func (b *outputBuffer) Close() {
+	b.once.Do(func() { close(b.done) })
+}
+
+// Done is closed once the output is complete
+func (b *outputBuffer) Done() <-chan struct{} {
+	return b.done
+}
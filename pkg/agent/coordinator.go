@@ -0,0 +1,389 @@
+package agent
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pleimer/ci-server-go/pkg/logging"
+)
+
+// defaults of the coordinator
+const (
+	DefaultPollTimeout = 25 * time.Second
+	DefaultLostTimeout = 30 * time.Second
+)
+
+// AgentInfo registered agent
+type AgentInfo struct {
+	ID       string    `json:"id"`
+	Name     string    `json:"name"`
+	Labels   []string  `json:"labels"`
+	Task     string    `json:"task,omitempty"` // ID of the task running on the agent
+	LastSeen time.Time `json:"last_seen"`
+}
+
+// task dispatched task, waiting for an agent or running on one
+type task struct {
+	Task
+	agent    string
+	lastSeen time.Time
+	result   chan Result
+
+	// output is not called once the task is closed, that is once Dispatch returned
+	lock   sync.Mutex
+	output func(string)
+	closed bool
+}
+
+// Coordinator hands tasks to the agents polling it. It is served under /agents/
+type Coordinator struct {
+	PollTimeout time.Duration // time an agent poll is held open without a task
+	LostTimeout time.Duration // time after which a silent agent is considered gone
+	Log         *logging.Logger
+
+	token string
+
+	lock    sync.Mutex
+	agents  map[string]*AgentInfo
+	pending []*task // tasks waiting for an agent, oldest first
+	tasks   map[string]*task
+	changed chan struct{} // closed whenever pending tasks are added
+}
+
+// NewCoordinator creates a coordinator accepting agents that authenticate with token
+func NewCoordinator(token string, log *logging.Logger) *Coordinator {
+	return &Coordinator{
+		PollTimeout: DefaultPollTimeout,
+		LostTimeout: DefaultLostTimeout,
+		Log:         log,
+		token:       token,
+		agents:      make(map[string]*AgentInfo),
+		tasks:       make(map[string]*task),
+		changed:     make(chan struct{}),
+	}
+}
+
+// Agents lists the registered agents by name
+func (c *Coordinator) Agents() []AgentInfo {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.prune()
+
+	agents := []AgentInfo{}
+	for _, a := range c.agents {
+		info := *a
+		info.Labels = append([]string{}, a.Labels...)
+		agents = append(agents, info)
+	}
+	sort.Slice(agents, func(i, j int) bool {
+		if agents[i].Name == agents[j].Name {
+			return agents[i].ID < agents[j].ID
+		}
+		return agents[i].Name < agents[j].Name
+	})
+	return agents
+}
+
+// Dispatch runs t on an agent carrying all of its labels and waits for the result. Each line of
+// output of the script is passed to output as it arrives. Returns ErrNoAgents if no suitable agent is
+// registered, ErrAgentLost if the agent stops reporting, a *ScriptError if the script failed, or the
+// error of ctx, in which case the agent is told to stop the script
+func (c *Coordinator) Dispatch(ctx context.Context, t Task, output func(string)) error {
+	ID, err := newID()
+	if err != nil {
+		return err
+	}
+	t.ID = ID
+	tk := &task{
+		Task:   t,
+		result: make(chan Result, 1),
+		output: output,
+	}
+
+	c.lock.Lock()
+	c.prune()
+	if !c.available(t.Labels) {
+		c.lock.Unlock()
+		return ErrNoAgents
+	}
+	c.tasks[ID] = tk
+	c.pending = append(c.pending, tk)
+	close(c.changed)
+	c.changed = make(chan struct{})
+	c.lock.Unlock()
+	defer c.finish(tk)
+
+	c.Log.Metadata(map[string]interface{}{"module": "agent", "task": ID, "labels": strings.Join(t.Labels, ",")})
+	c.Log.Info("dispatched task")
+
+	ticker := time.NewTicker(c.LostTimeout / 4)
+	defer ticker.Stop()
+	for {
+		select {
+		case res := <-tk.result:
+			if res.Error != "" {
+				return &ScriptError{Agent: c.agentName(tk), Err: res.Error}
+			}
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+			switch err := c.check(tk); err {
+			case ErrAgentLost:
+				c.Log.Metadata(map[string]interface{}{"module": "agent", "task": ID, "agent": c.agentName(tk)})
+				c.Log.Warn("agent stopped reporting on task")
+				return err
+			case ErrNoAgents:
+				c.Log.Metadata(map[string]interface{}{"module": "agent", "task": ID, "labels": strings.Join(t.Labels, ",")})
+				c.Log.Warn("agents carrying the labels of the task are gone")
+				return err
+			}
+		}
+	}
+}
+
+// ServeHTTP implements http.Handler
+func (c *Coordinator) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if subtle.ConstantTimeCompare([]byte(req.Header.Get("Authorization")), []byte("Bearer "+c.token)) != 1 {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	path := strings.Split(strings.Trim(strings.TrimPrefix(req.URL.Path, "/agents"), "/"), "/")
+	switch {
+	case req.Method == http.MethodPost && len(path) == 1 && path[0] == "register":
+		c.register(w, req)
+	case req.Method == http.MethodGet && len(path) == 2 && path[1] == "task":
+		c.poll(w, req, path[0])
+	case req.Method == http.MethodGet && len(path) == 3 && path[0] == "tasks" && path[2] == "workspace":
+		c.workspace(w, req, path[1])
+	case req.Method == http.MethodPost && len(path) == 3 && path[0] == "tasks" && path[2] == "output":
+		c.appendOutput(w, req, path[1])
+	case req.Method == http.MethodPost && len(path) == 3 && path[0] == "tasks" && path[2] == "result":
+		c.report(w, req, path[1])
+	default:
+		http.Error(w, "not found", http.StatusNotFound)
+	}
+}
+
+// POST /agents/register
+func (c *Coordinator) register(w http.ResponseWriter, req *http.Request) {
+	reg := Registration{}
+	if err := json.NewDecoder(req.Body).Decode(&reg); err != nil || reg.Name == "" {
+		http.Error(w, "invalid registration", http.StatusBadRequest)
+		return
+	}
+	ID, err := newID()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	c.lock.Lock()
+	c.agents[ID] = &AgentInfo{ID: ID, Name: reg.Name, Labels: reg.Labels, LastSeen: time.Now()}
+	c.lock.Unlock()
+
+	c.Log.Metadata(map[string]interface{}{"module": "agent", "agent": reg.Name, "labels": strings.Join(reg.Labels, ",")})
+	c.Log.Info("registered agent")
+	writeJSON(w, http.StatusOK, map[string]string{"id": ID})
+}
+
+// GET /agents/<agent>/task
+func (c *Coordinator) poll(w http.ResponseWriter, req *http.Request, agentID string) {
+	timeout := time.NewTimer(c.PollTimeout)
+	defer timeout.Stop()
+
+	for {
+		c.lock.Lock()
+		a, ok := c.agents[agentID]
+		if !ok {
+			c.lock.Unlock()
+			http.Error(w, ErrUnknownAgent.Error(), http.StatusNotFound)
+			return
+		}
+		a.LastSeen = time.Now()
+		if tk, ok := c.tasks[a.Task]; ok && tk.agent == agentID {
+			// an agent only polls between tasks, so the previous one will never be reported
+			tk.lastSeen = time.Time{}
+		}
+		a.Task = ""
+
+		for i, tk := range c.pending {
+			if !carries(a.Labels, tk.Labels) {
+				continue
+			}
+			c.pending = append(c.pending[:i], c.pending[i+1:]...)
+			tk.agent = agentID
+			tk.lastSeen = time.Now()
+			a.Task = tk.ID
+			c.lock.Unlock()
+
+			c.Log.Metadata(map[string]interface{}{"module": "agent", "task": tk.ID, "agent": a.Name})
+			c.Log.Info("assigned task to agent")
+			writeJSON(w, http.StatusOK, tk.Task)
+			return
+		}
+		changed := c.changed
+		c.lock.Unlock()
+
+		select {
+		case <-changed:
+		case <-timeout.C:
+			w.WriteHeader(http.StatusNoContent)
+			return
+		case <-req.Context().Done():
+			return
+		}
+	}
+}
+
+// GET /agents/tasks/<task>/workspace
+func (c *Coordinator) workspace(w http.ResponseWriter, req *http.Request, taskID string) {
+	tk, ok := c.running(taskID)
+	if !ok {
+		http.Error(w, ErrTaskGone.Error(), http.StatusGone)
+		return
+	}
+	w.Header().Set("Content-Type", "application/gzip")
+	if err := writeArchive(w, tk.Workspace); err != nil {
+		c.Log.Metadata(map[string]interface{}{"module": "agent", "task": taskID, "error": err})
+		c.Log.Error("failed sending workspace to agent")
+	}
+}
+
+// POST /agents/tasks/<task>/output
+func (c *Coordinator) appendOutput(w http.ResponseWriter, req *http.Request, taskID string) {
+	lines := []string{}
+	if err := json.NewDecoder(req.Body).Decode(&lines); err != nil {
+		http.Error(w, "invalid output", http.StatusBadRequest)
+		return
+	}
+	tk, ok := c.running(taskID)
+	if !ok {
+		http.Error(w, ErrTaskGone.Error(), http.StatusGone)
+		return
+	}
+
+	tk.lock.Lock()
+	defer tk.lock.Unlock()
+	if tk.closed {
+		http.Error(w, ErrTaskGone.Error(), http.StatusGone)
+		return
+	}
+	for _, line := range lines {
+		tk.output(line)
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// POST /agents/tasks/<task>/result
+func (c *Coordinator) report(w http.ResponseWriter, req *http.Request, taskID string) {
+	res := Result{}
+	if err := json.NewDecoder(req.Body).Decode(&res); err != nil {
+		http.Error(w, "invalid result", http.StatusBadRequest)
+		return
+	}
+	tk, ok := c.running(taskID)
+	if !ok {
+		http.Error(w, ErrTaskGone.Error(), http.StatusGone)
+		return
+	}
+	select {
+	case tk.result <- res:
+	default:
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// running retrieves the task assigned to an agent, recording that the agent is still at work
+func (c *Coordinator) running(taskID string) (*task, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	tk, ok := c.tasks[taskID]
+	if !ok || tk.agent == "" {
+		return nil, false
+	}
+	tk.lastSeen = time.Now()
+	if a, ok := c.agents[tk.agent]; ok {
+		a.LastSeen = tk.lastSeen
+	}
+	return tk, true
+}
+
+// finish forgets tk and stops passing its output on
+func (c *Coordinator) finish(tk *task) {
+	tk.lock.Lock()
+	tk.closed = true
+	tk.lock.Unlock()
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	delete(c.tasks, tk.ID)
+	for i, p := range c.pending {
+		if p == tk {
+			c.pending = append(c.pending[:i], c.pending[i+1:]...)
+			break
+		}
+	}
+	if a, ok := c.agents[tk.agent]; ok && a.Task == tk.ID {
+		a.Task = ""
+	}
+}
+
+// check returns ErrAgentLost if the agent running tk stopped reporting, and ErrNoAgents if tk waits
+// for an agent while none carrying its labels is left
+func (c *Coordinator) check(tk *task) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if tk.agent != "" {
+		if time.Since(tk.lastSeen) > c.LostTimeout {
+			return ErrAgentLost
+		}
+		return nil
+	}
+	c.prune()
+	if !c.available(tk.Labels) {
+		return ErrNoAgents
+	}
+	return nil
+}
+
+func (c *Coordinator) agentName(tk *task) string {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if a, ok := c.agents[tk.agent]; ok {
+		return a.Name
+	}
+	return tk.agent
+}
+
+// available reports whether a registered agent carries labels. Must be called with lock held
+func (c *Coordinator) available(labels []string) bool {
+	for _, a := range c.agents {
+		if carries(a.Labels, labels) {
+			return true
+		}
+	}
+	return false
+}
+
+// prune forgets idle agents that stopped polling. Must be called with lock held
+func (c *Coordinator) prune() {
+	for ID, a := range c.agents {
+		if a.Task == "" && time.Since(a.LastSeen) > c.PollTimeout+c.LostTimeout {
+			delete(c.agents, ID)
+		}
+	}
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(v)
+}
@@ -5,7 +5,9 @@ import (
 	"fmt"
 	"io"
 	"io/ioutil"
+	"path/filepath"
 	"strings"
+	"time"
 
 	"github.com/pkg/errors"
 	"gopkg.in/go-playground/validator.v9"
@@ -15,8 +17,23 @@ import (
 //Config holds foundational configurations for the ci engine.
 type Config struct {
 	Github struct {
-		User  string `yaml:"user" validate:"required"`
-		Oauth string `yaml:"oauth" validate:"required"`
+		User          string `yaml:"user"`
+		Oauth         string `yaml:"oauth"`
+		WebhookSecret string `yaml:"webhookSecret"`
+		APIURL        string `yaml:"apiURL"`    // github.com if empty
+		UploadURL     string `yaml:"uploadURL"` // derived from apiURL if empty
+		GistURL       string `yaml:"gistURL"`   // derived from apiURL if empty
+		WebURL        string `yaml:"webURL"`    // derived from apiURL if empty
+		TLS           struct {
+			CAFile   string `yaml:"caFile"`
+			CertFile string `yaml:"certFile"`
+			KeyFile  string `yaml:"keyFile"`
+		} `yaml:"tls"`
+		App struct {
+			ID         int64  `yaml:"id"`
+			PrivateKey string `yaml:"privateKey"` // path to PEM encoded private key
+		} `yaml:"app"`
+		RefreshInterval time.Duration `yaml:"refreshInterval"` // reload interval of configured repositories
 	} `yaml:"github" validate:"required"`
 
 	Listener struct {
@@ -29,9 +46,127 @@ type Config struct {
 	} `yaml:"logger" validate:"required"`
 
 	Runner struct {
-		NumWorkers      int      `yaml:"numWorkers" validate:"required"`
-		AuthorizedUsers []string `yaml:"authorizedUsers" validate:"required"`
+		NumWorkers      int        `yaml:"numWorkers" validate:"required"`
+		AuthorizedUsers []string   `yaml:"authorizedUsers" validate:"required"`
+		Priorities      Priorities `yaml:"priorities"`
+		Recovery        string     `yaml:"recovery" validate:"omitempty,oneof=requeue error"` // jobs interrupted by a restart
+
+		// how long running jobs may take to finish when the server drains before shutting down
+		DrainTimeout time.Duration `yaml:"drainTimeout" validate:"min=0"`
+		// running jobs are cancelled once they run longer than JobTimeout. Jobs run without limit if zero
+		JobTimeout time.Duration `yaml:"jobTimeout" validate:"min=0"`
 	} `yaml:"runner" validate:"required"`
+
+	Admin struct {
+		Token string `yaml:"token"` // admin endpoints are disabled if empty
+	} `yaml:"admin"`
+
+	Agents struct {
+		Token string `yaml:"token"` // remote agents are disabled if empty
+	} `yaml:"agents"`
+
+	Cache struct {
+		BlobMemory int `yaml:"blobMemory" validate:"min=0"` // MiB of cached blob contents
+		TreeMemory int `yaml:"treeMemory" validate:"min=0"` // MiB of cached trees
+		Commits    int `yaml:"commits" validate:"min=0"`    // number of indexed commits
+		Responses  int `yaml:"responses" validate:"min=0"`  // MiB of cached api responses
+	} `yaml:"cache"`
+
+	Storage struct {
+		Dir string `yaml:"dir"` // state is kept in memory only if empty
+	} `yaml:"storage"`
+
+	Repositories []RepositoryConfig `yaml:"repositories" validate:"dive"`
+}
+
+// strategies for downloading repository contents into a job workspace
+const (
+	FetchTree    = "tree"    // walk git trees and blobs through the api
+	FetchTarball = "tarball" // download a single archive of the commit
+	FetchGit     = "git"     // clone with the local git binary
+)
+
+// policies for jobs targeting the same reference of a repository
+const (
+	ConcurrencyCancel   = "cancel-in-progress" // a new job cancels the running job
+	ConcurrencyQueue    = "queue"              // a new job waits for the running job to finish
+	ConcurrencyCoalesce = "coalesce"           // as queue, dropping waiting jobs when a newer one arrives
+	ConcurrencyParallel = "parallel"           // jobs run independently
+)
+
+// handling of jobs that were queued or running when the server stopped
+const (
+	RecoveryRequeue = "requeue" // the jobs are queued again
+	RecoveryError   = "error"   // the commits of the jobs are marked errored
+)
+
+// backends for reporting job results
+const (
+	ReportStatus = "status" // legacy commit statuses
+	ReportChecks = "checks" // check runs with annotations
+)
+
+// RepositoryConfig holds settings that apply to a single monitored repository
+type RepositoryConfig struct {
+	Name          string `yaml:"name" validate:"required"` // in the form owner/repo
+	WebhookSecret string `yaml:"webhookSecret"`
+	Fetch         string `yaml:"fetch" validate:"omitempty,oneof=tree tarball git"`
+	Depth         int    `yaml:"depth" validate:"min=0"` // clone depth for git fetch strategy. 0 fetches full history
+	Reporter      string `yaml:"reporter" validate:"omitempty,oneof=status checks"`
+	Concurrency   string `yaml:"concurrency" validate:"omitempty,oneof=cancel-in-progress queue coalesce parallel"`
+}
+
+// Priorities order of queued jobs. The priority of a job is the sum of the priority of its type, of its
+// repository and of the user it runs for, plus DefaultBranch for jobs on the default branch of the repository.
+// Jobs of higher priority run first
+type Priorities struct {
+	Types         map[string]int `yaml:"types"`         // by job type: push, pull_request or comment
+	DefaultBranch int            `yaml:"defaultBranch"` // added for jobs on the default branch
+	Repositories  map[string]int `yaml:"repositories"`  // by repository, in the form owner/repo
+	Users         map[string]int `yaml:"users"`
+
+	// waiting in the queue for Aging raises the priority of a job by one, so that jobs of low
+	// priority are not starved. Aging is disabled if zero
+	Aging time.Duration `yaml:"aging"`
+}
+
+// DefaultPriorities jobs requested explicitly come before pull request updates, which come before pushes
+func DefaultPriorities() Priorities {
+	return Priorities{
+		Types: map[string]int{
+			"comment":      2,
+			"pull_request": 1,
+			"push":         0,
+		},
+		DefaultBranch: 1,
+		Aging:         5 * time.Minute,
+	}
+}
+
+// Repository priority of jobs of repository fullName (owner/repo)
+func (p Priorities) Repository(fullName string) int {
+	for name, priority := range p.Repositories {
+		if strings.EqualFold(name, fullName) {
+			return priority
+		}
+	}
+	return 0
+}
+
+// RecoveryPolicy handling of jobs interrupted by a restart. Defaults to RecoveryRequeue
+func (c *Config) RecoveryPolicy() string {
+	if c.Runner.Recovery == "" {
+		return RecoveryRequeue
+	}
+	return c.Runner.Recovery
+}
+
+// FetchStrategy strategy used to download repository contents. Defaults to FetchTree
+func (rc RepositoryConfig) FetchStrategy() string {
+	if rc.Fetch == "" {
+		return FetchTree
+	}
+	return rc.Fetch
 }
 
 // New generate config object with defaults
@@ -50,14 +185,88 @@ func New() *Config {
 			Target: "console",
 		},
 		Runner: struct {
-			NumWorkers      int      `yaml:"numWorkers" validate:"required"`
-			AuthorizedUsers []string `yaml:"authorizedUsers" validate:"required"`
+			NumWorkers      int           `yaml:"numWorkers" validate:"required"`
+			AuthorizedUsers []string      `yaml:"authorizedUsers" validate:"required"`
+			Priorities      Priorities    `yaml:"priorities"`
+			Recovery        string        `yaml:"recovery" validate:"omitempty,oneof=requeue error"`
+			DrainTimeout    time.Duration `yaml:"drainTimeout" validate:"min=0"`
+			JobTimeout      time.Duration `yaml:"jobTimeout" validate:"min=0"`
+		}{
+			NumWorkers:   4,
+			Priorities:   DefaultPriorities(),
+			DrainTimeout: 10 * time.Minute,
+		},
+		Cache: struct {
+			BlobMemory int `yaml:"blobMemory" validate:"min=0"`
+			TreeMemory int `yaml:"treeMemory" validate:"min=0"`
+			Commits    int `yaml:"commits" validate:"min=0"`
+			Responses  int `yaml:"responses" validate:"min=0"`
 		}{
-			NumWorkers: 4,
+			BlobMemory: 256,
+			TreeMemory: 64,
+			Commits:    10000,
+			Responses:  32,
 		},
 	}
 }
 
+// Repository retrieve settings for repository fullName (owner/repo). Returns
+// an empty configuration if the repository has no entry
+func (c *Config) Repository(fullName string) RepositoryConfig {
+	for _, r := range c.Repositories {
+		if strings.EqualFold(r.Name, fullName) {
+			return r
+		}
+	}
+	return RepositoryConfig{Name: fullName}
+}
+
+// StoragePath path of name within the storage directory. Returns an empty
+// string if no storage directory is configured
+func (c *Config) StoragePath(name string) string {
+	if c.Storage.Dir == "" {
+		return ""
+	}
+	return filepath.Join(c.Storage.Dir, name)
+}
+
+// RepositoryNames names of configured repositories in the form owner/repo
+func (c *Config) RepositoryNames() []string {
+	names := make([]string, 0, len(c.Repositories))
+	for _, r := range c.Repositories {
+		names = append(names, r.Name)
+	}
+	return names
+}
+
+// WebhookSecrets map of repository names to webhook secrets for repositories
+// that override the global secret
+func (c *Config) WebhookSecrets() map[string]string {
+	secrets := make(map[string]string)
+	for _, r := range c.Repositories {
+		if r.WebhookSecret != "" {
+			secrets[r.Name] = r.WebhookSecret
+		}
+	}
+	return secrets
+}
+
+// ConcurrencyPolicy policy for jobs targeting the same reference. Defaults to ConcurrencyCancel
+func (rc RepositoryConfig) ConcurrencyPolicy() string {
+	if rc.Concurrency == "" {
+		return ConcurrencyCancel
+	}
+	return rc.Concurrency
+}
+
+// ReportBackend backend used to report job results. Defaults to ReportStatus
+func (rc RepositoryConfig) ReportBackend() string {
+	if rc.Reporter == "" {
+		return ReportStatus
+	}
+	return rc.Reporter
+}
+
 //Parse parse yaml from reader
 func (c *Config) Parse(r io.Reader) error {
 	validate := validator.New()
@@ -84,6 +293,62 @@ func (c *Config) Parse(r io.Reader) error {
 		return errors.Wrap(err, "error while validating configuration")
 	}
 
+	err = c.validateGithub()
+	if err != nil {
+		return err
+	}
+	return c.validateReporters()
+}
+
+// UseApp returns true if the server authenticates as a github app
+func (c *Config) UseApp() bool {
+	return c.Github.App.ID != 0
+}
+
+// either an app or an oauth token must be configured. Gists are owned by users,
+// so the oauth token is still needed in app mode for gist reports
+func (c *Config) validateGithub() error {
+	missingFields := []string{}
+	switch {
+	case c.UseApp():
+		if c.Github.App.PrivateKey == "" {
+			missingFields = append(missingFields, "github.app.privateKey")
+		}
+		if c.Github.Oauth != "" && c.Github.User == "" {
+			missingFields = append(missingFields, "github.user")
+		}
+	default:
+		if c.Github.User == "" {
+			missingFields = append(missingFields, "github.user")
+		}
+		if c.Github.Oauth == "" {
+			missingFields = append(missingFields, "github.oauth")
+		}
+	}
+
+	if c.Github.TLS.CertFile != "" && c.Github.TLS.KeyFile == "" {
+		missingFields = append(missingFields, "github.tls.keyFile")
+	}
+	if c.Github.TLS.KeyFile != "" && c.Github.TLS.CertFile == "" {
+		missingFields = append(missingFields, "github.tls.certFile")
+	}
+
+	if len(missingFields) > 0 {
+		return fmt.Errorf("missing fields in config: (%s)", strings.Join(missingFields, " , "))
+	}
+	return nil
+}
+
+// the checks api only accepts app credentials, so check runs cannot be reported with an oauth token
+func (c *Config) validateReporters() error {
+	if c.UseApp() {
+		return nil
+	}
+	for _, repo := range c.Repositories {
+		if repo.Reporter == ReportChecks {
+			return fmt.Errorf("repository %s: reporter '%s' requires github.app", repo.Name, ReportChecks)
+		}
+	}
 	return nil
 }
 
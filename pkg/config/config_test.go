@@ -1 +1,139 @@
 package config
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pleimer/ci-server-go/pkg/assert"
+)
+
+const baseConfig = `
+listener:
+    address: ":3000"
+logger:
+    level: INFO
+    target: console
+runner:
+    numWorkers: 2
+    authorizedUsers:
+        - user1
+`
+
+func TestParseGithubAuthentication(t *testing.T) {
+	tests := []struct {
+		name   string
+		github string
+		err    string
+	}{
+		{"oauth", "github:\n    user: admin\n    oauth: token\n", ""},
+		{"app", "github:\n    app:\n        id: 42\n        privateKey: /etc/key.pem\n", ""},
+		{"app with gist user", "github:\n    user: admin\n    oauth: token\n    app:\n        id: 42\n        privateKey: /etc/key.pem\n", ""},
+		{"missing oauth", "github:\n    user: admin\n", "missing fields in config: (github.oauth)"},
+		{"missing private key", "github:\n    app:\n        id: 42\n", "missing fields in config: (github.app.privateKey)"},
+		{"oauth without user", "github:\n    oauth: token\n    app:\n        id: 42\n        privateKey: /etc/key.pem\n", "missing fields in config: (github.user)"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := New().Parse(strings.NewReader(baseConfig + test.github))
+			if test.err == "" {
+				assert.Ok(t, err)
+				return
+			}
+			assert.Assert(t, (err != nil), "should have been an error")
+			assert.Equals(t, test.err, err.Error())
+		})
+	}
+}
+
+func TestParsePriorities(t *testing.T) {
+	conf := New()
+	err := conf.Parse(strings.NewReader(baseConfig + `
+    priorities:
+        types:
+            push: 5
+        repositories:
+            Owner/Example: 3
+        users:
+            user1: 1
+        aging: 30s
+github:
+    user: admin
+    oauth: token
+`))
+	assert.Ok(t, err)
+
+	p := conf.Runner.Priorities
+	assert.Equals(t, map[string]int{"comment": 2, "pull_request": 1, "push": 5}, p.Types)
+	assert.Equals(t, 1, p.DefaultBranch)
+	assert.Equals(t, 3, p.Repository("owner/example"))
+	assert.Equals(t, 0, p.Repository("owner/other"))
+	assert.Equals(t, 1, p.Users["user1"])
+	assert.Equals(t, "30s", p.Aging.String())
+}
+
+func TestConcurrencyPolicy(t *testing.T) {
+	github := "github:\n    user: admin\n    oauth: token\n"
+
+	conf := New()
+	assert.Ok(t, conf.Parse(strings.NewReader(baseConfig+github+"repositories:\n    - name: owner/queued\n      concurrency: queue\n    - name: owner/default\n")))
+	assert.Equals(t, ConcurrencyQueue, conf.Repository("owner/queued").ConcurrencyPolicy())
+	assert.Equals(t, ConcurrencyCancel, conf.Repository("owner/default").ConcurrencyPolicy())
+	assert.Equals(t, ConcurrencyCancel, conf.Repository("owner/unknown").ConcurrencyPolicy())
+
+	err := New().Parse(strings.NewReader(baseConfig + github + "repositories:\n    - name: owner/repo\n      concurrency: sometimes\n"))
+	assert.Assert(t, err != nil, "unknown policy should be rejected")
+}
+
+func TestChecksReporter(t *testing.T) {
+	repositories := "repositories:\n    - name: owner/repo\n      reporter: checks\n"
+	app := "github:\n    app:\n        id: 42\n        privateKey: /etc/key.pem\n"
+	assert.Ok(t, New().Parse(strings.NewReader(baseConfig+app+repositories)))
+
+	err := New().Parse(strings.NewReader(baseConfig + "github:\n    user: admin\n    oauth: token\n" + repositories))
+	assert.Assert(t, err != nil, "checks reporter should be rejected with oauth authentication")
+	assert.Equals(t, "repository owner/repo: reporter 'checks' requires github.app", err.Error())
+}
+
+func TestRecoveryPolicy(t *testing.T) {
+	github := "github:\n    user: admin\n    oauth: token\n"
+
+	conf := New()
+	assert.Ok(t, conf.Parse(strings.NewReader(baseConfig+github)))
+	assert.Equals(t, RecoveryRequeue, conf.RecoveryPolicy())
+
+	conf = New()
+	assert.Ok(t, conf.Parse(strings.NewReader(baseConfig+"    recovery: error\n"+github)))
+	assert.Equals(t, RecoveryError, conf.RecoveryPolicy())
+
+	err := New().Parse(strings.NewReader(baseConfig + "    recovery: retry\n" + github))
+	assert.Assert(t, err != nil, "unknown recovery policy should be rejected")
+}
+
+func TestDrainTimeout(t *testing.T) {
+	github := "github:\n    user: admin\n    oauth: token\n"
+
+	conf := New()
+	assert.Ok(t, conf.Parse(strings.NewReader(baseConfig+github)))
+	assert.Equals(t, "10m0s", conf.Runner.DrainTimeout.String())
+
+	conf = New()
+	assert.Ok(t, conf.Parse(strings.NewReader(baseConfig+"    drainTimeout: 90s\n"+github)))
+	assert.Equals(t, "1m30s", conf.Runner.DrainTimeout.String())
+}
+
+func TestJobTimeout(t *testing.T) {
+	github := "github:\n    user: admin\n    oauth: token\n"
+
+	conf := New()
+	assert.Ok(t, conf.Parse(strings.NewReader(baseConfig+github)))
+	assert.Equals(t, time.Duration(0), conf.Runner.JobTimeout)
+
+	conf = New()
+	assert.Ok(t, conf.Parse(strings.NewReader(baseConfig+"    jobTimeout: 2h\n"+github)))
+	assert.Equals(t, "2h0m0s", conf.Runner.JobTimeout.String())
+
+	conf = New()
+	assert.Assert(t, conf.Parse(strings.NewReader(baseConfig+"    jobTimeout: -1m\n"+github)) != nil, "negative job timeout should be rejected")
+}
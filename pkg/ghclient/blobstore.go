@@ -0,0 +1,62 @@
+package ghclient
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// blobStore content addressed store of decoded blob contents on disk, keyed by git object sha
+type blobStore struct {
+	dir string
+}
+
+func newBlobStore(dir string) (*blobStore, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	return &blobStore{dir: dir}, nil
+}
+
+// get retrieve contents of blob sha. Contents that do not hash to sha are discarded
+func (bs *blobStore) get(sha string) ([]byte, bool) {
+	path := bs.path(sha)
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, false
+	}
+	if gitBlobSha(content) != sha {
+		os.Remove(path)
+		return nil, false
+	}
+	return content, true
+}
+
+func (bs *blobStore) put(sha string, content []byte) error {
+	path := bs.path(sha)
+	if _, err := os.Stat(path); err == nil {
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	return writeFileAtomic(path, content)
+}
+
+func (bs *blobStore) path(sha string) string {
+	if len(sha) <= 2 {
+		return filepath.Join(bs.dir, sha)
+	}
+	return filepath.Join(bs.dir, sha[:2], sha[2:])
+}
+
+// gitBlobSha object id git assigns to a blob with content
+func gitBlobSha(content []byte) string {
+	h := sha1.New()
+	fmt.Fprintf(h, "blob %d\x00", len(content))
+	h.Write(content)
+	return hex.EncodeToString(h.Sum(nil))
+}
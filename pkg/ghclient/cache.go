@@ -1,63 +1,146 @@
 package ghclient
 
-import "sync"
+import (
+	"encoding/base64"
+)
 
-//Cache one way cache for tracking github trees
+// approximate memory overhead of a cached object beyond its variable length fields
+const objectOverhead = 64
+
+// CacheLimits bounds the memory used by the object cache. A limit of 0 disables that bound
+type CacheLimits struct {
+	BlobBytes int64 // total size of cached blob contents
+	TreeBytes int64 // approximate total size of cached trees
+	Commits   int   // number of indexed commits
+}
+
+// DefaultCacheLimits limits of caches created with NewCache
+var DefaultCacheLimits = CacheLimits{
+	BlobBytes: 256 << 20,
+	TreeBytes: 64 << 20,
+	Commits:   10000,
+}
+
+//Cache least recently used cache of github trees, blobs and commits. Blobs can additionally
+//be kept in a content addressed store on disk
 type Cache struct {
-	// trees       map[string]*Tree
-	// blobs       map[string]*Blob
-	// commitIndex map[string]*Commit
-	// rw          sync.RWMutex
-	trees       sync.Map
-	blobs       sync.Map
-	commitIndex sync.Map
+	trees       *lru
+	blobs       *lru
+	commitIndex *lru
+	store       *blobStore
 }
 
-//NewCache create cache
+//NewCache create cache with default limits
 func NewCache() Cache {
+	return NewCacheWithLimits(DefaultCacheLimits)
+}
+
+// NewCacheWithLimits create cache bounded by limits
+func NewCacheWithLimits(limits CacheLimits) Cache {
 	return Cache{
-		// trees:       make(map[string]*Tree),
-		// blobs:       make(map[string]*Blob),
-		// commitIndex: make(map[string]*Commit),
-		trees:       sync.Map{},
-		blobs:       sync.Map{},
-		commitIndex: sync.Map{},
+		trees:       newLRU("trees", limits.TreeBytes),
+		blobs:       newLRU("blobs", limits.BlobBytes),
+		commitIndex: newLRU("commits", int64(limits.Commits)),
 	}
 }
 
+// SetBlobStore keep blob contents in directory dir, so that they survive eviction and restarts
+func (c *Cache) SetBlobStore(dir string) error {
+	store, err := newBlobStore(dir)
+	if err != nil {
+		return err
+	}
+	c.store = store
+	return nil
+}
+
+// GetBlob retrieve blob sha from memory or the blob store. The returned blob is not attached to a tree
 func (c *Cache) GetBlob(sha string) *Blob {
-	if res, found := c.blobs.Load(sha); found {
+	if res, found := c.blobs.get(sha); found {
 		return res.(*Blob)
 	}
-	return nil
+	if c.store == nil {
+		return nil
+	}
+
+	content, found := c.store.get(sha)
+	if !found {
+		return nil
+	}
+	b := &Blob{
+		Sha:      sha,
+		Encoding: "base64",
+		Content:  base64.StdEncoding.EncodeToString(content),
+	}
+	c.blobs.add(sha, b, blobCost(b))
+	return b
 }
 
-func (c *Cache) GetTree(sha string) *Tree {
-	if res, found := c.trees.Load(sha); found {
-		return res.(*Tree)
+// GetTree retrieve entries of tree sha
+func (c *Cache) GetTree(sha string) *TreeMarshal {
+	if res, found := c.trees.get(sha); found {
+		return res.(*TreeMarshal)
 	}
 	return nil
 }
 
 func (c *Cache) GetCommit(sha string) *Commit {
-	if res, found := c.commitIndex.Load(sha); found {
+	if res, found := c.commitIndex.get(sha); found {
 		return res.(*Commit)
 	}
 	return nil
 }
 
 func (c *Cache) WriteBlob(b *Blob) {
-	c.blobs.Store(b.Sha, b)
+	c.blobs.add(b.Sha, b, blobCost(b))
+	if c.store == nil {
+		return
+	}
+	if content, err := base64.StdEncoding.DecodeString(b.Content); err == nil {
+		c.store.put(b.Sha, content)
+	}
 }
 
-func (c *Cache) WriteTree(t *Tree) {
-	c.trees.Store(t.Sha, t)
+func (c *Cache) WriteTree(t *TreeMarshal) {
+	c.trees.add(t.Sha, t, treeCost(t))
 }
 
+// WriteTreeAs caches t under sha of another object that resolves to it, such as a commit
+func (c *Cache) WriteTreeAs(sha string, t *TreeMarshal) {
+	c.trees.add(sha, t, treeCost(t))
+}
+
+// WriteCommits index copies of head and its parents. Commits that are already indexed are kept,
+// as they may carry state of running jobs. The copies leave out the check runs of the commits
+// passed in, which belong to the jobs owning those commits
 func (c *Cache) WriteCommits(head *Commit) {
 	for p := head; p != nil; p = p.parent {
-		if _, found := c.commitIndex.Load(p.Sha); !found {
-			c.commitIndex.Store(p.Sha, p)
-		}
+		indexed := *p
+		indexed.CheckRun = 0
+		indexed.checkRunStatus = ""
+		c.commitIndex.addIfAbsent(p.Sha, &indexed, 1)
+	}
+}
+
+// PinCommit keeps commit sha indexed until UnpinCommit is called as many times, so that the status of
+// queued and running jobs can be updated however many commits are indexed in the meantime
+func (c *Cache) PinCommit(sha string) {
+	c.commitIndex.pin(sha)
+}
+
+// UnpinCommit releases a pin taken with PinCommit
+func (c *Cache) UnpinCommit(sha string) {
+	c.commitIndex.unpin(sha)
+}
+
+func blobCost(b *Blob) int64 {
+	return int64(len(b.Content)+len(b.Sha)) + objectOverhead
+}
+
+func treeCost(t *TreeMarshal) int64 {
+	cost := int64(len(t.Sha)) + objectOverhead
+	for _, ref := range t.Tree {
+		cost += int64(len(ref.Path)+len(ref.Sha)+len(ref.Type)) + objectOverhead
 	}
+	return cost
 }
@@ -0,0 +1,91 @@
+package ghclient
+
+import (
+	"encoding/base64"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/pleimer/ci-server-go/pkg/assert"
+)
+
+func TestCacheEviction(t *testing.T) {
+	blob := func(sha string) *Blob {
+		return &Blob{Sha: sha, Encoding: "base64", Content: "dGhpcyBpcyBteSBsaWZl"}
+	}
+	cost := blobCost(blob("b1"))
+	cache := NewCacheWithLimits(CacheLimits{BlobBytes: 2 * cost, Commits: 2})
+
+	t.Run("least recently used blob evicted", func(t *testing.T) {
+		evictions := cacheEvictions.Counter("blobs").Value()
+		cache.WriteBlob(blob("b1"))
+		cache.WriteBlob(blob("b2"))
+		assert.Assert(t, cache.GetBlob("b1") != nil, "b1 should be cached")
+
+		cache.WriteBlob(blob("b3"))
+		assert.Assert(t, cache.GetBlob("b2") == nil, "b2 should have been evicted")
+		assert.Assert(t, cache.GetBlob("b1") != nil, "b1 should be cached")
+		assert.Assert(t, cache.GetBlob("b3") != nil, "b3 should be cached")
+		assert.Equals(t, 2, cache.blobs.len())
+		assert.Equals(t, evictions+1, cacheEvictions.Counter("blobs").Value())
+	})
+
+	t.Run("indexed commits kept", func(t *testing.T) {
+		head := &Commit{Sha: "c2", parent: &Commit{Sha: "c1"}}
+		cache.WriteCommits(head)
+		cache.GetCommit("c1").Status.State = "pending"
+
+		cache.WriteCommits(&Commit{Sha: "c1"})
+		assert.Equals(t, "pending", cache.GetCommit("c1").Status.State)
+
+		cache.WriteCommits(&Commit{Sha: "c3"})
+		assert.Assert(t, cache.GetCommit("c2") == nil, "c2 should have been evicted")
+	})
+
+	t.Run("pinned commits kept", func(t *testing.T) {
+		cache.PinCommit("c1")
+		cache.WriteCommits(&Commit{Sha: "c4"})
+		cache.WriteCommits(&Commit{Sha: "c5"})
+		assert.Equals(t, "pending", cache.GetCommit("c1").Status.State)
+		assert.Assert(t, cache.GetCommit("c3") == nil, "c3 should have been evicted")
+
+		cache.UnpinCommit("c1")
+		cache.GetCommit("c5")
+		cache.WriteCommits(&Commit{Sha: "c6"})
+		assert.Assert(t, cache.GetCommit("c1") == nil, "unpinned c1 should have been evicted")
+	})
+}
+
+func TestBlobStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "blobstore")
+	assert.Ok(t, err)
+	defer os.RemoveAll(dir)
+
+	content := []byte("this is my life")
+	sha := gitBlobSha(content)
+	assert.Equals(t, "1c964df46d82b1d4ac9d093ee80ac62daf87d85b", sha)
+
+	cache := NewCache()
+	assert.Ok(t, cache.SetBlobStore(dir))
+	cache.WriteBlob(&Blob{Sha: sha, Encoding: "base64", Content: base64.StdEncoding.EncodeToString(content)})
+
+	t.Run("blob survives restart", func(t *testing.T) {
+		restarted := NewCache()
+		assert.Ok(t, restarted.SetBlobStore(dir))
+		b := restarted.GetBlob(sha)
+		assert.Assert(t, b != nil, "blob should have been loaded from disk")
+		assert.Equals(t, base64.StdEncoding.EncodeToString(content), b.Content)
+	})
+
+	t.Run("corrupt blob discarded", func(t *testing.T) {
+		store, err := newBlobStore(dir)
+		assert.Ok(t, err)
+		assert.Ok(t, ioutil.WriteFile(store.path(sha), []byte("tampered"), 0600))
+
+		restarted := NewCache()
+		assert.Ok(t, restarted.SetBlobStore(dir))
+		assert.Assert(t, restarted.GetBlob(sha) == nil, "corrupt blob should not be served")
+		_, err = os.Stat(store.path(sha))
+		assert.Assert(t, os.IsNotExist(err), "corrupt blob should have been removed")
+	})
+}
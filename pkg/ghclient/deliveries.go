@@ -0,0 +1,200 @@
+package ghclient
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pleimer/ci-server-go/pkg/metrics"
+)
+
+var duplicateDeliveries = metrics.NewCounter("ci_webhook_duplicate_deliveries_total", "Webhook deliveries dropped as duplicates")
+
+// defaults for delivery logs created by the server
+const (
+	DefaultDeliveryWindow   = time.Hour
+	DefaultDeliveryCapacity = 10000
+)
+
+// DeliveryLog remembers the IDs of webhook deliveries received within a time window, so that
+// redelivered copies can be dropped. At most capacity IDs are kept, oldest first out. Only confirmed
+// IDs are persisted, so that deliveries whose job was lost in a crash are accepted again after a restart
+type DeliveryLog struct {
+	window   time.Duration
+	capacity int
+	path     string
+
+	lock      sync.Mutex
+	seen      map[string]time.Time
+	confirmed map[string]bool
+	order     []string // delivery IDs in order of arrival
+	written   int      // records in the file at path
+	now       func() time.Time
+}
+
+// NewDeliveryLog create delivery log. If path is not empty, confirmed delivery IDs are appended
+// to the file at path and loaded from it on creation
+func NewDeliveryLog(path string, window time.Duration, capacity int) (*DeliveryLog, error) {
+	dl := &DeliveryLog{
+		window:    window,
+		capacity:  capacity,
+		path:      path,
+		seen:      make(map[string]time.Time),
+		confirmed: make(map[string]bool),
+		now:       time.Now,
+	}
+	if path == "" {
+		return dl, nil
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, err
+	}
+
+	err := dl.load()
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	return dl, dl.compact()
+}
+
+// Record records delivery ID. Returns false if ID has already been recorded within the window.
+// The ID is only persisted once confirmed
+func (dl *DeliveryLog) Record(ID string) bool {
+	dl.lock.Lock()
+	defer dl.lock.Unlock()
+
+	now := dl.now()
+	dl.expire(now)
+	if _, ok := dl.seen[ID]; ok {
+		duplicateDeliveries.Inc()
+		return false
+	}
+
+	dl.add(ID, now)
+	return true
+}
+
+// Confirm persists recorded delivery ID, once its delivery has been processed far enough to
+// survive a restart of the server
+func (dl *DeliveryLog) Confirm(ID string) {
+	dl.lock.Lock()
+	defer dl.lock.Unlock()
+	at, ok := dl.seen[ID]
+	if !ok || dl.confirmed[ID] {
+		return
+	}
+	dl.confirmed[ID] = true
+	if dl.path != "" {
+		dl.append(ID, at)
+	}
+}
+
+// Forget removes delivery ID, so that a redelivery is accepted. Used when processing a delivery failed
+func (dl *DeliveryLog) Forget(ID string) {
+	dl.lock.Lock()
+	defer dl.lock.Unlock()
+	if _, ok := dl.seen[ID]; !ok {
+		return
+	}
+	delete(dl.seen, ID)
+	delete(dl.confirmed, ID)
+	for i, id := range dl.order {
+		if id == ID {
+			dl.order = append(dl.order[:i], dl.order[i+1:]...)
+			break
+		}
+	}
+	if dl.path != "" {
+		dl.compact()
+	}
+}
+
+func (dl *DeliveryLog) add(ID string, at time.Time) {
+	dl.seen[ID] = at
+	dl.order = append(dl.order, ID)
+	for len(dl.order) > dl.capacity {
+		delete(dl.seen, dl.order[0])
+		delete(dl.confirmed, dl.order[0])
+		dl.order = dl.order[1:]
+	}
+}
+
+// expire drops IDs that were recorded before the window
+func (dl *DeliveryLog) expire(now time.Time) {
+	i := 0
+	for ; i < len(dl.order); i++ {
+		if now.Sub(dl.seen[dl.order[i]]) < dl.window {
+			break
+		}
+		delete(dl.seen, dl.order[i])
+		delete(dl.confirmed, dl.order[i])
+	}
+	dl.order = dl.order[i:]
+}
+
+// append adds record to the file, compacting it once it holds twice as many records as the log.
+// Failing to persist only weakens deduplication across restarts, so errors are ignored
+func (dl *DeliveryLog) append(ID string, at time.Time) {
+	if dl.written >= 2*dl.capacity {
+		dl.compact()
+		return
+	}
+	f, err := os.OpenFile(dl.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	if _, err := fmt.Fprintf(f, "%s %d\n", ID, at.UnixNano()); err == nil {
+		dl.written++
+	}
+}
+
+// compact rewrites the file with the confirmed records currently held
+func (dl *DeliveryLog) compact() error {
+	var sb strings.Builder
+	written := 0
+	for _, id := range dl.order {
+		if !dl.confirmed[id] {
+			continue
+		}
+		fmt.Fprintf(&sb, "%s %d\n", id, dl.seen[id].UnixNano())
+		written++
+	}
+	err := writeFileAtomic(dl.path, []byte(sb.String()))
+	if err != nil {
+		return err
+	}
+	dl.written = written
+	return nil
+}
+
+func (dl *DeliveryLog) load() error {
+	f, err := os.Open(dl.path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 2 {
+			continue
+		}
+		nanos, err := strconv.ParseInt(fields[1], 10, 64)
+		if err != nil {
+			continue
+		}
+		if _, ok := dl.seen[fields[0]]; !ok {
+			dl.add(fields[0], time.Unix(0, nanos))
+			dl.confirmed[fields[0]] = true
+		}
+	}
+	dl.expire(dl.now())
+	return scanner.Err()
+}
@@ -0,0 +1,72 @@
+package ghclient
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/pleimer/ci-server-go/pkg/assert"
+)
+
+func TestDeliveryLog(t *testing.T) {
+	dir, err := ioutil.TempDir("", "deliveries")
+	assert.Ok(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "deliveries")
+
+	now := time.Now()
+	newLog := func() *DeliveryLog {
+		dl, err := NewDeliveryLog(path, time.Hour, 3)
+		assert.Ok(t, err)
+		dl.now = func() time.Time { return now }
+		return dl
+	}
+	dl := newLog()
+
+	t.Run("duplicates dropped", func(t *testing.T) {
+		assert.Assert(t, dl.Record("a"), "first delivery should be accepted")
+		assert.Assert(t, !dl.Record("a"), "redelivery should be dropped")
+	})
+
+	t.Run("forgotten delivery accepted", func(t *testing.T) {
+		dl.Forget("a")
+		assert.Assert(t, dl.Record("a"), "forgotten delivery should be accepted")
+	})
+
+	t.Run("unconfirmed delivery accepted after restart", func(t *testing.T) {
+		restarted := newLog()
+		assert.Assert(t, restarted.Record("a"), "unconfirmed delivery should be accepted after restart")
+	})
+
+	t.Run("survives restart", func(t *testing.T) {
+		dl.Confirm("a")
+		restarted := newLog()
+		assert.Assert(t, !restarted.Record("a"), "redelivery should be dropped after restart")
+	})
+
+	t.Run("bounded by capacity", func(t *testing.T) {
+		for _, id := range []string{"b", "c", "d"} {
+			assert.Assert(t, dl.Record(id), "new delivery should be accepted")
+		}
+		assert.Equals(t, []string{"b", "c", "d"}, dl.order)
+		assert.Assert(t, dl.Record("a"), "oldest delivery should have been evicted")
+	})
+
+	t.Run("expires after window", func(t *testing.T) {
+		now = now.Add(time.Hour)
+		assert.Assert(t, dl.Record("c"), "expired delivery should be accepted")
+		assert.Equals(t, []string{"c"}, dl.order)
+	})
+
+	t.Run("file compacted", func(t *testing.T) {
+		for _, id := range []string{"e", "f", "g", "h", "i", "j", "k"} {
+			dl.Record(id)
+			dl.Confirm(id)
+		}
+		restarted := newLog()
+		assert.Equals(t, []string{"i", "j", "k"}, restarted.order)
+		assert.Assert(t, dl.written <= 6, "file should have been compacted")
+	})
+}
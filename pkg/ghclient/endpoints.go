@@ -0,0 +1,92 @@
+package ghclient
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+)
+
+// Endpoints base urls of a github instance
+type Endpoints struct {
+	API    string // rest api
+	Upload string // uploads api
+	Gist   string // published gists
+	Web    string // web interface and git over https
+}
+
+// GithubEndpoints endpoints of github.com
+var GithubEndpoints = Endpoints{
+	API:    "https://api.github.com",
+	Upload: "https://uploads.github.com",
+	Gist:   "https://gist.github.com",
+	Web:    "https://github.com",
+}
+
+// EnterpriseEndpoints endpoints of a github enterprise server instance with api at apiURL, which
+// is either the root of the instance (https://github.example.com) or its api (https://github.example.com/api/v3).
+// Returns GithubEndpoints for the api of github.com
+func EnterpriseEndpoints(apiURL string) Endpoints {
+	apiURL = strings.TrimSuffix(apiURL, "/")
+	if apiURL == GithubEndpoints.API {
+		return GithubEndpoints
+	}
+	root := strings.TrimSuffix(apiURL, "/api/v3")
+	return Endpoints{
+		API:    root + "/api/v3",
+		Upload: root + "/api/uploads",
+		Gist:   root + "/gist",
+		Web:    root,
+	}
+}
+
+// SetEndpoints point api at github instance
+func (a *API) SetEndpoints(e Endpoints) {
+	a.BaseURL = strings.TrimSuffix(e.API, "/")
+	a.UploadURL = strings.TrimSuffix(e.Upload, "/")
+	a.GistURL = strings.TrimSuffix(e.Gist, "/")
+	a.WebURL = strings.TrimSuffix(e.Web, "/")
+}
+
+// TLSFiles paths of PEM encoded files used to secure connections to github. Empty fields use system defaults
+type TLSFiles struct {
+	CAFile   string // bundle of certificate authorities trusted in addition to the system roots
+	CertFile string // client certificate
+	KeyFile  string // client certificate key
+}
+
+// SetTLS configure api client and git checkouts with custom certificate authorities and client certificate
+func (a *API) SetTLS(files TLSFiles) error {
+	config := &tls.Config{}
+
+	if files.CAFile != "" {
+		pem, err := ioutil.ReadFile(files.CAFile)
+		if err != nil {
+			return a.err.withMessage(fmt.Sprintf("failed reading CA bundle: %s", err))
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil || pool == nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return a.err.withMessage(fmt.Sprintf("no certificates found in %s", files.CAFile))
+		}
+		config.RootCAs = pool
+	}
+
+	if files.CertFile != "" || files.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(files.CertFile, files.KeyFile)
+		if err != nil {
+			return a.err.withMessage(fmt.Sprintf("failed loading client certificate: %s", err))
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = config
+	a.Client = &http.Client{Transport: transport}
+	a.tlsFiles = files
+	return nil
+}
@@ -0,0 +1,77 @@
+package ghclient
+
+import (
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/pleimer/ci-server-go/pkg/assert"
+)
+
+func TestEndpoints(t *testing.T) {
+	t.Run("github.com", func(t *testing.T) {
+		api := NewAPI()
+		assert.Equals(t, "https://api.github.com/gists", api.NewGistURL())
+		assert.Equals(t, "https://gist.github.com/user/id", api.PublishedGistURL("id", "user"))
+		assert.Equals(t, GithubEndpoints, EnterpriseEndpoints("https://api.github.com/"))
+	})
+
+	t.Run("enterprise", func(t *testing.T) {
+		expected := Endpoints{
+			API:    "https://ghe.example.com/api/v3",
+			Upload: "https://ghe.example.com/api/uploads",
+			Gist:   "https://ghe.example.com/gist",
+			Web:    "https://ghe.example.com",
+		}
+		assert.Equals(t, expected, EnterpriseEndpoints("https://ghe.example.com"))
+		assert.Equals(t, expected, EnterpriseEndpoints("https://ghe.example.com/api/v3/"))
+
+		api := NewAPI()
+		api.SetEndpoints(expected)
+		assert.Equals(t, "https://ghe.example.com/api/v3/repos/owner/repo/statuses/sha", api.StatusURL("owner", "repo", "sha"))
+		assert.Equals(t, "https://ghe.example.com/gist/user/id", api.PublishedGistURL("id", "user"))
+		assert.Equals(t, "https://ghe.example.com/owner/repo.git", api.CloneURL("owner", "repo"))
+
+		owner, repo, ok := api.repositoryFromURL(api.StatusURL("owner", "repo", "sha"))
+		assert.Assert(t, ok, "should have parsed repository from url")
+		assert.Equals(t, "owner/repo", owner+"/"+repo)
+	})
+}
+
+func TestSetTLS(t *testing.T) {
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	defer srv.Close()
+
+	dir, err := ioutil.TempDir("", "tls")
+	assert.Ok(t, err)
+	defer os.RemoveAll(dir)
+	caFile := filepath.Join(dir, "ca.pem")
+	assert.Ok(t, ioutil.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw}), 0600))
+
+	api := NewAPI()
+	api.Retry.MaxRetries = 0
+	_, err = api.get(srv.URL)
+	assert.Assert(t, err != nil, "untrusted certificate should have been rejected")
+
+	assert.Ok(t, api.SetTLS(TLSFiles{CAFile: caFile}))
+	res, err := api.get(srv.URL)
+	assert.Ok(t, err)
+	assert.Equals(t, 200, res.StatusCode)
+
+	gh := NewClient(nil, "testuser")
+	gh.Api = api
+	env, err := gh.gitEnv(Repository{}, "https://ghe.example.com/owner/repo.git")
+	assert.Ok(t, err)
+	assert.Assert(t, strings.Contains(strings.Join(env, "\n"), "GIT_CONFIG_KEY_0=http.sslCAInfo\nGIT_CONFIG_VALUE_0="+caFile),
+		"git should trust the CA bundle")
+
+	err = api.SetTLS(TLSFiles{CAFile: filepath.Join(dir, "missing.pem")})
+	assert.Assert(t, err != nil, "missing CA bundle should be an error")
+}
@@ -2,31 +2,55 @@ package ghclient
 
 import (
 	"bytes"
+	"context"
+	"encoding/json"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"net/http"
+	"strconv"
 	"strings"
+	"time"
+
+	"github.com/pleimer/ci-server-go/pkg/logging"
 )
 
 //API generates github URLS
 type API struct {
-	Client  *http.Client
-	BaseURL string
-	oauth   string
+	Client    *http.Client
+	BaseURL   string
+	UploadURL string
+	GistURL   string
+	WebURL    string
+	Retry     RetryPolicy
+	Log       *logging.Logger
+
+	// Responses caches GET responses for conditional requests. Disabled if nil
+	Responses *ResponseCache
+
+	oauth    string
+	app      *AppAuth
+	tlsFiles TLSFiles
+	quota    *quotaTracker
+	sleep    func(context.Context, time.Duration) error
+	ctx      context.Context // of the requests, see WithContext
 
 	err GithubClientError
 }
 
 // NewAPI creates new api type
 func NewAPI() API {
-	return API{
-		Client:  &http.Client{},
-		BaseURL: "https://api.github.com",
+	api := API{
+		Client: &http.Client{},
+		Retry:  DefaultRetryPolicy,
+		quota:  newQuotaTracker(),
+		sleep:  sleepContext,
 		err: GithubClientError{
 			module: "API",
 		},
 	}
+	api.SetEndpoints(GithubEndpoints)
+	return api
 }
 
 // Authenticate set and test authentication with Oauth token
@@ -48,6 +72,39 @@ func (a *API) Authenticate(oauth io.Reader) error {
 	return nil
 }
 
+// AuthenticateApp authenticate as github app. Requests targeting a repository use the access token
+// of the app installation on that repository, other requests fall back to the oauth token if one is set
+func (a *API) AuthenticateApp(app *AppAuth) error {
+	a.app = app
+	info := struct {
+		Slug string `json:"slug"`
+	}{}
+	err := a.appRequest("GET", a.makeURL([]string{"app"}), 200, &info)
+	if err != nil {
+		return a.err.withMessage(fmt.Sprintf("app authentication failed: %s", err))
+	}
+	app.Login = info.Slug + "[bot]"
+	return nil
+}
+
+// SetInstallation record app installation for repository fullName (owner/repo), as found in webhook
+// deliveries. Has no effect unless authenticated as a github app
+func (a *API) SetInstallation(fullName string, installationID int64) {
+	if a.app == nil || installationID == 0 {
+		return
+	}
+	a.app.SetInstallation(fullName, installationID)
+}
+
+// Token retrieve token used to authenticate requests against repository owner/repo
+func (a *API) Token(owner, repo string) (string, error) {
+	if a.app != nil {
+		token, _, err := a.installationToken(owner, repo)
+		return token, err
+	}
+	return a.oauth, nil
+}
+
 // PostStatus sends post request to status
 func (a *API) PostStatus(owner, repo, commitSha string, body []byte) error {
 	res, err := a.post(a.StatusURL(owner, repo, commitSha), body)
@@ -104,6 +161,46 @@ func (a *API) UpdateGist(body []byte, ID string) ([]byte, error) {
 	return info, nil
 }
 
+// PostCheckRun creates check run
+func (a *API) PostCheckRun(owner, repo string, body []byte) ([]byte, error) {
+	res, err := a.post(a.CheckRunsURL(owner, repo), body)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	info, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return nil, a.err.withMessage(fmt.Sprintf("failed reading server response: %s", err))
+	}
+
+	cCode := 201
+	if res.StatusCode != cCode {
+		return nil, a.err.withMessage(fmt.Sprintf("expected status code %d, received %s", cCode, res.Status))
+	}
+	return info, nil
+}
+
+// UpdateCheckRun updates check run with ID
+func (a *API) UpdateCheckRun(owner, repo string, ID int64, body []byte) ([]byte, error) {
+	res, err := a.patch(a.CheckRunURL(owner, repo, ID), body)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	info, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return nil, a.err.withMessage(fmt.Sprintf("failed reading server response: %s", err))
+	}
+
+	cCode := 200
+	if res.StatusCode != cCode {
+		return nil, a.err.withMessage(fmt.Sprintf("expected status code %d, received %s", cCode, res.Status))
+	}
+	return info, nil
+}
+
 // GetTree retrieve github tree
 func (a *API) GetTree(owner, repo, sha string) ([]byte, error) {
 	res, err := a.get(a.TreeURL(owner, repo, sha))
@@ -124,6 +221,27 @@ func (a *API) GetTree(owner, repo, sha string) ([]byte, error) {
 	return info, nil
 }
 
+// GetTreeRecursive retrieve github tree with the entries of all its subtrees. Check the truncated
+// field of the response, as github limits the number of entries returned
+func (a *API) GetTreeRecursive(owner, repo, sha string) ([]byte, error) {
+	res, err := a.get(a.TreeURL(owner, repo, sha) + "?recursive=1")
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	cCode := 200
+	if res.StatusCode != cCode {
+		return nil, a.err.withMessage(fmt.Sprintf("expected status code %d, received %s", cCode, res.Status))
+	}
+
+	info, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return nil, a.err.withMessage(fmt.Sprintf("failed reading server response: %s", err))
+	}
+	return info, nil
+}
+
 // GetBlob retrieve github tree
 func (a *API) GetBlob(owner, repo, sha string) ([]byte, error) {
 	res, err := a.get(a.BlobURL(owner, repo, sha))
@@ -144,6 +262,172 @@ func (a *API) GetBlob(owner, repo, sha string) ([]byte, error) {
 	return info, nil
 }
 
+// GetTarball retrieve gzipped tar archive of repository at sha. Caller must close the returned reader
+func (a *API) GetTarball(owner, repo, sha string) (io.ReadCloser, error) {
+	res, err := a.get(a.TarballURL(owner, repo, sha))
+	if err != nil {
+		return nil, err
+	}
+
+	cCode := 200
+	if res.StatusCode != cCode {
+		res.Body.Close()
+		return nil, a.err.withMessage(fmt.Sprintf("expected status code %d, received %s", cCode, res.Status))
+	}
+	return res.Body, nil
+}
+
+// GetRepository retrieve github repository
+func (a *API) GetRepository(owner, repo string) ([]byte, error) {
+	res, err := a.get(a.RepositoryURL(owner, repo))
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	cCode := 200
+	if res.StatusCode != cCode {
+		return nil, a.err.withMessage(fmt.Sprintf("expected status code %d, received %s", cCode, res.Status))
+	}
+
+	info, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return nil, a.err.withMessage(fmt.Sprintf("failed reading server response: %s", err))
+	}
+	return info, nil
+}
+
+// GetPullRequests retrieve all open pull requests of repository as a json array
+func (a *API) GetPullRequests(owner, repo string) ([]byte, error) {
+	return a.getPages(a.PullRequestsURL(owner, repo))
+}
+
+// GetPullRequestCommits retrieve commits of pull request number as a json array, oldest first.
+// Github lists at most 250 commits
+func (a *API) GetPullRequestCommits(owner, repo string, number int) ([]byte, error) {
+	return a.getPages(a.PullRequestCommitsURL(owner, repo, number))
+}
+
+// PostIssueComment comments on issue or pull request number
+func (a *API) PostIssueComment(owner, repo string, number int, body []byte) ([]byte, error) {
+	res, err := a.post(a.IssueCommentsURL(owner, repo, number), body)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	info, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return nil, a.err.withMessage(fmt.Sprintf("failed reading server response: %s", err))
+	}
+
+	cCode := 201
+	if res.StatusCode != cCode {
+		return nil, a.err.withMessage(fmt.Sprintf("expected status code %d, received %s", cCode, res.Status))
+	}
+	return info, nil
+}
+
+// GetIssueComments retrieve comments of issue or pull request number as a json array
+func (a *API) GetIssueComments(owner, repo string, number int) ([]byte, error) {
+	return a.getPages(a.IssueCommentsURL(owner, repo, number) + "?per_page=100")
+}
+
+// UpdateIssueComment edits issue or pull request comment with ID
+func (a *API) UpdateIssueComment(owner, repo string, ID int64, body []byte) ([]byte, error) {
+	res, err := a.patch(a.IssueCommentURL(owner, repo, ID), body)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	info, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return nil, a.err.withMessage(fmt.Sprintf("failed reading server response: %s", err))
+	}
+
+	cCode := 200
+	if res.StatusCode != cCode {
+		return nil, a.err.withMessage(fmt.Sprintf("expected status code %d, received %s", cCode, res.Status))
+	}
+	return info, nil
+}
+
+// PostReaction reacts to issue or pull request comment with ID. Github answers with 200 instead
+// of 201 if the reaction already exists
+func (a *API) PostReaction(owner, repo string, commentID int64, body []byte) ([]byte, error) {
+	res, err := a.post(a.ReactionsURL(owner, repo, commentID), body)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	info, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return nil, a.err.withMessage(fmt.Sprintf("failed reading server response: %s", err))
+	}
+
+	if res.StatusCode != 200 && res.StatusCode != 201 {
+		return nil, a.err.withMessage(fmt.Sprintf("expected status code 201, received %s", res.Status))
+	}
+	return info, nil
+}
+
+// DeleteReaction removes reaction with ID from issue or pull request comment with commentID
+func (a *API) DeleteReaction(owner, repo string, commentID, ID int64) error {
+	res, err := a.delete(a.ReactionsURL(owner, repo, commentID) + "/" + strconv.FormatInt(ID, 10))
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	cCode := 204
+	if res.StatusCode != cCode {
+		return a.err.withMessage(fmt.Sprintf("expected status code %d, received %s", cCode, res.Status))
+	}
+	return nil
+}
+
+// GetCommit retrieve github commit
+func (a *API) GetCommit(owner, repo, sha string) ([]byte, error) {
+	res, err := a.get(a.CommitURL(owner, repo, sha))
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	cCode := 200
+	if res.StatusCode != cCode {
+		return nil, a.err.withMessage(fmt.Sprintf("expected status code %d, received %s", cCode, res.Status))
+	}
+
+	info, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return nil, a.err.withMessage(fmt.Sprintf("failed reading server response: %s", err))
+	}
+	return info, nil
+}
+
+// GetCombinedStatus retrieve the latest status of commit sha for each context
+func (a *API) GetCombinedStatus(owner, repo, sha string) ([]byte, error) {
+	res, err := a.get(a.CombinedStatusURL(owner, repo, sha))
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	cCode := 200
+	if res.StatusCode != cCode {
+		return nil, a.err.withMessage(fmt.Sprintf("expected status code %d, received %s", cCode, res.Status))
+	}
+
+	info, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return nil, a.err.withMessage(fmt.Sprintf("failed reading server response: %s", err))
+	}
+	return info, nil
+}
+
 // GetURL generic function for querying a preconcieved URL
 func (a *API) GetURL(url string) ([]byte, error) {
 	res, err := a.get(url)
@@ -151,34 +435,117 @@ func (a *API) GetURL(url string) ([]byte, error) {
 		return nil, err
 	}
 	defer res.Body.Close()
+
+	cCode := 200
+	if res.StatusCode != cCode {
+		return nil, a.err.withMessage(fmt.Sprintf("expected status code %d, received %s", cCode, res.Status))
+	}
 	return ioutil.ReadAll(res.Body)
 }
 
+// getPages retrieve all pages of the json array at URL, following pagination
+func (a *API) getPages(URL string) ([]byte, error) {
+	items := []json.RawMessage{}
+	for URL != "" {
+		res, err := a.get(URL)
+		if err != nil {
+			return nil, err
+		}
+
+		cCode := 200
+		if res.StatusCode != cCode {
+			res.Body.Close()
+			return nil, a.err.withMessage(fmt.Sprintf("expected status code %d, received %s", cCode, res.Status))
+		}
+
+		page := []json.RawMessage{}
+		err = json.NewDecoder(res.Body).Decode(&page)
+		res.Body.Close()
+		if err != nil {
+			return nil, a.err.withMessage(fmt.Sprintf("failed reading server response: %s", err))
+		}
+		items = append(items, page...)
+		URL = nextPage(res.Header)
+	}
+	return json.Marshal(items)
+}
+
+// WithContext returns a copy of the api whose requests are bound to ctx. Requests, and their waits for
+// the rate limit to reset or before a retry, are abandoned once ctx is done
+func (a *API) WithContext(ctx context.Context) *API {
+	bound := *a
+	bound.ctx = ctx
+	return &bound
+}
+
+func (a *API) context() context.Context {
+	if a.ctx == nil {
+		return context.Background()
+	}
+	return a.ctx
+}
+
 func (a *API) get(URL string) (*http.Response, error) {
-	req, err := http.NewRequest("GET", URL, nil)
+	req, err := http.NewRequestWithContext(a.context(), "GET", URL, nil)
 	if err != nil {
 		return nil, err
 	}
-	req.Header.Set("Authorization", "token "+a.oauth)
-	return a.Client.Do(req)
+	if a.Responses != nil && isCacheableURL(URL) {
+		return a.conditionalGet(req)
+	}
+	return a.do(req)
 }
 
 func (a *API) post(URL string, body []byte) (*http.Response, error) {
-	req, err := http.NewRequest("POST", URL, bytes.NewReader(body))
+	req, err := http.NewRequestWithContext(a.context(), "POST", URL, bytes.NewReader(body))
 	if err != nil {
 		return nil, err
 	}
-	req.Header.Set("Authorization", "token "+a.oauth)
-	return a.Client.Do(req)
+	return a.do(req)
 }
 
-func (a *API) patch(URL string) (*http.Response, error) {
-	req, err := http.NewRequest("GET", URL, nil)
+func (a *API) patch(URL string, body []byte) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(a.context(), "PATCH", URL, bytes.NewReader(body))
 	if err != nil {
 		return nil, err
 	}
+	return a.do(req)
+}
+
+func (a *API) delete(URL string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(a.context(), "DELETE", URL, nil)
+	if err != nil {
+		return nil, err
+	}
+	return a.do(req)
+}
+
+func (a *API) do(req *http.Request) (*http.Response, error) {
+	return a.send(req)
+}
+
+// authorize sets the credentials of req. Returns a name of the credentials, which share a rate limit
+func (a *API) authorize(req *http.Request) (string, error) {
+	if a.app != nil {
+		if owner, repo, ok := a.repositoryFromURL(req.URL.String()); ok {
+			token, installationID, err := a.installationToken(owner, repo)
+			if err != nil {
+				return "", err
+			}
+			req.Header.Set("Authorization", "token "+token)
+			return fmt.Sprintf("installation %d", installationID), nil
+		}
+		if a.oauth == "" {
+			jwt, err := a.app.JWT()
+			if err != nil {
+				return "", err
+			}
+			req.Header.Set("Authorization", "Bearer "+jwt)
+			return "app", nil
+		}
+	}
 	req.Header.Set("Authorization", "token "+a.oauth)
-	return a.Client.Do(req)
+	return "token", nil
 }
 
 // StatusURL generates url for querying status
@@ -186,6 +553,24 @@ func (a *API) StatusURL(owner, repo, sha string) string {
 	return a.makeURL([]string{"repos", owner, repo, "statuses", sha})
 }
 
+// CommitURL url of commit
+func (a *API) CommitURL(owner, repo, sha string) string {
+	return a.makeURL([]string{"repos", owner, repo, "commits", sha})
+}
+
+// CombinedStatusURL url of the combined status of commit
+func (a *API) CombinedStatusURL(owner, repo, sha string) string {
+	return a.makeURL([]string{"repos", owner, repo, "commits", sha, "status"})
+}
+
+func (a *API) CheckRunsURL(owner, repo string) string {
+	return a.makeURL([]string{"repos", owner, repo, "check-runs"})
+}
+
+func (a *API) CheckRunURL(owner, repo string, ID int64) string {
+	return a.makeURL([]string{"repos", owner, repo, "check-runs", strconv.FormatInt(ID, 10)})
+}
+
 func (a *API) TreeURL(owner, repo, treeSha string) string {
 	return a.makeURL([]string{"repos", owner, repo, "git", "trees", treeSha})
 }
@@ -194,6 +579,40 @@ func (a *API) BlobURL(owner, repo, fileSha string) string {
 	return a.makeURL([]string{"repos", owner, repo, "git", "blobs", fileSha})
 }
 
+// RepositoryURL url of repository metadata
+func (a *API) RepositoryURL(owner, repo string) string {
+	return a.makeURL([]string{"repos", owner, repo})
+}
+
+// PullRequestsURL url listing the open pull requests of repository
+func (a *API) PullRequestsURL(owner, repo string) string {
+	return a.makeURL([]string{"repos", owner, repo, "pulls"}, "state=open", "per_page=100")
+}
+
+// PullRequestCommitsURL url listing the commits of pull request number
+func (a *API) PullRequestCommitsURL(owner, repo string, number int) string {
+	return a.makeURL([]string{"repos", owner, repo, "pulls", strconv.Itoa(number), "commits"}, "per_page=100")
+}
+
+// IssueCommentsURL url of the comments of issue or pull request number
+func (a *API) IssueCommentsURL(owner, repo string, number int) string {
+	return a.makeURL([]string{"repos", owner, repo, "issues", strconv.Itoa(number), "comments"})
+}
+
+// IssueCommentURL url of issue or pull request comment with ID
+func (a *API) IssueCommentURL(owner, repo string, ID int64) string {
+	return a.makeURL([]string{"repos", owner, repo, "issues", "comments", strconv.FormatInt(ID, 10)})
+}
+
+// ReactionsURL url of the reactions to issue or pull request comment with ID
+func (a *API) ReactionsURL(owner, repo string, ID int64) string {
+	return a.IssueCommentURL(owner, repo, ID) + "/reactions"
+}
+
+func (a *API) TarballURL(owner, repo, sha string) string {
+	return a.makeURL([]string{"repos", owner, repo, "tarball", sha})
+}
+
 func (a *API) NewGistURL() string {
 	return a.makeURL([]string{"gists"})
 }
@@ -202,8 +621,29 @@ func (a *API) UpdateGistURL(ID string) string {
 	return a.makeURL([]string{"gists", ID})
 }
 
+// CloneURL url for cloning repository over https
+func (a *API) CloneURL(owner, repo string) string {
+	return fmt.Sprintf("%s/%s/%s.git", a.WebURL, owner, repo)
+}
+
 func (a *API) PublishedGistURL(id, user string) string {
-	return fmt.Sprintf("https://gist.github.com/%s/%s", user, id)
+	return fmt.Sprintf("%s/%s/%s", a.GistURL, user, id)
+}
+
+// nextPage url of the next page of a paginated response, or an empty string on the last page
+func nextPage(header http.Header) string {
+	for _, link := range strings.Split(header.Get("Link"), ",") {
+		parts := strings.Split(link, ";")
+		if len(parts) < 2 {
+			continue
+		}
+		for _, param := range parts[1:] {
+			if strings.TrimSpace(param) == `rel="next"` {
+				return strings.Trim(strings.TrimSpace(parts[0]), "<>")
+			}
+		}
+	}
+	return ""
 }
 
 func (a *API) makeURL(items []string, params ...string) string {
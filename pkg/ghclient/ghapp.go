@@ -0,0 +1,253 @@
+package ghclient
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// installation tokens are refreshed this long before they expire so that they remain
+// valid for the duration of a request
+const tokenRefreshMargin = 5 * time.Minute
+
+// AppAuth authenticates as a github app. Requests targeting a repository are authorized
+// with an access token of the installation of the app on that repository
+type AppAuth struct {
+	ID    int64
+	Login string // of the bot user acting for the installations, set once authenticated
+
+	key           *rsa.PrivateKey
+	lock          sync.Mutex
+	installations map[string]int64 // keyed by lower case owner/repo
+	tokens        map[int64]installationToken
+	requests      flights // installation lookups and token requests in progress
+	now           func() time.Time
+}
+
+type installationToken struct {
+	Token     string    `json:"token"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// NewAppAuth create app authenticator from app ID and PEM encoded private key
+func NewAppAuth(ID int64, privateKey []byte) (*AppAuth, error) {
+	block, _ := pem.Decode(privateKey)
+	if block == nil {
+		return nil, appError("private key is not PEM encoded")
+	}
+
+	key, err := x509.ParsePKCS1PrivateKey(block.Bytes)
+	if err != nil {
+		parsed, err8 := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err8 != nil {
+			return nil, appError(fmt.Sprintf("failed parsing private key: %s", err))
+		}
+		var ok bool
+		if key, ok = parsed.(*rsa.PrivateKey); !ok {
+			return nil, appError("private key is not an RSA key")
+		}
+	}
+
+	return &AppAuth{
+		ID:            ID,
+		key:           key,
+		installations: make(map[string]int64),
+		tokens:        make(map[int64]installationToken),
+		requests:      flights{calls: make(map[string]*flight)},
+		now:           time.Now,
+	}, nil
+}
+
+// JWT generates signed json web token identifying the app
+func (aa *AppAuth) JWT() (string, error) {
+	now := aa.now()
+	header := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"RS256","typ":"JWT"}`))
+	claims, err := json.Marshal(map[string]int64{
+		"iat": now.Add(-time.Minute).Unix(), // allow for clock drift
+		"exp": now.Add(9 * time.Minute).Unix(),
+		"iss": aa.ID,
+	})
+	if err != nil {
+		return "", err
+	}
+
+	unsigned := header + "." + base64.RawURLEncoding.EncodeToString(claims)
+	digest := sha256.Sum256([]byte(unsigned))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, aa.key, crypto.SHA256, digest[:])
+	if err != nil {
+		return "", appError(fmt.Sprintf("failed signing jwt: %s", err))
+	}
+	return unsigned + "." + base64.RawURLEncoding.EncodeToString(signature), nil
+}
+
+// SetInstallation records installation of the app on repository fullName (owner/repo)
+func (aa *AppAuth) SetInstallation(fullName string, installationID int64) {
+	aa.lock.Lock()
+	defer aa.lock.Unlock()
+	aa.installations[strings.ToLower(fullName)] = installationID
+}
+
+// installationToken retrieves cached access token and ID of the installation of the app on repository
+// owner/repo, requesting a new token if it is missing or about to expire. Concurrent callers share the
+// requests for an installation, which are sent without holding the lock, so that a slow request for
+// one installation does not hold up the others
+func (a *API) installationToken(owner, repo string) (string, int64, error) {
+	aa := a.app
+	fullName := strings.ToLower(owner + "/" + repo)
+	aa.lock.Lock()
+	installationID, ok := aa.installations[fullName]
+	aa.lock.Unlock()
+
+	// shared requests run detached from the context of the caller that started them, as callers
+	// arriving later wait for them too
+	shared := a.WithContext(context.Background())
+	if !ok {
+		ID, err := aa.requests.do(a.context(), "installation "+fullName, func() (interface{}, error) {
+			installation := struct {
+				ID int64 `json:"id"`
+			}{}
+			err := shared.appRequest("GET", shared.makeURL([]string{"repos", owner, repo, "installation"}), 200, &installation)
+			if err != nil {
+				return nil, appError(fmt.Sprintf("failed finding installation for %s/%s: %s", owner, repo, err))
+			}
+			aa.SetInstallation(fullName, installation.ID)
+			return installation.ID, nil
+		})
+		if err != nil {
+			return "", 0, err
+		}
+		installationID = ID.(int64)
+	}
+
+	if token, ok := aa.validToken(installationID); ok {
+		return token, installationID, nil
+	}
+	token, err := aa.requests.do(a.context(), "token "+strconv.FormatInt(installationID, 10), func() (interface{}, error) {
+		// a request that completed since the check above may have refreshed the token
+		if token, ok := aa.validToken(installationID); ok {
+			return token, nil
+		}
+		token := installationToken{}
+		URL := shared.makeURL([]string{"app", "installations", strconv.FormatInt(installationID, 10), "access_tokens"})
+		err := shared.appRequest("POST", URL, 201, &token)
+		if err != nil {
+			return nil, appError(fmt.Sprintf("failed creating token for installation %d: %s", installationID, err))
+		}
+		aa.lock.Lock()
+		aa.tokens[installationID] = token
+		aa.lock.Unlock()
+		return token.Token, nil
+	})
+	if err != nil {
+		return "", 0, err
+	}
+	return token.(string), installationID, nil
+}
+
+// validToken retrieves the cached token of installationID unless it is about to expire
+func (aa *AppAuth) validToken(installationID int64) (string, bool) {
+	aa.lock.Lock()
+	defer aa.lock.Unlock()
+	token, ok := aa.tokens[installationID]
+	if !ok || !aa.now().Add(tokenRefreshMargin).Before(token.ExpiresAt) {
+		return "", false
+	}
+	return token.Token, true
+}
+
+// flights shares requests in progress between the callers asking for the same key
+type flights struct {
+	lock  sync.Mutex
+	calls map[string]*flight
+}
+
+type flight struct {
+	done  chan struct{}
+	value interface{}
+	err   error
+}
+
+// do runs fn unless a call with key is already running, then waits for the result of the call or for
+// ctx to be done. The call completes even if its callers stop waiting
+func (f *flights) do(ctx context.Context, key string, fn func() (interface{}, error)) (interface{}, error) {
+	f.lock.Lock()
+	call, ok := f.calls[key]
+	if !ok {
+		call = &flight{done: make(chan struct{})}
+		f.calls[key] = call
+		go func() {
+			call.value, call.err = fn()
+			f.lock.Lock()
+			delete(f.calls, key)
+			f.lock.Unlock()
+			close(call.done)
+		}()
+	}
+	f.lock.Unlock()
+
+	select {
+	case <-call.done:
+		return call.value, call.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// appRequest sends request authenticated as the app itself and parses the response into v
+func (a *API) appRequest(method, URL string, expected int, v interface{}) error {
+	jwt, err := a.app.JWT()
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(a.context(), method, URL, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+jwt)
+	req.Header.Set("Accept", "application/vnd.github.v3+json")
+
+	res, err := a.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != expected {
+		return fmt.Errorf("expected status code %d, received %s", expected, res.Status)
+	}
+	return json.NewDecoder(res.Body).Decode(v)
+}
+
+// repositoryFromURL retrieves owner and repository name from api urls of the form
+// BaseURL/repos/owner/repo/...
+func (a *API) repositoryFromURL(URL string) (string, string, bool) {
+	path := strings.TrimPrefix(URL, a.BaseURL+"/repos/")
+	if path == URL {
+		return "", "", false
+	}
+	items := strings.SplitN(path, "/", 3)
+	if len(items) < 2 || items[0] == "" || items[1] == "" {
+		return "", "", false
+	}
+	return items[0], strings.SplitN(items[1], "?", 2)[0], true
+}
+
+func appError(msg string) error {
+	return &GithubClientError{
+		module: "App",
+		err:    msg,
+	}
+}
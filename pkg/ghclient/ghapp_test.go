@@ -0,0 +1,212 @@
+package ghclient
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pleimer/ci-server-go/pkg/assert"
+)
+
+func genAppAuth(t *testing.T) (*AppAuth, *rsa.PrivateKey) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.Ok(t, err)
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+
+	app, err := NewAppAuth(42, keyPEM)
+	assert.Ok(t, err)
+	return app, key
+}
+
+func TestAppJWT(t *testing.T) {
+	app, key := genAppAuth(t)
+	now := time.Unix(1600000000, 0)
+	app.now = func() time.Time { return now }
+
+	jwt, err := app.JWT()
+	assert.Ok(t, err)
+
+	parts := strings.Split(jwt, ".")
+	assert.Equals(t, 3, len(parts))
+
+	claimBytes, err := base64.RawURLEncoding.DecodeString(parts[1])
+	assert.Ok(t, err)
+	claims := map[string]int64{}
+	assert.Ok(t, json.Unmarshal(claimBytes, &claims))
+	assert.Equals(t, map[string]int64{"iat": 1599999940, "exp": 1600000540, "iss": 42}, claims)
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	assert.Ok(t, err)
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	assert.Ok(t, rsa.VerifyPKCS1v15(&key.PublicKey, crypto.SHA256, digest[:], signature))
+
+	_, err = NewAppAuth(42, []byte("not a key"))
+	assert.Assert(t, (err != nil), "should have been an error")
+}
+
+func TestAppInstallationTokens(t *testing.T) {
+	app, _ := genAppAuth(t)
+	now := time.Unix(1600000000, 0)
+	app.now = func() time.Time { return now }
+
+	issued := 0
+	lookups := 0
+	client := NewTestClient(func(req *http.Request) *http.Response {
+		respond := func(code int, body string) *http.Response {
+			return &http.Response{
+				StatusCode: code,
+				Status:     fmt.Sprintf("%d", code),
+				Body:       ioutil.NopCloser(bytes.NewBufferString(body)),
+				Header:     make(http.Header),
+			}
+		}
+
+		switch req.URL.String() {
+		case "https://api.github.com/repos/owner/example/installation":
+			assert.Assert(t, strings.HasPrefix(req.Header.Get("Authorization"), "Bearer "), "installation lookup must use jwt")
+			lookups++
+			return respond(200, `{"id": 7}`)
+		case "https://api.github.com/app/installations/7/access_tokens", "https://api.github.com/app/installations/8/access_tokens":
+			assert.Assert(t, strings.HasPrefix(req.Header.Get("Authorization"), "Bearer "), "token request must use jwt")
+			issued++
+			expires := now.Add(time.Hour).Format(time.RFC3339)
+			return respond(201, fmt.Sprintf(`{"token": "token-%d", "expires_at": "%s"}`, issued, expires))
+		case "https://api.github.com/repos/owner/example/statuses/sha", "https://api.github.com/repos/other/example/statuses/sha":
+			return respond(201, req.Header.Get("Authorization"))
+		case "https://api.github.com/gists":
+			return respond(201, req.Header.Get("Authorization"))
+		}
+		t.Errorf("unexpected request to %s", req.URL.String())
+		return respond(404, "not found")
+	})
+
+	api := NewAPI()
+	api.Client = client
+	api.oauth = "oauthstring"
+	api.app = app
+
+	authorization := func(URL string) string {
+		res, err := api.post(URL, nil)
+		assert.Ok(t, err)
+		body, err := ioutil.ReadAll(res.Body)
+		assert.Ok(t, err)
+		return string(body)
+	}
+
+	t.Run("repository requests use installation token", func(t *testing.T) {
+		assert.Equals(t, "token token-1", authorization(api.StatusURL("owner", "example", "sha")))
+		assert.Equals(t, "token token-1", authorization(api.StatusURL("owner", "example", "sha")))
+		assert.Equals(t, 1, issued)
+		assert.Equals(t, 1, lookups)
+	})
+
+	t.Run("other requests use oauth token", func(t *testing.T) {
+		assert.Equals(t, "token oauthstring", authorization(api.NewGistURL()))
+	})
+
+	t.Run("token refreshed before expiry", func(t *testing.T) {
+		now = now.Add(56 * time.Minute)
+		assert.Equals(t, "token token-2", authorization(api.StatusURL("owner", "example", "sha")))
+		assert.Equals(t, 2, issued)
+	})
+
+	t.Run("installation from webhook", func(t *testing.T) {
+		api.SetInstallation("Other/Example", 8)
+		assert.Equals(t, "token token-3", authorization(api.StatusURL("other", "example", "sha")))
+		assert.Equals(t, 1, lookups)
+
+		token, err := api.Token("other", "example")
+		assert.Ok(t, err)
+		assert.Equals(t, "token-3", token)
+	})
+}
+
+func TestAppInstallationTokensConcurrent(t *testing.T) {
+	app, _ := genAppAuth(t)
+	release := make(chan struct{})
+	var lock sync.Mutex
+	issued := map[string]int{}
+	client := NewTestClient(func(req *http.Request) *http.Response {
+		lock.Lock()
+		issued[req.URL.Path]++
+		lock.Unlock()
+		if req.URL.Path == "/app/installations/7/access_tokens" {
+			<-release
+		}
+		expires := time.Now().Add(time.Hour).Format(time.RFC3339)
+		return &http.Response{
+			StatusCode: 201,
+			Status:     "201 Created",
+			Body:       ioutil.NopCloser(bytes.NewBufferString(fmt.Sprintf(`{"token": "%s", "expires_at": "%s"}`, req.URL.Path, expires))),
+			Header:     make(http.Header),
+		}
+	})
+	api := NewAPI()
+	api.Client = client
+	api.app = app
+	api.SetInstallation("owner/slow", 7)
+	api.SetInstallation("owner/fast", 8)
+	requested := func(path string) int {
+		lock.Lock()
+		defer lock.Unlock()
+		return issued[path]
+	}
+
+	var wg sync.WaitGroup
+	tokens := make([]string, 4)
+	for i := range tokens {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			token, err := api.Token("owner", "slow")
+			assert.Ok(t, err)
+			tokens[i] = token
+		}(i)
+	}
+	for requested("/app/installations/7/access_tokens") == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	t.Run("other installations not held up", func(t *testing.T) {
+		token, err := api.Token("owner", "fast")
+		assert.Ok(t, err)
+		assert.Equals(t, "/app/installations/8/access_tokens", token)
+	})
+
+	t.Run("concurrent callers share the request", func(t *testing.T) {
+		close(release)
+		wg.Wait()
+		for _, token := range tokens {
+			assert.Equals(t, "/app/installations/7/access_tokens", token)
+		}
+		assert.Equals(t, 1, requested("/app/installations/7/access_tokens"))
+	})
+
+	t.Run("waiting abandoned with the context", func(t *testing.T) {
+		api.SetInstallation("owner/stuck", 9)
+		stuck := make(chan struct{})
+		defer close(stuck)
+		api.Client = NewTestClient(func(req *http.Request) *http.Response {
+			<-stuck
+			return nil
+		})
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		_, err := api.WithContext(ctx).Token("owner", "stuck")
+		assert.Equals(t, context.Canceled, err)
+	})
+}
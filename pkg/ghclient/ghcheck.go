@@ -0,0 +1,139 @@
+package ghclient
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// check run statuses and conclusions
+const (
+	CheckQueued     = "queued"
+	CheckInProgress = "in_progress"
+	CheckCompleted  = "completed"
+
+	CheckSuccess        = "success"
+	CheckFailure        = "failure"
+	CheckCancelled      = "cancelled"
+	CheckTimedOut       = "timed_out"
+	CheckActionRequired = "action_required"
+)
+
+// github limits
+const (
+	// MaxCheckSummary maximum number of characters in a check run output summary
+	MaxCheckSummary = 65535
+	// MaxCheckAnnotations maximum number of annotations per check run request
+	MaxCheckAnnotations = 50
+)
+
+// Annotation github check run annotation pointing at a line in a file
+type Annotation struct {
+	Path            string `json:"path"`
+	StartLine       int    `json:"start_line"`
+	EndLine         int    `json:"end_line"`
+	AnnotationLevel string `json:"annotation_level"` // notice, warning or failure
+	Message         string `json:"message"`
+}
+
+// CheckOutput github check run output
+type CheckOutput struct {
+	Title       string       `json:"title"`
+	Summary     string       `json:"summary"`
+	Annotations []Annotation `json:"annotations,omitempty"`
+}
+
+// CheckRun github check run object
+type CheckRun struct {
+	ID         int64        `json:"id,omitempty"`
+	Name       string       `json:"name,omitempty"`
+	HeadSha    string       `json:"head_sha,omitempty"`
+	Status     string       `json:"status,omitempty"`
+	Conclusion string       `json:"conclusion,omitempty"`
+	DetailsURL string       `json:"details_url,omitempty"`
+	Output     *CheckOutput `json:"output,omitempty"`
+}
+
+// NewCheckRunFromStatus maps commit status onto check run. Pending statuses are queued until
+// the job starts running. Errored runs, which did not test the commit, require action rather than
+// pass as neutral, unless the status carries a more specific conclusion
+func NewCheckRunFromStatus(sha string, status Status) CheckRun {
+	cr := CheckRun{
+		Name:       status.Context,
+		HeadSha:    sha,
+		DetailsURL: status.TargetURL,
+	}
+
+	switch status.State {
+	case PENDING.String():
+		cr.Status = CheckInProgress
+		if status.Description == "queued" {
+			cr.Status = CheckQueued
+		}
+	case SUCCESS.String():
+		cr.Status = CheckCompleted
+		cr.Conclusion = CheckSuccess
+	case ERROR.String():
+		cr.Status = CheckCompleted
+		cr.Conclusion = CheckActionRequired
+	default:
+		cr.Status = CheckCompleted
+		cr.Conclusion = CheckFailure
+	}
+	if cr.Status == CheckCompleted && status.Conclusion != "" {
+		cr.Conclusion = status.Conclusion
+	}
+
+	cr.Output = &CheckOutput{
+		Title:   status.Description,
+		Summary: status.Description,
+	}
+	return cr
+}
+
+// UpdateCheckRun reports status of commit through the checks api. Check runs are tracked by the
+// copy of the commit passed in, which jobs own, so that jobs on the same commit report separately.
+// The first update creates the check run, subsequent updates modify it until it is completed. An
+// update after completion starts a new check run. Output overrides the default output generated
+// from the commit status
+func (c *Client) UpdateCheckRun(repo Repository, commit *Commit, output *CheckOutput) error {
+	if cIn := c.Cache.GetCommit(commit.Sha); cIn != nil {
+		cIn.Status = commit.Status
+	}
+
+	cr := NewCheckRunFromStatus(commit.Sha, commit.Status)
+	if output != nil {
+		cr.Output = output
+	}
+
+	if commit.CheckRun == 0 || (commit.checkRunStatus == CheckCompleted && cr.Status != CheckCompleted) {
+		body, err := json.Marshal(cr)
+		if err != nil {
+			return c.err.withMessage(fmt.Sprintf("failed to marshal check run: %s", err))
+		}
+		resp, err := c.Api.PostCheckRun(repo.Owner.Login, repo.Name, body)
+		if err != nil {
+			return err
+		}
+		created := &CheckRun{}
+		err = json.Unmarshal(resp, created)
+		if err != nil || created.ID == 0 {
+			return ErrInvalidResp
+		}
+		commit.CheckRun = created.ID
+		commit.checkRunStatus = cr.Status
+		return nil
+	}
+
+	// name and head sha cannot be changed once the check run exists
+	cr.HeadSha = ""
+	body, err := json.Marshal(cr)
+	if err != nil {
+		return c.err.withMessage(fmt.Sprintf("failed to marshal check run: %s", err))
+	}
+	_, err = c.Api.UpdateCheckRun(repo.Owner.Login, repo.Name, commit.CheckRun, body)
+	if err != nil {
+		return err
+	}
+	commit.checkRunStatus = cr.Status
+	return nil
+}
@@ -0,0 +1,157 @@
+package ghclient
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/pleimer/ci-server-go/pkg/assert"
+)
+
+func TestUpdateCheckRun(t *testing.T) {
+	repo := Repository{
+		Name: "example",
+		Owner: struct {
+			Login string `json:"login"`
+		}{
+			Login: "owner",
+		},
+	}
+
+	requests := []CheckRun{}
+	methods := []string{}
+	URLs := []string{}
+	created := int64(3)
+	client := NewTestClient(func(req *http.Request) *http.Response {
+		body, err := ioutil.ReadAll(req.Body)
+		assert.Ok(t, err)
+		cr := CheckRun{}
+		assert.Ok(t, json.Unmarshal(body, &cr))
+		requests = append(requests, cr)
+		methods = append(methods, req.Method)
+		URLs = append(URLs, req.URL.String())
+
+		switch {
+		case req.URL.String() == "https://api.github.com/repos/owner/example/check-runs":
+			created++
+			return &http.Response{
+				StatusCode: 201,
+				Status:     "201 Created",
+				Body:       ioutil.NopCloser(bytes.NewBufferString(fmt.Sprintf(`{"id": %d}`, created))),
+				Header:     make(http.Header),
+			}
+		case strings.HasPrefix(req.URL.String(), "https://api.github.com/repos/owner/example/check-runs/"):
+			return &http.Response{
+				StatusCode: 200,
+				Status:     "200 OK",
+				Body:       ioutil.NopCloser(bytes.NewBufferString(`{"id": 4}`)),
+				Header:     make(http.Header),
+			}
+		}
+		t.Errorf("unexpected request to %s", req.URL.String())
+		return &http.Response{
+			StatusCode: 404,
+			Status:     "404 Not Found",
+			Body:       ioutil.NopCloser(bytes.NewBufferString(`not found`)),
+			Header:     make(http.Header),
+		}
+	})
+
+	api := NewAPI()
+	api.Client = client
+	gh := Client{
+		Api:   api,
+		Cache: NewCache(),
+	}
+
+	commit := Commit{Sha: "sha"}
+	gh.Cache.WriteCommits(&commit)
+	commit.SetContext("ci-server-go")
+
+	commit.SetStatus(PENDING, "queued", "")
+	assert.Ok(t, gh.UpdateCheckRun(repo, &commit, nil))
+
+	commit.SetStatus(PENDING, "running main script", "gist.url")
+	assert.Ok(t, gh.UpdateCheckRun(repo, &commit, nil))
+
+	output := &CheckOutput{
+		Title:   "main script failed",
+		Summary: "## Main Script",
+		Annotations: []Annotation{
+			{Path: "main.go", StartLine: 3, EndLine: 3, AnnotationLevel: "failure", Message: "undefined: x"},
+		},
+	}
+	commit.SetStatus(FAILURE, "main script failed", "gist.url")
+	assert.Ok(t, gh.UpdateCheckRun(repo, &commit, output))
+
+	// rerun on the same commit starts a new check run
+	commit.SetStatus(PENDING, "queued", "")
+	assert.Ok(t, gh.UpdateCheckRun(repo, &commit, nil))
+
+	assert.Equals(t, []string{"POST", "PATCH", "PATCH", "POST"}, methods)
+
+	assert.Equals(t, "ci-server-go", requests[0].Name)
+	assert.Equals(t, "sha", requests[0].HeadSha)
+	assert.Equals(t, CheckQueued, requests[0].Status)
+
+	assert.Equals(t, CheckInProgress, requests[1].Status)
+	assert.Equals(t, "gist.url", requests[1].DetailsURL)
+
+	assert.Equals(t, CheckCompleted, requests[2].Status)
+	assert.Equals(t, CheckFailure, requests[2].Conclusion)
+	assert.Equals(t, output, requests[2].Output)
+
+	assert.Equals(t, CheckQueued, requests[3].Status)
+	assert.Equals(t, int64(5), commit.CheckRun)
+
+	t.Run("jobs on the same commit report separately", func(t *testing.T) {
+		other := *gh.Cache.GetCommit("sha")
+		assert.Equals(t, int64(0), other.CheckRun)
+		other.SetStatus(PENDING, "queued", "")
+		assert.Ok(t, gh.UpdateCheckRun(repo, &other, nil))
+		assert.Equals(t, int64(6), other.CheckRun)
+
+		commit.SetStatus(PENDING, "running main script", "")
+		assert.Ok(t, gh.UpdateCheckRun(repo, &commit, nil))
+		assert.Equals(t, "https://api.github.com/repos/owner/example/check-runs/5", URLs[len(URLs)-1])
+	})
+
+	t.Run("restored commit keeps its check run", func(t *testing.T) {
+		restored := Commit{Sha: "sha", CheckRun: 5}
+		restored.SetContext("ci-server-go")
+		restored.SetStatus(SUCCESS, "main script successful", "")
+		assert.Ok(t, gh.UpdateCheckRun(repo, &restored, nil))
+		assert.Equals(t, "PATCH", methods[len(methods)-1])
+		assert.Equals(t, "https://api.github.com/repos/owner/example/check-runs/5", URLs[len(URLs)-1])
+	})
+}
+
+func TestNewCheckRunFromStatus(t *testing.T) {
+	conclusion := func(state CommitState, override string) string {
+		commit := Commit{Sha: "sha"}
+		commit.SetStatus(state, "done", "")
+		if override != "" {
+			commit.SetConclusion(override)
+		}
+		return NewCheckRunFromStatus(commit.Sha, commit.Status).Conclusion
+	}
+
+	assert.Equals(t, CheckSuccess, conclusion(SUCCESS, ""))
+	assert.Equals(t, CheckFailure, conclusion(FAILURE, ""))
+	assert.Equals(t, CheckActionRequired, conclusion(ERROR, ""))
+	assert.Equals(t, CheckCancelled, conclusion(ERROR, CheckCancelled))
+	assert.Equals(t, CheckTimedOut, conclusion(FAILURE, CheckTimedOut))
+	assert.Equals(t, "", conclusion(PENDING, CheckCancelled))
+
+	t.Run("new status clears conclusion", func(t *testing.T) {
+		commit := Commit{Sha: "sha"}
+		commit.SetStatus(ERROR, "canceled", "")
+		commit.SetConclusion(CheckCancelled)
+		commit.SetStatus(FAILURE, "failed", "")
+		assert.Equals(t, CheckFailure, NewCheckRunFromStatus(commit.Sha, commit.Status).Conclusion)
+	})
+}
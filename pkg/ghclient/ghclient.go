@@ -1,25 +1,45 @@
 package ghclient
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"net/http"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/pleimer/ci-server-go/pkg/logging"
+	"github.com/pleimer/ci-server-go/pkg/metrics"
 )
 
 // Client github client object
 type Client struct {
 	EventChan chan Event
 	User      string
+	Secrets   WebhookSecrets
+
+	// Deliveries tracks received deliveries to drop redelivered copies. Disabled if nil
+	Deliveries *DeliveryLog
+
+	// Journal keeps received deliveries for replay. Disabled if nil
+	Journal *Journal
 
 	Api          API
 	Cache        Cache
-	Repositories map[string]*Repository
+	Repositories *RepositoryRegistry
+
+	// FetchWorkers number of blobs downloaded concurrently. Defaults to DefaultFetchWorkers
+	FetchWorkers int
 
-	err GithubClientError
+	handlers map[string]http.Handler
+	err      GithubClientError
+	draining int32 // set once deliveries are rejected
+
+	// summary comments by pull request
+	sticky     map[string]stickyComment
+	stickyLock sync.Mutex
 }
 
 // NewClient create a new github Client
@@ -27,9 +47,10 @@ func NewClient(eventChan chan Event, user string) *Client {
 	return &Client{
 		Api:          NewAPI(),
 		User:         user,
-		Repositories: make(map[string]*Repository),
+		Repositories: NewRepositoryRegistry(),
 		Cache:        NewCache(),
 		EventChan:    eventChan,
+		handlers:     make(map[string]http.Handler),
 		err: GithubClientError{
 			module: "ghclient",
 		},
@@ -54,23 +75,151 @@ func (c *Client) UpdateCommitStatus(repo Repository, commit Commit) error {
 	return c.Api.PostStatus(repo.Owner.Login, repo.Name, cIn.Sha, body)
 }
 
+// GetCommit retrieve commit sha of repo together with the status previously posted by the server.
+// Commits fetched from the api are indexed so that their status can be updated
+func (c *Client) GetCommit(ctx context.Context, repo Repository, sha string) (*Commit, error) {
+	if commit := c.Cache.GetCommit(sha); commit != nil {
+		return commit, nil
+	}
+
+	api := c.Api.WithContext(ctx)
+	commitJSON, err := api.GetCommit(repo.Owner.Login, repo.Name, sha)
+	if err != nil {
+		return nil, err
+	}
+	commit, err := newCommitFromAPI(commitJSON)
+	if err != nil {
+		return nil, c.err.withMessage(fmt.Sprintf("failed parsing commit %s: %s", sha, err))
+	}
+
+	statusJSON, err := api.GetCombinedStatus(repo.Owner.Login, repo.Name, commit.Sha)
+	if err != nil {
+		return nil, err
+	}
+	combined := struct {
+		Statuses []Status `json:"statuses"`
+	}{}
+	err = json.Unmarshal(statusJSON, &combined)
+	if err != nil {
+		return nil, c.err.withMessage(fmt.Sprintf("failed parsing status of commit %s: %s", sha, err))
+	}
+	for _, status := range combined.Statuses {
+		if status.Context == StatusContext {
+			commit.Status = status
+		}
+	}
+
+	c.Cache.WriteCommits(commit)
+	if indexed := c.Cache.GetCommit(commit.Sha); indexed != nil {
+		return indexed, nil
+	}
+	return commit, nil
+}
+
+// Handle registers handler for pattern on the webhook server. Must be called before Listen
+func (c *Client) Handle(pattern string, handler http.Handler) {
+	if c.handlers == nil {
+		c.handlers = make(map[string]http.Handler)
+	}
+	c.handlers[pattern] = handler
+}
+
+// Replay processes journaled delivery again as if it had just been received
+func (c *Client) Replay(delivery string, log *logging.Logger) error {
+	if c.Journal == nil {
+		return ErrDeliveryNotFound
+	}
+	entry, ok := c.Journal.Get(delivery)
+	if !ok {
+		return ErrDeliveryNotFound
+	}
+
+	log.Metadata(map[string]interface{}{"module": "ghclient", "delivery": delivery, "event": entry.Event})
+	log.Info("replaying delivery")
+	return c.dispatch(delivery, entry.Event, []byte(entry.Body), log)
+}
+
+// dispatch parses payload of delivery into an event and sends it to the event channel
+func (c *Client) dispatch(delivery, eventType string, payload []byte, log *logging.Logger) error {
+	c.Api.SetInstallation(payloadRepository(payload), payloadInstallation(payload))
+
+	ev, err := EventFactory(eventType)
+	if err != nil {
+		c.setOutcome(delivery, OutcomeIgnored, err, log)
+		log.Metadata(map[string]interface{}{"module": "ghclient", "delivery": delivery, "error": err})
+		log.Error("failed parsing incoming event")
+		return err
+	}
+
+	log.Metadata(map[string]interface{}{"module": "ghclient", "delivery": delivery})
+	log.Debug(fmt.Sprintf("received payload: %s", string(payload)))
+
+	err = ev.Handle(c, payload)
+	if err != nil {
+		c.setOutcome(delivery, OutcomeFailed, err, log)
+		log.Metadata(map[string]interface{}{"module": "ghclient", "delivery": delivery, "error": err.Error()})
+		log.Error("problem handling event")
+		return err
+	}
+
+	setDelivery(ev, delivery)
+	c.setOutcome(delivery, OutcomeDispatched, nil, log)
+	c.EventChan <- ev
+	return nil
+}
+
+// setDelivery records delivery in the events that create jobs, so that the delivery can be confirmed
+// once their job is stored
+func setDelivery(ev Event, delivery string) {
+	switch e := ev.(type) {
+	case *Push:
+		e.Delivery = delivery
+	case *PullRequest:
+		e.Delivery = delivery
+	case *Comment:
+		e.Delivery = delivery
+	}
+}
+
+func (c *Client) journal(entry JournalEntry, log *logging.Logger) {
+	if c.Journal == nil {
+		return
+	}
+	if err := c.Journal.Record(entry); err != nil {
+		log.Metadata(map[string]interface{}{"module": "ghclient", "delivery": entry.Delivery, "error": err})
+		log.Warn("failed writing delivery to journal")
+	}
+}
+
+func (c *Client) setOutcome(delivery, outcome string, err error, log *logging.Logger) {
+	if c.Journal == nil {
+		return
+	}
+	if jerr := c.Journal.SetOutcome(delivery, outcome, err); jerr != nil {
+		log.Metadata(map[string]interface{}{"module": "ghclient", "delivery": delivery, "error": jerr})
+		log.Warn("failed writing delivery outcome to journal")
+	}
+}
+
 // Listen listen on address for webhooks
 func (c *Client) Listen(wg *sync.WaitGroup, address string, log *logging.Logger) *http.Server {
-	srv := &http.Server{Addr: address}
+	mux := http.NewServeMux()
+	srv := &http.Server{Addr: address, Handler: mux}
 
-	http.HandleFunc("/", func(w http.ResponseWriter, req *http.Request) {
+	mux.HandleFunc("/", func(w http.ResponseWriter, req *http.Request) {
 		w.Write([]byte("Hello!"))
 	})
-	http.HandleFunc("/webhook", func(w http.ResponseWriter, req *http.Request) {
+	mux.Handle("/metrics", metrics.Handler())
+	mux.HandleFunc("/webhook", func(w http.ResponseWriter, req *http.Request) {
+		if c.Draining() {
+			log.Metadata(map[string]interface{}{"module": "ghclient", "endpoint": "/webhook"})
+			log.Info("rejected event while draining")
+			http.Error(w, ErrDraining.Error(), http.StatusServiceUnavailable)
+			return
+		}
 		log.Metadata(map[string]interface{}{"module": "ghclient", "endpoint": "/webhook"})
 		log.Info("received event")
 
-		ev, err := EventFactory(req.Header.Get("X-Github-Event"))
-		if err != nil {
-			log.Metadata(map[string]interface{}{"module": "ghclient", "endpoint": "/webhook", "error": err})
-			log.Error("failed parsing incoming event")
-			return
-		}
 		json, err := ioutil.ReadAll(req.Body)
 		if err != nil {
 			log.Metadata(map[string]interface{}{"module": "ghclient", "endpoint": "/webhook"})
@@ -78,18 +227,45 @@ func (c *Client) Listen(wg *sync.WaitGroup, address string, log *logging.Logger)
 			return
 		}
 
-		log.Metadata(map[string]interface{}{"module": "ghclient", "endpoint": "/webhook"})
-		log.Debug(fmt.Sprintf("received payload: %s", string(json)))
+		repoName := payloadRepository(json)
+		if c.Secrets.Enabled() {
+			if err := VerifySignature(c.Secrets.Get(repoName), req.Header, json); err != nil {
+				log.Metadata(map[string]interface{}{"module": "ghclient", "endpoint": "/webhook", "repository": repoName, "error": err})
+				log.Warn("rejected delivery with invalid signature")
+				http.Error(w, err.Error(), http.StatusUnauthorized)
+				return
+			}
+		}
 
-		err = ev.Handle(c, json)
-		if err != nil {
-			log.Metadata(map[string]interface{}{"module": "ghclient", "endpoint": "/webhook", "error": err.Error()})
-			log.Error("problem handling event")
+		delivery := req.Header.Get("X-GitHub-Delivery")
+		if c.Deliveries != nil && delivery != "" && !c.Deliveries.Record(delivery) {
+			log.Metadata(map[string]interface{}{"module": "ghclient", "endpoint": "/webhook", "delivery": delivery})
+			log.Debug("dropped duplicate delivery")
+			w.WriteHeader(http.StatusOK)
 			return
 		}
+		if delivery == "" {
+			delivery = fmt.Sprintf("local-%d", time.Now().UnixNano())
+		}
+
+		eventType := req.Header.Get("X-Github-Event")
+		c.journal(JournalEntry{
+			Delivery: delivery,
+			Event:    eventType,
+			Received: time.Now(),
+			Header:   req.Header,
+			Body:     string(json),
+			Outcome:  OutcomeReceived,
+		}, log)
 
-		c.EventChan <- ev
+		err = c.dispatch(delivery, eventType, json, log)
+		if err != nil {
+			c.forgetDelivery(delivery)
+		}
 	})
+	for pattern, handler := range c.handlers {
+		mux.Handle(pattern, handler)
+	}
 
 	go func() {
 		defer wg.Done()
@@ -103,3 +279,21 @@ func (c *Client) Listen(wg *sync.WaitGroup, address string, log *logging.Logger)
 	}()
 	return srv
 }
+
+// Drain rejects deliveries from now on, so that github reports them as failed and they can be
+// redelivered once the server is back
+func (c *Client) Drain() {
+	atomic.StoreInt32(&c.draining, 1)
+}
+
+// Draining whether deliveries are rejected
+func (c *Client) Draining() bool {
+	return atomic.LoadInt32(&c.draining) == 1
+}
+
+// forgetDelivery allows a delivery that could not be processed to be redelivered
+func (c *Client) forgetDelivery(delivery string) {
+	if c.Deliveries != nil && delivery != "" {
+		c.Deliveries.Forget(delivery)
+	}
+}
@@ -2,7 +2,13 @@ package ghclient
 
 import (
 	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
+	"hash"
 	"io/ioutil"
 	"net/http"
 	"strings"
@@ -106,26 +112,175 @@ func TestUpdateStatus(t *testing.T) {
 func TestListen(t *testing.T) {
 	eventChan := make(chan Event, 10)
 	gh := NewClient(eventChan, "testuser")
+	gh.Secrets = WebhookSecrets{Default: "secret"}
 	log, err := logging.NewLogger(logging.NONE, "console")
 	assert.Ok(t, err)
+	gh.Deliveries, err = NewDeliveryLog("", time.Hour, 10)
+	assert.Ok(t, err)
+
+	payload, err := json.Marshal(getWebhook())
+	assert.Ok(t, err)
 
 	go gh.Listen(nil, ":8888", log)
-	req, _ := http.NewRequest("POST", "http://127.0.0.1:8888/webhook", strings.NewReader(`{payload:"payload"}`))
+	time.Sleep(time.Second)
+
+	t.Run("signed delivery", func(t *testing.T) {
+		req, _ := http.NewRequest("POST", "http://127.0.0.1:8888/webhook", bytes.NewReader(payload))
+		req.Header.Set("X-Github-Event", "push")
+		req.Header.Set("X-Hub-Signature-256", sign(sha256.New, "sha256=", "secret", payload))
+
+		srv := http.Client{}
+		res, err := srv.Do(req)
+		assert.Ok(t, err)
+		assert.Equals(t, 200, res.StatusCode)
+
+		select {
+		case <-gh.EventChan:
+		default:
+			t.Errorf("Did not receive event")
+		}
+	})
+
+	t.Run("unsigned delivery", func(t *testing.T) {
+		req, _ := http.NewRequest("POST", "http://127.0.0.1:8888/webhook", bytes.NewReader(payload))
+		req.Header.Set("X-Github-Event", "push")
+
+		srv := http.Client{}
+		res, err := srv.Do(req)
+		assert.Ok(t, err)
+		assert.Equals(t, 401, res.StatusCode)
+
+		select {
+		case <-gh.EventChan:
+			t.Errorf("unsigned delivery should have been rejected")
+		default:
+		}
+	})
+
+	t.Run("duplicate delivery", func(t *testing.T) {
+		deliver := func() int {
+			req, _ := http.NewRequest("POST", "http://127.0.0.1:8888/webhook", bytes.NewReader(payload))
+			req.Header.Set("X-Github-Event", "push")
+			req.Header.Set("X-GitHub-Delivery", "72d3162e-cc78-11e3-81ab-4c9367dc0958")
+			req.Header.Set("X-Hub-Signature-256", sign(sha256.New, "sha256=", "secret", payload))
+
+			srv := http.Client{}
+			res, err := srv.Do(req)
+			assert.Ok(t, err)
+			return res.StatusCode
+		}
+
+		assert.Equals(t, 200, deliver())
+		ev := <-gh.EventChan
+		assert.Equals(t, "72d3162e-cc78-11e3-81ab-4c9367dc0958", ev.(*Push).Delivery)
+		assert.Equals(t, 200, deliver())
+
+		select {
+		case <-gh.EventChan:
+			t.Errorf("duplicate delivery should have been dropped")
+		default:
+		}
+	})
+
+	t.Run("draining", func(t *testing.T) {
+		gh.Drain()
+		req, _ := http.NewRequest("POST", "http://127.0.0.1:8888/webhook", bytes.NewReader(payload))
+		req.Header.Set("X-Github-Event", "push")
+		req.Header.Set("X-GitHub-Delivery", "f8f5c6a2-cc78-11e3-81ab-4c9367dc0958")
+		req.Header.Set("X-Hub-Signature-256", sign(sha256.New, "sha256=", "secret", payload))
+
+		srv := http.Client{}
+		res, err := srv.Do(req)
+		assert.Ok(t, err)
+		assert.Equals(t, 503, res.StatusCode)
 
+		select {
+		case <-gh.EventChan:
+			t.Errorf("delivery should have been rejected while draining")
+		default:
+		}
+		// the delivery is accepted when github redelivers it to the restarted server
+		assert.Assert(t, gh.Deliveries.Record("f8f5c6a2-cc78-11e3-81ab-4c9367dc0958"), "rejected delivery should not be recorded")
+	})
+}
+
+func TestListenRepositorySecrets(t *testing.T) {
+	eventChan := make(chan Event, 10)
+	gh := NewClient(eventChan, "testuser")
+	gh.Secrets = WebhookSecrets{Repositories: map[string]string{"owner/example": "secret"}}
+	log, err := logging.NewLogger(logging.NONE, "console")
+	assert.Ok(t, err)
+
+	// delivery for a repository without a secret of its own, signed with the empty default
+	payload, err := json.Marshal(getWebhook())
+	assert.Ok(t, err)
+
+	go gh.Listen(nil, ":8889", log)
 	time.Sleep(time.Second)
+
+	req, _ := http.NewRequest("POST", "http://127.0.0.1:8889/webhook", bytes.NewReader(payload))
 	req.Header.Set("X-Github-Event", "push")
+	req.Header.Set("X-Hub-Signature-256", sign(sha256.New, "sha256=", "", payload))
 
 	srv := http.Client{}
-	_, err = srv.Do(req)
+	res, err := srv.Do(req)
 	assert.Ok(t, err)
+	assert.Equals(t, 401, res.StatusCode)
 
 	select {
 	case <-gh.EventChan:
+		t.Errorf("delivery for repository without secret should have been rejected")
 	default:
-		t.Errorf("Did not receive event")
 	}
 }
 
+func TestVerifySignature(t *testing.T) {
+	body := []byte(`{"zen":"Keep it logically awesome."}`)
+
+	tests := []struct {
+		name   string
+		header string
+		value  string
+		err    error
+	}{
+		{"sha256", "X-Hub-Signature-256", sign(sha256.New, "sha256=", "secret", body), nil},
+		{"legacy sha1", "X-Hub-Signature", sign(sha1.New, "sha1=", "secret", body), nil},
+		{"wrong secret", "X-Hub-Signature-256", sign(sha256.New, "sha256=", "other", body), ErrSignatureMismatch},
+		{"wrong algorithm prefix", "X-Hub-Signature-256", sign(sha1.New, "sha1=", "secret", body), ErrSignatureMismatch},
+		{"malformed", "X-Hub-Signature-256", "sha256=zz", ErrSignatureMismatch},
+		{"unsigned", "X-Other", "", ErrMissingSignature},
+	}
+
+	t.Run("empty secret", func(t *testing.T) {
+		header := make(http.Header)
+		header.Set("X-Hub-Signature-256", sign(sha256.New, "sha256=", "", body))
+		assert.Equals(t, ErrNoSecret, VerifySignature("", header, body))
+	})
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			header := make(http.Header)
+			header.Set(test.header, test.value)
+			assert.Equals(t, test.err, VerifySignature("secret", header, body))
+		})
+	}
+
+	t.Run("repository secret", func(t *testing.T) {
+		secrets := WebhookSecrets{
+			Default:      "default",
+			Repositories: map[string]string{"owner/example": "repo"},
+		}
+		assert.Equals(t, "repo", secrets.Get("Owner/Example"))
+		assert.Equals(t, "default", secrets.Get("owner/other"))
+	})
+}
+
+func sign(hashFn func() hash.Hash, prefix, secret string, body []byte) string {
+	mac := hmac.New(hashFn, []byte(secret))
+	mac.Write(body)
+	return prefix + hex.EncodeToString(mac.Sum(nil))
+}
+
 func TestGetTree(t *testing.T) {
 	// Test inputs
 	t.Run("no cache hits", func(t *testing.T) {
@@ -249,7 +404,7 @@ func TestGetTree(t *testing.T) {
 			Cache: NewCache(),
 		}
 
-		tree, err := gh.GetTree("t0", repo)
+		tree, err := gh.GetTree(context.Background(), "t0", repo)
 		assert.Ok(t, err)
 		assert.Equals(t, t0, tree)
 
@@ -297,9 +452,9 @@ func TestGetTree(t *testing.T) {
 			Cache: NewCache(),
 		}
 
-		_, err = gh.GetTree("t0", repo)
+		_, err = gh.GetTree(context.Background(), "t0", repo)
 		assert.Ok(t, err)
-		_, err = gh.GetTree("t0", repo)
+		_, err = gh.GetTree(context.Background(), "t0", repo)
 		assert.Ok(t, err)
 	})
 }
@@ -8,6 +8,9 @@ import (
 
 type CommitState int
 
+// StatusContext context of the statuses posted by the server
+const StatusContext = "ci-server-go"
+
 const (
 	ERROR CommitState = iota
 	FAILURE
@@ -26,6 +29,9 @@ type Status struct {
 	TargetURL   string `json:"target_url"`
 	Description string `json:"description"`
 	Context     string `json:"context"`
+
+	// check run conclusion, derived from State if empty. Commit statuses have no equivalent
+	Conclusion string `json:"-"`
 }
 
 // Commit resource tracking a github commit
@@ -40,8 +46,13 @@ type Commit struct {
 		Email    string `json:"email"`
 		Username string `json:"username"`
 	}
-	parent *Commit
-	child  *Commit
+	// check run reporting the status of the job owning this copy of the commit, see UpdateCheckRun.
+	// Persisted with the job, so that a restored job keeps reporting to the same check run
+	CheckRun int64 `json:"check_run,omitempty"`
+
+	parent         *Commit
+	child          *Commit
+	checkRunStatus string // as of the last update, empty if unknown
 }
 
 // SetContext set context of commit status
@@ -54,6 +65,13 @@ func (c *Commit) SetStatus(state CommitState, message string, targetURL string)
 	c.Status.State = state.String()
 	c.Status.Description = message
 	c.Status.TargetURL = targetURL
+	c.Status.Conclusion = ""
+}
+
+// SetConclusion overrides the check run conclusion derived from the status set last, for outcomes
+// such as cancelled runs that commit statuses cannot express
+func (c *Commit) SetConclusion(conclusion string) {
+	c.Status.Conclusion = conclusion
 }
 
 // GetParent returns copy of parent commit
@@ -93,6 +111,43 @@ func NewCommitFromJSON(commitJSON []byte) (*Commit, error) {
 	return commit, nil
 }
 
+// newCommitFromAPI build commit from the json of the github commits api, which nests
+// the git commit data below the commit key
+func newCommitFromAPI(commitJSON []byte) (*Commit, error) {
+	data := struct {
+		Sha     string `json:"sha"`
+		HTMLURL string `json:"html_url"`
+		Commit  struct {
+			Message string `json:"message"`
+			Author  struct {
+				Name  string `json:"name"`
+				Email string `json:"email"`
+			} `json:"author"`
+		} `json:"commit"`
+		Author struct {
+			Login string `json:"login"`
+		} `json:"author"`
+	}{}
+	err := json.Unmarshal(commitJSON, &data)
+	if err != nil {
+		return nil, err
+	}
+	if data.Sha == "" {
+		return nil, commitError("no sha in commit json")
+	}
+
+	commit := &Commit{
+		Sha:     data.Sha,
+		ID:      data.Sha,
+		Message: data.Commit.Message,
+		URL:     data.HTMLURL,
+	}
+	commit.Author.Name = data.Commit.Author.Name
+	commit.Author.Email = data.Commit.Author.Email
+	commit.Author.Username = data.Author.Login
+	return commit, nil
+}
+
 func commitError(msg string) error {
 	return &GithubClientError{
 		module: "Commit",
@@ -9,22 +9,23 @@ import (
 	"gopkg.in/go-playground/validator.v9"
 )
 
-// add pull request and comment
-
 // Event definitions from github
 type Event interface {
 	Handle(*Client, []byte) error
 }
 
-var events map[string]Event = map[string]Event{
-	"push":          &Push{},
-	"issue_comment": &Comment{},
+// each delivery must be handled by its own event object since jobs keep referencing
+// the event after the next delivery arrives
+var events map[string]func() Event = map[string]func() Event{
+	"push":          func() Event { return &Push{} },
+	"issue_comment": func() Event { return &Comment{} },
+	"pull_request":  func() Event { return &PullRequest{} },
 }
 
 // EventFactory create github event based on string name
 func EventFactory(incoming string) (Event, error) {
 	if e := events[incoming]; e != nil {
-		return e, nil
+		return e(), nil
 	}
 	return nil, fmt.Errorf("unknown event type '%s'", incoming)
 }
@@ -32,33 +33,56 @@ func EventFactory(incoming string) (Event, error) {
 type commentWebHook struct {
 	Action string `json:"action" validate:"required"`
 	Issue  struct {
+		Number      int `json:"number"`
 		PullRequest struct {
 			URL string `json:"url" validate:"required"`
 		} `json:"pull_request" validate:"required"`
 	} `json:"issue" validate:"required"`
 	Comment struct {
+		ID   int64 `json:"id"`
 		User struct {
 			Login string `json:"login" validate:"required"`
 		} `json:"user" validate:"required"`
 		Body string `json:"body" validate:"required"`
 	} `json:"comment" validate:"required"`
-	Repository struct {
-		Name string `json:"name" validate:"required"`
-	} `json:"repository" validate:"required"`
+	Repository json.RawMessage `json:"repository" validate:"required"`
+}
+
+// pullRequestData pull request as returned by the api
+type pullRequestData struct {
+	Number int `json:"number"`
+	User   struct {
+		Login string `json:"login"`
+	} `json:"user"`
+	Head struct {
+		Ref  string `json:"ref" validate:"required"`
+		Sha  string `json:"sha" validate:"required"`
+		Repo struct {
+			FullName string `json:"full_name"`
+		} `json:"repo"`
+	} `json:"head" validate:"required"`
 }
 
 // Comment implements Event interface. Represents a github comment webhook
 type Comment struct {
-	Ref  Reference
-	Repo Repository
+	Repo   Repository
+	Commit Commit // head of the pull request, resolved by the job from Head
+	Head   string // sha of the head of the pull request
+
+	Action  string
+	ID      int64 // of the comment
+	Number  int
+	RefName string
+	Body    string
+	User    string
+	Author  string // author of the pull request
 
-	Action    string
-	RefName   string
-	Body      string
-	CommitSHA string
-	User      string
+	Delivery string // ID of the webhook delivery the event was received with
 }
 
+// CommentCreated action of comment events whose commands are run. Comments can also be edited or deleted
+const CommentCreated = "created"
+
 // Handle parses the contents of a github issue comment
 func (c *Comment) Handle(client *Client, commentJSON []byte) error {
 	// There are four types of comment webhooks:
@@ -82,52 +106,55 @@ func (c *Comment) Handle(client *Client, commentJSON []byte) error {
 	}
 
 	c.Action = comment.Action
+	c.ID = comment.Comment.ID
 	c.Body = comment.Comment.Body
 	c.User = comment.Comment.User.Login
+	c.Number = comment.Issue.Number
 
-	// find resources based on parsed values
-	if repo := client.Repositories[comment.Repository.Name]; repo == nil {
-		return commentEventError(fmt.Sprintf("could not find '%s' repository", comment.Repository.Name))
+	repo, err := NewRepositoryFromJSON(comment.Repository)
+	if err != nil {
+		return err
+	}
+	c.Repo = client.Repositories.Register(repo)
+
+	// most comments are discussion or replies of the server itself, which are not worth any api call
+	if c.Action != CommentCreated || c.User == client.User || !hasCommand(c.Body) {
+		return nil
 	}
-	c.Repo = *client.Repositories[comment.Repository.Name]
 
-	// retrieve pull request data for issue comment
-	prData := make(map[string]interface{})
+	// the branch of the pull request decides which jobs the comment conflicts with, so it is
+	// known before the job is set up. Its head commit is resolved by the job
 	prDataBytes, err := client.Api.GetURL(comment.Issue.PullRequest.URL)
 	if err != nil {
 		return err
 	}
+	prData := pullRequestData{}
 	err = json.Unmarshal(prDataBytes, &prData)
 	if err != nil {
 		return errors.Wrap(err, "failed to parse pull request json")
 	}
-
-	head, ok := prData["head"].(map[string]interface{})
-	if !ok {
-		return fmt.Errorf("failed to find pull request head commit data")
+	err = validator.Struct(prData)
+	if err != nil {
+		return commentEventError(fmt.Sprintf("failed to find pull request head: %s", err))
 	}
-
-	c.CommitSHA, ok = head["sha"].(string)
-	if !ok {
-		return fmt.Errorf("failed to find commit sha from pull request data")
+	if prData.Number != 0 {
+		c.Number = prData.Number
 	}
+	c.Author = prData.User.Login
 
-	c.RefName, ok = head["ref"].(string)
-	if !ok {
-		return fmt.Errorf("failed to find reference data from pull request data")
-	}
-
-	//TODO: query this from commit URL instead of this hack
-	c.RefName = strings.Join([]string{"refs", "heads", c.RefName}, "/")
-	c.RefName = "\"" + c.RefName + "\""
+	c.RefName = pullRequestRefName(c.Number, prData.Head.Ref, isFork(prData.Head.Repo.FullName, c.Repo))
+	c.Head = prData.Head.Sha
+	return nil
+}
 
-	if ref := client.Repositories[comment.Repository.Name].GetReference(c.RefName); ref == nil {
-		return fmt.Errorf("could not find '%s' reference in repository '%s'", c.RefName, comment.Repository.Name)
+// hasCommand whether a line of comment body starts with a /command
+func hasCommand(body string) bool {
+	for _, line := range strings.Split(body, "\n") {
+		if fields := strings.Fields(line); len(fields) > 0 && len(fields[0]) > 1 && strings.HasPrefix(fields[0], "/") {
+			return true
+		}
 	}
-
-	c.Ref = *client.Repositories[comment.Repository.Name].GetReference(c.RefName)
-
-	return nil
+	return false
 }
 
 // Push implements github Event interface
@@ -136,6 +163,8 @@ type Push struct {
 	RefName string
 	Repo    Repository
 	User    string
+
+	Delivery string // ID of the webhook delivery the event was received with
 }
 
 func (p *Push) Handle(client *Client, pushJSON []byte) error {
@@ -152,9 +181,7 @@ func (p *Push) Handle(client *Client, pushJSON []byte) error {
 		return err
 	}
 
-	if _, ok := client.Repositories[repo.Name]; !ok {
-		client.Repositories[repo.Name] = repo
-	}
+	client.Repositories.Register(repo)
 
 	var cSliceJSON []json.RawMessage
 	err = json.Unmarshal(eventMap["commits"], &cSliceJSON)
@@ -208,18 +235,115 @@ func (p *Push) Handle(client *Client, pushJSON []byte) error {
 		return pushEventError("no reference found in event message")
 	}
 	p.RefName = refName
-	client.Repositories[repo.Name].registerCommits(head, refName)
+	client.Repositories.RegisterCommits(repo.FullName(), refName, head)
 	client.Cache.WriteCommits(head)
 
-	p.Repo = *client.Repositories[repo.Name]
-	if p.Repo.GetReference(refName) == nil {
+	p.Repo, _ = client.Repositories.Get(repo.FullName())
+	if p.Ref, ok = client.Repositories.Reference(repo.FullName(), refName); !ok {
 		return pushEventError("failed to retrieve reference from repository")
 	}
+	return nil
+}
 
-	p.Ref = *p.Repo.GetReference(refName)
+type pullRequestWebHook struct {
+	Action      string `json:"action" validate:"required"`
+	Number      int    `json:"number" validate:"required"`
+	PullRequest struct {
+		Draft  bool `json:"draft"`
+		Merged bool `json:"merged"`
+		User   struct {
+			Login string `json:"login" validate:"required"`
+		} `json:"user" validate:"required"`
+		Head struct {
+			Ref  string `json:"ref" validate:"required"`
+			Sha  string `json:"sha" validate:"required"`
+			Repo struct {
+				FullName string `json:"full_name"`
+			} `json:"repo"`
+		} `json:"head" validate:"required"`
+	} `json:"pull_request" validate:"required"`
+	Repository json.RawMessage `json:"repository" validate:"required"`
+	Sender     struct {
+		Login string `json:"login" validate:"required"`
+	} `json:"sender" validate:"required"`
+}
+
+// PullRequest implements github Event interface. Represents a github pull_request webhook
+type PullRequest struct {
+	Repo   Repository
+	Commit Commit
+
+	Action  string
+	Number  int
+	RefName string
+	Author  string
+	User    string
+	Draft   bool
+	Merged  bool
+	Fork    bool // whether the pull request was opened from a fork, whose pushes the server does not receive
+
+	Delivery string // ID of the webhook delivery the event was received with
+}
+
+// pull request actions that result in a job
+const (
+	PullRequestOpened         = "opened"
+	PullRequestSynchronize    = "synchronize"
+	PullRequestReopened       = "reopened"
+	PullRequestReadyForReview = "ready_for_review"
+	PullRequestClosed         = "closed"
+)
+
+// Handle parses the contents of a github pull request event
+func (pr *PullRequest) Handle(client *Client, prJSON []byte) error {
+	validator := validator.New()
+
+	event := pullRequestWebHook{}
+	err := json.Unmarshal(prJSON, &event)
+	if err != nil {
+		return pullRequestEventError(fmt.Sprintf("failed parsing pull request event json: %s", err))
+	}
+
+	err = validator.Struct(event)
+	if err != nil {
+		return pullRequestEventError(fmt.Sprintf("json validation failed: %s", err))
+	}
+
+	repo, err := NewRepositoryFromJSON(event.Repository)
+	if err != nil {
+		return err
+	}
+
+	pr.Repo = client.Repositories.Register(repo)
+	pr.Action = event.Action
+	pr.Number = event.Number
+	pr.Author = event.PullRequest.User.Login
+	pr.User = event.Sender.Login
+	pr.Draft = event.PullRequest.Draft
+	pr.Merged = event.PullRequest.Merged
+
+	// reference name formatted the same as in push events so that jobs on the same branch conflict
+	pr.Fork = isFork(event.PullRequest.Head.Repo.FullName, pr.Repo)
+	pr.RefName = pullRequestRefName(event.Number, event.PullRequest.Head.Ref, pr.Fork)
+
+	commit := client.Cache.GetCommit(event.PullRequest.Head.Sha)
+	if commit == nil {
+		commit = &Commit{
+			Sha: event.PullRequest.Head.Sha,
+		}
+		client.Cache.WriteCommits(commit)
+	}
+	pr.Commit = *commit
 	return nil
 }
 
+func pullRequestEventError(msg string) error {
+	return &GithubClientError{
+		module: "PullRequest",
+		err:    msg,
+	}
+}
+
 func pushEventError(msg string) error {
 	return &GithubClientError{
 		module: "Push",
@@ -1,8 +1,13 @@
 package ghclient
 
 import (
+	"bytes"
+	"context"
 	"encoding/json"
+	"fmt"
 	"io/ioutil"
+	"net/http"
+	"strings"
 	"testing"
 
 	"github.com/pleimer/ci-server-go/pkg/assert"
@@ -31,6 +36,9 @@ func getWebhook() map[string]interface{} {
 			},
 			"fork": false,
 		},
+		"sender": map[string]interface{}{
+			"login": "Codertocat",
+		},
 	}
 }
 
@@ -44,11 +52,10 @@ func TestCommentHandle(t *testing.T) {
 	assert.Ok(t, err)
 
 	gh := NewClient(nil, "testuser")
-	repo := &Repository{}
-	gh.Repositories = make(map[string]*Repository)
-	gh.Repositories["Hello-World"] = repo
+	repo := &Repository{Name: "Hello-World"}
 	repo.refs = make(map[string]*Reference)
 	repo.refs["changes"] = &Reference{}
+	gh.Repositories.Register(repo)
 
 	standard.Repo = *repo
 
@@ -58,6 +65,107 @@ func TestCommentHandle(t *testing.T) {
 	assert.Equals(t, standard, *commentEvent)
 }
 
+func TestCommentHandleHead(t *testing.T) {
+	requests := 0
+	client := NewTestClient(func(req *http.Request) *http.Response {
+		requests++
+		var body interface{}
+		switch strings.TrimPrefix(req.URL.String(), "https://api.github.com/repos/") {
+		case "owner/example/pulls/7":
+			body = map[string]interface{}{"number": 7, "head": map[string]interface{}{
+				"ref": "master", "sha": "c7", "repo": map[string]string{"full_name": "contributor/example"},
+			}}
+		case "owner/example/pulls/8":
+			body = map[string]interface{}{"number": 8, "head": map[string]interface{}{
+				"ref": "feature", "sha": "c8", "repo": map[string]string{"full_name": "owner/example"},
+			}}
+		case "owner/example/commits/c7":
+			body = map[string]interface{}{
+				"sha":    "c7",
+				"commit": map[string]interface{}{"message": "fix", "author": map[string]string{"name": "Contributor", "email": "c@example.com"}},
+				"author": map[string]string{"login": "contributor"},
+			}
+		case "owner/example/commits/c7/status":
+			body = map[string]interface{}{"statuses": []map[string]string{
+				{"context": "other-ci", "state": "success"},
+				{"context": StatusContext, "state": "failure", "description": "failed"},
+			}}
+		default:
+			return &http.Response{
+				StatusCode: 404,
+				Status:     "404 Not Found",
+				Body:       ioutil.NopCloser(strings.NewReader("not found")),
+				Header:     make(http.Header),
+			}
+		}
+		respBody, err := json.Marshal(body)
+		assert.Ok(t, err)
+		return &http.Response{
+			StatusCode: 200,
+			Status:     "200 OK",
+			Body:       ioutil.NopCloser(bytes.NewReader(respBody)),
+			Header:     make(http.Header),
+		}
+	})
+	comment := func(number int, action, user, body string) []byte {
+		return []byte(fmt.Sprintf(`{
+			"action": %q,
+			"issue": {"number": %d, "pull_request": {"url": "https://api.github.com/repos/owner/example/pulls/%d"}},
+			"comment": {"user": {"login": %q}, "body": %q},
+			"repository": {"name": "example", "owner": {"login": "owner"}}
+		}`, action, number, number, user, body))
+	}
+
+	gh := NewClient(nil, "ci-bot")
+	gh.Api.Client = client
+
+	t.Run("pull request from fork", func(t *testing.T) {
+		ev := &Comment{}
+		assert.Ok(t, ev.Handle(gh, comment(7, CommentCreated, "testuser", "/runtest")))
+		assert.Equals(t, "owner/example", ev.Repo.FullName())
+		assert.Equals(t, 7, ev.Number)
+		assert.Equals(t, `"refs/pull/7/head"`, ev.RefName)
+		assert.Equals(t, "c7", ev.Head)
+		assert.Equals(t, "", ev.Commit.Sha)
+
+		commit, err := gh.GetCommit(context.Background(), ev.Repo, ev.Head)
+		assert.Ok(t, err)
+		assert.Equals(t, "contributor", commit.Author.Username)
+		assert.Equals(t, "failure", commit.Status.State)
+		assert.Assert(t, gh.Cache.GetCommit("c7") != nil, "head commit should be indexed")
+	})
+
+	t.Run("indexed head", func(t *testing.T) {
+		gh.Cache.WriteCommits(&Commit{Sha: "c8"})
+		ev := &Comment{}
+		assert.Ok(t, ev.Handle(gh, comment(8, CommentCreated, "testuser", "/runtest")))
+		assert.Equals(t, `"refs/heads/feature"`, ev.RefName)
+		commit, err := gh.GetCommit(context.Background(), ev.Repo, ev.Head)
+		assert.Ok(t, err)
+		assert.Equals(t, "c8", commit.Sha)
+	})
+
+	t.Run("unknown pull request", func(t *testing.T) {
+		ev := &Comment{}
+		assert.Assert(t, ev.Handle(gh, comment(9, CommentCreated, "testuser", "/runtest")) != nil, "should have been an error")
+	})
+
+	t.Run("comments without commands", func(t *testing.T) {
+		for _, payload := range [][]byte{
+			comment(7, CommentCreated, "testuser", "looks good, see /docs"),
+			comment(7, "edited", "testuser", "/runtest"),
+			comment(7, CommentCreated, "ci-bot", "/runtest"),
+		} {
+			requests = 0
+			ev := &Comment{}
+			assert.Ok(t, ev.Handle(gh, payload))
+			assert.Equals(t, 0, requests)
+			assert.Equals(t, "", ev.Head)
+			assert.Equals(t, "owner/example", ev.Repo.FullName())
+		}
+	})
+}
+
 func TestPushHandle(t *testing.T) {
 	t.Run("null event", func(t *testing.T) {
 		gh := NewClient(nil, "testuser")
@@ -80,11 +188,11 @@ func TestPushHandle(t *testing.T) {
 		err = pushEvent.Handle(gh, testRepoJSON)
 		assert.Ok(t, err)
 
-		repoName := webhook["repository"].(map[string]interface{})["name"].(string)
+		repoName := "Codertocat/" + webhook["repository"].(map[string]interface{})["name"].(string)
 		refName := webhook["ref"].(string)
-		ref := gh.Repositories[repoName].refs[`"`+refName+`"`]
+		ref := gh.Repositories.repos[strings.ToLower(repoName)].refs[`"`+refName+`"`]
 
-		assert.Assert(t, (gh.Repositories[repoName] != nil), "failed to create repository")
+		assert.Assert(t, (gh.Repositories.repos[strings.ToLower(repoName)] != nil), "failed to create repository")
 		assert.Assert(t, (ref != nil), "failed to create reference")
 		assert.Assert(t, (ref.head != nil), "failed to create commit")
 
@@ -93,7 +201,7 @@ func TestPushHandle(t *testing.T) {
 			assert.Ok(t, err)
 		}
 
-		assert.Assert(t, (gh.Repositories[repoName] != nil), "failed to create repository")
+		assert.Assert(t, (gh.Repositories.repos[strings.ToLower(repoName)] != nil), "failed to create repository")
 		assert.Assert(t, (ref != nil), "failed to create reference")
 		assert.Assert(t, (ref.head != nil), "failed to create commit")
 	})
@@ -110,11 +218,11 @@ func TestPushHandle(t *testing.T) {
 		err = pushEvent.Handle(gh, testRepoJSON)
 		assert.Ok(t, err)
 
-		repoName := webhook["repository"].(map[string]interface{})["name"].(string)
+		repoName := "Codertocat/" + webhook["repository"].(map[string]interface{})["name"].(string)
 		refName := webhook["ref"].(string)
-		ref := gh.Repositories[repoName].refs[`"`+refName+`"`]
+		ref := gh.Repositories.repos[strings.ToLower(repoName)].refs[`"`+refName+`"`]
 
-		assert.Assert(t, (gh.Repositories[repoName] != nil), "failed to create repository")
+		assert.Assert(t, (gh.Repositories.repos[strings.ToLower(repoName)] != nil), "failed to create repository")
 		assert.Assert(t, (ref != nil), "failed to create reference")
 		assert.Assert(t, (ref.head != nil), "failed to create commit")
 
@@ -126,11 +234,11 @@ func TestPushHandle(t *testing.T) {
 			assert.Ok(t, err)
 		}
 
-		repoName = webhook["repository"].(map[string]interface{})["name"].(string)
+		repoName = "Codertocat/" + webhook["repository"].(map[string]interface{})["name"].(string)
 		refName = webhook["ref"].(string)
-		ref = gh.Repositories[repoName].refs[`"`+refName+`"`]
+		ref = gh.Repositories.repos[strings.ToLower(repoName)].refs[`"`+refName+`"`]
 
-		assert.Assert(t, (gh.Repositories[repoName] != nil), "failed to create repository")
+		assert.Assert(t, (gh.Repositories.repos[strings.ToLower(repoName)] != nil), "failed to create repository")
 		assert.Assert(t, (ref != nil), "failed to create reference")
 		assert.Assert(t, (ref.head != nil), "failed to create commit")
 	})
@@ -155,11 +263,11 @@ func TestPushHandle(t *testing.T) {
 			assert.Ok(t, err)
 		}
 
-		repoName := webhook["repository"].(map[string]interface{})["name"].(string)
+		repoName := "Codertocat/" + webhook["repository"].(map[string]interface{})["name"].(string)
 		refName := webhook["ref"].(string)
-		ref := gh.Repositories[repoName].refs[`"`+refName+`"`]
+		ref := gh.Repositories.repos[strings.ToLower(repoName)].refs[`"`+refName+`"`]
 
-		assert.Assert(t, (gh.Repositories[repoName] != nil), "failed to create repository")
+		assert.Assert(t, (gh.Repositories.repos[strings.ToLower(repoName)] != nil), "failed to create repository")
 		assert.Assert(t, (ref != nil), "failed to create reference")
 		assert.Assert(t, (ref.head != nil), "failed to create commit")
 
@@ -196,12 +304,55 @@ func TestPushHandle(t *testing.T) {
 			assert.Ok(t, err)
 		}
 
-		repoName := webhook["repository"].(map[string]interface{})["name"].(string)
+		repoName := "Codertocat/" + webhook["repository"].(map[string]interface{})["name"].(string)
 		refName := webhook["ref"].(string)
-		ref := gh.Repositories[repoName].refs[`"`+refName+`"`]
+		ref := gh.Repositories.repos[strings.ToLower(repoName)].refs[`"`+refName+`"`]
 
-		assert.Assert(t, (gh.Repositories[repoName] != nil), "failed to create repository")
+		assert.Assert(t, (gh.Repositories.repos[strings.ToLower(repoName)] != nil), "failed to create repository")
 		assert.Assert(t, (ref != nil), "failed to create reference")
 		assert.Assert(t, (ref.head != nil), "failed to create commit")
 	})
 }
+
+func TestPullRequestHandle(t *testing.T) {
+	prData, err := ioutil.ReadFile("payloads/pull_request.json")
+	assert.Ok(t, err)
+
+	t.Run("opened", func(t *testing.T) {
+		gh := NewClient(nil, "testuser")
+
+		prEvent := &PullRequest{}
+		err = prEvent.Handle(gh, prData)
+		assert.Ok(t, err)
+
+		assert.Equals(t, "opened", prEvent.Action)
+		assert.Equals(t, 2, prEvent.Number)
+		assert.Equals(t, "Codertocat", prEvent.Author)
+		assert.Equals(t, `"refs/heads/changes"`, prEvent.RefName)
+		assert.Equals(t, "ec26c3e57ca3a959ca5aad62de7213c562f8c821", prEvent.Commit.Sha)
+		assert.Equals(t, "Codertocat", prEvent.Repo.Owner.Login)
+
+		_, ok := gh.Repositories.Get("Codertocat/Hello-World")
+		assert.Assert(t, ok, "failed to register repository")
+		assert.Assert(t, (gh.Cache.GetCommit(prEvent.Commit.Sha) != nil), "failed to index head commit")
+	})
+
+	t.Run("missing head", func(t *testing.T) {
+		gh := NewClient(nil, "testuser")
+
+		prEvent := &PullRequest{}
+		err = prEvent.Handle(gh, []byte(`{"action":"opened","number":2,"pull_request":{"user":{"login":"Codertocat"}}}`))
+		assert.Assert(t, (err != nil), "should have been an error")
+	})
+}
+
+func TestEventFactory(t *testing.T) {
+	first, err := EventFactory("pull_request")
+	assert.Ok(t, err)
+	second, err := EventFactory("pull_request")
+	assert.Ok(t, err)
+	assert.Assert(t, (first != second), "each delivery should receive its own event object")
+
+	_, err = EventFactory("unknown")
+	assert.Assert(t, (err != nil), "should have been an error")
+}
@@ -0,0 +1,186 @@
+package ghclient
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// ErrCommitNotInPullRequest no commit of the pull request matches the requested sha
+var ErrCommitNotInPullRequest = fmt.Errorf("commit is not part of the pull request")
+
+// FindPullRequestCommit retrieve the commit of pull request number in repo whose sha starts with prefix
+func (c *Client) FindPullRequestCommit(ctx context.Context, repo Repository, number int, prefix string) (*Commit, error) {
+	commitsJSON, err := c.Api.WithContext(ctx).GetPullRequestCommits(repo.Owner.Login, repo.Name, number)
+	if err != nil {
+		return nil, err
+	}
+	commits := []struct {
+		Sha string `json:"sha"`
+	}{}
+	err = json.Unmarshal(commitsJSON, &commits)
+	if err != nil {
+		return nil, c.err.withMessage(fmt.Sprintf("failed parsing commits of pull request #%d: %s", number, err))
+	}
+
+	prefix = strings.ToLower(prefix)
+	match := ""
+	for _, commit := range commits {
+		if !strings.HasPrefix(commit.Sha, prefix) {
+			continue
+		}
+		if match != "" {
+			return nil, c.err.withMessage(fmt.Sprintf("sha '%s' matches more than one commit of pull request #%d", prefix, number))
+		}
+		match = commit.Sha
+	}
+	if match == "" {
+		return nil, ErrCommitNotInPullRequest
+	}
+	return c.GetCommit(ctx, repo, match)
+}
+
+// CommentOnPullRequest posts comment body on pull request number in repo
+func (c *Client) CommentOnPullRequest(ctx context.Context, repo Repository, number int, body string) error {
+	comment, err := json.Marshal(map[string]string{"body": body})
+	if err != nil {
+		return c.err.withMessage(fmt.Sprintf("failed to create comment json: %s", err))
+	}
+	_, err = c.Api.WithContext(ctx).PostIssueComment(repo.Owner.Login, repo.Name, number, comment)
+	return err
+}
+
+// reactions to comments
+const (
+	ReactionEyes       = "eyes"
+	ReactionThumbsUp   = "+1"
+	ReactionThumbsDown = "-1"
+)
+
+// stickyMarker identifies the summary comment of the server on a pull request
+const stickyMarker = "<!-- ci-server-go summary -->"
+
+// AddReaction reacts to comment with ID in repo with content. Returns the ID of the reaction
+func (c *Client) AddReaction(repo Repository, commentID int64, content string) (int64, error) {
+	body, err := json.Marshal(map[string]string{"content": content})
+	if err != nil {
+		return 0, c.err.withMessage(fmt.Sprintf("failed to create reaction json: %s", err))
+	}
+	res, err := c.Api.PostReaction(repo.Owner.Login, repo.Name, commentID, body)
+	if err != nil {
+		return 0, err
+	}
+	reaction := struct {
+		ID int64 `json:"id"`
+	}{}
+	err = json.Unmarshal(res, &reaction)
+	if err != nil {
+		return 0, c.err.withMessage(fmt.Sprintf("failed parsing reaction: %s", err))
+	}
+	return reaction.ID, nil
+}
+
+// RemoveReaction removes reaction with ID from comment with commentID in repo
+func (c *Client) RemoveReaction(repo Repository, commentID, ID int64) error {
+	return c.Api.DeleteReaction(repo.Owner.Login, repo.Name, commentID, ID)
+}
+
+// stickyComment summary comment of the server on a pull request
+type stickyComment struct {
+	ID   int64
+	Body string // without stickyMarker
+}
+
+// UpdateStickyComment sets body of the single summary comment the server keeps on pull request number,
+// creating the comment if it does not exist yet
+func (c *Client) UpdateStickyComment(repo Repository, number int, body string) error {
+	c.stickyLock.Lock()
+	defer c.stickyLock.Unlock()
+
+	sticky, err := c.loadStickyComment(repo, number)
+	if err != nil {
+		return err
+	}
+	return c.writeStickyComment(repo, number, sticky, body)
+}
+
+// loadStickyComment retrieve summary comment of pull request number. The ID is 0 if there is none yet.
+// Comments with the marker posted by anyone but the server are ignored, since their content would be
+// republished by the server. Must be called with stickyLock held
+func (c *Client) loadStickyComment(repo Repository, number int) (stickyComment, error) {
+	if sticky, ok := c.sticky[stickyKey(repo, number)]; ok {
+		return sticky, nil
+	}
+
+	commentsJSON, err := c.Api.GetIssueComments(repo.Owner.Login, repo.Name, number)
+	if err != nil {
+		return stickyComment{}, err
+	}
+	comments := []struct {
+		ID   int64  `json:"id"`
+		Body string `json:"body"`
+		User struct {
+			Login string `json:"login"`
+		} `json:"user"`
+	}{}
+	err = json.Unmarshal(commentsJSON, &comments)
+	if err != nil {
+		return stickyComment{}, c.err.withMessage(fmt.Sprintf("failed parsing comments of pull request #%d: %s", number, err))
+	}
+	for _, comment := range comments {
+		if c.ownComment(comment.User.Login) && strings.HasPrefix(comment.Body, stickyMarker) {
+			body := strings.TrimPrefix(strings.TrimPrefix(comment.Body, stickyMarker), "\n")
+			return stickyComment{ID: comment.ID, Body: body}, nil
+		}
+	}
+	return stickyComment{}, nil
+}
+
+// writeStickyComment sets body of summary comment sticky, creating it if it does not exist.
+// Must be called with stickyLock held
+func (c *Client) writeStickyComment(repo Repository, number int, sticky stickyComment, body string) error {
+	comment, err := json.Marshal(map[string]string{"body": stickyMarker + "\n" + body})
+	if err != nil {
+		return c.err.withMessage(fmt.Sprintf("failed to create comment json: %s", err))
+	}
+	if c.sticky == nil {
+		c.sticky = make(map[string]stickyComment)
+	}
+
+	if sticky.ID != 0 {
+		_, err = c.Api.UpdateIssueComment(repo.Owner.Login, repo.Name, sticky.ID, comment)
+		if err == nil {
+			c.sticky[stickyKey(repo, number)] = stickyComment{ID: sticky.ID, Body: body}
+			return nil
+		}
+		// the comment may have been deleted, so a new one is created
+	}
+
+	res, err := c.Api.PostIssueComment(repo.Owner.Login, repo.Name, number, comment)
+	if err != nil {
+		return err
+	}
+	created := struct {
+		ID int64 `json:"id"`
+	}{}
+	err = json.Unmarshal(res, &created)
+	if err != nil {
+		return c.err.withMessage(fmt.Sprintf("failed parsing comment: %s", err))
+	}
+	c.sticky[stickyKey(repo, number)] = stickyComment{ID: created.ID, Body: body}
+	return nil
+}
+
+// ownComment returns true if comments authored by login were posted by the server. As a github app,
+// the server comments as the bot user of the app
+func (c *Client) ownComment(login string) bool {
+	if c.Api.app != nil {
+		return strings.EqualFold(login, c.Api.app.Login)
+	}
+	return strings.EqualFold(login, c.User)
+}
+
+func stickyKey(repo Repository, number int) string {
+	return fmt.Sprintf("%s#%d", strings.ToLower(repo.FullName()), number)
+}
@@ -0,0 +1,105 @@
+package ghclient
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/pleimer/ci-server-go/pkg/assert"
+)
+
+func TestUpdateStickyComment(t *testing.T) {
+	repo := Repository{Name: "example"}
+	repo.Owner.Login = "owner"
+
+	comments := map[int64]string{}
+	requests := []string{}
+	var nextID int64 = 10
+	gh := NewClient(nil, "testuser")
+	gh.Api.Client = NewTestClient(func(req *http.Request) *http.Response {
+		path := strings.TrimPrefix(req.URL.String(), "https://api.github.com/repos/owner/example/")
+		requests = append(requests, req.Method+" "+path)
+		respond := func(code int, body interface{}) *http.Response {
+			b, err := json.Marshal(body)
+			assert.Ok(t, err)
+			return &http.Response{
+				StatusCode: code,
+				Status:     http.StatusText(code),
+				Body:       ioutil.NopCloser(strings.NewReader(string(b))),
+				Header:     make(http.Header),
+			}
+		}
+		decode := func() string {
+			comment := map[string]string{}
+			assert.Ok(t, json.NewDecoder(req.Body).Decode(&comment))
+			return comment["body"]
+		}
+
+		switch {
+		case req.Method == "GET" && path == "issues/1/comments?per_page=100":
+			list := []map[string]interface{}{
+				{"id": 1, "body": "unrelated", "user": map[string]string{"login": "testuser"}},
+				{"id": 2, "body": stickyMarker + "\nforged", "user": map[string]string{"login": "stranger"}},
+			}
+			for ID, body := range comments {
+				list = append(list, map[string]interface{}{"id": ID, "body": body, "user": map[string]string{"login": "testuser"}})
+			}
+			return respond(200, list)
+		case req.Method == "POST" && path == "issues/1/comments":
+			nextID++
+			comments[nextID] = decode()
+			return respond(201, map[string]int64{"id": nextID})
+		case req.Method == "PATCH" && strings.HasPrefix(path, "issues/comments/"):
+			ID, err := strconv.ParseInt(strings.TrimPrefix(path, "issues/comments/"), 10, 64)
+			assert.Ok(t, err)
+			if _, ok := comments[ID]; ok {
+				comments[ID] = decode()
+				return respond(200, map[string]int64{"id": ID})
+			}
+		}
+		return respond(404, "not found")
+	})
+
+	t.Run("create", func(t *testing.T) {
+		assert.Ok(t, gh.UpdateStickyComment(repo, 1, "first run"))
+		assert.Equals(t, []string{"GET issues/1/comments?per_page=100", "POST issues/1/comments"}, requests)
+		assert.Equals(t, stickyMarker+"\nfirst run", comments[11])
+	})
+
+	t.Run("edit", func(t *testing.T) {
+		requests = requests[:0]
+		assert.Ok(t, gh.UpdateStickyComment(repo, 1, "second run"))
+		assert.Equals(t, []string{"PATCH issues/comments/11"}, requests)
+		assert.Equals(t, 1, len(comments))
+		assert.Equals(t, stickyMarker+"\nsecond run", comments[11])
+	})
+
+	t.Run("find after restart", func(t *testing.T) {
+		requests = requests[:0]
+		restarted := NewClient(nil, "testuser")
+		restarted.Api.Client = gh.Api.Client
+		assert.Ok(t, restarted.UpdateStickyComment(repo, 1, "third run"))
+		assert.Equals(t, []string{"GET issues/1/comments?per_page=100", "PATCH issues/comments/11"}, requests)
+		assert.Equals(t, stickyMarker+"\nthird run", comments[11])
+	})
+
+	t.Run("app bot comment", func(t *testing.T) {
+		app, _ := genAppAuth(t)
+		app.Login = "ci-app[bot]"
+		asApp := NewClient(nil, "testuser")
+		asApp.Api.app = app
+		assert.Assert(t, asApp.ownComment("ci-app[bot]"), "comment of the app bot should be owned")
+		assert.Assert(t, !asApp.ownComment("testuser"), "comment of the oauth user should not be owned by the app")
+	})
+
+	t.Run("deleted comment", func(t *testing.T) {
+		requests = requests[:0]
+		delete(comments, 11)
+		assert.Ok(t, gh.UpdateStickyComment(repo, 1, "fourth run"))
+		assert.Equals(t, []string{"PATCH issues/comments/11", "POST issues/1/comments"}, requests)
+		assert.Equals(t, stickyMarker+"\nfourth run", comments[12])
+	})
+}
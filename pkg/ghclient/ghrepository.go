@@ -9,9 +9,11 @@ import (
 
 // Repository object for tracking remote repository
 type Repository struct {
-	Name  string `json:"name"`
-	Fork  bool   `json:"fork"`
-	Owner struct {
+	Name          string `json:"name"`
+	Fork          bool   `json:"fork"`
+	CloneURL      string `json:"clone_url"`
+	DefaultBranch string `json:"default_branch"`
+	Owner         struct {
 		Login string `json:"login"`
 	}
 
@@ -54,6 +56,11 @@ func NewRepositoryFromMap(m map[string]interface{}) (*Repository, error) {
 	return &repo, nil
 }
 
+// FullName name of repository in the form owner/repo
+func (r *Repository) FullName() string {
+	return strings.Join([]string{r.Owner.Login, r.Name}, "/")
+}
+
 // GetReference retrieve git reference by ID
 func (r *Repository) GetReference(refName string) *Reference {
 	return r.refs[refName]
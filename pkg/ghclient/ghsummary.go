@@ -0,0 +1,106 @@
+package ghclient
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// MaxPullRequestRuns number of runs listed in the summary comment of a pull request
+const MaxPullRequestRuns = 10
+
+// PullRequestRun run of the tests on a commit of a pull request
+type PullRequestRun struct {
+	Sha         string        `json:"sha"`
+	Trigger     string        `json:"trigger"` // what started the run, in markdown
+	State       string        `json:"state"`
+	Description string        `json:"description"`
+	Duration    time.Duration `json:"duration"`
+	URL         string        `json:"url"` // test output
+}
+
+// the runs are stored in the summary comment itself so that the history survives restarts
+var runsData = regexp.MustCompile(`(?m)^<!-- ci-server-go runs: (.*) -->$`)
+
+// RecordPullRequestRun adds run to the history of recent runs in the summary comment of pull request number
+func (c *Client) RecordPullRequestRun(repo Repository, number int, run PullRequestRun) error {
+	c.stickyLock.Lock()
+	defer c.stickyLock.Unlock()
+
+	sticky, err := c.loadStickyComment(repo, number)
+	if err != nil {
+		return err
+	}
+
+	runs := parseRuns(sticky.Body)
+	runs = append([]PullRequestRun{run}, runs...)
+	if len(runs) > MaxPullRequestRuns {
+		runs = runs[:MaxPullRequestRuns]
+	}
+
+	body, err := renderRuns(runs)
+	if err != nil {
+		return c.err.withMessage(fmt.Sprintf("failed to render runs of pull request #%d: %s", number, err))
+	}
+	return c.writeStickyComment(repo, number, sticky, body)
+}
+
+// parseRuns retrieve runs stored in summary comment body, most recent first. Unreadable data is dropped
+func parseRuns(body string) []PullRequestRun {
+	runs := []PullRequestRun{}
+	match := runsData.FindStringSubmatch(body)
+	if match == nil {
+		return runs
+	}
+	if err := json.Unmarshal([]byte(match[1]), &runs); err != nil {
+		return []PullRequestRun{}
+	}
+	return runs
+}
+
+// renderRuns markdown table of runs followed by their data
+func renderRuns(runs []PullRequestRun) (string, error) {
+	// json escapes '<' and '>', so the data cannot terminate the html comment
+	data, err := json.Marshal(runs)
+	if err != nil {
+		return "", err
+	}
+
+	var sb strings.Builder
+	sb.WriteString("### CI runs\n\nCommit | Trigger | Result | Duration | Output\n-|-|-|-|-\n")
+	for _, run := range runs {
+		result := run.State
+		if run.Description != "" {
+			result += fmt.Sprintf(" (%s)", strings.ReplaceAll(run.Description, "|", "\\|"))
+		}
+		output := "-"
+		if run.URL != "" {
+			output = fmt.Sprintf("[gist](%s)", run.URL)
+		}
+		sb.WriteString(fmt.Sprintf("`%s` | %s | %s %s | %s | %s\n",
+			shortSha(run.Sha), run.Trigger, stateEmoji(run.State), result, run.Duration.Round(time.Second), output))
+	}
+	sb.WriteString(fmt.Sprintf("\n<!-- ci-server-go runs: %s -->\n", data))
+	return sb.String(), nil
+}
+
+func shortSha(sha string) string {
+	if len(sha) > 7 {
+		return sha[:7]
+	}
+	return sha
+}
+
+func stateEmoji(state string) string {
+	switch state {
+	case SUCCESS.String():
+		return ":heavy_check_mark:"
+	case FAILURE.String():
+		return ":x:"
+	case ERROR.String():
+		return ":warning:"
+	}
+	return ":hourglass:"
+}
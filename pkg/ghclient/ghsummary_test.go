@@ -0,0 +1,104 @@
+package ghclient
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pleimer/ci-server-go/pkg/assert"
+)
+
+func TestRecordPullRequestRun(t *testing.T) {
+	repo := Repository{Name: "example"}
+	repo.Owner.Login = "owner"
+
+	// single summary comment kept by the fake server
+	body := ""
+	gh := NewClient(nil, "testuser")
+	gh.Api.Client = NewTestClient(func(req *http.Request) *http.Response {
+		path := strings.TrimPrefix(req.URL.String(), "https://api.github.com/repos/owner/example/")
+		respond := func(code int, res interface{}) *http.Response {
+			b, err := json.Marshal(res)
+			assert.Ok(t, err)
+			return &http.Response{
+				StatusCode: code,
+				Status:     http.StatusText(code),
+				Body:       ioutil.NopCloser(strings.NewReader(string(b))),
+				Header:     make(http.Header),
+			}
+		}
+		decode := func() string {
+			comment := map[string]string{}
+			assert.Ok(t, json.NewDecoder(req.Body).Decode(&comment))
+			return comment["body"]
+		}
+
+		switch {
+		case req.Method == "GET" && path == "issues/1/comments?per_page=100":
+			if body == "" {
+				return respond(200, []interface{}{})
+			}
+			return respond(200, []map[string]interface{}{{"id": 5, "body": body, "user": map[string]string{"login": "testuser"}}})
+		case req.Method == "POST" && path == "issues/1/comments":
+			body = decode()
+			return respond(201, map[string]int64{"id": 5})
+		case req.Method == "PATCH" && path == "issues/comments/5":
+			body = decode()
+			return respond(200, map[string]int64{"id": 5})
+		}
+		return respond(404, "not found")
+	})
+
+	run := func(sha, state string) PullRequestRun {
+		return PullRequestRun{
+			Sha:         sha,
+			Trigger:     "`/runtest` by @testuser",
+			State:       state,
+			Description: "main script " + state,
+			Duration:    90 * time.Second,
+			URL:         "https://gist.github.com/testuser/" + sha,
+		}
+	}
+
+	t.Run("history", func(t *testing.T) {
+		assert.Ok(t, gh.RecordPullRequestRun(repo, 1, run("aaaaaaaaaa", FAILURE.String())))
+		assert.Ok(t, gh.RecordPullRequestRun(repo, 1, run("bbbbbbbbbb", SUCCESS.String())))
+
+		assert.Assert(t, strings.HasPrefix(body, stickyMarker), "summary comment should be marked")
+		first := strings.Index(body, "`bbbbbbb` | `/runtest` by @testuser | :heavy_check_mark: success (main script success) | 1m30s | [gist](https://gist.github.com/testuser/bbbbbbbbbb)")
+		second := strings.Index(body, "`aaaaaaa` | `/runtest` by @testuser | :x: failure (main script failure) | 1m30s | [gist](https://gist.github.com/testuser/aaaaaaaaaa)")
+		assert.Assert(t, first != -1 && second != -1, "unexpected summary: "+body)
+		assert.Assert(t, first < second, "most recent run should come first")
+	})
+
+	t.Run("restart", func(t *testing.T) {
+		restarted := NewClient(nil, "testuser")
+		restarted.Api.Client = gh.Api.Client
+		assert.Ok(t, restarted.RecordPullRequestRun(repo, 1, run("cccccccccc", ERROR.String())))
+
+		runs := parseRuns(body)
+		assert.Equals(t, 3, len(runs))
+		assert.Equals(t, []string{"cccccccccc", "bbbbbbbbbb", "aaaaaaaaaa"}, []string{runs[0].Sha, runs[1].Sha, runs[2].Sha})
+		assert.Equals(t, 90*time.Second, runs[2].Duration)
+	})
+
+	t.Run("limit", func(t *testing.T) {
+		for i := 0; i < MaxPullRequestRuns; i++ {
+			assert.Ok(t, gh.RecordPullRequestRun(repo, 1, run(fmt.Sprintf("d%d", i), SUCCESS.String())))
+		}
+		runs := parseRuns(body)
+		assert.Equals(t, MaxPullRequestRuns, len(runs))
+		assert.Equals(t, fmt.Sprintf("d%d", MaxPullRequestRuns-1), runs[0].Sha)
+	})
+
+	t.Run("comment terminator in data", func(t *testing.T) {
+		r := run("eeeeeeeeee", ERROR.String())
+		r.Description = "error logging: -->"
+		assert.Ok(t, gh.RecordPullRequestRun(repo, 1, r))
+		assert.Equals(t, "error logging: -->", parseRuns(body)[0].Description)
+	})
+}
@@ -78,7 +78,13 @@ func treeMarshalFromTree(tree *Tree) TreeMarshal {
 		case *Blob:
 			cRef.Sha = v.Sha
 			cRef.Path = v.Path
+			cRef.Mode = v.Mode
 			cRef.Type = "blob"
+		case *Submodule:
+			cRef.Sha = v.Sha
+			cRef.Path = v.Path
+			cRef.Mode = ModeSubmodule
+			cRef.Type = "commit"
 		case *Tree:
 			cRef.Sha = v.Sha
 			cRef.Path = v.Path
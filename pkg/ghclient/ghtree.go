@@ -1,23 +1,39 @@
 package ghclient
 
 import (
+	"context"
 	"encoding/base64"
 	"encoding/json"
 	"fmt"
 	"io"
 	"os"
+	"path/filepath"
 	"strings"
+	"sync"
+)
+
+// DefaultFetchWorkers number of blobs downloaded concurrently when FetchWorkers is not set
+const DefaultFetchWorkers = 8
+
+// git modes of tree entries
+const (
+	ModeFile       = "100644"
+	ModeExecutable = "100755"
+	ModeSymlink    = "120000"
+	ModeSubmodule  = "160000"
 )
 
 // Interim object for holding tree data from api calls in expected format
 type ChildRef struct {
 	Path string `json:"path"`
+	Mode string `json:"mode,omitempty"`
 	Type string `json:"type"`
 	Sha  string `json:"sha"`
 }
 type TreeMarshal struct {
-	Sha  string     `json:"sha"`
-	Tree []ChildRef `json:"tree"`
+	Sha       string     `json:"sha"`
+	Tree      []ChildRef `json:"tree"`
+	Truncated bool       `json:"truncated,omitempty"` // set on recursive listings that github cut short
 }
 
 // Node represents node in file tree
@@ -101,6 +117,7 @@ type Blob struct {
 	Content  string `json:"content"`
 
 	Path   string `json:"Path"`
+	Mode   string `json:"-"` // git mode of the tree entry
 	parent Node
 }
 
@@ -140,89 +157,278 @@ func (b *Blob) Write(w io.Writer) error {
 		return fmt.Errorf("when decoding blob %s content: %s", b.Sha, err)
 	}
 	_, err = w.Write(decoded)
-	return fmt.Errorf("when writing blob %s to writer: %s", b.Sha, err)
+	if err != nil {
+		return fmt.Errorf("when writing blob %s to writer: %s", b.Sha, err)
+	}
+	return nil
+}
+
+// writeFile writes blob to path according to its mode, replacing whatever is there. Symbolic links are
+// created with the blob content as their target. Blobs without a mode are executable if they are shell scripts
+func (b *Blob) writeFile(path string) error {
+	// an existing symbolic link would otherwise be written through
+	err := os.Remove(path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	if b.Mode == ModeSymlink {
+		target, err := base64.StdEncoding.DecodeString(b.Content)
+		if err != nil {
+			return fmt.Errorf("when decoding blob %s content: %s", b.Sha, err)
+		}
+		return os.Symlink(string(target), path)
+	}
+
+	perm := os.FileMode(0666)
+	if b.Mode == ModeExecutable || (b.Mode == "" && strings.HasSuffix(b.Path, ".sh")) {
+		perm = 0777
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, perm)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return b.Write(f)
 }
 
-func (c *Client) buildTree(parent Node, treeMarsh TreeMarshal, repo Repository) error {
+// buildTree attaches the entries of treeMarsh to parent, collecting blob nodes in blobs. Blob contents are
+// filled in separately by fetchBlobs
+func (c *Client) buildTree(ctx context.Context, parent Node, treeMarsh TreeMarshal, repo Repository, blobs *[]*Blob) error {
 	for _, cRef := range treeMarsh.Tree {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
 		switch cRef.Type {
 		case "blob":
-			child := c.Cache.GetBlob(cRef.Sha)
-			if child != nil {
-				parent.SetChild(child)
-				continue
+			child := &Blob{
+				Sha:  cRef.Sha,
+				Path: cRef.Path,
+				Mode: cRef.Mode,
 			}
+			parent.SetChild(child)
+			*blobs = append(*blobs, child)
 
-			blobJSON, err := c.Api.GetBlob(repo.Owner.Login, repo.Name, cRef.Sha)
+		case "commit":
+			parent.SetChild(&Submodule{
+				Sha:  cRef.Sha,
+				Path: cRef.Path,
+			})
+
+		case "tree":
+			newTreeMarsh, err := c.getTreeMarshal(ctx, cRef.Sha, repo)
 			if err != nil {
-				return c.err.withMessage(fmt.Sprintf("failed to get blob: %s", err))
+				return c.err.withMessage(fmt.Sprintf("failed to get tree: %s", err))
+			}
+
+			child := &Tree{
+				Sha:  cRef.Sha,
+				Path: cRef.Path,
 			}
+			parent.SetChild(child)
 
-			child, err = NewBlobFromJSON(blobJSON)
+			err = c.buildTree(ctx, child, *newTreeMarsh, repo, blobs)
 			if err != nil {
-				return c.err.withMessage(fmt.Sprintf("failed to create blob object from JSON: %s", err))
+				return c.err.withMessage(fmt.Sprintf("failed to build tree: %s", err))
 			}
+		}
+	}
+	return nil
+}
 
-			child.Path = cRef.Path
+// getTreeMarshal checks cache for entries of tree sha, else pulls them from github
+func (c *Client) getTreeMarshal(ctx context.Context, sha string, repo Repository) (*TreeMarshal, error) {
+	if treeMarsh := c.Cache.GetTree(sha); treeMarsh != nil {
+		return treeMarsh, nil
+	}
 
-			c.Cache.WriteBlob(child)
-			parent.SetChild(child)
+	treeJSON, err := c.Api.WithContext(ctx).GetTree(repo.Owner.Login, repo.Name, sha)
+	if err != nil {
+		return nil, err
+	}
 
-		case "tree":
+	treeMarsh := &TreeMarshal{}
+	err = json.Unmarshal(treeJSON, treeMarsh)
+	if err != nil {
+		return nil, fmt.Errorf("error unmarshalling tree json: %s", err)
+	}
+	c.Cache.WriteTree(treeMarsh)
+	if sha != treeMarsh.Sha {
+		c.Cache.WriteTreeAs(sha, treeMarsh)
+	}
+	return treeMarsh, nil
+}
 
-			child := c.Cache.GetTree(cRef.Sha)
-			if child != nil {
-				parent.SetChild(child)
-				continue
-			}
+// loadTrees caches tree sha and all of its subtrees using as few recursive listings as possible. If
+// github truncates a listing, the entries of that tree are fetched on their own and each subtree is
+// listed separately. Trees that cannot be listed are left to be walked one by one in buildTree
+func (c *Client) loadTrees(ctx context.Context, sha string, repo Repository) error {
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	if c.Cache.GetTree(sha) != nil {
+		return nil
+	}
 
-			treeJSON, err := c.Api.GetTree(repo.Owner.Login, repo.Name, cRef.Sha)
-			if err != nil {
-				return c.err.withMessage(fmt.Sprintf("failed to get tree: %s", err))
-			}
+	listingJSON, err := c.Api.WithContext(ctx).GetTreeRecursive(repo.Owner.Login, repo.Name, sha)
+	if err != nil {
+		return nil
+	}
+	listing := TreeMarshal{}
+	err = json.Unmarshal(listingJSON, &listing)
+	if err != nil {
+		return nil
+	}
 
-			child, err = NewTreeFromJSON(treeJSON)
-			if err != nil {
-				return c.err.withMessage(fmt.Sprintf("failed to create tree object from JSON: %s", err))
-			}
+	if !listing.Truncated {
+		c.cacheListing(sha, listing)
+		return nil
+	}
 
-			child.Path = cRef.Path
+	top, err := c.getTreeMarshal(ctx, sha, repo)
+	if err != nil {
+		return c.err.withMessage(fmt.Sprintf("failed to get tree: %s", err))
+	}
+	for _, cRef := range top.Tree {
+		if cRef.Type != "tree" {
+			continue
+		}
+		if err := c.loadTrees(ctx, cRef.Sha, repo); err != nil {
+			return err
+		}
+	}
+	return nil
+}
 
-			c.Cache.WriteTree(child)
-			parent.SetChild(child)
+// cacheListing splits complete recursive listing of tree sha into the entries of each tree
+func (c *Client) cacheListing(sha string, listing TreeMarshal) {
+	root := &TreeMarshal{Sha: listing.Sha, Tree: []ChildRef{}}
+	trees := map[string]*TreeMarshal{"": root}
+	for _, entry := range listing.Tree {
+		if entry.Type == "tree" {
+			trees[entry.Path] = &TreeMarshal{Sha: entry.Sha, Tree: []ChildRef{}}
+		}
+	}
 
-			var newTreeMarsh TreeMarshal
-			err = json.Unmarshal(treeJSON, &newTreeMarsh)
-			if err != nil {
-				return c.err.withMessage(fmt.Sprintf("failed to parse tree JSON: %s", err))
-			}
+	for _, entry := range listing.Tree {
+		dir, name := "", entry.Path
+		if i := strings.LastIndex(entry.Path, "/"); i >= 0 {
+			dir, name = entry.Path[:i], entry.Path[i+1:]
+		}
+		parent, ok := trees[dir]
+		if !ok {
+			continue
+		}
+		entry.Path = name
+		parent.Tree = append(parent.Tree, entry)
+	}
 
-			err = c.buildTree(child, newTreeMarsh, repo)
-			if err != nil {
-				return c.err.withMessage(fmt.Sprintf("failed to build tree: %s", err))
+	for _, t := range trees {
+		c.Cache.WriteTree(t)
+	}
+	if sha != root.Sha {
+		c.Cache.WriteTreeAs(sha, root)
+	}
+}
+
+// fetchBlobs fills in the contents of blob nodes from the cache, downloading missing blobs
+// concurrently. No new downloads are started once ctx is done
+func (c *Client) fetchBlobs(ctx context.Context, nodes []*Blob, repo Repository) error {
+	pending := make(map[string][]*Blob)
+	for _, node := range nodes {
+		if blob := c.Cache.GetBlob(node.Sha); blob != nil {
+			node.Encoding, node.Content = blob.Encoding, blob.Content
+			continue
+		}
+		pending[node.Sha] = append(pending[node.Sha], node)
+	}
+	if len(pending) == 0 {
+		return nil
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	workers := c.FetchWorkers
+	if workers <= 0 {
+		workers = DefaultFetchWorkers
+	}
+	if workers > len(pending) {
+		workers = len(pending)
+	}
+
+	var (
+		wg       sync.WaitGroup
+		once     sync.Once
+		firstErr error
+		shas     = make(chan string)
+	)
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for sha := range shas {
+				if ctx.Err() != nil {
+					continue
+				}
+				blob, err := c.fetchBlob(ctx, sha, repo)
+				if err != nil {
+					once.Do(func() {
+						firstErr = err
+						cancel()
+					})
+					continue
+				}
+				for _, node := range pending[sha] {
+					node.Encoding, node.Content = blob.Encoding, blob.Content
+				}
 			}
+		}()
+	}
+
+feed:
+	for sha := range pending {
+		select {
+		case shas <- sha:
+		case <-ctx.Done():
+			break feed
 		}
 	}
-	return nil
+	close(shas)
+	wg.Wait()
+
+	if firstErr != nil {
+		return firstErr
+	}
+	return ctx.Err()
 }
 
-// GetTree checks cache for tree, else pulls tree from github
-func (c *Client) GetTree(sha string, repo Repository) (*Tree, error) {
-	t := c.Cache.GetTree(sha)
+func (c *Client) fetchBlob(ctx context.Context, sha string, repo Repository) (*Blob, error) {
+	blobJSON, err := c.Api.WithContext(ctx).GetBlob(repo.Owner.Login, repo.Name, sha)
+	if err != nil {
+		return nil, c.err.withMessage(fmt.Sprintf("failed to get blob: %s", err))
+	}
 
-	if t != nil {
-		return t, nil
+	blob, err := NewBlobFromJSON(blobJSON)
+	if err != nil {
+		return nil, c.err.withMessage(fmt.Sprintf("failed to create blob object from JSON: %s", err))
 	}
+	c.Cache.WriteBlob(blob)
+	return blob, nil
+}
 
-	treeJSON, err := c.Api.GetTree(repo.Owner.Login, repo.Name, sha)
+// GetTree builds tree sha from cached trees and blobs, pulling missing objects from github. Blobs
+// are downloaded concurrently by up to FetchWorkers workers
+func (c *Client) GetTree(ctx context.Context, sha string, repo Repository) (*Tree, error) {
+	err := c.loadTrees(ctx, sha, repo)
 	if err != nil {
 		return nil, err
 	}
 
-	treeMarsh := TreeMarshal{}
-	err = json.Unmarshal(treeJSON, &treeMarsh)
+	treeMarsh, err := c.getTreeMarshal(ctx, sha, repo)
 	if err != nil {
-		return nil, fmt.Errorf("error unmarshalling tree json: %s", err)
+		return nil, err
 	}
 
 	top := &Tree{
@@ -232,43 +438,84 @@ func (c *Client) GetTree(sha string, repo Repository) (*Tree, error) {
 		children: []Node{},
 	}
 
-	c.Cache.WriteTree(top)
-	err = c.buildTree(top, treeMarsh, repo)
+	blobs := []*Blob{}
+	err = c.buildTree(ctx, top, *treeMarsh, repo, &blobs)
+	if err != nil {
+		return nil, err
+	}
+
+	err = c.fetchBlobs(ctx, blobs, repo)
 	if err != nil {
 		return nil, err
 	}
 	return top, nil
 }
 
-// WriteTreeToDirectory write tree to specified directory path
+// WriteTreeToDirectory write tree to directory basePath/<tree path>, restoring executable files and
+// symbolic links from their git modes. Submodules are left as empty directories, see Client.WriteTree.
+// Any previous contents of the directory are removed, and entries that would be written outside of it
+// are rejected
 func WriteTreeToDirectory(top Node, basePath string) error {
-	return recurseTreeAction(top,
-		[]string{basePath},
-		func(t *Tree, path []string) ([]string, error) {
-			path = append(path, t.Path)
-			pathStr := strings.Join(path, "/")
-			err := os.MkdirAll(pathStr, 0777)
-			if err != nil {
-				return nil, err
-			}
-			return path, nil
-		},
-		func(b *Blob, path []string) ([]string, error) {
-			path = append(path, b.Path)
-			pathStr := strings.Join(path, "/")
-			f, err := os.Create(pathStr)
-			if err != nil {
-				return nil, err
-			}
-			defer f.Close()
+	workspace, err := treeWorkspace(top, basePath)
+	if err != nil {
+		return err
+	}
+	err = os.RemoveAll(workspace)
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(workspace, 0777)
+	if err != nil {
+		return err
+	}
+	return writeChildren(top, workspace, "")
+}
 
-			ft := strings.Split(b.Path, ".")
-			if ft[len(ft)-1] == "sh" {
-				f.Chmod(0777)
-			}
-			b.Write(f)
-			return path, nil
-		})
+// treeWorkspace directory under basePath the contents of tree top are written to
+func treeWorkspace(top Node, basePath string) (string, error) {
+	name := top.GetPath()
+	if name == "" || name == "." || name == ".." || strings.Contains(name, "/") {
+		return "", fmt.Errorf("invalid path '%s' in tree", name)
+	}
+	return filepath.Join(basePath, name), nil
+}
+
+// writeNode writes node into directory dir, relative to base
+func writeNode(node Node, base, dir string) error {
+	name := node.GetPath()
+	if name == "" || name == "." || name == ".." || strings.Contains(name, "/") {
+		return fmt.Errorf("invalid path '%s' in tree", filepath.Join(dir, name))
+	}
+
+	rel := filepath.Join(dir, name)
+	path, err := safeJoin(base, rel)
+	if err != nil {
+		return err
+	}
+
+	switch v := node.(type) {
+	case *Tree:
+		err = os.MkdirAll(path, 0777)
+		if err != nil {
+			return err
+		}
+		return writeChildren(v, base, rel)
+	case *Submodule:
+		return os.MkdirAll(path, 0777)
+	case *Blob:
+		return v.writeFile(path)
+	}
+	return nil
+}
+
+// writeChildren writes the entries of tree into directory dir, relative to base
+func writeChildren(tree Node, base, dir string) error {
+	for _, child := range tree.GetChildren() {
+		if err := writeNode(child, base, dir); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 func recurseTreeAction(top Node, metadata []string, treeAction func(*Tree, []string) ([]string, error), blobAction func(*Blob, []string) ([]string, error)) error {
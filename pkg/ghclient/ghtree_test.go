@@ -0,0 +1,337 @@
+package ghclient
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/pleimer/ci-server-go/pkg/assert"
+)
+
+func TestGetTreeRecursive(t *testing.T) {
+	repo := Repository{
+		Name: "example",
+		Owner: struct {
+			Login string `json:"login"`
+		}{
+			Login: "owner",
+		},
+	}
+
+	// commit c0 -> tree t0 { a, dir(t1) { b, sub(t2) { c } } }
+	full := TreeMarshal{
+		Sha: "t0",
+		Tree: []ChildRef{
+			{Path: "a", Type: "blob", Sha: "ba"},
+			{Path: "dir", Type: "tree", Sha: "t1"},
+			{Path: "dir/b", Type: "blob", Sha: "bb"},
+			{Path: "dir/sub", Type: "tree", Sha: "t2"},
+			{Path: "dir/sub/c", Type: "blob", Sha: "bc"},
+		},
+	}
+	truncated := TreeMarshal{Sha: "t0", Tree: full.Tree[:2], Truncated: true}
+	t0 := TreeMarshal{Sha: "t0", Tree: []ChildRef{full.Tree[0], full.Tree[1]}}
+	t1 := TreeMarshal{
+		Sha: "t1",
+		Tree: []ChildRef{
+			{Path: "b", Type: "blob", Sha: "bb"},
+			{Path: "sub", Type: "tree", Sha: "t2"},
+		},
+	}
+	t1Recursive := TreeMarshal{
+		Sha: "t1",
+		Tree: []ChildRef{
+			{Path: "b", Type: "blob", Sha: "bb"},
+			{Path: "sub", Type: "tree", Sha: "t2"},
+			{Path: "sub/c", Type: "blob", Sha: "bc"},
+		},
+	}
+
+	type server struct {
+		lock     sync.Mutex
+		requests []string
+	}
+	serve := func(srv *server, listings map[string]interface{}, blocked chan struct{}) *http.Client {
+		return NewTestClient(func(req *http.Request) *http.Response {
+			path := strings.TrimPrefix(req.URL.String(), "https://api.github.com/repos/owner/example/git/")
+			srv.lock.Lock()
+			srv.requests = append(srv.requests, path)
+			srv.lock.Unlock()
+
+			var body interface{}
+			if strings.HasPrefix(path, "blobs/") {
+				if blocked != nil {
+					<-blocked
+				}
+				sha := strings.TrimPrefix(path, "blobs/")
+				body = Blob{Sha: sha, Encoding: "base64", Content: "Y29udGVudA=="}
+			} else if listing, ok := listings[path]; ok {
+				body = listing
+			} else {
+				return &http.Response{
+					StatusCode: 404,
+					Status:     "404 Not Found",
+					Body:       ioutil.NopCloser(strings.NewReader("not found")),
+					Header:     make(http.Header),
+				}
+			}
+
+			respBody, err := json.Marshal(body)
+			assert.Ok(t, err)
+			return &http.Response{
+				StatusCode: 200,
+				Status:     "200 OK",
+				Body:       ioutil.NopCloser(bytes.NewReader(respBody)),
+				Header:     make(http.Header),
+			}
+		})
+	}
+	newClient := func(httpClient *http.Client) *Client {
+		api := NewAPI()
+		api.Client = httpClient
+		return &Client{Api: api, Cache: NewCache(), FetchWorkers: 2}
+	}
+	paths := func(tree *Tree) string {
+		s, err := RecursivePrint(tree)
+		assert.Ok(t, err)
+		return s
+	}
+
+	t.Run("single listing", func(t *testing.T) {
+		srv := &server{}
+		gh := newClient(serve(srv, map[string]interface{}{"trees/c0?recursive=1": full}, nil))
+
+		tree, err := gh.GetTree(context.Background(), "c0", repo)
+		assert.Ok(t, err)
+		assert.Equals(t, "t0\na\ndir\nb\nsub\nc", paths(tree))
+		assert.Equals(t, "trees/c0?recursive=1", srv.requests[0])
+		assert.Equals(t, 4, len(srv.requests))
+
+		// second checkout served from the cache
+		_, err = gh.GetTree(context.Background(), "c0", repo)
+		assert.Ok(t, err)
+		assert.Equals(t, 4, len(srv.requests))
+	})
+
+	t.Run("truncated listing", func(t *testing.T) {
+		srv := &server{}
+		gh := newClient(serve(srv, map[string]interface{}{
+			"trees/c0?recursive=1": truncated,
+			"trees/c0":             t0,
+			"trees/t1?recursive=1": t1Recursive,
+			"trees/t1":             t1,
+		}, nil))
+
+		tree, err := gh.GetTree(context.Background(), "c0", repo)
+		assert.Ok(t, err)
+		assert.Equals(t, "t0\na\ndir\nb\nsub\nc", paths(tree))
+		assert.Equals(t, []string{"trees/c0?recursive=1", "trees/c0", "trees/t1?recursive=1"}, srv.requests[:3])
+		assert.Equals(t, 6, len(srv.requests))
+	})
+
+	t.Run("canceled while fetching blobs", func(t *testing.T) {
+		srv := &server{}
+		blocked := make(chan struct{})
+		gh := newClient(serve(srv, map[string]interface{}{"trees/c0?recursive=1": full}, blocked))
+
+		ctx, cancel := context.WithCancel(context.Background())
+		done := make(chan error)
+		go func() {
+			_, err := gh.GetTree(ctx, "c0", repo)
+			done <- err
+		}()
+
+		cancel()
+		close(blocked)
+		assert.Equals(t, context.Canceled, <-done)
+
+		srv.lock.Lock()
+		defer srv.lock.Unlock()
+		assert.Assert(t, len(srv.requests) <= 3, "no blobs should be requested after cancellation beyond those in flight")
+	})
+}
+
+func TestWriteTreeToDirectory(t *testing.T) {
+	encode := func(s string) string {
+		return base64.StdEncoding.EncodeToString([]byte(s))
+	}
+
+	t.Run("modes and symlinks", func(t *testing.T) {
+		dir, err := ioutil.TempDir("", "workspace")
+		assert.Ok(t, err)
+		defer os.RemoveAll(dir)
+
+		top := &Tree{Sha: "t0", Path: "t0"}
+		top.SetChild(&Blob{Path: "run", Mode: ModeExecutable, Content: encode("#!/bin/sh")})
+		top.SetChild(&Blob{Path: "data.sh", Mode: ModeFile, Content: encode("not executable")})
+		top.SetChild(&Blob{Path: "link", Mode: ModeSymlink, Content: encode("run")})
+		top.SetChild(&Submodule{Path: "lib", Sha: "c1"})
+		assert.Ok(t, WriteTreeToDirectory(top, dir))
+
+		info, err := os.Stat(filepath.Join(dir, "t0", "run"))
+		assert.Ok(t, err)
+		assert.Assert(t, info.Mode()&0100 != 0, "run should be executable")
+
+		info, err = os.Stat(filepath.Join(dir, "t0", "data.sh"))
+		assert.Ok(t, err)
+		assert.Assert(t, info.Mode()&0100 == 0, "data.sh should not be executable")
+
+		target, err := os.Readlink(filepath.Join(dir, "t0", "link"))
+		assert.Ok(t, err)
+		assert.Equals(t, "run", target)
+
+		info, err = os.Stat(filepath.Join(dir, "t0", "lib"))
+		assert.Ok(t, err)
+		assert.Assert(t, info.IsDir(), "submodule should be an empty directory")
+	})
+
+	t.Run("written again", func(t *testing.T) {
+		dir, err := ioutil.TempDir("", "workspace")
+		assert.Ok(t, err)
+		defer os.RemoveAll(dir)
+
+		top := &Tree{Sha: "t0", Path: "t0"}
+		top.SetChild(&Blob{Path: "link", Mode: ModeSymlink, Content: encode("run")})
+		assert.Ok(t, WriteTreeToDirectory(top, dir))
+		assert.Ok(t, ioutil.WriteFile(filepath.Join(dir, "t0", "stale"), []byte("left by the last run"), 0666))
+		assert.Ok(t, WriteTreeToDirectory(top, dir))
+
+		_, err = os.Lstat(filepath.Join(dir, "t0", "stale"))
+		assert.Assert(t, os.IsNotExist(err), "workspace should be cleared before writing")
+		target, err := os.Readlink(filepath.Join(dir, "t0", "link"))
+		assert.Ok(t, err)
+		assert.Equals(t, "run", target)
+	})
+
+	t.Run("paths escaping workspace rejected", func(t *testing.T) {
+		for _, name := range []string{"..", "a/../../b"} {
+			dir, err := ioutil.TempDir("", "workspace")
+			assert.Ok(t, err)
+			defer os.RemoveAll(dir)
+
+			top := &Tree{Sha: "t0", Path: "t0"}
+			top.SetChild(&Blob{Path: name, Content: encode("escaped")})
+			assert.Assert(t, WriteTreeToDirectory(top, dir) != nil, "should have rejected "+name)
+		}
+
+		dir, err := ioutil.TempDir("", "workspace")
+		assert.Ok(t, err)
+		defer os.RemoveAll(dir)
+
+		// a file written through a symlink to a directory outside the workspace
+		top := &Tree{Sha: "t0", Path: "t0"}
+		top.SetChild(&Blob{Path: "out", Mode: ModeSymlink, Content: encode(os.TempDir())})
+		sub := &Tree{Sha: "t1", Path: "out"}
+		sub.SetChild(&Blob{Path: "escaped", Content: encode("escaped")})
+		top.SetChild(sub)
+		assert.Assert(t, WriteTreeToDirectory(top, dir) != nil, "should have rejected write through symlink")
+
+		// the workspace of another tree in the same base directory is outside the workspace too
+		top = &Tree{Sha: "t0", Path: "t0"}
+		top.SetChild(&Blob{Path: "up", Mode: ModeSymlink, Content: encode("..")})
+		sub = &Tree{Sha: "t1", Path: "up"}
+		sub.SetChild(&Blob{Path: "escaped", Content: encode("escaped")})
+		top.SetChild(sub)
+		assert.Assert(t, WriteTreeToDirectory(top, dir) != nil, "should have rejected write through symlink to base directory")
+		_, err = os.Lstat(filepath.Join(dir, "escaped"))
+		assert.Assert(t, os.IsNotExist(err), "file should not have been written to base directory")
+	})
+}
+
+func TestWriteTreeSubmodules(t *testing.T) {
+	dir, err := ioutil.TempDir("", "workspace")
+	assert.Ok(t, err)
+	defer os.RemoveAll(dir)
+
+	encode := func(s string) string {
+		return base64.StdEncoding.EncodeToString([]byte(s))
+	}
+	listings := map[string]TreeMarshal{
+		"repos/owner/example/git/trees/c0?recursive=1": {
+			Sha: "t0",
+			Tree: []ChildRef{
+				{Path: ".gitmodules", Mode: ModeFile, Type: "blob", Sha: "gm"},
+				{Path: "vendor", Mode: "040000", Type: "tree", Sha: "t1"},
+				{Path: "vendor/lib", Mode: ModeSubmodule, Type: "commit", Sha: "c1"},
+			},
+		},
+		"repos/owner/lib/git/trees/c1?recursive=1": {
+			Sha: "t2",
+			Tree: []ChildRef{
+				{Path: "lib.go", Mode: ModeFile, Type: "blob", Sha: "bl"},
+			},
+		},
+	}
+	blobs := map[string]string{
+		"repos/owner/example/git/blobs/gm": encode("[submodule \"lib\"]\n\tpath = vendor/lib\n\turl = ../lib.git\n"),
+		"repos/owner/lib/git/blobs/bl":     encode("package lib"),
+	}
+
+	client := NewTestClient(func(req *http.Request) *http.Response {
+		path := strings.TrimPrefix(req.URL.String(), "https://api.github.com/")
+		var body interface{}
+		if listing, ok := listings[path]; ok {
+			body = listing
+		} else if content, ok := blobs[path]; ok {
+			body = Blob{Encoding: "base64", Content: content}
+		} else {
+			return &http.Response{
+				StatusCode: 404,
+				Status:     "404 Not Found",
+				Body:       ioutil.NopCloser(strings.NewReader("not found")),
+				Header:     make(http.Header),
+			}
+		}
+		respBody, err := json.Marshal(body)
+		assert.Ok(t, err)
+		return &http.Response{
+			StatusCode: 200,
+			Status:     "200 OK",
+			Body:       ioutil.NopCloser(bytes.NewReader(respBody)),
+			Header:     make(http.Header),
+		}
+	})
+
+	gh := NewClient(nil, "testuser")
+	gh.Api.Client = client
+	repo := Repository{Name: "example"}
+	repo.Owner.Login = "owner"
+
+	tree, err := gh.GetTree(context.Background(), "c0", repo)
+	assert.Ok(t, err)
+	assert.Ok(t, gh.WriteTree(context.Background(), tree, repo, dir))
+
+	content, err := ioutil.ReadFile(filepath.Join(dir, "t0", "vendor", "lib", "lib.go"))
+	assert.Ok(t, err)
+	assert.Equals(t, "package lib", string(content))
+
+	t.Run("submodule urls", func(t *testing.T) {
+		tests := map[string]string{
+			"../lib.git":                        "owner/lib",
+			"../../other/lib":                   "other/lib",
+			"https://github.com/other/lib.git":  "other/lib",
+			"git@github.com:other/lib.git":      "other/lib",
+			"ssh://git@github.com/other/lib":    "other/lib",
+			"https://gitlab.com/other/lib.git":  "",
+			"../../../lib.git":                  "",
+			"https://github.com/other/lib/tree": "",
+		}
+		for URL, expected := range tests {
+			sub, err := gh.submoduleRepository(repo, URL)
+			if expected == "" {
+				assert.Assert(t, err != nil, "should have rejected "+URL)
+				continue
+			}
+			assert.Ok(t, err)
+			assert.Equals(t, expected, sub.Owner.Login+"/"+sub.Name)
+		}
+	})
+}
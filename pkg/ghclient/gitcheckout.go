@@ -0,0 +1,103 @@
+package ghclient
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+// GitCheckout clones repository into dest with the local git binary and checks out sha, so that
+// the workspace contains a real .git directory. A depth greater than 0 creates a shallow clone
+// with that many commits. Any previous contents of dest are removed
+func (c *Client) GitCheckout(ctx context.Context, sha string, repo Repository, dest string, depth int) error {
+	err := os.RemoveAll(dest)
+	if err != nil {
+		return c.err.withMessage(fmt.Sprintf("failed to clean workspace: %s", err))
+	}
+
+	url := repo.CloneURL
+	if url == "" {
+		url = c.Api.CloneURL(repo.Owner.Login, repo.Name)
+	}
+
+	fetchArgs := []string{"fetch", "--no-tags", "origin", sha}
+	if depth > 0 {
+		fetchArgs = append(fetchArgs, "--depth", strconv.Itoa(depth))
+	}
+
+	steps := [][]string{
+		{"init", "-q", dest},
+		{"-C", dest, "remote", "add", "origin", url},
+		append([]string{"-C", dest}, fetchArgs...),
+		{"-C", dest, "checkout", "-q", "--detach", sha},
+	}
+
+	env, err := c.gitEnv(repo, url)
+	if err != nil {
+		return c.err.withMessage(fmt.Sprintf("failed to retrieve credentials: %s", err))
+	}
+	for _, args := range steps {
+		if err := runGit(ctx, env, args...); err != nil {
+			return c.err.withMessage(fmt.Sprintf("git checkout of %s failed: %s", sha, err))
+		}
+	}
+	return nil
+}
+
+// gitEnv environment for git commands. Credentials are passed through the environment
+// rather than the command line or the repository configuration, so that they are
+// neither visible in the process list nor left behind in the workspace
+func (c *Client) gitEnv(repo Repository, url string) ([]string, error) {
+	env := append(os.Environ(), "GIT_TERMINAL_PROMPT=0")
+	if !strings.HasPrefix(url, "https://") {
+		return env, nil
+	}
+
+	config := [][2]string{}
+	tlsFiles := c.Api.tlsFiles
+	if tlsFiles.CAFile != "" {
+		config = append(config, [2]string{"http.sslCAInfo", tlsFiles.CAFile})
+	}
+	if tlsFiles.CertFile != "" {
+		config = append(config, [2]string{"http.sslCert", tlsFiles.CertFile}, [2]string{"http.sslKey", tlsFiles.KeyFile})
+	}
+
+	token, err := c.Api.Token(repo.Owner.Login, repo.Name)
+	if err != nil {
+		return env, err
+	}
+	if token != "" {
+		credentials := base64.StdEncoding.EncodeToString([]byte("x-access-token:" + token))
+		config = append(config, [2]string{"http.extraHeader", "Authorization: Basic " + credentials})
+	}
+
+	if len(config) == 0 {
+		return env, nil
+	}
+	env = append(env, fmt.Sprintf("GIT_CONFIG_COUNT=%d", len(config)))
+	for i, kv := range config {
+		env = append(env, fmt.Sprintf("GIT_CONFIG_KEY_%d=%s", i, kv[0]), fmt.Sprintf("GIT_CONFIG_VALUE_%d=%s", i, kv[1]))
+	}
+	return env, nil
+}
+
+func runGit(ctx context.Context, env []string, args ...string) error {
+	var stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, "git", args...)
+	cmd.Env = env
+	cmd.Stderr = &stderr
+
+	err := cmd.Run()
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	if err != nil {
+		return fmt.Errorf("git %s: %s: %s", args[len(args)-1], err, strings.TrimSpace(stderr.String()))
+	}
+	return nil
+}
@@ -0,0 +1,102 @@
+package ghclient
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/pleimer/ci-server-go/pkg/assert"
+)
+
+// genBareRepository creates a bare repository with two commits. Returns the path
+// of the bare repository and the sha of each commit, oldest first
+func genBareRepository(t *testing.T, dir string) (string, []string) {
+	src := filepath.Join(dir, "src")
+	git := func(args ...string) string {
+		cmd := exec.Command("git", append([]string{"-C", src, "-c", "user.name=test", "-c", "user.email=test@example.com"}, args...)...)
+		out, err := cmd.CombinedOutput()
+		assert.Assert(t, (err == nil), "git %v failed: %s", args, out)
+		return strings.TrimSpace(string(out))
+	}
+
+	assert.Ok(t, os.MkdirAll(src, 0777))
+	git("init", "-q")
+
+	shas := []string{}
+	for _, content := range []string{"first", "second"} {
+		assert.Ok(t, ioutil.WriteFile(filepath.Join(src, "ci.yml"), []byte(content), 0644))
+		git("add", "ci.yml")
+		git("commit", "-q", "-m", content)
+		shas = append(shas, git("rev-parse", "HEAD"))
+	}
+
+	bare := filepath.Join(dir, "bare.git")
+	out, err := exec.Command("git", "clone", "-q", "--bare", src, bare).CombinedOutput()
+	assert.Assert(t, (err == nil), "git clone failed: %s", out)
+	return bare, shas
+}
+
+func TestGitCheckout(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git binary not available")
+	}
+
+	dir, err := ioutil.TempDir("", "gitcheckout")
+	assert.Ok(t, err)
+	defer os.RemoveAll(dir)
+
+	bare, shas := genBareRepository(t, dir)
+	repo := Repository{
+		Name:     "example",
+		CloneURL: "file://" + bare,
+	}
+	gh := NewClient(nil, "testuser")
+
+	t.Run("shallow checkout of older commit", func(t *testing.T) {
+		dest := filepath.Join(dir, "workspace")
+		err := gh.GitCheckout(context.Background(), shas[0], repo, dest, 1)
+		assert.Ok(t, err)
+
+		content, err := ioutil.ReadFile(filepath.Join(dest, "ci.yml"))
+		assert.Ok(t, err)
+		assert.Equals(t, "first", string(content))
+
+		head, err := exec.Command("git", "-C", dest, "rev-parse", "HEAD").Output()
+		assert.Ok(t, err)
+		assert.Equals(t, shas[0], strings.TrimSpace(string(head)))
+
+		count, err := exec.Command("git", "-C", dest, "rev-list", "--count", "HEAD").Output()
+		assert.Ok(t, err)
+		assert.Equals(t, "1", strings.TrimSpace(string(count)))
+	})
+
+	t.Run("full checkout replaces workspace", func(t *testing.T) {
+		dest := filepath.Join(dir, "workspace")
+		err := gh.GitCheckout(context.Background(), shas[1], repo, dest, 0)
+		assert.Ok(t, err)
+
+		content, err := ioutil.ReadFile(filepath.Join(dest, "ci.yml"))
+		assert.Ok(t, err)
+		assert.Equals(t, "second", string(content))
+
+		count, err := exec.Command("git", "-C", dest, "rev-list", "--count", "HEAD").Output()
+		assert.Ok(t, err)
+		assert.Equals(t, "2", strings.TrimSpace(string(count)))
+	})
+
+	t.Run("unknown commit", func(t *testing.T) {
+		err := gh.GitCheckout(context.Background(), strings.Repeat("0", 40), repo, filepath.Join(dir, "missing"), 1)
+		assert.Assert(t, (err != nil), "should have been an error")
+	})
+
+	t.Run("cancelled", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		err := gh.GitCheckout(ctx, shas[1], repo, filepath.Join(dir, "cancelled"), 1)
+		assert.Assert(t, (err != nil), "should have been an error")
+	})
+}
@@ -0,0 +1,247 @@
+package ghclient
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/pleimer/ci-server-go/pkg/metrics"
+)
+
+var cacheRequests = metrics.NewCounterVec("ci_github_cache_requests_total", "Conditional github requests by cache result", "result")
+
+// ResponseCache caches the bodies of GET responses by URL together with their validators, so that
+// repeated requests can be made conditional. Github does not count 304 responses against the rate limit.
+// Entries are kept in memory up to a total body size, least recently used entries are evicted first.
+// Persisted entries are bound by the same size, the files of evicted entries are removed
+type ResponseCache struct {
+	dir     string
+	entries *lru
+}
+
+type cachedResponse struct {
+	URL          string `json:"url"`
+	ETag         string `json:"etag,omitempty"`
+	LastModified string `json:"last_modified,omitempty"`
+	ContentType  string `json:"content_type,omitempty"`
+	Body         []byte `json:"body"`
+}
+
+// NewResponseCache create response cache holding up to maxBytes of response bodies, 0 meaning no limit.
+// If dir is not empty, entries are persisted there and survive restarts. Persisted entries exceeding
+// maxBytes, such as those left by a server that ran with a larger limit, are removed
+func NewResponseCache(dir string, maxBytes int64) (*ResponseCache, error) {
+	rc := &ResponseCache{
+		dir:     dir,
+		entries: newLRU("responses", maxBytes),
+	}
+	if dir == "" {
+		return rc, nil
+	}
+
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	rc.entries.onEvict = func(URL string, value interface{}) {
+		os.Remove(rc.entryPath(URL))
+	}
+	if maxBytes > 0 {
+		if err := rc.load(); err != nil {
+			return nil, err
+		}
+	}
+	return rc, nil
+}
+
+// load reads the persisted entries, least recently written first, so that the oldest entries exceeding
+// the size of the cache are evicted. Unreadable entries are removed
+func (rc *ResponseCache) load() error {
+	files, err := ioutil.ReadDir(rc.dir)
+	if err != nil {
+		return err
+	}
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].ModTime().Before(files[j].ModTime())
+	})
+	for _, file := range files {
+		if file.IsDir() || filepath.Ext(file.Name()) != ".json" {
+			continue
+		}
+		path := filepath.Join(rc.dir, file.Name())
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		entry := &cachedResponse{}
+		if err := json.Unmarshal(data, entry); err != nil || rc.entryPath(entry.URL) != path {
+			os.Remove(path)
+			continue
+		}
+		if !rc.entries.add(entry.URL, entry, int64(len(entry.Body))) {
+			os.Remove(path)
+		}
+	}
+	return nil
+}
+
+func (rc *ResponseCache) get(URL string) *cachedResponse {
+	if entry, ok := rc.entries.get(URL); ok {
+		return entry.(*cachedResponse)
+	}
+	if rc.dir == "" {
+		return nil
+	}
+
+	data, err := ioutil.ReadFile(rc.entryPath(URL))
+	if err != nil {
+		return nil
+	}
+	entry := &cachedResponse{}
+	if err := json.Unmarshal(data, entry); err != nil || entry.URL != URL {
+		return nil
+	}
+	rc.entries.add(URL, entry, int64(len(entry.Body)))
+	return entry
+}
+
+func (rc *ResponseCache) put(entry *cachedResponse) error {
+	cost := int64(len(entry.Body))
+	if rc.dir != "" {
+		path := rc.entryPath(entry.URL)
+		if !rc.entries.fits(cost) {
+			// neither kept in memory nor on disk, where a previous response to the URL may be
+			os.Remove(path)
+		} else {
+			// written before it is added, so that the file is removed if the entry is evicted
+			data, err := json.Marshal(entry)
+			if err != nil {
+				return err
+			}
+			if err := writeFileAtomic(path, data); err != nil {
+				return err
+			}
+		}
+	}
+	rc.entries.add(entry.URL, entry, cost)
+	return nil
+}
+
+func (rc *ResponseCache) entryPath(URL string) string {
+	sum := sha256.Sum256([]byte(URL))
+	return filepath.Join(rc.dir, hex.EncodeToString(sum[:])+".json")
+}
+
+// response rebuild http response from cached entry
+func (cr *cachedResponse) response(req *http.Request) *http.Response {
+	header := make(http.Header)
+	header.Set("Content-Type", cr.ContentType)
+	if cr.ETag != "" {
+		header.Set("ETag", cr.ETag)
+	}
+	if cr.LastModified != "" {
+		header.Set("Last-Modified", cr.LastModified)
+	}
+	return &http.Response{
+		Status:        "200 OK",
+		StatusCode:    http.StatusOK,
+		Header:        header,
+		Body:          ioutil.NopCloser(bytes.NewReader(cr.Body)),
+		ContentLength: int64(len(cr.Body)),
+		Request:       req,
+	}
+}
+
+// conditionalGet sends GET request with validators of the cached response for its URL, if there
+// is one, and serves the cached body when github answers with 304 Not Modified
+func (a *API) conditionalGet(req *http.Request) (*http.Response, error) {
+	URL := req.URL.String()
+	entry := a.Responses.get(URL)
+	if entry != nil {
+		if entry.ETag != "" {
+			req.Header.Set("If-None-Match", entry.ETag)
+		}
+		if entry.LastModified != "" {
+			req.Header.Set("If-Modified-Since", entry.LastModified)
+		}
+	}
+
+	res, err := a.do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	switch {
+	case res.StatusCode == http.StatusNotModified && entry != nil:
+		io.Copy(ioutil.Discard, res.Body)
+		res.Body.Close()
+		cacheRequests.Counter("hit").Inc()
+		return entry.response(req), nil
+	case res.StatusCode == http.StatusOK && isCacheable(res):
+		body, err := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		res.Body = ioutil.NopCloser(bytes.NewReader(body))
+		cacheRequests.Counter("miss").Inc()
+
+		err = a.Responses.put(&cachedResponse{
+			URL:          URL,
+			ETag:         res.Header.Get("ETag"),
+			LastModified: res.Header.Get("Last-Modified"),
+			ContentType:  res.Header.Get("Content-Type"),
+			Body:         body,
+		})
+		if err != nil {
+			a.logWarn(map[string]interface{}{"url": URL, "error": err}, "failed persisting cached response")
+		}
+	}
+	return res, nil
+}
+
+// responses of git objects are not cached. They never change, are kept by the object cache
+// and would crowd out the responses that do change. Archives are streamed to disk
+func isCacheableURL(URL string) bool {
+	for _, path := range []string{"/git/blobs/", "/git/trees/", "/tarball/"} {
+		if strings.Contains(URL, path) {
+			return false
+		}
+	}
+	return true
+}
+
+// only json api responses that carry a validator are cached. Archives are streamed
+// to disk and would bloat the cache
+func isCacheable(res *http.Response) bool {
+	if res.Header.Get("ETag") == "" && res.Header.Get("Last-Modified") == "" {
+		return false
+	}
+	return strings.Contains(res.Header.Get("Content-Type"), "json")
+}
+
+// writeFileAtomic writes data to a temporary file and renames it over path, so that
+// readers never observe a partially written file
+func writeFileAtomic(path string, data []byte) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
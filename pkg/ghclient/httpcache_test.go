@@ -0,0 +1,140 @@
+package ghclient
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/pleimer/ci-server-go/pkg/assert"
+)
+
+func TestConditionalGet(t *testing.T) {
+	dir, err := ioutil.TempDir("", "httpcache")
+	assert.Ok(t, err)
+	defer os.RemoveAll(dir)
+
+	requests := 0
+	client := NewTestClient(func(req *http.Request) *http.Response {
+		requests++
+		res := &http.Response{
+			Header: make(http.Header),
+			Body:   ioutil.NopCloser(bytes.NewBufferString("")),
+		}
+		if req.Header.Get("If-None-Match") == `"v1"` {
+			res.StatusCode = 304
+			res.Status = "304 Not Modified"
+			return res
+		}
+		res.StatusCode = 200
+		res.Status = "200 OK"
+		res.Header.Set("ETag", `"v1"`)
+		res.Header.Set("Content-Type", "application/json; charset=utf-8")
+		res.Body = ioutil.NopCloser(bytes.NewBufferString(`{"sha": "commit"}`))
+		return res
+	})
+
+	newAPI := func() API {
+		api := NewAPI()
+		api.Client = client
+		api.Responses, err = NewResponseCache(dir, 0)
+		assert.Ok(t, err)
+		return api
+	}
+
+	api := newAPI()
+	URL := api.CommitURL("owner", "repo", "commit")
+
+	t.Run("response cached", func(t *testing.T) {
+		body, err := api.GetCommit("owner", "repo", "commit")
+		assert.Ok(t, err)
+		assert.Equals(t, `{"sha": "commit"}`, string(body))
+		assert.Equals(t, `"v1"`, api.Responses.get(URL).ETag)
+	})
+
+	t.Run("not modified served from cache", func(t *testing.T) {
+		hits := cacheRequests.Counter("hit").Value()
+		body, err := api.GetCommit("owner", "repo", "commit")
+		assert.Ok(t, err)
+		assert.Equals(t, `{"sha": "commit"}`, string(body))
+		assert.Equals(t, 2, requests)
+		assert.Equals(t, hits+1, cacheRequests.Counter("hit").Value())
+	})
+
+	t.Run("cache survives restart", func(t *testing.T) {
+		restarted := newAPI()
+		body, err := restarted.GetCommit("owner", "repo", "commit")
+		assert.Ok(t, err)
+		assert.Equals(t, `{"sha": "commit"}`, string(body))
+		assert.Equals(t, 3, requests)
+	})
+
+	t.Run("responses without validator not cached", func(t *testing.T) {
+		memory, err := NewResponseCache("", 0)
+		assert.Ok(t, err)
+		res := &http.Response{Header: make(http.Header)}
+		res.Header.Set("Content-Type", "application/x-gzip")
+		res.Header.Set("ETag", `"archive"`)
+		assert.Assert(t, !isCacheable(res), "archives should not be cached")
+		assert.Assert(t, memory.get(URL) == nil, "memory cache should start empty")
+	})
+
+	t.Run("git objects not cached", func(t *testing.T) {
+		assert.Assert(t, !isCacheableURL(api.TreeURL("owner", "repo", "tree")), "trees should not be cached")
+		assert.Assert(t, !isCacheableURL(api.BlobURL("owner", "repo", "blob")), "blobs should not be cached")
+		assert.Assert(t, !isCacheableURL(api.TarballURL("owner", "repo", "sha")), "archives should not be cached")
+		assert.Assert(t, isCacheableURL(URL), "commits should be cached")
+	})
+
+	t.Run("memory bounded", func(t *testing.T) {
+		bounded, err := NewResponseCache("", 20)
+		assert.Ok(t, err)
+		assert.Ok(t, bounded.put(&cachedResponse{URL: "first", Body: []byte("0123456789")}))
+		assert.Ok(t, bounded.put(&cachedResponse{URL: "second", Body: []byte("0123456789")}))
+		assert.Assert(t, bounded.get("first") != nil, "first response should be cached")
+		assert.Ok(t, bounded.put(&cachedResponse{URL: "third", Body: []byte("0123456789")}))
+		assert.Assert(t, bounded.get("second") == nil, "least recently used response should be evicted")
+		assert.Assert(t, bounded.get("first") != nil && bounded.get("third") != nil, "recent responses should be kept")
+	})
+
+	t.Run("disk bounded", func(t *testing.T) {
+		dir, err := ioutil.TempDir("", "httpcache")
+		assert.Ok(t, err)
+		defer os.RemoveAll(dir)
+		persisted := func() int {
+			files, err := ioutil.ReadDir(dir)
+			assert.Ok(t, err)
+			return len(files)
+		}
+
+		unbounded, err := NewResponseCache(dir, 0)
+		assert.Ok(t, err)
+		for i, URL := range []string{"first", "second", "third"} {
+			assert.Ok(t, unbounded.put(&cachedResponse{URL: URL, Body: []byte("0123456789")}))
+			// modification times decide which entries are kept on restart
+			mtime := time.Now().Add(time.Duration(i-3) * time.Minute)
+			assert.Ok(t, os.Chtimes(unbounded.entryPath(URL), mtime, mtime))
+		}
+		assert.Equals(t, 3, persisted())
+
+		// entries over the bound are removed on restart, oldest first
+		bounded, err := NewResponseCache(dir, 20)
+		assert.Ok(t, err)
+		assert.Equals(t, 2, persisted())
+		assert.Assert(t, bounded.get("first") == nil, "oldest response should be removed")
+		assert.Assert(t, bounded.get("second") != nil && bounded.get("third") != nil, "recent responses should be kept")
+
+		// evicted entries are removed from disk
+		assert.Ok(t, bounded.put(&cachedResponse{URL: "fourth", Body: []byte("0123456789")}))
+		assert.Equals(t, 2, persisted())
+		_, err = os.Stat(bounded.entryPath("second"))
+		assert.Assert(t, os.IsNotExist(err), "evicted response should be removed from disk")
+
+		// responses larger than the cache are not kept, nor are previous responses to their URL
+		assert.Ok(t, bounded.put(&cachedResponse{URL: "third", Body: []byte("0123456789012345678901")}))
+		assert.Equals(t, 1, persisted())
+		assert.Assert(t, bounded.get("third") == nil, "oversized response should not be cached")
+	})
+}
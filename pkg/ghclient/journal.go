@@ -0,0 +1,194 @@
+package ghclient
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultJournalCapacity number of deliveries kept in journals created by the server
+const DefaultJournalCapacity = 1000
+
+// outcomes of journaled deliveries
+const (
+	OutcomeReceived   = "received"   // accepted, not yet processed
+	OutcomeDispatched = "dispatched" // event handed to the job factory
+	OutcomeIgnored    = "ignored"    // event type is not supported
+	OutcomeFailed     = "failed"     // event could not be handled
+)
+
+var safeDeliveryID = regexp.MustCompile(`^[A-Za-z0-9-]+$`)
+
+// JournalEntry webhook delivery as received by the server
+type JournalEntry struct {
+	Delivery string      `json:"delivery"`
+	Event    string      `json:"event"`
+	Received time.Time   `json:"received"`
+	Header   http.Header `json:"header,omitempty"`
+	Body     string      `json:"body,omitempty"`
+	Outcome  string      `json:"outcome"`
+	Error    string      `json:"error,omitempty"`
+}
+
+// Journal keeps the most recent webhook deliveries so that they can be inspected and replayed.
+// If dir is set, each delivery is also written to its own file in dir
+type Journal struct {
+	dir      string
+	capacity int
+
+	lock    sync.Mutex
+	entries map[string]*JournalEntry
+	order   []string // delivery IDs, oldest first
+}
+
+// NewJournal create journal holding up to capacity deliveries, loading previous deliveries from dir
+func NewJournal(dir string, capacity int) (*Journal, error) {
+	j := &Journal{
+		dir:      dir,
+		capacity: capacity,
+		entries:  make(map[string]*JournalEntry),
+	}
+	if dir == "" {
+		return j, nil
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	return j, j.load()
+}
+
+// Record adds delivery to the journal, evicting the oldest delivery if the journal is full
+func (j *Journal) Record(entry JournalEntry) error {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+
+	if _, ok := j.entries[entry.Delivery]; !ok {
+		j.order = append(j.order, entry.Delivery)
+	}
+	j.entries[entry.Delivery] = &entry
+	for len(j.order) > j.capacity {
+		j.remove(j.order[0])
+	}
+	return j.write(&entry)
+}
+
+// SetOutcome records the outcome of processing delivery
+func (j *Journal) SetOutcome(delivery, outcome string, err error) error {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+
+	entry, ok := j.entries[delivery]
+	if !ok {
+		return nil
+	}
+	entry.Outcome = outcome
+	entry.Error = ""
+	if err != nil {
+		entry.Error = err.Error()
+	}
+	return j.write(entry)
+}
+
+// Get retrieve delivery
+func (j *Journal) Get(delivery string) (JournalEntry, bool) {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	entry, ok := j.entries[delivery]
+	if !ok {
+		return JournalEntry{}, false
+	}
+	return *entry, true
+}
+
+// List retrieve deliveries newest first, without headers and payloads
+func (j *Journal) List() []JournalEntry {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	entries := make([]JournalEntry, 0, len(j.order))
+	for i := len(j.order) - 1; i >= 0; i-- {
+		entry := *j.entries[j.order[i]]
+		entry.Header = nil
+		entry.Body = ""
+		entries = append(entries, entry)
+	}
+	return entries
+}
+
+func (j *Journal) remove(delivery string) {
+	delete(j.entries, delivery)
+	for i, id := range j.order {
+		if id == delivery {
+			j.order = append(j.order[:i], j.order[i+1:]...)
+			break
+		}
+	}
+	if j.dir != "" {
+		os.Remove(j.path(delivery))
+	}
+}
+
+func (j *Journal) write(entry *JournalEntry) error {
+	if j.dir == "" {
+		return nil
+	}
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(j.path(entry.Delivery), data)
+}
+
+// path file of delivery. Delivery IDs are taken from an unsigned header, so
+// anything but a plain GUID is hashed
+func (j *Journal) path(delivery string) string {
+	name := delivery
+	if !safeDeliveryID.MatchString(delivery) {
+		sum := sha256.Sum256([]byte(delivery))
+		name = hex.EncodeToString(sum[:])
+	}
+	return filepath.Join(j.dir, name+".json")
+}
+
+func (j *Journal) load() error {
+	files, err := ioutil.ReadDir(j.dir)
+	if err != nil {
+		return err
+	}
+
+	entries := []*JournalEntry{}
+	for _, f := range files {
+		if f.IsDir() || !strings.HasSuffix(f.Name(), ".json") {
+			continue
+		}
+		data, err := ioutil.ReadFile(filepath.Join(j.dir, f.Name()))
+		if err != nil {
+			continue
+		}
+		entry := &JournalEntry{}
+		if err := json.Unmarshal(data, entry); err != nil || entry.Delivery == "" {
+			continue
+		}
+		entries = append(entries, entry)
+	}
+
+	sort.Slice(entries, func(a, b int) bool {
+		return entries[a].Received.Before(entries[b].Received)
+	})
+	for _, entry := range entries {
+		j.entries[entry.Delivery] = entry
+		j.order = append(j.order, entry.Delivery)
+	}
+	for len(j.order) > j.capacity {
+		j.remove(j.order[0])
+	}
+	return nil
+}
@@ -0,0 +1,101 @@
+package ghclient
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/pleimer/ci-server-go/pkg/assert"
+	"github.com/pleimer/ci-server-go/pkg/logging"
+)
+
+func TestJournal(t *testing.T) {
+	dir, err := ioutil.TempDir("", "journal")
+	assert.Ok(t, err)
+	defer os.RemoveAll(dir)
+
+	journal, err := NewJournal(dir, 2)
+	assert.Ok(t, err)
+
+	received := time.Unix(1600000000, 0).UTC()
+	record := func(delivery string) {
+		assert.Ok(t, journal.Record(JournalEntry{
+			Delivery: delivery,
+			Event:    "push",
+			Received: received,
+			Header:   http.Header{"X-Github-Event": []string{"push"}},
+			Body:     `{"ref": "refs/heads/master"}`,
+			Outcome:  OutcomeReceived,
+		}))
+		received = received.Add(time.Second)
+	}
+
+	t.Run("outcome recorded", func(t *testing.T) {
+		record("a")
+		assert.Ok(t, journal.SetOutcome("a", OutcomeFailed, errors.New("broken")))
+		entry, ok := journal.Get("a")
+		assert.Assert(t, ok, "delivery should be journaled")
+		assert.Equals(t, OutcomeFailed, entry.Outcome)
+		assert.Equals(t, "broken", entry.Error)
+	})
+
+	t.Run("bounded by capacity", func(t *testing.T) {
+		record("b")
+		record("../c")
+		_, ok := journal.Get("a")
+		assert.Assert(t, !ok, "oldest delivery should have been evicted")
+
+		list := journal.List()
+		assert.Equals(t, 2, len(list))
+		assert.Equals(t, "../c", list[0].Delivery)
+		assert.Equals(t, "", list[0].Body)
+
+		files, err := ioutil.ReadDir(dir)
+		assert.Ok(t, err)
+		assert.Equals(t, 2, len(files))
+	})
+
+	t.Run("survives restart", func(t *testing.T) {
+		restarted, err := NewJournal(dir, 2)
+		assert.Ok(t, err)
+		entry, ok := restarted.Get("b")
+		assert.Assert(t, ok, "delivery should have been loaded from disk")
+		assert.Equals(t, `{"ref": "refs/heads/master"}`, entry.Body)
+		assert.Equals(t, "push", entry.Header.Get("X-Github-Event"))
+		assert.Equals(t, []string{"b", "../c"}, restarted.order)
+	})
+}
+
+func TestReplay(t *testing.T) {
+	eventChan := make(chan Event, 1)
+	gh := NewClient(eventChan, "testuser")
+	log, err := logging.NewLogger(logging.NONE, "console")
+	assert.Ok(t, err)
+
+	gh.Journal, err = NewJournal("", DefaultJournalCapacity)
+	assert.Ok(t, err)
+
+	payload, err := json.Marshal(getWebhook())
+	assert.Ok(t, err)
+	assert.Ok(t, gh.Journal.Record(JournalEntry{
+		Delivery: "delivery",
+		Event:    "push",
+		Body:     string(payload),
+		Outcome:  OutcomeFailed,
+	}))
+
+	assert.Equals(t, ErrDeliveryNotFound, gh.Replay("missing", log))
+	assert.Ok(t, gh.Replay("delivery", log))
+
+	ev := <-eventChan
+	push, ok := ev.(*Push)
+	assert.Assert(t, ok, "replayed delivery should be a push event")
+	assert.Equals(t, "example-repo", push.Repo.Name)
+
+	entry, _ := gh.Journal.Get("delivery")
+	assert.Equals(t, OutcomeDispatched, entry.Outcome)
+}
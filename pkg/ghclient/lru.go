@@ -0,0 +1,144 @@
+package ghclient
+
+import (
+	"container/list"
+	"sync"
+
+	"github.com/pleimer/ci-server-go/pkg/metrics"
+)
+
+var (
+	cacheEvictions = metrics.NewCounterVec("ci_cache_evictions_total", "Objects evicted from the object cache", "cache")
+	cacheEntries   = metrics.NewGaugeVec("ci_cache_entries", "Objects held in the object cache", "cache")
+	cacheCost      = metrics.NewGaugeVec("ci_cache_cost", "Cost of objects held in the object cache, in bytes or entries depending on the cache", "cache")
+)
+
+// lru least recently used cache bounded by the total cost of its entries. The least recently
+// used entries are evicted once the cost exceeds maxCost. A maxCost of 0 disables the bound.
+// Pinned entries are never evicted, so the cost may exceed maxCost while they are held
+type lru struct {
+	name    string
+	maxCost int64
+
+	lock  sync.Mutex
+	cost  int64
+	order *list.List // front is most recently used
+	items map[string]*list.Element
+	pins  map[string]int // by key, number of holders of the pin
+
+	// onEvict is called with the lock held for each evicted entry, if set
+	onEvict func(key string, value interface{})
+}
+
+type lruEntry struct {
+	key   string
+	value interface{}
+	cost  int64
+}
+
+func newLRU(name string, maxCost int64) *lru {
+	return &lru{
+		name:    name,
+		maxCost: maxCost,
+		order:   list.New(),
+		items:   make(map[string]*list.Element),
+		pins:    make(map[string]int),
+	}
+}
+
+func (l *lru) get(key string) (interface{}, bool) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	el, ok := l.items[key]
+	if !ok {
+		return nil, false
+	}
+	l.order.MoveToFront(el)
+	return el.Value.(*lruEntry).value, true
+}
+
+// add inserts value under key, replacing any previous value. Values that cost
+// more than the entire cache are not stored. Returns whether value was stored
+func (l *lru) add(key string, value interface{}, cost int64) bool {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if el, ok := l.items[key]; ok {
+		l.remove(el)
+	}
+	if !l.fits(cost) {
+		l.updateMetrics()
+		return false
+	}
+
+	l.items[key] = l.order.PushFront(&lruEntry{key: key, value: value, cost: cost})
+	l.cost += cost
+	l.evict(key)
+	l.updateMetrics()
+	return true
+}
+
+// fits whether an entry costing cost can be stored at all
+func (l *lru) fits(cost int64) bool {
+	return l.maxCost == 0 || cost <= l.maxCost
+}
+
+// pin keeps key from being evicted until unpin is called as many times. key does not need to be present
+func (l *lru) pin(key string) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.pins[key]++
+}
+
+func (l *lru) unpin(key string) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if l.pins[key] <= 1 {
+		delete(l.pins, key)
+	} else {
+		l.pins[key]--
+	}
+	l.evict("")
+	l.updateMetrics()
+}
+
+// evict removes the least recently used entries that are neither pinned nor keep until the cost is within maxCost
+func (l *lru) evict(keep string) {
+	for el := l.order.Back(); el != nil && l.maxCost > 0 && l.cost > l.maxCost; {
+		prev := el.Prev()
+		if entry := el.Value.(*lruEntry); entry.key != keep && l.pins[entry.key] == 0 {
+			l.remove(el)
+			cacheEvictions.Counter(l.name).Inc()
+			if l.onEvict != nil {
+				l.onEvict(entry.key, entry.value)
+			}
+		}
+		el = prev
+	}
+}
+
+// addIfAbsent inserts value under key unless the key is already present. Returns true if the value was inserted
+func (l *lru) addIfAbsent(key string, value interface{}, cost int64) bool {
+	if _, ok := l.get(key); ok {
+		return false
+	}
+	l.add(key, value, cost)
+	return true
+}
+
+func (l *lru) len() int {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return l.order.Len()
+}
+
+func (l *lru) remove(el *list.Element) {
+	entry := l.order.Remove(el).(*lruEntry)
+	delete(l.items, entry.key)
+	l.cost -= entry.cost
+}
+
+func (l *lru) updateMetrics() {
+	cacheEntries.Gauge(l.name).Set(float64(l.order.Len()))
+	cacheCost.Gauge(l.name).Set(float64(l.cost))
+}
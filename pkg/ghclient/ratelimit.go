@@ -0,0 +1,272 @@
+package ghclient
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/pleimer/ci-server-go/pkg/metrics"
+)
+
+var (
+	quotaRemaining = metrics.NewGaugeVec("ci_github_ratelimit_remaining", "Requests remaining in the current github rate limit window by credentials", "credentials")
+	quotaLimit     = metrics.NewGaugeVec("ci_github_ratelimit_limit", "Requests allowed per github rate limit window by credentials", "credentials")
+	quotaReset     = metrics.NewGaugeVec("ci_github_ratelimit_reset_timestamp_seconds", "Unix time at which the github rate limit window resets by credentials", "credentials")
+	apiRequests    = metrics.NewCounterVec("ci_github_requests_total", "Requests sent to the github api by response status", "status")
+	apiRetries     = metrics.NewCounter("ci_github_retries_total", "Requests to the github api that were retried")
+)
+
+// RetryPolicy controls retries of failed api requests
+type RetryPolicy struct {
+	MaxRetries int
+	BaseDelay  time.Duration // delay before the first retry, doubled on each subsequent retry
+	MaxDelay   time.Duration
+}
+
+// DefaultRetryPolicy retry policy of new API objects
+var DefaultRetryPolicy = RetryPolicy{
+	MaxRetries: 3,
+	BaseDelay:  time.Second,
+	MaxDelay:   time.Minute,
+}
+
+// Quota github rate limit state as of the last response
+type Quota struct {
+	Limit     int
+	Remaining int
+	Reset     time.Time
+}
+
+// quotaTracker rate limit state of each of the credentials requests are sent with. Each installation of a
+// github app has its own quota, separate from that of the app and of an oauth token
+type quotaTracker struct {
+	lock   sync.Mutex
+	quotas map[string]*trackedQuota // keyed by credentials, see API.authorize
+	last   string                   // credentials of the last response
+}
+
+type trackedQuota struct {
+	quota  Quota
+	warned time.Time // reset of the window the quota was reported running low in
+}
+
+func newQuotaTracker() *quotaTracker {
+	return &quotaTracker{quotas: make(map[string]*trackedQuota)}
+}
+
+// Quota retrieve rate limit state as of the last response
+func (a *API) Quota() Quota {
+	a.quota.lock.Lock()
+	defer a.quota.lock.Unlock()
+	if tracked, ok := a.quota.quotas[a.quota.last]; ok {
+		return tracked.quota
+	}
+	return Quota{}
+}
+
+// update rate limit state of credentials from response headers
+func (a *API) updateQuota(res *http.Response, credentials string) {
+	remaining, err := strconv.Atoi(res.Header.Get("X-RateLimit-Remaining"))
+	if err != nil {
+		return
+	}
+	limit, _ := strconv.Atoi(res.Header.Get("X-RateLimit-Limit"))
+	reset, _ := strconv.ParseInt(res.Header.Get("X-RateLimit-Reset"), 10, 64)
+
+	a.quota.lock.Lock()
+	tracked, ok := a.quota.quotas[credentials]
+	if !ok {
+		tracked = &trackedQuota{}
+		a.quota.quotas[credentials] = tracked
+	}
+	tracked.quota = Quota{
+		Limit:     limit,
+		Remaining: remaining,
+		Reset:     time.Unix(reset, 0),
+	}
+	a.quota.last = credentials
+	// warned once per window, as remaining keeps dropping below the threshold with every request
+	low := limit > 0 && remaining <= limit/10 && !tracked.warned.Equal(tracked.quota.Reset)
+	if low {
+		tracked.warned = tracked.quota.Reset
+	}
+	a.quota.lock.Unlock()
+
+	quotaRemaining.Gauge(credentials).Set(float64(remaining))
+	quotaLimit.Gauge(credentials).Set(float64(limit))
+	quotaReset.Gauge(credentials).Set(float64(reset))
+
+	a.logDebug(map[string]interface{}{"credentials": credentials, "remaining": remaining, "limit": limit, "reset": time.Unix(reset, 0)}, "github rate limit")
+	if low {
+		a.logWarn(map[string]interface{}{"credentials": credentials, "remaining": remaining, "limit": limit, "reset": time.Unix(reset, 0)},
+			"github rate limit running low")
+	}
+}
+
+// waitForQuota blocks until the rate limit window of credentials resets if their quota is exhausted, or until
+// ctx is done. Returns whether it waited
+func (a *API) waitForQuota(ctx context.Context, credentials string) (bool, error) {
+	a.quota.lock.Lock()
+	wait := time.Duration(0)
+	if tracked, ok := a.quota.quotas[credentials]; ok && tracked.quota.Remaining == 0 {
+		wait = time.Until(tracked.quota.Reset)
+	}
+	a.quota.lock.Unlock()
+
+	if wait > 0 {
+		a.logWarn(map[string]interface{}{"credentials": credentials, "wait": wait.Round(time.Second)}, "github rate limit exhausted - holding request until reset")
+		return true, a.sleep(ctx, wait)
+	}
+	return false, nil
+}
+
+// send sends request, retrying it according to the retry policy. Waits are abandoned once the
+// context of the request is done
+func (a *API) send(req *http.Request) (*http.Response, error) {
+	ctx := req.Context()
+	for attempt := 0; ; attempt++ {
+		credentials, err := a.authorize(req)
+		if err != nil {
+			return nil, err
+		}
+		waited, err := a.waitForQuota(ctx, credentials)
+		if err != nil {
+			return nil, err
+		}
+		if waited {
+			// installation tokens may have expired while waiting
+			credentials, err = a.authorize(req)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		res, err := a.Client.Do(req)
+		if res != nil {
+			a.updateQuota(res, credentials)
+			apiRequests.Counter(strconv.Itoa(res.StatusCode)).Inc()
+		} else {
+			apiRequests.Counter("error").Inc()
+		}
+
+		delay, retry := a.retryDelay(req, res, err, attempt)
+		if !retry {
+			return res, err
+		}
+
+		if res != nil {
+			io.Copy(ioutil.Discard, res.Body)
+			res.Body.Close()
+		}
+		if req.GetBody != nil {
+			req.Body, err = req.GetBody()
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		reason := fmt.Sprintf("%v", err)
+		if res != nil {
+			reason = res.Status
+		}
+		a.logWarn(map[string]interface{}{"url": req.URL.String(), "attempt": attempt + 1, "reason": reason, "delay": delay.Round(time.Millisecond)},
+			"retrying github request")
+		apiRetries.Inc()
+		if err := a.sleep(ctx, delay); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// sleepContext waits for d, returning early with the error of ctx once it is done
+func sleepContext(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// retryDelay decides whether request should be retried and how long to wait beforehand. Rate limited
+// requests are never processed by github and are retried regardless of method. Server and network errors
+// are only retried for idempotent requests
+func (a *API) retryDelay(req *http.Request, res *http.Response, err error, attempt int) (time.Duration, bool) {
+	if attempt >= a.Retry.MaxRetries {
+		return 0, false
+	}
+
+	if err != nil || res == nil {
+		return a.backoff(attempt), isIdempotent(req.Method)
+	}
+
+	if res.StatusCode == http.StatusTooManyRequests || (res.StatusCode == http.StatusForbidden && isRateLimited(res)) {
+		if after, err := strconv.Atoi(res.Header.Get("Retry-After")); err == nil {
+			return time.Duration(after) * time.Second, true
+		}
+		if res.Header.Get("X-RateLimit-Remaining") == "0" {
+			reset, err := strconv.ParseInt(res.Header.Get("X-RateLimit-Reset"), 10, 64)
+			if err == nil {
+				return time.Until(time.Unix(reset, 0)), true
+			}
+		}
+		return a.backoff(attempt), true
+	}
+
+	switch res.StatusCode {
+	case http.StatusInternalServerError, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return a.backoff(attempt), isIdempotent(req.Method)
+	}
+	return 0, false
+}
+
+// backoff exponential delay with jitter
+func (a *API) backoff(attempt int) time.Duration {
+	delay := a.Retry.BaseDelay << uint(attempt)
+	if delay > a.Retry.MaxDelay || delay <= 0 {
+		delay = a.Retry.MaxDelay
+	}
+	if delay <= 0 {
+		return 0
+	}
+	half := delay / 2
+	return half + time.Duration(rand.Int63n(int64(half)+1))
+}
+
+func isRateLimited(res *http.Response) bool {
+	return res.Header.Get("Retry-After") != "" || res.Header.Get("X-RateLimit-Remaining") == "0"
+}
+
+func isIdempotent(method string) bool {
+	switch method {
+	case "GET", "HEAD", "OPTIONS", "PUT", "DELETE":
+		return true
+	}
+	return false
+}
+
+func (a *API) logWarn(metadata map[string]interface{}, message string) {
+	if a.Log == nil {
+		return
+	}
+	metadata["module"] = "API"
+	a.Log.Metadata(metadata)
+	a.Log.Warn(message)
+}
+
+func (a *API) logDebug(metadata map[string]interface{}, message string) {
+	if a.Log == nil {
+		return
+	}
+	metadata["module"] = "API"
+	a.Log.Metadata(metadata)
+	a.Log.Debug(message)
+}
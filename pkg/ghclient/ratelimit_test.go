@@ -0,0 +1,263 @@
+package ghclient
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pleimer/ci-server-go/pkg/assert"
+	"github.com/pleimer/ci-server-go/pkg/logging"
+)
+
+func genRateLimitedAPI(responses []*http.Response) (*API, *[]time.Duration, *int) {
+	requests := 0
+	client := NewTestClient(func(req *http.Request) *http.Response {
+		res := responses[requests]
+		requests++
+		return res
+	})
+
+	slept := []time.Duration{}
+	api := NewAPI()
+	api.Client = client
+	api.oauth = "oauthstring"
+	api.Retry = RetryPolicy{MaxRetries: 2, BaseDelay: time.Second, MaxDelay: 4 * time.Second}
+	api.sleep = func(ctx context.Context, d time.Duration) error {
+		slept = append(slept, d)
+		return ctx.Err()
+	}
+	return &api, &slept, &requests
+}
+
+func rateLimitResponse(code int, headers map[string]string) *http.Response {
+	res := &http.Response{
+		StatusCode: code,
+		Status:     fmt.Sprintf("%d", code),
+		Body:       ioutil.NopCloser(bytes.NewBufferString("body")),
+		Header:     make(http.Header),
+	}
+	for k, v := range headers {
+		res.Header.Set(k, v)
+	}
+	return res
+}
+
+func TestRetry(t *testing.T) {
+	t.Run("server errors retried for get", func(t *testing.T) {
+		api, slept, requests := genRateLimitedAPI([]*http.Response{
+			rateLimitResponse(502, nil),
+			rateLimitResponse(503, nil),
+			rateLimitResponse(200, nil),
+		})
+		res, err := api.get(api.BaseURL)
+		assert.Ok(t, err)
+		assert.Equals(t, 200, res.StatusCode)
+		assert.Equals(t, 3, *requests)
+		assert.Equals(t, 2, len(*slept))
+		assert.Assert(t, (*slept)[0] >= 500*time.Millisecond && (*slept)[0] <= time.Second, "first delay out of range")
+		assert.Assert(t, (*slept)[1] >= time.Second && (*slept)[1] <= 2*time.Second, "second delay out of range")
+	})
+
+	t.Run("retries exhausted", func(t *testing.T) {
+		api, _, requests := genRateLimitedAPI([]*http.Response{
+			rateLimitResponse(500, nil),
+			rateLimitResponse(500, nil),
+			rateLimitResponse(500, nil),
+		})
+		res, err := api.get(api.BaseURL)
+		assert.Ok(t, err)
+		assert.Equals(t, 500, res.StatusCode)
+		assert.Equals(t, 3, *requests)
+	})
+
+	t.Run("server errors not retried for post", func(t *testing.T) {
+		api, slept, requests := genRateLimitedAPI([]*http.Response{
+			rateLimitResponse(502, nil),
+		})
+		res, err := api.post(api.BaseURL, []byte("{}"))
+		assert.Ok(t, err)
+		assert.Equals(t, 502, res.StatusCode)
+		assert.Equals(t, 1, *requests)
+		assert.Equals(t, 0, len(*slept))
+	})
+
+	t.Run("secondary rate limit honours retry-after", func(t *testing.T) {
+		api, slept, requests := genRateLimitedAPI([]*http.Response{
+			rateLimitResponse(403, map[string]string{"Retry-After": "30"}),
+			rateLimitResponse(201, nil),
+		})
+		res, err := api.post(api.BaseURL, []byte("{}"))
+		assert.Ok(t, err)
+		assert.Equals(t, 201, res.StatusCode)
+		assert.Equals(t, 2, *requests)
+		assert.Equals(t, []time.Duration{30 * time.Second}, *slept)
+	})
+
+	t.Run("forbidden without rate limit not retried", func(t *testing.T) {
+		api, _, requests := genRateLimitedAPI([]*http.Response{
+			rateLimitResponse(403, nil),
+		})
+		res, err := api.get(api.BaseURL)
+		assert.Ok(t, err)
+		assert.Equals(t, 403, res.StatusCode)
+		assert.Equals(t, 1, *requests)
+	})
+}
+
+func TestQuota(t *testing.T) {
+	reset := time.Now().Add(time.Hour).Unix()
+	api, slept, requests := genRateLimitedAPI([]*http.Response{
+		rateLimitResponse(200, map[string]string{
+			"X-RateLimit-Limit":     "5000",
+			"X-RateLimit-Remaining": "0",
+			"X-RateLimit-Reset":     strconv.FormatInt(reset, 10),
+		}),
+		rateLimitResponse(200, map[string]string{
+			"X-RateLimit-Limit":     "5000",
+			"X-RateLimit-Remaining": "4999",
+			"X-RateLimit-Reset":     strconv.FormatInt(reset+3600, 10),
+		}),
+	})
+
+	_, err := api.get(api.BaseURL)
+	assert.Ok(t, err)
+	assert.Equals(t, Quota{Limit: 5000, Remaining: 0, Reset: time.Unix(reset, 0)}, api.Quota())
+	assert.Equals(t, 0, len(*slept))
+
+	// quota exhausted, next request held until reset
+	_, err = api.get(api.BaseURL)
+	assert.Ok(t, err)
+	assert.Equals(t, 2, *requests)
+	assert.Equals(t, 1, len(*slept))
+	assert.Assert(t, (*slept)[0] > 59*time.Minute && (*slept)[0] <= time.Hour, "should have waited for reset")
+	assert.Equals(t, 4999, api.Quota().Remaining)
+}
+
+func TestQuotaCancelled(t *testing.T) {
+	reset := time.Now().Add(time.Hour).Unix()
+	api, _, requests := genRateLimitedAPI([]*http.Response{
+		rateLimitResponse(200, map[string]string{
+			"X-RateLimit-Limit":     "5000",
+			"X-RateLimit-Remaining": "0",
+			"X-RateLimit-Reset":     strconv.FormatInt(reset, 10),
+		}),
+	})
+	api.sleep = sleepContext
+
+	_, err := api.get(api.BaseURL)
+	assert.Ok(t, err)
+
+	// the wait for the reset ends with the context of the request
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, err = api.WithContext(ctx).get(api.BaseURL)
+	assert.Equals(t, context.DeadlineExceeded, err)
+	assert.Assert(t, time.Since(start) < time.Minute, "wait should have been abandoned")
+	assert.Equals(t, 1, *requests)
+
+	t.Run("retry backoff", func(t *testing.T) {
+		api, _, requests := genRateLimitedAPI([]*http.Response{
+			rateLimitResponse(502, nil),
+		})
+		api.Retry.BaseDelay = time.Hour
+		api.Retry.MaxDelay = time.Hour
+		api.sleep = sleepContext
+
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+		_, err := api.WithContext(ctx).get(api.BaseURL)
+		assert.Equals(t, context.DeadlineExceeded, err)
+		assert.Equals(t, 1, *requests)
+	})
+}
+
+func TestQuotaLow(t *testing.T) {
+	reset := time.Now().Add(time.Hour).Unix()
+	quota := func(remaining int, reset int64) *http.Response {
+		return rateLimitResponse(200, map[string]string{
+			"X-RateLimit-Limit":     "5000",
+			"X-RateLimit-Remaining": strconv.Itoa(remaining),
+			"X-RateLimit-Reset":     strconv.FormatInt(reset, 10),
+		})
+	}
+	api, _, _ := genRateLimitedAPI([]*http.Response{
+		quota(501, reset), quota(500, reset), quota(499, reset), quota(4999, reset+3600), quota(400, reset+3600),
+	})
+
+	dir, err := ioutil.TempDir("", "ratelimit")
+	assert.Ok(t, err)
+	defer os.RemoveAll(dir)
+	api.Log, err = logging.NewLogger(logging.WARN, filepath.Join(dir, "log"))
+	assert.Ok(t, err)
+	defer api.Log.Destroy()
+
+	for i := 0; i < 5; i++ {
+		_, err := api.get(api.BaseURL)
+		assert.Ok(t, err)
+	}
+	log, err := ioutil.ReadFile(filepath.Join(dir, "log"))
+	assert.Ok(t, err)
+	// once when dropping below a tenth of the limit in each window
+	assert.Equals(t, 2, strings.Count(string(log), "github rate limit running low"))
+}
+
+func TestQuotaCredentials(t *testing.T) {
+	app, _ := genAppAuth(t)
+	now := time.Now()
+	app.now = func() time.Time { return now }
+	reset := now.Add(time.Hour).Unix()
+
+	requests := map[string]int{}
+	client := NewTestClient(func(req *http.Request) *http.Response {
+		requests[req.URL.Path]++
+		switch req.URL.Path {
+		case "/app/installations/7/access_tokens", "/app/installations/8/access_tokens":
+			res := rateLimitResponse(201, nil)
+			res.Body = ioutil.NopCloser(strings.NewReader(fmt.Sprintf(`{"token": "token", "expires_at": "%s"}`, now.Add(time.Hour).Format(time.RFC3339))))
+			return res
+		case "/repos/owner/exhausted/statuses/sha":
+			return rateLimitResponse(201, map[string]string{
+				"X-RateLimit-Limit": "5000", "X-RateLimit-Remaining": "0", "X-RateLimit-Reset": strconv.FormatInt(reset, 10),
+			})
+		}
+		return rateLimitResponse(201, map[string]string{
+			"X-RateLimit-Limit": "5000", "X-RateLimit-Remaining": "4999", "X-RateLimit-Reset": strconv.FormatInt(reset, 10),
+		})
+	})
+
+	slept := []time.Duration{}
+	api := NewAPI()
+	api.Client = client
+	api.oauth = "oauthstring"
+	api.app = app
+	api.sleep = func(ctx context.Context, d time.Duration) error {
+		slept = append(slept, d)
+		return nil
+	}
+	api.SetInstallation("owner/exhausted", 7)
+	api.SetInstallation("owner/other", 8)
+
+	_, err := api.post(api.StatusURL("owner", "exhausted", "sha"), nil)
+	assert.Ok(t, err)
+
+	// the quota of other installations and of the oauth token is separate
+	_, err = api.post(api.StatusURL("owner", "other", "sha"), nil)
+	assert.Ok(t, err)
+	_, err = api.post(api.NewGistURL(), nil)
+	assert.Ok(t, err)
+	assert.Equals(t, 0, len(slept))
+
+	_, err = api.post(api.StatusURL("owner", "exhausted", "sha"), nil)
+	assert.Ok(t, err)
+	assert.Equals(t, 1, len(slept))
+	assert.Equals(t, 2, requests["/repos/owner/exhausted/statuses/sha"])
+}
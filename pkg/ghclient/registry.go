@@ -0,0 +1,238 @@
+package ghclient
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pleimer/ci-server-go/pkg/logging"
+)
+
+// DefaultRefreshInterval interval between refreshes of repositories loaded with LoadRepositories
+const DefaultRefreshInterval = 10 * time.Minute
+
+// RepositoryRegistry repositories known to the client and their references, safe for concurrent use.
+// Repositories are keyed by owner/repo, case insensitively
+type RepositoryRegistry struct {
+	lock  sync.RWMutex
+	repos map[string]*Repository
+}
+
+// NewRepositoryRegistry create empty registry
+func NewRepositoryRegistry() *RepositoryRegistry {
+	return &RepositoryRegistry{
+		repos: make(map[string]*Repository),
+	}
+}
+
+// Register adds repo to the registry. If the repository is already registered, its metadata
+// is updated and its references kept. Returns a snapshot of the registered repository
+func (rr *RepositoryRegistry) Register(repo *Repository) Repository {
+	rr.lock.Lock()
+	defer rr.lock.Unlock()
+
+	key := strings.ToLower(repo.FullName())
+	existing, ok := rr.repos[key]
+	if !ok {
+		if repo.refs == nil {
+			repo.refs = make(map[string]*Reference)
+		}
+		rr.repos[key] = repo
+		return repo.snapshot()
+	}
+	existing.Fork = repo.Fork
+	existing.CloneURL = repo.CloneURL
+	if repo.DefaultBranch != "" {
+		existing.DefaultBranch = repo.DefaultBranch
+	}
+	return existing.snapshot()
+}
+
+// Get retrieve snapshot of repository name, given either as owner/repo or as a bare repository
+// name. A bare name is only resolved if a single registered repository carries it
+func (rr *RepositoryRegistry) Get(name string) (Repository, bool) {
+	rr.lock.RLock()
+	defer rr.lock.RUnlock()
+
+	repo := rr.find(name)
+	if repo == nil {
+		return Repository{}, false
+	}
+	return repo.snapshot(), true
+}
+
+// Reference retrieve copy of reference refName in repository name
+func (rr *RepositoryRegistry) Reference(name, refName string) (Reference, bool) {
+	rr.lock.RLock()
+	defer rr.lock.RUnlock()
+
+	repo := rr.find(name)
+	if repo == nil {
+		return Reference{}, false
+	}
+	ref := repo.GetReference(refName)
+	if ref == nil {
+		return Reference{}, false
+	}
+	return *ref, true
+}
+
+// RegisterCommits points refName of repository name at head, creating the reference if needed.
+// Returns false if the repository is not registered
+func (rr *RepositoryRegistry) RegisterCommits(name, refName string, head *Commit) bool {
+	rr.lock.Lock()
+	defer rr.lock.Unlock()
+
+	repo := rr.find(name)
+	if repo == nil {
+		return false
+	}
+	repo.registerCommits(head, refName)
+	return true
+}
+
+// Names full names of registered repositories in alphabetical order
+func (rr *RepositoryRegistry) Names() []string {
+	rr.lock.RLock()
+	defer rr.lock.RUnlock()
+
+	names := make([]string, 0, len(rr.repos))
+	for _, repo := range rr.repos {
+		names = append(names, repo.FullName())
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (rr *RepositoryRegistry) find(name string) *Repository {
+	if strings.Contains(name, "/") {
+		return rr.repos[strings.ToLower(name)]
+	}
+
+	var found *Repository
+	for _, repo := range rr.repos {
+		if strings.EqualFold(repo.Name, name) {
+			if found != nil {
+				return nil
+			}
+			found = repo
+		}
+	}
+	return found
+}
+
+// snapshot copy of repository that can be read while the registry is modified
+func (r *Repository) snapshot() Repository {
+	s := *r
+	s.refs = make(map[string]*Reference, len(r.refs))
+	for name, ref := range r.refs {
+		s.refs[name] = ref
+	}
+	return s
+}
+
+// LoadRepositories registers repositories given as owner/repo together with the head commits of their
+// open pull requests, so that events referencing them can be handled before any push arrives.
+// All repositories are attempted; the first error is returned
+func (c *Client) LoadRepositories(names []string, log *logging.Logger) error {
+	var firstErr error
+	for _, name := range names {
+		err := c.loadRepository(name)
+		if err != nil {
+			log.Metadata(map[string]interface{}{"module": "ghclient", "repository": name, "error": err})
+			log.Warn("failed loading repository")
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		log.Metadata(map[string]interface{}{"module": "ghclient", "repository": name})
+		log.Debug("loaded repository")
+	}
+	return firstErr
+}
+
+// RefreshRepositories reloads repositories every interval until ctx is done
+func (c *Client) RefreshRepositories(ctx context.Context, names []string, interval time.Duration, log *logging.Logger) {
+	if interval <= 0 {
+		interval = DefaultRefreshInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			c.LoadRepositories(names, log)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (c *Client) loadRepository(fullName string) error {
+	items := strings.Split(fullName, "/")
+	if len(items) != 2 || items[0] == "" || items[1] == "" {
+		return repositoryError(fmt.Sprintf("'%s' is not in the form owner/repo", fullName))
+	}
+
+	repoJSON, err := c.Api.GetRepository(items[0], items[1])
+	if err != nil {
+		return err
+	}
+	repo, err := NewRepositoryFromJSON(repoJSON)
+	if err != nil {
+		return err
+	}
+	c.Repositories.Register(repo)
+
+	pullsJSON, err := c.Api.GetPullRequests(items[0], items[1])
+	if err != nil {
+		return err
+	}
+	pulls := []pullRequestData{}
+	err = json.Unmarshal(pullsJSON, &pulls)
+	if err != nil {
+		return repositoryError(fmt.Sprintf("failed parsing pull requests of %s: %s", fullName, err))
+	}
+
+	for _, pr := range pulls {
+		if pr.Head.Ref == "" || pr.Head.Sha == "" {
+			continue
+		}
+		refName := pullRequestRefName(pr.Number, pr.Head.Ref, isFork(pr.Head.Repo.FullName, *repo))
+		c.registerHead(repo.FullName(), refName, pr.Head.Sha)
+	}
+	return nil
+}
+
+// registerHead points refName at commit sha unless it already does
+func (c *Client) registerHead(repoName, refName, sha string) {
+	if ref, ok := c.Repositories.Reference(repoName, refName); ok && ref.GetHead() != nil && ref.GetHead().Sha == sha {
+		return
+	}
+	commit := c.Cache.GetCommit(sha)
+	if commit == nil {
+		commit = &Commit{Sha: sha}
+		c.Cache.WriteCommits(commit)
+	}
+	c.Repositories.RegisterCommits(repoName, refName, commit)
+}
+
+// pullRequestRefName reference name of the head of pull request number in the format of push events.
+// Branches of forks may share names with branches of the repository, so they are named after the pull request
+func pullRequestRefName(number int, branch string, fork bool) string {
+	if fork {
+		return "\"" + fmt.Sprintf("refs/pull/%d/head", number) + "\""
+	}
+	return "\"" + strings.Join([]string{"refs", "heads", branch}, "/") + "\""
+}
+
+// isFork whether headRepo, the full name of the repository a pull request was opened from, is a fork of repo
+func isFork(headRepo string, repo Repository) bool {
+	return headRepo != "" && !strings.EqualFold(headRepo, repo.FullName())
+}
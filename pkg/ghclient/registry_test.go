@@ -0,0 +1,123 @@
+package ghclient
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/pleimer/ci-server-go/pkg/assert"
+	"github.com/pleimer/ci-server-go/pkg/logging"
+)
+
+func TestLoadRepositories(t *testing.T) {
+	log, err := logging.NewLogger(logging.NONE, "console")
+	assert.Ok(t, err)
+
+	var lock sync.Mutex
+	heads := map[string]string{"feature": "s1", "other": "s2"}
+	pull := func(ref string) map[string]interface{} {
+		return map[string]interface{}{"head": map[string]string{"ref": ref, "sha": heads[ref]}}
+	}
+	client := NewTestClient(func(req *http.Request) *http.Response {
+		lock.Lock()
+		defer lock.Unlock()
+
+		header := make(http.Header)
+		var body interface{}
+		switch strings.TrimPrefix(req.URL.String(), "https://api.github.com/") {
+		case "repos/owner/example":
+			body = map[string]interface{}{"name": "example", "fork": false, "owner": map[string]string{"login": "owner"}}
+		case "repos/owner/example/pulls?state=open&per_page=100":
+			header.Set("Link", `<https://api.github.com/repositories/1/pulls?page=2>; rel="next", <https://api.github.com/repositories/1/pulls?page=2>; rel="last"`)
+			body = []interface{}{pull("feature")}
+		case "repositories/1/pulls?page=2":
+			body = []interface{}{pull("other")}
+		default:
+			return &http.Response{
+				StatusCode: 404,
+				Status:     "404 Not Found",
+				Body:       ioutil.NopCloser(strings.NewReader("not found")),
+				Header:     header,
+			}
+		}
+		respBody, err := json.Marshal(body)
+		assert.Ok(t, err)
+		return &http.Response{
+			StatusCode: 200,
+			Status:     "200 OK",
+			Body:       ioutil.NopCloser(bytes.NewReader(respBody)),
+			Header:     header,
+		}
+	})
+
+	gh := NewClient(nil, "testuser")
+	gh.Api.Client = client
+
+	err = gh.LoadRepositories([]string{"owner/example", "owner/missing", "invalid"}, log)
+	assert.Assert(t, err != nil, "should report repositories that failed to load")
+	assert.Equals(t, []string{"owner/example"}, gh.Repositories.Names())
+
+	head := func(refName string) string {
+		ref, ok := gh.Repositories.Reference("owner/example", `"refs/heads/`+refName+`"`)
+		assert.Assert(t, ok, "reference "+refName+" should be registered")
+		return ref.GetHead().Sha
+	}
+	assert.Equals(t, "s1", head("feature"))
+	assert.Equals(t, "s2", head("other"))
+
+	t.Run("refresh", func(t *testing.T) {
+		lock.Lock()
+		heads["feature"] = "s4"
+		lock.Unlock()
+
+		assert.Ok(t, gh.LoadRepositories([]string{"owner/example"}, log))
+		assert.Equals(t, "s4", head("feature"))
+		assert.Equals(t, "s2", head("other"))
+	})
+}
+
+func TestRepositoryRegistry(t *testing.T) {
+	rr := NewRepositoryRegistry()
+	for _, owner := range []string{"alice", "bob"} {
+		repo := &Repository{Name: "shared"}
+		repo.Owner.Login = owner
+		rr.Register(repo)
+	}
+	unique := &Repository{Name: "Unique"}
+	unique.Owner.Login = "alice"
+	rr.Register(unique)
+
+	_, ok := rr.Get("shared")
+	assert.Assert(t, !ok, "ambiguous bare name should not resolve")
+	repo, ok := rr.Get("Bob/Shared")
+	assert.Assert(t, ok, "full name should resolve case insensitively")
+	assert.Equals(t, "bob", repo.Owner.Login)
+	repo, ok = rr.Get("unique")
+	assert.Assert(t, ok, "unique bare name should resolve")
+	assert.Equals(t, "alice", repo.Owner.Login)
+
+	// concurrent pushes and lookups
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				refName := fmt.Sprintf(`"refs/heads/b%d"`, j%4)
+				rr.RegisterCommits("alice/shared", refName, &Commit{Sha: fmt.Sprintf("%d-%d", i, j)})
+				rr.Reference("alice/shared", refName)
+				rr.Get("alice/shared")
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	repo, _ = rr.Get("alice/shared")
+	assert.Equals(t, 4, len(repo.refs))
+	assert.Assert(t, !rr.RegisterCommits("carol/shared", `"refs/heads/b0"`, &Commit{}), "unknown repository should be rejected")
+}
@@ -0,0 +1,214 @@
+package ghclient
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"net/url"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// submodules nested deeper than this are not checked out, which also stops submodule cycles
+const maxSubmoduleDepth = 5
+
+// Submodule commit of another repository pinned in a tree
+type Submodule struct {
+	Sha  string `json:"sha"`
+	Path string `json:"path"`
+
+	parent Node
+}
+
+func (s *Submodule) GetParent() Node {
+	return s.parent
+}
+
+func (s *Submodule) GetChildren() []Node {
+	return nil
+}
+
+func (s *Submodule) GetPath() string {
+	return s.Path
+}
+
+func (s *Submodule) SetChild(child Node) {}
+
+func (s *Submodule) setParent(parent Node) {
+	s.parent = parent
+}
+
+// WriteTree writes tree to basePath like WriteTreeToDirectory, then checks out its submodules at their
+// pinned commits. Submodules must be hosted on the same github instance as repo
+func (c *Client) WriteTree(ctx context.Context, top *Tree, repo Repository, basePath string) error {
+	err := WriteTreeToDirectory(top, basePath)
+	if err != nil {
+		return err
+	}
+	workspace, err := treeWorkspace(top, basePath)
+	if err != nil {
+		return err
+	}
+	return c.checkoutSubmodules(ctx, top, repo, workspace, "", 0)
+}
+
+// checkoutSubmodules writes the submodules of tree, whose contents have been written to dir relative to base
+func (c *Client) checkoutSubmodules(ctx context.Context, tree *Tree, repo Repository, base, dir string, depth int) error {
+	submodules := map[string]*Submodule{}
+	collectSubmodules(tree, "", submodules)
+	if len(submodules) == 0 {
+		return nil
+	}
+	if depth >= maxSubmoduleDepth {
+		return c.err.withMessage(fmt.Sprintf("submodules of %s/%s nested too deeply", repo.Owner.Login, repo.Name))
+	}
+
+	urls, err := parseGitmodules(tree)
+	if err != nil {
+		return c.err.withMessage(fmt.Sprintf("failed parsing .gitmodules of %s/%s: %s", repo.Owner.Login, repo.Name, err))
+	}
+
+	paths := make([]string, 0, len(submodules))
+	for p := range submodules {
+		paths = append(paths, p)
+	}
+	sort.Strings(paths)
+
+	for _, p := range paths {
+		URL, ok := urls[p]
+		if !ok {
+			return c.err.withMessage(fmt.Sprintf("submodule '%s' has no url in .gitmodules", p))
+		}
+		subRepo, err := c.submoduleRepository(repo, URL)
+		if err != nil {
+			return c.err.withMessage(fmt.Sprintf("submodule '%s': %s", p, err))
+		}
+
+		subTree, err := c.GetTree(ctx, submodules[p].Sha, subRepo)
+		if err != nil {
+			return c.err.withMessage(fmt.Sprintf("failed to get submodule '%s': %s", p, err))
+		}
+
+		subDir := filepath.Join(dir, p)
+		err = writeChildren(subTree, base, subDir)
+		if err != nil {
+			return err
+		}
+		err = c.checkoutSubmodules(ctx, subTree, subRepo, base, subDir, depth+1)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// collectSubmodules indexes submodules of tree by path relative to the tree
+func collectSubmodules(node Node, dir string, submodules map[string]*Submodule) {
+	for _, child := range node.GetChildren() {
+		switch v := child.(type) {
+		case *Submodule:
+			submodules[path.Join(dir, v.Path)] = v
+		case *Tree:
+			collectSubmodules(v, path.Join(dir, v.Path), submodules)
+		}
+	}
+}
+
+// parseGitmodules retrieves the urls of submodules by path from the .gitmodules file at the root of tree
+func parseGitmodules(tree *Tree) (map[string]string, error) {
+	urls := map[string]string{}
+	var gitmodules *Blob
+	for _, child := range tree.GetChildren() {
+		if b, ok := child.(*Blob); ok && b.Path == ".gitmodules" {
+			gitmodules = b
+		}
+	}
+	if gitmodules == nil {
+		return urls, nil
+	}
+
+	content, err := base64.StdEncoding.DecodeString(gitmodules.Content)
+	if err != nil {
+		return nil, err
+	}
+
+	// values of the current [submodule "name"] section
+	var modulePath, moduleURL string
+	flush := func() {
+		if modulePath != "" && moduleURL != "" {
+			urls[path.Clean(modulePath)] = moduleURL
+		}
+		modulePath, moduleURL = "", ""
+	}
+
+	scanner := bufio.NewScanner(strings.NewReader(string(content)))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if strings.HasPrefix(line, "[") {
+			flush()
+			continue
+		}
+		kv := strings.SplitN(line, "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		switch strings.TrimSpace(kv[0]) {
+		case "path":
+			modulePath = strings.TrimSpace(kv[1])
+		case "url":
+			moduleURL = strings.TrimSpace(kv[1])
+		}
+	}
+	flush()
+	return urls, scanner.Err()
+}
+
+// submoduleRepository resolves submodule URL of parent, which may be relative to parent, to a repository
+// on the github instance of the api
+func (c *Client) submoduleRepository(parent Repository, URL string) (Repository, error) {
+	var fullName string
+	switch {
+	case strings.HasPrefix(URL, "./") || strings.HasPrefix(URL, "../"):
+		fullName = path.Join(parent.Owner.Login, parent.Name, URL)
+
+	case !strings.Contains(URL, "://") && strings.Contains(URL, ":"):
+		// scp-like syntax: git@host:owner/repo.git
+		hostPath := strings.SplitN(URL, ":", 2)
+		host := hostPath[0][strings.LastIndex(hostPath[0], "@")+1:]
+		if !c.isGithubHost(host) {
+			return Repository{}, fmt.Errorf("url '%s' is not hosted on %s", URL, c.Api.WebURL)
+		}
+		fullName = hostPath[1]
+
+	default:
+		u, err := url.Parse(URL)
+		if err != nil {
+			return Repository{}, err
+		}
+		if !c.isGithubHost(u.Hostname()) {
+			return Repository{}, fmt.Errorf("url '%s' is not hosted on %s", URL, c.Api.WebURL)
+		}
+		webPath := ""
+		if web, err := url.Parse(c.Api.WebURL); err == nil {
+			webPath = strings.TrimSuffix(web.Path, "/")
+		}
+		fullName = strings.TrimPrefix(u.Path, webPath)
+	}
+
+	items := strings.Split(strings.Trim(strings.TrimSuffix(fullName, ".git"), "/"), "/")
+	if len(items) != 2 || items[0] == "" || items[1] == "" || items[0] == ".." {
+		return Repository{}, fmt.Errorf("url '%s' does not point to a repository", URL)
+	}
+
+	repo := Repository{Name: items[1]}
+	repo.Owner.Login = items[0]
+	return repo, nil
+}
+
+func (c *Client) isGithubHost(host string) bool {
+	web, err := url.Parse(c.Api.WebURL)
+	return err == nil && strings.EqualFold(web.Hostname(), host)
+}
@@ -0,0 +1,153 @@
+package ghclient
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// DownloadTarball retrieves the archive of repository at sha in a single api call and
+// extracts it into dest. Any previous contents of dest are removed
+func (c *Client) DownloadTarball(ctx context.Context, sha string, repo Repository, dest string) error {
+	body, err := c.Api.WithContext(ctx).GetTarball(repo.Owner.Login, repo.Name, sha)
+	if err != nil {
+		return c.err.withMessage(fmt.Sprintf("failed to get tarball: %s", err))
+	}
+	defer body.Close()
+
+	err = os.RemoveAll(dest)
+	if err != nil {
+		return c.err.withMessage(fmt.Sprintf("failed to clean workspace: %s", err))
+	}
+
+	err = ExtractTarball(body, dest)
+	if err != nil {
+		return c.err.withMessage(fmt.Sprintf("failed to extract tarball: %s", err))
+	}
+	return nil
+}
+
+// ExtractTarball extracts gzipped tar archive into dest. Github archives nest the repository
+// contents under a single top level directory, which is stripped. Entries that would be written
+// outside of dest are rejected
+func ExtractTarball(r io.Reader, dest string) error {
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return err
+	}
+	defer gz.Close()
+
+	err = os.MkdirAll(dest, 0777)
+	if err != nil {
+		return err
+	}
+
+	tr := tar.NewReader(gz)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		// strip top level directory
+		components := strings.SplitN(strings.TrimPrefix(hdr.Name, "./"), "/", 2)
+		if len(components) < 2 || components[1] == "" {
+			continue
+		}
+
+		path, err := safeJoin(dest, components[1])
+		if err != nil {
+			return err
+		}
+
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			err = os.MkdirAll(path, 0777)
+		case tar.TypeReg, tar.TypeRegA:
+			err = writeFile(path, tr, os.FileMode(hdr.Mode).Perm())
+		case tar.TypeSymlink:
+			err = os.MkdirAll(filepath.Dir(path), 0777)
+			if err == nil {
+				err = removeEntry(path)
+			}
+			if err == nil {
+				err = os.Symlink(hdr.Linkname, path)
+			}
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// writeFile writes r to a new file at path, replacing an earlier entry of the archive. safeJoin only
+// checks the ancestors of path, so the file is created exclusively rather than opened, which would
+// follow a symbolic link written at path itself
+func writeFile(path string, r io.Reader, perm os.FileMode) error {
+	err := os.MkdirAll(filepath.Dir(path), 0777)
+	if err != nil {
+		return err
+	}
+	err = removeEntry(path)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, perm)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	_, err = io.Copy(f, r)
+	return err
+}
+
+// removeEntry removes the file or symbolic link at path, if any
+func removeEntry(path string) error {
+	err := os.Remove(path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// safeJoin joins name to base, rejecting names that escape base either lexically or
+// through a symbolic link written earlier
+func safeJoin(base, name string) (string, error) {
+	path := filepath.Join(base, name)
+	if !isWithin(base, path) || filepath.IsAbs(name) {
+		return "", fmt.Errorf("path '%s' escapes workspace", name)
+	}
+
+	realBase, err := filepath.EvalSymlinks(base)
+	if err != nil {
+		return "", err
+	}
+
+	// resolve the closest existing ancestor of path
+	for dir := filepath.Dir(path); isWithin(base, dir); dir = filepath.Dir(dir) {
+		resolved, err := filepath.EvalSymlinks(dir)
+		if err != nil {
+			continue
+		}
+		if !isWithin(realBase, resolved) {
+			return "", fmt.Errorf("path '%s' escapes workspace through symbolic link", name)
+		}
+		break
+	}
+	return path, nil
+}
+
+func isWithin(base, path string) bool {
+	rel, err := filepath.Rel(base, path)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
@@ -0,0 +1,172 @@
+package ghclient
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/pleimer/ci-server-go/pkg/assert"
+)
+
+type tarEntry struct {
+	name     string
+	typeflag byte
+	mode     int64
+	content  string
+	linkname string
+}
+
+func genTarball(t *testing.T, entries []tarEntry) []byte {
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gz)
+	for _, e := range entries {
+		hdr := &tar.Header{
+			Name:     e.name,
+			Typeflag: e.typeflag,
+			Mode:     e.mode,
+			Size:     int64(len(e.content)),
+			Linkname: e.linkname,
+		}
+		if e.typeflag != tar.TypeReg {
+			hdr.Size = 0
+		}
+		assert.Ok(t, tw.WriteHeader(hdr))
+		if e.typeflag == tar.TypeReg {
+			_, err := tw.Write([]byte(e.content))
+			assert.Ok(t, err)
+		}
+	}
+	assert.Ok(t, tw.Close())
+	assert.Ok(t, gz.Close())
+	return buf.Bytes()
+}
+
+func TestExtractTarball(t *testing.T) {
+	t.Run("repository contents", func(t *testing.T) {
+		dest, err := ioutil.TempDir("", "tarball")
+		assert.Ok(t, err)
+		defer os.RemoveAll(dest)
+
+		archive := genTarball(t, []tarEntry{
+			{name: "owner-example-t0/", typeflag: tar.TypeDir, mode: 0755},
+			{name: "owner-example-t0/ci.yml", typeflag: tar.TypeReg, mode: 0644, content: "script: []"},
+			{name: "owner-example-t0/scripts/", typeflag: tar.TypeDir, mode: 0755},
+			{name: "owner-example-t0/scripts/run", typeflag: tar.TypeReg, mode: 0755, content: "exit 0"},
+			{name: "owner-example-t0/link", typeflag: tar.TypeSymlink, linkname: "scripts/run"},
+		})
+
+		err = ExtractTarball(bytes.NewReader(archive), dest)
+		assert.Ok(t, err)
+
+		content, err := ioutil.ReadFile(filepath.Join(dest, "ci.yml"))
+		assert.Ok(t, err)
+		assert.Equals(t, "script: []", string(content))
+
+		info, err := os.Stat(filepath.Join(dest, "scripts", "run"))
+		assert.Ok(t, err)
+		assert.Equals(t, os.FileMode(0755), info.Mode().Perm())
+
+		target, err := os.Readlink(filepath.Join(dest, "link"))
+		assert.Ok(t, err)
+		assert.Equals(t, "scripts/run", target)
+	})
+
+	t.Run("path traversal", func(t *testing.T) {
+		dest, err := ioutil.TempDir("", "tarball")
+		assert.Ok(t, err)
+		defer os.RemoveAll(dest)
+
+		archive := genTarball(t, []tarEntry{
+			{name: "owner-example-t0/../../evil", typeflag: tar.TypeReg, mode: 0644, content: "evil"},
+		})
+		err = ExtractTarball(bytes.NewReader(archive), dest)
+		assert.Assert(t, (err != nil), "should have been an error")
+	})
+
+	t.Run("write through symbolic link", func(t *testing.T) {
+		dest, err := ioutil.TempDir("", "tarball")
+		assert.Ok(t, err)
+		defer os.RemoveAll(dest)
+
+		archive := genTarball(t, []tarEntry{
+			{name: "owner-example-t0/link", typeflag: tar.TypeSymlink, linkname: "/tmp"},
+			{name: "owner-example-t0/link/evil", typeflag: tar.TypeReg, mode: 0644, content: "evil"},
+		})
+		err = ExtractTarball(bytes.NewReader(archive), dest)
+		assert.Assert(t, (err != nil), "should have been an error")
+	})
+
+	t.Run("file written over symbolic link", func(t *testing.T) {
+		dest, err := ioutil.TempDir("", "tarball")
+		assert.Ok(t, err)
+		defer os.RemoveAll(dest)
+		outside, err := ioutil.TempDir("", "outside")
+		assert.Ok(t, err)
+		defer os.RemoveAll(outside)
+		target := filepath.Join(outside, "target")
+		assert.Ok(t, ioutil.WriteFile(target, []byte("untouched"), 0644))
+
+		archive := genTarball(t, []tarEntry{
+			{name: "owner-example-t0/file", typeflag: tar.TypeSymlink, linkname: target},
+			{name: "owner-example-t0/file", typeflag: tar.TypeReg, mode: 0644, content: "evil"},
+		})
+		assert.Ok(t, ExtractTarball(bytes.NewReader(archive), dest))
+
+		content, err := ioutil.ReadFile(target)
+		assert.Ok(t, err)
+		assert.Equals(t, "untouched", string(content))
+		info, err := os.Lstat(filepath.Join(dest, "file"))
+		assert.Ok(t, err)
+		assert.Assert(t, info.Mode().IsRegular(), "symbolic link should have been replaced by the file")
+	})
+}
+
+func TestDownloadTarball(t *testing.T) {
+	archive := genTarball(t, []tarEntry{
+		{name: "owner-example-t0/ci.yml", typeflag: tar.TypeReg, mode: 0644, content: "script: []"},
+	})
+
+	client := NewTestClient(func(req *http.Request) *http.Response {
+		assert.Equals(t, "https://api.github.com/repos/owner/example/tarball/t0", req.URL.String())
+		return &http.Response{
+			StatusCode: 200,
+			Status:     "200 OK",
+			Body:       ioutil.NopCloser(bytes.NewReader(archive)),
+			Header:     make(http.Header),
+		}
+	})
+
+	repo := Repository{
+		Name: "example",
+		Owner: struct {
+			Login string `json:"login"`
+		}{
+			Login: "owner",
+		},
+	}
+
+	api := NewAPI()
+	api.Client = client
+
+	gh := Client{
+		Api:   api,
+		Cache: NewCache(),
+	}
+
+	dest, err := ioutil.TempDir("", "tarball")
+	assert.Ok(t, err)
+	defer os.RemoveAll(dest)
+
+	err = gh.DownloadTarball(context.Background(), "t0", repo, filepath.Join(dest, "t0"))
+	assert.Ok(t, err)
+
+	_, err = os.Stat(filepath.Join(dest, "t0", "ci.yml"))
+	assert.Ok(t, err)
+}
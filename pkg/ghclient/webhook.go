@@ -0,0 +1,120 @@
+package ghclient
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"hash"
+	"net/http"
+	"strings"
+)
+
+var (
+	//ErrMissingSignature occurs when a delivery arrives without a signature header
+	ErrMissingSignature error = errors.New("delivery is not signed")
+
+	//ErrNoSecret occurs when a delivery targets a repository without a secret while other secrets are configured
+	ErrNoSecret error = errors.New("no webhook secret configured for repository")
+
+	//ErrSignatureMismatch occurs when a delivery signature does not match its payload
+	ErrSignatureMismatch error = errors.New("signature does not match payload")
+
+	//ErrDeliveryNotFound occurs when replaying a delivery that is not in the journal
+	ErrDeliveryNotFound error = errors.New("delivery not found in journal")
+
+	//ErrDraining occurs when a delivery arrives while the server is draining
+	ErrDraining error = errors.New("server is draining")
+)
+
+// WebhookSecrets resolves the secret github uses to sign deliveries for a repository.
+// Repository specific secrets take precedence over the default secret
+type WebhookSecrets struct {
+	Default      string
+	Repositories map[string]string // keyed by owner/repo
+}
+
+// Get retrieve secret for repository fullName (owner/repo). Falls back to
+// the default secret
+func (ws WebhookSecrets) Get(fullName string) string {
+	for name, secret := range ws.Repositories {
+		if strings.EqualFold(name, fullName) {
+			return secret
+		}
+	}
+	return ws.Default
+}
+
+// Enabled returns true if any secret has been configured
+func (ws WebhookSecrets) Enabled() bool {
+	return ws.Default != "" || len(ws.Repositories) > 0
+}
+
+// VerifySignature checks the X-Hub-Signature-256 header, or the legacy X-Hub-Signature
+// header if the former is not present, against the HMAC of body. An empty secret verifies nothing
+func VerifySignature(secret string, header http.Header, body []byte) error {
+	if secret == "" {
+		// anyone can sign with an empty key
+		return ErrNoSecret
+	}
+	if sig := header.Get("X-Hub-Signature-256"); sig != "" {
+		return compareSignature(sha256.New, "sha256=", secret, sig, body)
+	}
+	if sig := header.Get("X-Hub-Signature"); sig != "" {
+		return compareSignature(sha1.New, "sha1=", secret, sig, body)
+	}
+	return ErrMissingSignature
+}
+
+func compareSignature(hashFn func() hash.Hash, prefix, secret, signature string, body []byte) error {
+	if !strings.HasPrefix(signature, prefix) {
+		return ErrSignatureMismatch
+	}
+	received, err := hex.DecodeString(strings.TrimPrefix(signature, prefix))
+	if err != nil {
+		return ErrSignatureMismatch
+	}
+
+	mac := hmac.New(hashFn, []byte(secret))
+	mac.Write(body)
+	if !hmac.Equal(received, mac.Sum(nil)) {
+		return ErrSignatureMismatch
+	}
+	return nil
+}
+
+// payloadRepository retrieves the full name of the repository a delivery targets
+func payloadRepository(body []byte) string {
+	payload := struct {
+		Repository struct {
+			FullName string `json:"full_name"`
+			Name     string `json:"name"`
+			Owner    struct {
+				Login string `json:"login"`
+			} `json:"owner"`
+		} `json:"repository"`
+	}{}
+	if err := json.Unmarshal(body, &payload); err != nil {
+		return ""
+	}
+	if payload.Repository.FullName != "" {
+		return payload.Repository.FullName
+	}
+	return strings.Join([]string{payload.Repository.Owner.Login, payload.Repository.Name}, "/")
+}
+
+// payloadInstallation retrieves the ID of the github app installation a delivery was sent for.
+// Returns 0 for deliveries of repository webhooks
+func payloadInstallation(body []byte) int64 {
+	payload := struct {
+		Installation struct {
+			ID int64 `json:"id"`
+		} `json:"installation"`
+	}{}
+	if err := json.Unmarshal(body, &payload); err != nil {
+		return 0
+	}
+	return payload.Installation.ID
+}
@@ -0,0 +1,126 @@
+package job
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// Permission who may use a comment command
+type Permission int
+
+// permission levels of comment commands
+const (
+	PermissionAnyone     Permission = iota
+	PermissionAuthor                // author of the pull request and authorized users
+	PermissionAuthorized            // users listed in runner.authorizedUsers
+)
+
+func (p Permission) String() string {
+	return [...]string{"anyone", "pull request author", "authorized users"}[p]
+}
+
+// Command comment command in the form /name [argument...] [key=value...]
+type Command struct {
+	Name    string
+	Args    []string
+	Options map[string]string
+}
+
+// CommandSpec definition of a comment command
+type CommandSpec struct {
+	Name        string
+	Usage       string // arguments shown in help, e.g. [sha]
+	Description string
+	Permission  Permission
+	Options     map[string]string // accepted key=value options and their descriptions
+
+	// Replaces is set for commands that replace jobs running for the pull request, as the
+	// concurrency policy of the repository allows
+	Replaces bool
+
+	// Cancels is set for commands that cancel all jobs of the pull request, whatever the concurrency policy
+	Cancels bool
+
+	// Handle applies the command to the comment job during setup, with the context of the setup. Errors
+	// are replied on the pull request
+	Handle func(cj *CommentJob, ctx context.Context, cmd Command) error
+}
+
+var commandName = regexp.MustCompile(`^/[A-Za-z][A-Za-z0-9-]*$`)
+
+var commands = map[string]*CommandSpec{}
+
+// RegisterCommand makes command available in pull request comments, replacing any command of the same name
+func RegisterCommand(spec *CommandSpec) {
+	commands[spec.Name] = spec
+}
+
+// ParseCommands retrieves the commands of a comment. Each command is on its own line
+func ParseCommands(body string) []Command {
+	cmds := []Command{}
+	for _, line := range strings.Split(body, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 || !commandName.MatchString(fields[0]) {
+			continue
+		}
+
+		cmd := Command{
+			Name:    strings.ToLower(strings.TrimPrefix(fields[0], "/")),
+			Options: make(map[string]string),
+		}
+		for _, field := range fields[1:] {
+			kv := strings.SplitN(field, "=", 2)
+			if len(kv) == 2 && kv[0] != "" {
+				cmd.Options[strings.ToLower(kv[0])] = kv[1]
+				continue
+			}
+			cmd.Args = append(cmd.Args, field)
+		}
+		cmds = append(cmds, cmd)
+	}
+	return cmds
+}
+
+// validate checks that cmd only sets options accepted by spec
+func (spec *CommandSpec) validate(cmd Command) error {
+	for key := range cmd.Options {
+		if _, ok := spec.Options[key]; !ok {
+			return fmt.Errorf("unknown option `%s`, see `/help`", key)
+		}
+	}
+	return nil
+}
+
+// helpText markdown table of the registered commands
+func helpText() string {
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var sb strings.Builder
+	sb.WriteString("Available commands, one per line:\n\nCommand | Description | Allowed for\n-|-|-\n")
+	for _, name := range names {
+		spec := commands[name]
+		usage := "/" + spec.Name
+		if spec.Usage != "" {
+			usage += " " + spec.Usage
+		}
+		options := make([]string, 0, len(spec.Options))
+		for key := range spec.Options {
+			options = append(options, key)
+		}
+		sort.Strings(options)
+		description := spec.Description
+		for _, key := range options {
+			usage += fmt.Sprintf(" [%s=...]", key)
+			description += fmt.Sprintf("<br>`%s`: %s", key, spec.Options[key])
+		}
+		sb.WriteString(fmt.Sprintf("`%s` | %s | %s\n", usage, description, spec.Permission))
+	}
+	return sb.String()
+}
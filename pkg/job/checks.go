@@ -0,0 +1,87 @@
+package job
+
+import (
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/pleimer/ci-server-go/pkg/ghclient"
+)
+
+// matches compiler and linter style messages such as 'pkg/file.go:12:5: message'
+var annotationRegex = regexp.MustCompile(`^\s*([^\s:]+):(\d+)(?::\d+)?:\s*(.+)$`)
+
+// checkOutput builds check run output from the markdown report written so far
+func (cj *coreJob) checkOutput() *ghclient.CheckOutput {
+	report := cj.summary.String()
+	return &ghclient.CheckOutput{
+		Title:       cj.commit.Status.Description,
+		Summary:     truncateSummary(report, ghclient.MaxCheckSummary),
+		Annotations: parseAnnotations(report, cj.BasePath, ghclient.MaxCheckAnnotations),
+	}
+}
+
+// truncateSummary keeps the end of the report, where failures are usually found. The report is cut
+// on a rune boundary, so that the result is at most max bytes of valid UTF-8
+func truncateSummary(report string, max int) string {
+	if len(report) <= max {
+		return report
+	}
+	notice := "*report truncated, see details for full output*\n\n"
+	start := len(report) - max + len(notice)
+	for start < len(report) && !utf8.RuneStart(report[start]) {
+		start++
+	}
+	return notice + report[start:]
+}
+
+// parseAnnotations finds lines in script output that refer to a line in a file of the workspace
+func parseAnnotations(output string, workspace string, max int) []ghclient.Annotation {
+	annotations := []ghclient.Annotation{}
+	for _, line := range strings.Split(output, "\n") {
+		if len(annotations) == max {
+			break
+		}
+
+		match := annotationRegex.FindStringSubmatch(line)
+		if match == nil {
+			continue
+		}
+
+		path := filepath.ToSlash(filepath.Clean(strings.TrimPrefix(match[1], "./")))
+		if strings.HasPrefix(path, "..") || filepath.IsAbs(path) {
+			continue
+		}
+		if info, err := os.Stat(filepath.Join(workspace, path)); err != nil || info.IsDir() {
+			continue
+		}
+
+		lineNum, err := strconv.Atoi(match[2])
+		if err != nil || lineNum < 1 {
+			continue
+		}
+
+		annotations = append(annotations, ghclient.Annotation{
+			Path:            path,
+			StartLine:       lineNum,
+			EndLine:         lineNum,
+			AnnotationLevel: annotationLevel(match[3]),
+			Message:         match[3],
+		})
+	}
+	return annotations
+}
+
+func annotationLevel(message string) string {
+	lower := strings.ToLower(message)
+	switch {
+	case strings.Contains(lower, "warn"):
+		return "warning"
+	case strings.Contains(lower, "error"), strings.Contains(lower, "fail"):
+		return "failure"
+	}
+	return "notice"
+}
@@ -0,0 +1,57 @@
+package job
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"unicode/utf8"
+
+	"github.com/pleimer/ci-server-go/pkg/assert"
+	"github.com/pleimer/ci-server-go/pkg/ghclient"
+)
+
+func TestParseAnnotations(t *testing.T) {
+	workspace, err := ioutil.TempDir("", "annotations")
+	assert.Ok(t, err)
+	defer os.RemoveAll(workspace)
+
+	assert.Ok(t, os.MkdirAll(filepath.Join(workspace, "pkg"), 0777))
+	assert.Ok(t, ioutil.WriteFile(filepath.Join(workspace, "pkg", "main.go"), []byte("package main"), 0644))
+
+	output := strings.Join([]string{
+		"## Main Script",
+		"```",
+		"./pkg/main.go:12:5: undefined: foo",
+		"pkg/main.go:3: warning: unused variable",
+		"pkg/missing.go:1: error: not part of the workspace",
+		"../outside.go:1: error: outside of the workspace",
+		"starting server on localhost:8080",
+		"```",
+	}, "\n")
+
+	annotations := parseAnnotations(output, workspace, ghclient.MaxCheckAnnotations)
+	assert.Equals(t, []ghclient.Annotation{
+		{Path: "pkg/main.go", StartLine: 12, EndLine: 12, AnnotationLevel: "notice", Message: "undefined: foo"},
+		{Path: "pkg/main.go", StartLine: 3, EndLine: 3, AnnotationLevel: "warning", Message: "warning: unused variable"},
+	}, annotations)
+
+	assert.Equals(t, 1, len(parseAnnotations(output, workspace, 1)))
+}
+
+func TestTruncateSummary(t *testing.T) {
+	assert.Equals(t, "short", truncateSummary("short", 100))
+
+	long := strings.Repeat("a", 200) + "the end"
+	truncated := truncateSummary(long, 100)
+	assert.Equals(t, 100, len(truncated))
+	assert.Assert(t, strings.HasSuffix(truncated, "the end"), "should keep the end of the report")
+
+	multibyte := strings.Repeat("é", 100) + "the end"
+	for max := 90; max < 94; max++ {
+		truncated := truncateSummary(multibyte, max)
+		assert.Assert(t, utf8.ValidString(truncated), "should cut on a rune boundary")
+		assert.Assert(t, len(truncated) <= max, "should not exceed the limit")
+	}
+}
@@ -0,0 +1,247 @@
+package job
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/pleimer/ci-server-go/pkg/assert"
+	"github.com/pleimer/ci-server-go/pkg/ghclient"
+)
+
+func TestCommentJobSetup(t *testing.T) {
+	_, github, repo, _, commit, log, _ := genTestEnvironment([]string{"echo $OCP_PROJECT"}, []string{"echo Done"})
+
+	github.User = "ci-bot"
+
+	replies := []string{}
+	github.Api.Client = ghclient.NewTestClient(func(req *http.Request) *http.Response {
+		path := strings.TrimPrefix(req.URL.String(), "https://api.github.com/repos/owner/example/")
+		respond := func(code int, body string) *http.Response {
+			return &http.Response{
+				StatusCode: code,
+				Status:     http.StatusText(code),
+				Body:       ioutil.NopCloser(strings.NewReader(body)),
+				Header:     make(http.Header),
+			}
+		}
+
+		switch {
+		case path == "pulls/1/commits?per_page=100":
+			return respond(200, `[{"sha": "aaaa1111"}, {"sha": "bbbb2222"}, {"sha": "bbbb3333"}]`)
+		case path == "commits/bbbb2222":
+			return respond(200, `{"sha": "bbbb2222", "commit": {"message": "older commit"}}`)
+		case path == "commits/bbbb2222/status":
+			return respond(200, `{"statuses": []}`)
+		case path == "issues/1/comments":
+			comment := map[string]string{}
+			assert.Ok(t, json.NewDecoder(req.Body).Decode(&comment))
+			replies = append(replies, comment["body"])
+			return respond(201, `{}`)
+		case strings.HasPrefix(path, "statuses/"):
+			return respond(201, `{}`)
+		}
+		return respond(404, "not found")
+	})
+
+	tests := []struct {
+		name     string
+		body     string
+		user     string
+		state    string
+		execute  bool
+		replaces bool
+		sha      string
+		reply    string
+	}{
+		{"head", "/runtest\n", "testuser", "", true, true, "t0", ""},
+		{"trailing words", "/runtest please", "testuser", "", true, true, "t0", ""},
+		{"sha prefix", "/runtest bbbb2222", "testuser", "", true, true, "bbbb2222", ""},
+		{"short sha prefix", "please test\n/RUNTEST BBBB2", "testuser", "", true, true, "bbbb2222", ""},
+		{"command within text", "please /runtest", "testuser", "", false, false, "t0", ""},
+		{"sha not in branch", "/runtest cccc", "testuser", "", false, true, "t0", "not part of this pull request"},
+		{"ambiguous sha", "/runtest bbbb", "testuser", "", false, true, "t0", "more than one commit"},
+		{"unauthorized", "/runtest bbbb2222", "stranger", "", false, false, "t0", "can only be used by authorized users"},
+		{"no trigger", "looks good", "testuser", "", false, false, "t0", ""},
+		{"options", "/runtest timeout=900 stage=e2e", "testuser", "", true, true, "t0", ""},
+		{"invalid timeout", "/runtest timeout=soon", "testuser", "", false, true, "t0", "positive number of seconds"},
+		{"unknown option", "/runtest retries=3", "testuser", "", false, true, "t0", "unknown option `retries`"},
+		{"unknown command", "/deploy", "testuser", "", false, false, "t0", "unknown command `/deploy`"},
+		{"unknown command by stranger", "/deploy", "stranger", "", false, false, "t0", ""},
+		{"help", "/help", "stranger", "", false, false, "t0", "`/runtest [sha] [stage=...] [timeout=...]`"},
+		{"retest failed", "/retest-failed", "testuser", "failure", true, true, "t0", ""},
+		{"retest passed", "/retest-failed", "testuser", "success", false, true, "t0", "did not fail"},
+		{"cancel by author", "/cancel", "author", "", false, true, "t0", ""},
+		{"cancel by stranger", "/cancel", "stranger", "", false, false, "t0", "can only be used by pull request author"},
+		{"skip", "/runtest\n/skip", "testuser", "", false, true, "t0", ""},
+		{"own comment", "/runtest", "ci-bot", "", false, false, "t0", ""},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			replies = replies[:0]
+			ev := &ghclient.Comment{
+				Repo:    *repo,
+				Commit:  commit,
+				Number:  1,
+				Action:  ghclient.CommentCreated,
+				RefName: `"refs/heads/feature"`,
+				Body:    test.body,
+				User:    test.user,
+				Author:  "author",
+			}
+			ev.Commit.Status.State = test.state
+			cj := CommentJob{
+				event:  ev,
+				client: github,
+				Log:    log,
+			}
+
+			assert.Equals(t, test.replaces, Replaces(&cj, []string{"testuser"}))
+			cj.Setup(context.Background(), []string{"testuser"})
+			assert.Equals(t, test.execute, cj.execute)
+			assert.Equals(t, test.sha, cj.event.Commit.Sha)
+			if test.reply == "" {
+				assert.Equals(t, 0, len(replies))
+				return
+			}
+			assert.Equals(t, 1, len(replies))
+			assert.Assert(t, strings.Contains(replies[0], test.reply), "unexpected reply: "+replies[0])
+		})
+	}
+
+	t.Run("run options", func(t *testing.T) {
+		cj := CommentJob{
+			event:  &ghclient.Comment{Repo: *repo, Commit: commit, Number: 1, Action: ghclient.CommentCreated, Body: "/runtest timeout=900 stage=e2e", User: "testuser"},
+			client: github,
+			Log:    log,
+		}
+		cj.Setup(context.Background(), []string{"testuser"})
+		assert.Equals(t, RunOptions{
+			Timeout:     900,
+			Env:         map[string]string{"CI_STAGE": "e2e"},
+			PullRequest: 1,
+			Trigger:     "`/runtest` by @testuser",
+		}, cj.options)
+	})
+
+	t.Run("head resolved", func(t *testing.T) {
+		cj := CommentJob{
+			event:  &ghclient.Comment{Repo: *repo, Head: "bbbb2222", Number: 1, Action: ghclient.CommentCreated, Body: "/runtest", User: "testuser"},
+			client: github,
+			Log:    log,
+		}
+		cj.Setup(context.Background(), []string{"testuser"})
+		assert.Assert(t, cj.execute, "comment should run")
+		assert.Equals(t, "bbbb2222", cj.event.Commit.Sha)
+		assert.Equals(t, "older commit", cj.event.Commit.Message)
+	})
+
+	t.Run("unknown head", func(t *testing.T) {
+		cj := CommentJob{
+			event:  &ghclient.Comment{Repo: *repo, Head: "cccc3333", Number: 1, Action: ghclient.CommentCreated, Body: "/runtest", User: "testuser"},
+			client: github,
+			Log:    log,
+		}
+		cj.Setup(context.Background(), []string{"testuser"})
+		assert.Assert(t, !cj.execute, "comment without head commit should not run")
+	})
+
+	for _, action := range []string{"edited", "deleted"} {
+		t.Run(action+" comment", func(t *testing.T) {
+			replies = replies[:0]
+			cj := CommentJob{
+				event:  &ghclient.Comment{Repo: *repo, Commit: commit, Number: 1, Action: action, Body: "/runtest\n/skip\n/help", User: "testuser"},
+				client: github,
+				Log:    log,
+			}
+			assert.Assert(t, !Replaces(&cj, []string{"testuser"}), "edited or deleted comment should not replace running jobs")
+			assert.Assert(t, !Cancels(&cj, []string{"testuser"}), "edited or deleted comment should not cancel running jobs")
+			cj.Setup(context.Background(), []string{"testuser"})
+			assert.Assert(t, !cj.execute, "edited or deleted comment should not run")
+			assert.Equals(t, 0, len(replies))
+		})
+	}
+}
+
+func TestCommentJobFeedback(t *testing.T) {
+	_, github, repo, _, commit, log, _ := genTestEnvironment([]string{"echo $OCP_PROJECT"}, []string{"echo Done"})
+	github.User = "ci-bot"
+
+	reactions := []string{}
+	github.Api.Client = ghclient.NewTestClient(func(req *http.Request) *http.Response {
+		path := strings.TrimPrefix(req.URL.String(), "https://api.github.com/repos/owner/example/")
+		respond := func(code int, body string) *http.Response {
+			return &http.Response{
+				StatusCode: code,
+				Status:     http.StatusText(code),
+				Body:       ioutil.NopCloser(strings.NewReader(body)),
+				Header:     make(http.Header),
+			}
+		}
+
+		switch {
+		case req.Method == "POST" && path == "issues/comments/7/reactions":
+			reaction := map[string]string{}
+			assert.Ok(t, json.NewDecoder(req.Body).Decode(&reaction))
+			reactions = append(reactions, reaction["content"])
+			return respond(201, `{"id": 3}`)
+		case req.Method == "DELETE" && path == "issues/comments/7/reactions/3":
+			reactions = append(reactions, "-"+ghclient.ReactionEyes)
+			return respond(204, "")
+		}
+		return respond(404, "not found")
+	})
+
+	newJob := func(body, state string) *CommentJob {
+		reactions = reactions[:0]
+		ev := &ghclient.Comment{Repo: *repo, Commit: commit, ID: 7, Number: 1, Action: ghclient.CommentCreated, Body: body, User: "testuser"}
+		ev.Commit.Status.State = state
+		return &CommentJob{event: ev, client: github, Log: log}
+	}
+
+	t.Run("command succeeded", func(t *testing.T) {
+		cj := newJob("/retest-failed", "failure")
+		cj.Setup(context.Background(), []string{"testuser"})
+		assert.Equals(t, []string{ghclient.ReactionEyes}, reactions)
+
+		cj.conclude(true)
+		assert.Equals(t, []string{ghclient.ReactionEyes, "-" + ghclient.ReactionEyes, ghclient.ReactionThumbsUp}, reactions)
+	})
+
+	t.Run("command failed", func(t *testing.T) {
+		cj := newJob("/retest-failed", "success")
+		cj.Setup(context.Background(), []string{"testuser"})
+		assert.Equals(t, []string{ghclient.ReactionEyes, "-" + ghclient.ReactionEyes, ghclient.ReactionThumbsDown}, reactions)
+	})
+
+	t.Run("not accepted", func(t *testing.T) {
+		cj := newJob("looks good", "")
+		cj.Setup(context.Background(), []string{"testuser"})
+		assert.Equals(t, 0, len(reactions))
+	})
+}
+
+func TestCommentJobCancels(t *testing.T) {
+	for body, expected := range map[string]map[string]bool{
+		"/cancel":  {"author": true, "testuser": true, "stranger": false},
+		"/skip":    {"author": false, "testuser": true},
+		"/runtest": {"testuser": false},
+	} {
+		for user, cancels := range expected {
+			cj := CommentJob{event: &ghclient.Comment{Action: ghclient.CommentCreated, Body: body, User: user, Author: "author"}}
+			assert.Equals(t, cancels, Cancels(&cj, []string{"testuser"}))
+		}
+	}
+}
+
+func TestParseCommands(t *testing.T) {
+	cmds := ParseCommands("thanks!\n/runtest abc123 timeout=900 Stage=e2e\n> /cancel quoted\n  /help\n/usr/bin/true")
+	assert.Equals(t, []Command{
+		{Name: "runtest", Args: []string{"abc123"}, Options: map[string]string{"timeout": "900", "stage": "e2e"}},
+		{Name: "help", Options: map[string]string{}},
+	}, cmds)
+}
@@ -3,29 +3,85 @@ package job
 import (
 	"context"
 	"fmt"
-	"strings"
+	"regexp"
+	"strconv"
 
-	"github.com/golang-collections/go-datastructures/queue"
+	"github.com/pleimer/ci-server-go/pkg/config"
 	"github.com/pleimer/ci-server-go/pkg/ghclient"
 	"github.com/pleimer/ci-server-go/pkg/logging"
 )
 
+// commit sha prefixes accepted as argument of /runtest
+var shaPrefix = regexp.MustCompile(`^[0-9a-fA-F]{4,40}$`)
+
+func init() {
+	RegisterCommand(&CommandSpec{
+		Name:        "runtest",
+		Usage:       "[sha]",
+		Description: "run the tests on the head of the branch, or on the commit of the branch starting with sha",
+		Permission:  PermissionAuthorized,
+		Options: map[string]string{
+			"timeout": "timeout of the scripts in seconds, overriding ci.yml",
+			"stage":   "exported to the scripts as CI_STAGE",
+		},
+		Replaces: true,
+		Handle:   (*CommentJob).runTest,
+	})
+	RegisterCommand(&CommandSpec{
+		Name:        "retest-failed",
+		Description: "run the tests on the head of the branch if its last run failed",
+		Permission:  PermissionAuthorized,
+		Replaces:    true,
+		Handle:      (*CommentJob).retestFailed,
+	})
+	RegisterCommand(&CommandSpec{
+		Name:        "cancel",
+		Description: "cancel the jobs running or waiting for the pull request",
+		Permission:  PermissionAuthor,
+		Replaces:    true,
+		Cancels:     true,
+		Handle:      (*CommentJob).cancel,
+	})
+	RegisterCommand(&CommandSpec{
+		Name:        "skip",
+		Description: "mark the head of the branch as passing without running the tests",
+		Permission:  PermissionAuthorized,
+		Replaces:    true,
+		Cancels:     true,
+		Handle:      (*CommentJob).skip,
+	})
+	RegisterCommand(&CommandSpec{
+		Name:        "help",
+		Description: "list the available commands",
+		Permission:  PermissionAnyone,
+		Handle:      (*CommentJob).help,
+	})
+}
+
 // CommentJob works on a comment webhook event.
 type CommentJob struct {
-	// This job runs a regular core job when it descovers the _trigger keyword in a comment message.
-	// Any trailing character sequence after the _trigger keyword will be treated as a commit sha
-	// on which to run the new core job sequence. This sha must be contained in the current branch
-	// of the PR request on which the comment is made.
+	// This job executes the commands found in a comment message, one per line, in the form
+	// /command [argument...] [key=value...]. Commands are registered with RegisterCommand, and each
+	// command requires its own permission level. Unknown commands are answered with the list of commands.
+
+	// /runtest runs a regular core job on the head of the branch. A hexadecimal character sequence
+	// following it will be treated as a commit sha prefix on which to run the new core job sequence
+	// instead. This sha must be contained in the current branch of the PR request on which the comment
+	// is made, otherwise the job replies on the PR and does not run.
 
-	// A message containing only the _trigger keyword, or a subsequent character sequence that does
-	// not match any of the commits contained within the branch, will trigger a core job sequence
-	// on the commit at the head of the branch
+	// Only newly created comments are handled, so that editing or deleting a comment does not run its
+	// commands again.
 
 	Log    *logging.Logger
 	client *ghclient.Client
+	config *config.Config
 	event  *ghclient.Comment
 
-	execute bool
+	commands []Command
+	options  RunOptions
+	execute  bool
+	failed   bool  // a command of the comment failed
+	reaction int64 // ID of the reaction acknowledging the comment
 }
 
 //SetLogger implements Job interface
@@ -33,47 +89,281 @@ func (cj *CommentJob) SetLogger(l *logging.Logger) {
 	cj.Log = l
 }
 
-// Setup posts a comment about queing the job
+// Setup executes the commands of the comment and posts a status about queing the job
 func (cj *CommentJob) Setup(ctx context.Context, authUsers []string) {
-	commit := cj.event.Ref.GetHead()
-	commit.SetContext("ci-server-go")
-
 	cj.Log.Metadata(map[string]interface{}{"process": "CommentJob"})
 	cj.Log.Info(fmt.Sprintf("received comment: %s", cj.event.Body))
 
-	//parse message body
-	tokens := strings.Split(cj.event.Body, " ")
-	if sliceContainsString(tokens, "/runtest") {
-		if sliceContainsString(authUsers, cj.event.User) {
-			cj.Log.Metadata(map[string]interface{}{"process": "CommentJob", "stage": "setup"})
-			cj.Log.Info(fmt.Sprintf("authorized user '%s' requested '/runtest' for commit '%s' in repository '%s', ref '%s'",
-				cj.event.User, commit.Sha, cj.event.Repo.Name, cj.event.RefName))
-
-			commit.SetStatus(ghclient.PENDING, "queued", "")
-			err := cj.client.UpdateCommitStatus(cj.event.Repo, *commit)
-			if err != nil {
-				cj.Log.Metadata(map[string]interface{}{"process": "CommentJob", "stage": "setup", "error": err.Error()})
-				cj.Log.Error("failed to update commit status to 'queued'")
-			}
-			cj.execute = true
+	if cj.event.User == cj.client.User {
+		// replies of the server itself
+		return
+	}
+	if cj.event.Action != ghclient.CommentCreated {
+		cj.Log.Metadata(map[string]interface{}{"process": "CommentJob", "stage": "setup"})
+		cj.Log.Debug(fmt.Sprintf("ignoring commands of %s comment", cj.event.Action))
+		return
+	}
+
+	cmds := cj.parseCommands()
+	if len(cmds) > 0 && cj.event.Commit.Sha == "" {
+		err := cj.resolveHead(ctx)
+		if err != nil {
+			cj.Log.Metadata(map[string]interface{}{"process": "CommentJob", "stage": "setup", "error": err.Error()})
+			cj.Log.Error("failed to retrieve pull request head commit")
 			return
 		}
-		cj.Log.Metadata(map[string]interface{}{"process": "CommentJob", "stage": "setup"})
-		cj.Log.Info(fmt.Sprintf("user '%s' not authorized to run jobs, ignoring", cj.event.User))
+	}
+
+	accepted := false
+	for _, cmd := range cmds {
+		spec, ok := commands[cmd.Name]
+		if !ok {
+			if !sliceContainsString(authUsers, cj.event.User) {
+				// not worth answering strangers, whose comments may only mention a path or a team
+				continue
+			}
+			cj.reply(ctx, fmt.Sprintf("@%s unknown command `/%s`.\n\n%s", cj.event.User, cmd.Name, helpText()))
+			continue
+		}
+		if !cj.permitted(spec.Permission, authUsers) {
+			cj.Log.Metadata(map[string]interface{}{"process": "CommentJob", "stage": "setup", "command": cmd.Name})
+			cj.Log.Info(fmt.Sprintf("user '%s' not authorized to use '/%s', ignoring", cj.event.User, cmd.Name))
+			cj.reply(ctx, fmt.Sprintf("@%s thanks for your comment! `/%s` can only be used by %s, so please ask one of them to run it for you.",
+				cj.event.User, cmd.Name, spec.Permission))
+			continue
+		}
+		if !accepted {
+			cj.acknowledge()
+			accepted = true
+		}
+
+		err := spec.validate(cmd)
+		if err == nil {
+			err = spec.Handle(cj, ctx, cmd)
+		}
+		if err != nil {
+			cj.failed = true
+			cj.Log.Metadata(map[string]interface{}{"process": "CommentJob", "stage": "setup", "command": cmd.Name, "error": err.Error()})
+			cj.Log.Warn("command failed")
+			cj.reply(ctx, fmt.Sprintf("@%s could not run `/%s`: %s", cj.event.User, cmd.Name, err))
+		}
+	}
+
+	if !cj.execute {
+		if accepted {
+			cj.conclude(!cj.failed)
+		}
+		return
+	}
+	commit := &cj.event.Commit
+	commit.SetContext("ci-server-go")
+	cj.Log.Metadata(map[string]interface{}{"process": "CommentJob", "stage": "setup"})
+	cj.Log.Info(fmt.Sprintf("authorized user '%s' requested a run for commit '%s' in repository '%s', ref '%s'",
+		cj.event.User, commit.Sha, cj.event.Repo.Name, cj.event.RefName))
+
+	commit.SetStatus(ghclient.PENDING, "queued", "")
+	err := postStatus(cj.client, repositoryConfig(cj.config, cj.event.Repo), cj.event.Repo, commit)
+	if err != nil {
+		cj.Log.Metadata(map[string]interface{}{"process": "CommentJob", "stage": "setup", "error": err.Error()})
+		cj.Log.Error("failed to update commit status to 'queued'")
 	}
 }
 
-//Run implements Job interface
-func (cj *CommentJob) Run(ctx context.Context) {
-	commit := cj.event.Ref.GetHead()
+// Replaces implements Replacer. Only comments with a command that cancels running jobs, used by a
+// permitted user, replace the job running for the pull request
+func (cj *CommentJob) Replaces(authUsers []string) bool {
+	for _, cmd := range cj.parseCommands() {
+		if spec, ok := commands[cmd.Name]; ok && spec.Replaces && cj.permitted(spec.Permission, authUsers) {
+			return true
+		}
+	}
+	return false
+}
+
+// Cancels implements Canceler. Comments with a command that cancels the jobs of the pull request, used by
+// a permitted user, cancel them whatever the concurrency policy of the repository
+func (cj *CommentJob) Cancels(authUsers []string) bool {
+	for _, cmd := range cj.parseCommands() {
+		if spec, ok := commands[cmd.Name]; ok && spec.Cancels && cj.permitted(spec.Permission, authUsers) {
+			return true
+		}
+	}
+	return false
+}
+
+func (cj *CommentJob) parseCommands() []Command {
+	if cj.event.Action != ghclient.CommentCreated {
+		return nil
+	}
+	if cj.commands == nil {
+		cj.commands = ParseCommands(cj.event.Body)
+	}
+	return cj.commands
+}
+
+func (cj *CommentJob) permitted(permission Permission, authUsers []string) bool {
+	switch permission {
+	case PermissionAnyone:
+		return true
+	case PermissionAuthor:
+		if cj.event.Author != "" && cj.event.User == cj.event.Author {
+			return true
+		}
+	}
+	return sliceContainsString(authUsers, cj.event.User)
+}
+
+// /runtest [sha] [timeout=<seconds>] [stage=<name>]
+func (cj *CommentJob) runTest(ctx context.Context, cmd Command) error {
+	if cj.execute {
+		return nil
+	}
+	if len(cmd.Args) > 0 && shaPrefix.MatchString(cmd.Args[0]) {
+		err := cj.resolveCommit(ctx, cmd.Args[0])
+		if err != nil {
+			return err
+		}
+	}
+
+	if timeout, ok := cmd.Options["timeout"]; ok {
+		seconds, err := strconv.Atoi(timeout)
+		if err != nil || seconds <= 0 {
+			return fmt.Errorf("timeout must be a positive number of seconds")
+		}
+		cj.options.Timeout = seconds
+	}
+	if stage, ok := cmd.Options["stage"]; ok {
+		cj.options.Env = map[string]string{"CI_STAGE": stage}
+	}
+	cj.trigger(cmd)
+	return nil
+}
+
+// resolveHead selects the head of the pull request as the commit to test. It may have been pushed before the
+// server started or to a fork, so it is resolved through the api
+func (cj *CommentJob) resolveHead(ctx context.Context) error {
+	commit, err := cj.client.GetCommit(ctx, cj.event.Repo, cj.event.Head)
+	if err != nil {
+		return err
+	}
+	cj.event.Commit = *commit
+	return nil
+}
+
+// resolveCommit selects the commit of the pull request matching sha prefix as the commit to test
+func (cj *CommentJob) resolveCommit(ctx context.Context, prefix string) error {
+	commit, err := cj.client.FindPullRequestCommit(ctx, cj.event.Repo, cj.event.Number, prefix)
+	if err == ghclient.ErrCommitNotInPullRequest {
+		return fmt.Errorf("commit `%s` is not part of this pull request's branch, no tests were run", prefix)
+	}
+	if err != nil {
+		return err
+	}
+	cj.event.Commit = *commit
+	return nil
+}
+
+// /retest-failed
+func (cj *CommentJob) retestFailed(ctx context.Context, cmd Command) error {
 	if cj.execute {
-		RunCoreJob(ctx, cj.client, cj.event.Repo, cj.GetRefName(), *commit, cj.Log)
+		return nil
+	}
+	switch cj.event.Commit.Status.State {
+	case ghclient.FAILURE.String(), ghclient.ERROR.String():
+		cj.trigger(cmd)
+		return nil
+	}
+	return fmt.Errorf("the last run of `%s` did not fail", cj.event.Commit.Sha)
+}
+
+// trigger makes cmd start a run of the tests
+func (cj *CommentJob) trigger(cmd Command) {
+	cj.execute = true
+	cj.options.PullRequest = cj.event.Number
+	cj.options.Trigger = fmt.Sprintf("`/%s` by @%s", cmd.Name, cj.event.User)
+}
+
+// /cancel. The job manager cancels the running job when this job arrives
+func (cj *CommentJob) cancel(ctx context.Context, cmd Command) error {
+	cj.Log.Metadata(map[string]interface{}{"process": "CommentJob", "stage": "setup"})
+	cj.Log.Info(fmt.Sprintf("user '%s' cancelled jobs in repository '%s', ref '%s'", cj.event.User, cj.event.Repo.Name, cj.event.RefName))
+	return nil
+}
+
+// /skip
+func (cj *CommentJob) skip(ctx context.Context, cmd Command) error {
+	cj.execute = false
+	commit := &cj.event.Commit
+	commit.SetContext("ci-server-go")
+	commit.SetStatus(ghclient.SUCCESS, fmt.Sprintf("skipped by %s", cj.event.User), "")
+	return postStatus(cj.client, repositoryConfig(cj.config, cj.event.Repo), cj.event.Repo, commit)
+}
+
+// /help
+func (cj *CommentJob) help(ctx context.Context, cmd Command) error {
+	cj.reply(ctx, helpText())
+	return nil
+}
+
+// acknowledge reacts to the comment to show that its commands are being processed
+func (cj *CommentJob) acknowledge() {
+	if cj.event.ID == 0 {
+		return
+	}
+	ID, err := cj.client.AddReaction(cj.event.Repo, cj.event.ID, ghclient.ReactionEyes)
+	if err != nil {
+		cj.Log.Metadata(map[string]interface{}{"process": "CommentJob", "error": err.Error()})
+		cj.Log.Warn("failed to react to comment")
+		return
+	}
+	cj.reaction = ID
+}
+
+// conclude replaces the acknowledgement of the comment with a reaction showing the outcome
+func (cj *CommentJob) conclude(success bool) {
+	concludeComment(cj.client, cj.event.Repo, cj.event.ID, cj.reaction, success, cj.Log)
+	cj.reaction = 0
+}
+
+// concludeComment replaces reaction to comment commentID with a reaction showing the outcome of its commands
+func concludeComment(client *ghclient.Client, repo ghclient.Repository, commentID, reaction int64, success bool, log *logging.Logger) {
+	if commentID == 0 {
+		return
+	}
+	if reaction != 0 {
+		err := client.RemoveReaction(repo, commentID, reaction)
+		if err != nil {
+			log.Metadata(map[string]interface{}{"process": "CommentJob", "error": err.Error()})
+			log.Warn("failed to remove reaction from comment")
+		}
+	}
+
+	content := ghclient.ReactionThumbsUp
+	if !success {
+		content = ghclient.ReactionThumbsDown
+	}
+	if _, err := client.AddReaction(repo, commentID, content); err != nil {
+		log.Metadata(map[string]interface{}{"process": "CommentJob", "error": err.Error()})
+		log.Warn("failed to react to comment")
+	}
+}
+
+// reply comments on the pull request
+func (cj *CommentJob) reply(ctx context.Context, body string) {
+	err := cj.client.CommentOnPullRequest(ctx, cj.event.Repo, cj.event.Number, body)
+	if err != nil {
+		cj.Log.Metadata(map[string]interface{}{"process": "CommentJob", "stage": "setup", "error": err.Error()})
+		cj.Log.Error("failed to reply on pull request")
 	}
 }
 
-//Compare implements queue.Item
-func (cj *CommentJob) Compare(queue.Item) int {
-	return 0
+//Run implements Job interface
+func (cj *CommentJob) Run(ctx context.Context) {
+	if !cj.execute {
+		return
+	}
+	result := RunCoreJob(ctx, cj.client, repositoryConfig(cj.config, cj.event.Repo), cj.event.Repo, cj.GetRefName(), cj.event.Commit, cj.options, cj.Log)
+	cj.conclude(result.Succeeded())
 }
 
 //GetRefName implements Job interface
@@ -83,5 +373,54 @@ func (cj *CommentJob) GetRefName() string {
 
 //GetRepoName implements Job interface
 func (cj *CommentJob) GetRepoName() string {
-	return ""
+	return cj.event.Repo.FullName()
+}
+
+//Delivery implements Deliverer
+func (cj *CommentJob) Delivery() string {
+	return cj.event.Delivery
+}
+
+//Info implements Describer
+func (cj *CommentJob) Info() Info {
+	branch := branchName(cj.GetRefName())
+	return Info{
+		Type:          TypeComment,
+		Repo:          cj.GetRepoName(),
+		Branch:        branch,
+		DefaultBranch: branch == cj.event.Repo.DefaultBranch,
+		User:          cj.event.User,
+	}
+}
+
+//Discard implements Discarder
+func (cj *CommentJob) Discard(reason string) {
+	if !cj.execute {
+		return
+	}
+	cj.execute = false
+	cj.event.Commit.SetStatus(ghclient.ERROR, reason, "")
+	cj.event.Commit.SetConclusion(ghclient.CheckCancelled)
+	err := postStatus(cj.client, repositoryConfig(cj.config, cj.event.Repo), cj.event.Repo, &cj.event.Commit)
+	if err != nil {
+		cj.Log.Metadata(map[string]interface{}{"process": "CommentJob", "error": err.Error()})
+		cj.Log.Error("failed to update status of discarded job")
+	}
+	cj.conclude(false)
+}
+
+//Record implements Recorder
+func (cj *CommentJob) Record() (Record, bool) {
+	if !cj.execute {
+		return Record{}, false
+	}
+	return Record{
+		Info:     cj.Info(),
+		Repo:     cj.event.Repo,
+		RefName:  cj.GetRefName(),
+		Commit:   cj.event.Commit,
+		Options:  cj.options,
+		Comment:  cj.event.ID,
+		Reaction: cj.reaction,
+	}, true
 }
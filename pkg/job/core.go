@@ -2,8 +2,10 @@ package job
 
 import (
 	"bufio"
+	"bytes"
 	"context"
 	"fmt"
+	"io/ioutil"
 	"os"
 	"os/exec"
 	"path/filepath"
@@ -11,27 +13,97 @@ import (
 	"sync"
 	"time"
 
+	"github.com/pleimer/ci-server-go/pkg/agent"
+	"github.com/pleimer/ci-server-go/pkg/config"
 	"github.com/pleimer/ci-server-go/pkg/ghclient"
 	"github.com/pleimer/ci-server-go/pkg/logging"
 	"github.com/pleimer/ci-server-go/pkg/parser"
 	"github.com/pleimer/ci-server-go/pkg/report"
 )
 
+// RunOptions adjust a single run of the core job
+type RunOptions struct {
+	Timeout int               `json:"timeout,omitempty"` // seconds, overrides the timeout of ci.yml if set
+	Env     map[string]string `json:"env,omitempty"`     // extra environment variables of the scripts
+
+	// PullRequest is the number of the pull request the run was triggered from. If set, the run is
+	// recorded in the summary comment of the pull request, with Trigger describing what started it
+	PullRequest int    `json:"pull_request,omitempty"`
+	Trigger     string `json:"trigger,omitempty"`
+}
+
+// Result outcome of a core job run
+type Result struct {
+	Status   ghclient.Status // final status of the commit
+	Duration time.Duration
+}
+
+// Succeeded whether the scripts of the run passed
+func (r Result) Succeeded() bool {
+	return r.Status.State == ghclient.SUCCESS.String()
+}
+
+// Dispatcher runs scripts on remote agents, see agent.Coordinator
+type Dispatcher interface {
+	Dispatch(ctx context.Context, t agent.Task, output func(string)) error
+}
+
+var dispatcher Dispatcher
+
+// SetDispatcher makes jobs run the scripts of specs with runs_on labels through d. Such scripts fail
+// with agent.ErrNoAgents while no dispatcher is set
+func SetDispatcher(d Dispatcher) {
+	dispatcher = d
+}
+
 // RunCoreJob executes the main sequence of steps that a CI job contains.
-func RunCoreJob(ctx context.Context, client *ghclient.Client, repo ghclient.Repository, refName string, commit ghclient.Commit, log *logging.Logger) {
+func RunCoreJob(ctx context.Context, client *ghclient.Client, conf config.RepositoryConfig, repo ghclient.Repository, refName string, commit ghclient.Commit, opts RunOptions, log *logging.Logger) (result Result) {
 	// This function downloads the git tree, loads in the ci.yml, creates writers
 	// to log test output to both a file and github gist, and runs the script and
 	// after_script sections of ci.yml
 
+	start := time.Now()
+	defer func() {
+		result.Duration = time.Since(start)
+		if opts.PullRequest != 0 {
+			recordRun(client, repo, commit, opts, result, log)
+		}
+	}()
+
 	cj := newCoreJob(client, repo, commit)
-	cj.BasePath = "/tmp"
+	cj.fetch = conf.FetchStrategy()
+	cj.depth = conf.Depth
+	cj.reporter = conf.ReportBackend()
 
-	log.Metadata(map[string]interface{}{"process": "Core"})
+	// every job has its own workspace, so that jobs of the same commit don't overwrite or remove each other's files
+	workspace, err := ioutil.TempDir("", fmt.Sprintf("%s-", commit.Sha))
+	if err != nil {
+		log.Metadata(map[string]interface{}{"process": "Core", "error": err})
+		log.Error("creating workspace")
+		result.Status = cj.abort(ctx, conf, "failed to create workspace", log)
+		return
+	}
+	defer func() {
+		if err := os.RemoveAll(workspace); err != nil {
+			log.Metadata(map[string]interface{}{"process": "Core", "error": err})
+			log.Warn("failed to remove workspace")
+		}
+	}()
+	cj.BasePath = workspace
+
+	log.Metadata(map[string]interface{}{"process": "Core", "strategy": cj.fetch})
 	log.Info("downloading git tree")
-	err := cj.GetTree()
+	err = cj.GetTree(ctx)
+	if err != nil && cj.fetch != config.FetchTree && ctx.Err() == nil {
+		log.Metadata(map[string]interface{}{"process": "Core", "strategy": cj.fetch, "error": err})
+		log.Warn("download failed - falling back to walking git tree")
+		cj.fetch = config.FetchTree
+		err = cj.GetTree(ctx)
+	}
 	if err != nil {
 		log.Metadata(map[string]interface{}{"process": "Core", "error": err})
 		log.Error("retrieving resources")
+		result.Status = cj.abort(ctx, conf, "failed retrieving repository", log)
 		return
 	}
 
@@ -41,8 +113,10 @@ func RunCoreJob(ctx context.Context, client *ghclient.Client, repo ghclient.Repo
 	if err != nil {
 		log.Metadata(map[string]interface{}{"process": "Core", "error": err})
 		log.Error("failed to load spec")
+		result.Status = cj.abort(ctx, conf, "failed to load ci.yml", log)
 		return
 	}
+	cj.applyOptions(opts)
 
 	// initialize writers
 	logPath := filepath.Join(cj.BasePath, fmt.Sprintf("%s.log", commit.Sha))
@@ -50,6 +124,7 @@ func RunCoreJob(ctx context.Context, client *ghclient.Client, repo ghclient.Repo
 	if err != nil {
 		log.Metadata(map[string]interface{}{"process": "Core", "error": err})
 		log.Error("opening log path")
+		result.Status = cj.abort(ctx, conf, "failed to create log file", log)
 		return
 	}
 	defer f.Close()
@@ -57,18 +132,23 @@ func RunCoreJob(ctx context.Context, client *ghclient.Client, repo ghclient.Repo
 	gist := ghclient.NewGist()
 	gist.Description = fmt.Sprintf("CI Results for repository '%s' commit '%s'", cj.repo.Name, cj.commit.Sha)
 
+	// without a gist the report is still written to the log file and, with the checks
+	// reporter, to the check run summary
+	writer := report.NewWriter(f, &cj.summary)
+	gistID := ""
 	gw, err := ghclient.NewGistWriter(&client.Api, gist, fmt.Sprintf("%s_%s.md", cj.repo.Name, cj.commit.Sha))
 	if err != nil {
 		log.Metadata(map[string]interface{}{"process": "Core", "error": err})
-		log.Error("creating gist writer")
-		return
+		log.Warn("creating gist writer failed - continuing without gist report")
+	} else {
+		writer = report.NewWriter(f, gw, &cj.summary)
+		gistID = gw.GetServerGistID()
 	}
-	writer := report.NewWriter(f, gw)
 
 	// run scripts
 	log.Metadata(map[string]interface{}{"process": "Core"})
 	log.Info("running main script")
-	err = cj.RunMainScript(ctx, writer, gw.GetServerGistID())
+	err = cj.RunMainScript(ctx, writer, gistID)
 	if err != nil {
 		log.Metadata(map[string]interface{}{"process": "Core", "error": err})
 		log.Info("script failed")
@@ -87,7 +167,7 @@ func RunCoreJob(ctx context.Context, client *ghclient.Client, repo ghclient.Repo
 	// so it isn't too terrible
 	log.Metadata(map[string]interface{}{"process": "Core"})
 	log.Info("running after script")
-	err = cj.RunAfterScript(context.Background(), writer, gw.GetServerGistID())
+	err = cj.RunAfterScript(context.Background(), writer, gistID)
 	if err != nil {
 		log.Metadata(map[string]interface{}{"process": "Core", "error": err})
 		log.Info("after_script failed")
@@ -99,6 +179,8 @@ func RunCoreJob(ctx context.Context, client *ghclient.Client, repo ghclient.Repo
 		log.Metadata(map[string]interface{}{"process": "Core", "error": err.Error()})
 		log.Error("posting commit status")
 	}
+	result.Status = cj.commit.Status
+	return
 }
 
 // coreJob contains processes for the stages of running a script in a repository, generating and posting reports
@@ -111,6 +193,10 @@ type coreJob struct {
 	spec              *parser.Spec
 	scriptOutput      []byte
 	afterScriptOutput []byte
+	fetch             string
+	depth             int
+	reporter          string
+	summary           bytes.Buffer // markdown report for check run output
 
 	BasePath string
 }
@@ -125,26 +211,42 @@ func newCoreJob(client *ghclient.Client, repo ghclient.Repository, commit ghclie
 	return &cj
 }
 
-func (cj *coreJob) GetTree() error {
-	tree, err := cj.client.GetTree(cj.commit.Sha, cj.repo)
-	if err != nil {
-		return err
+// GetTree downloads the repository contents at commit into a directory under BasePath
+// with the configured fetch strategy. BasePath is set to that directory on success
+func (cj *coreJob) GetTree(ctx context.Context) error {
+	switch cj.fetch {
+	case config.FetchGit:
+		workspace := filepath.Join(cj.BasePath, cj.commit.Sha)
+		err := cj.client.GitCheckout(ctx, cj.commit.Sha, cj.repo, workspace, cj.depth)
+		if err != nil {
+			return err
+		}
+		cj.BasePath = workspace
+		return nil
+	case config.FetchTarball:
+		workspace := filepath.Join(cj.BasePath, cj.commit.Sha)
+		err := cj.client.DownloadTarball(ctx, cj.commit.Sha, cj.repo, workspace)
+		if err != nil {
+			return err
+		}
+		cj.BasePath = workspace
+		return nil
 	}
 
-	err = ghclient.WriteTreeToDirectory(tree, cj.BasePath)
+	tree, err := cj.client.GetTree(ctx, cj.commit.Sha, cj.repo)
 	if err != nil {
 		return err
 	}
-	return nil
-}
 
-func (cj *coreJob) LoadSpec(refName string) error {
-	tree, err := cj.client.GetTree(cj.commit.Sha, cj.repo)
+	err = cj.client.WriteTree(ctx, tree, cj.repo, cj.BasePath)
 	if err != nil {
 		return err
 	}
 	cj.BasePath = filepath.Join(cj.BasePath, tree.Path)
+	return nil
+}
 
+func (cj *coreJob) LoadSpec(refName string) error {
 	f, err := os.Open(filepath.Join(cj.BasePath, "ci.yml"))
 	if err != nil {
 		return err
@@ -253,9 +355,73 @@ func (cj *coreJob) runScript(ctx context.Context, script *exec.Cmd, writer *repo
 	return nil
 }
 
+// runs commands on an agent carrying the runs_on labels of the spec and writes its output like runScript
+func (cj *coreJob) runRemoteScript(ctx context.Context, commands []string, writer *report.Writer) error {
+	if writer.Err() != nil {
+		return writer.Err()
+	}
+	writer.OpenBlock()
+	if dispatcher == nil {
+		writer.Write(fmt.Sprintf("error: %s", agent.ErrNoAgents))
+		writer.CloseBlock()
+		writer.Flush()
+		return agent.ErrNoAgents
+	}
+
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		ticker := time.NewTicker(60 * time.Second)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				writer.Flush()
+			}
+		}
+	}()
+
+	err := dispatcher.Dispatch(ctx, agent.Task{
+		Labels:    cj.spec.RunsOn,
+		Script:    parser.JoinCommands(commands),
+		Env:       cj.spec.Env(),
+		Workspace: cj.BasePath,
+	}, func(line string) {
+		writer.Write(line)
+	})
+	close(done)
+	wg.Wait()
+
+	if ctx.Err() != nil {
+		err = ctx.Err()
+	}
+	if err != nil {
+		switch err.(type) {
+		case *agent.ScriptError:
+			writer.Write(fmt.Sprintf("\n[ci-server] script error: %s", err))
+		default:
+			writer.Write(fmt.Sprintf("\nerror: %s", err))
+		}
+		writer.CloseBlock()
+		writer.Flush()
+		return err
+	}
+
+	writer.CloseBlock()
+	writer.Flush()
+	if writer.Err() != nil {
+		return writer.Err()
+	}
+	return nil
+}
+
 // runs spec.Script
 func (cj *coreJob) RunMainScript(ctx context.Context, writer *report.Writer, gistID string) error {
-	gistURL := cj.client.Api.PublishedGistURL(gistID, cj.client.User)
+	gistURL := cj.gistURL(gistID)
 
 	cj.commit.SetStatus(ghclient.PENDING, "running main script", gistURL)
 	cj.postCommitStatus()
@@ -264,16 +430,24 @@ func (cj *coreJob) RunMainScript(ctx context.Context, writer *report.Writer, gis
 	scriptCtx, cancel := context.WithTimeout(ctx, time.Second*time.Duration(cj.spec.Global.Timeout))
 	defer cancel()
 
-	cmd := cj.spec.ScriptCmd(scriptCtx, cj.BasePath)
 	writer.AddTitle("Main Script")
-	err := cj.runScript(scriptCtx, cmd, writer)
+	var err error
+	if len(cj.spec.RunsOn) > 0 {
+		err = cj.runRemoteScript(scriptCtx, cj.spec.Script, writer)
+	} else {
+		err = cj.runScript(scriptCtx, cj.spec.ScriptCmd(scriptCtx, cj.BasePath), writer)
+	}
 
 	if err != nil {
 		switch err {
+		case agent.ErrNoAgents, agent.ErrAgentLost:
+			cj.commit.SetStatus(ghclient.ERROR, fmt.Sprintf("main script: %s", err), gistURL)
 		case context.Canceled:
 			cj.commit.SetStatus(ghclient.ERROR, "main script canceled", gistURL)
+			cj.commit.SetConclusion(ghclient.CheckCancelled)
 		case context.DeadlineExceeded:
 			cj.commit.SetStatus(ghclient.FAILURE, "main script timed out", gistURL)
+			cj.commit.SetConclusion(ghclient.CheckTimedOut)
 		case ghclient.ErrInvalidResp:
 			cj.commit.SetStatus(ghclient.ERROR, fmt.Sprintf("error logging: %s", err), gistURL)
 		default:
@@ -286,20 +460,28 @@ func (cj *coreJob) RunMainScript(ctx context.Context, writer *report.Writer, gis
 
 // runs spec.AfterScript
 func (cj *coreJob) RunAfterScript(ctx context.Context, writer *report.Writer, gistID string) error {
-	gistURL := cj.client.Api.PublishedGistURL(gistID, cj.client.User)
+	gistURL := cj.gistURL(gistID)
 
 	scriptCtx, cancel := context.WithTimeout(ctx, time.Second*time.Duration(cj.spec.Global.Timeout))
 	defer cancel()
 
-	cmd := cj.spec.AfterScriptCmd(scriptCtx, cj.BasePath)
 	writer.AddTitle("After Script")
-	err := cj.runScript(scriptCtx, cmd, writer)
+	var err error
+	if len(cj.spec.RunsOn) > 0 {
+		err = cj.runRemoteScript(scriptCtx, cj.spec.AfterScript, writer)
+	} else {
+		err = cj.runScript(scriptCtx, cj.spec.AfterScriptCmd(scriptCtx, cj.BasePath), writer)
+	}
 	if err != nil {
 		switch err {
+		case agent.ErrNoAgents, agent.ErrAgentLost:
+			cj.commit.SetStatus(ghclient.ERROR, fmt.Sprintf("after_script: %s", err), gistURL)
 		case context.Canceled:
 			cj.commit.SetStatus(ghclient.ERROR, "after_script canceled", gistURL)
+			cj.commit.SetConclusion(ghclient.CheckCancelled)
 		case context.DeadlineExceeded:
 			cj.commit.SetStatus(ghclient.ERROR, "after_script timed out", gistURL)
+			cj.commit.SetConclusion(ghclient.CheckTimedOut)
 		case ghclient.ErrInvalidResp:
 			cj.commit.SetStatus(ghclient.ERROR, fmt.Sprintf("error logging: %s", err), gistURL)
 		default:
@@ -310,8 +492,69 @@ func (cj *coreJob) RunAfterScript(ctx context.Context, writer *report.Writer, gi
 	return nil
 }
 
+// applyOptions overrides settings of the loaded spec
+func (cj *coreJob) applyOptions(opts RunOptions) {
+	if cj.spec.Global == nil {
+		cj.spec.Global = &parser.Global{}
+	}
+	if opts.Timeout > 0 {
+		cj.spec.Global.Timeout = opts.Timeout
+	}
+	if len(opts.Env) > 0 && cj.spec.Global.Env == nil {
+		cj.spec.Global.Env = make(map[string]interface{})
+	}
+	for key, val := range opts.Env {
+		cj.spec.Global.Env[key] = val
+	}
+}
+
 // ----------- helper functions ---------------
+// recordRun adds result to the run history of the pull request the run was triggered from
+func recordRun(client *ghclient.Client, repo ghclient.Repository, commit ghclient.Commit, opts RunOptions, result Result, log *logging.Logger) {
+	err := client.RecordPullRequestRun(repo, opts.PullRequest, ghclient.PullRequestRun{
+		Sha:         commit.Sha,
+		Trigger:     opts.Trigger,
+		State:       result.Status.State,
+		Description: result.Status.Description,
+		Duration:    result.Duration,
+		URL:         result.Status.TargetURL,
+	})
+	if err != nil {
+		log.Metadata(map[string]interface{}{"process": "Core", "pull request": opts.PullRequest, "error": err.Error()})
+		log.Error("failed to update summary comment")
+	}
+}
+
+func (cj *coreJob) gistURL(gistID string) string {
+	if gistID == "" {
+		return ""
+	}
+	return cj.client.Api.PublishedGistURL(gistID, cj.client.User)
+}
+
+// abort marks the commit errored when the job stops before running its scripts, and posts the status so
+// that the check run or commit status the job started with is concluded. Returns the posted status
+func (cj *coreJob) abort(ctx context.Context, conf config.RepositoryConfig, description string, log *logging.Logger) ghclient.Status {
+	cj.commit.SetStatus(ghclient.ERROR, description, "")
+	if ctx.Err() == context.Canceled {
+		cj.commit.SetConclusion(ghclient.CheckCancelled)
+	}
+	if err := postStatus(cj.client, conf, cj.repo, &cj.commit); err != nil {
+		log.Metadata(map[string]interface{}{"process": "Core", "error": err.Error()})
+		log.Error("posting commit status")
+	}
+	return cj.commit.Status
+}
+
 func (cj *coreJob) postCommitStatus() error {
+	if cj.reporter == config.ReportChecks {
+		var output *ghclient.CheckOutput
+		if cj.commit.Status.State != ghclient.PENDING.String() {
+			output = cj.checkOutput()
+		}
+		return cj.client.UpdateCheckRun(cj.repo, &cj.commit, output)
+	}
+
 	err := cj.client.UpdateCommitStatus(cj.repo, cj.commit)
 	if err != nil {
 		return err
@@ -14,7 +14,9 @@ import (
 	"testing"
 	"time"
 
+	"github.com/pleimer/ci-server-go/pkg/agent"
 	"github.com/pleimer/ci-server-go/pkg/assert"
+	"github.com/pleimer/ci-server-go/pkg/config"
 	"github.com/pleimer/ci-server-go/pkg/ghclient"
 	"github.com/pleimer/ci-server-go/pkg/logging"
 	"github.com/pleimer/ci-server-go/pkg/parser"
@@ -44,6 +46,33 @@ func TestFailedScript(t *testing.T) {
 	}
 }
 
+func TestRunCoreJobAborted(t *testing.T) {
+	_, github, repo, _, commit, log, _ := genTestEnvironment([]string{"echo hi"}, []string{""})
+	checkRuns := []ghclient.CheckRun{}
+	github.Api.Client = ghclient.NewTestClient(func(req *http.Request) *http.Response {
+		if strings.HasSuffix(req.URL.Path, "/check-runs") {
+			cr := ghclient.CheckRun{}
+			assert.Ok(t, json.NewDecoder(req.Body).Decode(&cr))
+			checkRuns = append(checkRuns, cr)
+			return &http.Response{StatusCode: 201, Status: "201 Created", Body: ioutil.NopCloser(strings.NewReader(`{"id": 1}`)), Header: make(http.Header)}
+		}
+		return &http.Response{StatusCode: 404, Status: "404 Not Found", Body: ioutil.NopCloser(strings.NewReader("not found")), Header: make(http.Header)}
+	})
+	github.Cache = ghclient.NewCache()
+
+	conf := config.RepositoryConfig{Name: "owner/example", Reporter: config.ReportChecks}
+	result := RunCoreJob(context.Background(), github, conf, *repo, "refs/heads/master", commit, RunOptions{}, log)
+	assert.Equals(t, "failed retrieving repository", result.Status.Description)
+	assert.Equals(t, 1, len(checkRuns))
+	assert.Equals(t, ghclient.CheckCompleted, checkRuns[0].Status)
+	assert.Equals(t, ghclient.CheckActionRequired, checkRuns[0].Conclusion)
+
+	// the workspace of the job is removed once it finished
+	workspaces, err := filepath.Glob(filepath.Join(os.TempDir(), commit.Sha+"-*"))
+	assert.Ok(t, err)
+	assert.Equals(t, 0, len(workspaces))
+}
+
 func TestCancel(t *testing.T) {
 	spec, github, repo, _, commit, _, _ := genTestEnvironment([]string{"echo starting", "sleep 5", "echo ending"}, []string{"sleep 5"})
 	var sb strings.Builder
@@ -75,6 +104,77 @@ func TestCancel(t *testing.T) {
 	})
 }
 
+type testDispatcher struct {
+	task   agent.Task
+	output []string
+	err    error
+}
+
+func (d *testDispatcher) Dispatch(ctx context.Context, t agent.Task, output func(string)) error {
+	d.task = t
+	for _, line := range d.output {
+		output(line)
+	}
+	return d.err
+}
+
+func TestRemoteScript(t *testing.T) {
+	spec, github, repo, _, commit, _, _ := genTestEnvironment([]string{"echo $OCP_PROJECT", "echo $CI_AGENT_NAME"}, []string{"echo Done"})
+	spec.RunsOn = parser.Labels{"ocp", "large"}
+	defer SetDispatcher(nil)
+
+	newJob := func() *coreJob {
+		cj := newCoreJob(github, *repo, commit)
+		cj.spec = spec
+		cj.BasePath = "/tmp/t0"
+		return cj
+	}
+
+	t.Run("success", func(t *testing.T) {
+		d := &testDispatcher{output: []string{"t0", "agent-1"}}
+		SetDispatcher(d)
+		var sb strings.Builder
+		cj := newJob()
+
+		assert.Ok(t, cj.RunMainScript(context.Background(), report.NewWriter(&sb), ""))
+		assert.Equals(t, []string{"ocp", "large"}, d.task.Labels)
+		assert.Equals(t, "echo $OCP_PROJECT;echo $CI_AGENT_NAME", d.task.Script)
+		assert.Equals(t, []string{"OCP_PROJECT=__commit__"}, d.task.Env)
+		assert.Equals(t, "/tmp/t0", d.task.Workspace)
+		assert.Assert(t, strings.Contains(sb.String(), "t0\nagent-1"), "output of the agent should be reported")
+		assert.Equals(t, ghclient.SUCCESS.String(), cj.commit.Status.State)
+	})
+
+	t.Run("script failure", func(t *testing.T) {
+		SetDispatcher(&testDispatcher{err: &agent.ScriptError{Agent: "agent-1", Err: "exit status 1"}})
+		var sb strings.Builder
+		cj := newJob()
+
+		err := cj.RunMainScript(context.Background(), report.NewWriter(&sb), "")
+		assert.Assert(t, err != nil, "failed script should fail the job")
+		assert.Equals(t, ghclient.FAILURE.String(), cj.commit.Status.State)
+		assert.Assert(t, strings.Contains(sb.String(), "script error: exit status 1"), "script error should be reported")
+	})
+
+	t.Run("agent lost", func(t *testing.T) {
+		SetDispatcher(&testDispatcher{err: agent.ErrAgentLost})
+		cj := newJob()
+
+		err := cj.RunAfterScript(context.Background(), report.NewWriter(ioutil.Discard), "")
+		assert.Equals(t, agent.ErrAgentLost, err)
+		assert.Equals(t, ghclient.ERROR.String(), cj.commit.Status.State)
+	})
+
+	t.Run("no dispatcher", func(t *testing.T) {
+		SetDispatcher(nil)
+		cj := newJob()
+
+		err := cj.RunMainScript(context.Background(), report.NewWriter(ioutil.Discard), "")
+		assert.Equals(t, agent.ErrNoAgents, err)
+		assert.Equals(t, ghclient.ERROR.String(), cj.commit.Status.State)
+	})
+}
+
 // test helper functions
 func formatGistOutput(repoName, commitSha, scriptOutput, afterScriptOutput string) string {
 	var sb strings.Builder
@@ -3,8 +3,9 @@ package job
 import (
 	"context"
 	"fmt"
+	"strings"
 
-	"github.com/golang-collections/go-datastructures/queue"
+	"github.com/pleimer/ci-server-go/pkg/config"
 	"github.com/pleimer/ci-server-go/pkg/ghclient"
 	"github.com/pleimer/ci-server-go/pkg/logging"
 )
@@ -28,26 +29,117 @@ func (js Status) String() string {
 type Job interface {
 	Setup(context.Context, []string)
 	Run(context.Context)
-	Compare(queue.Item) int
 
 	SetLogger(*logging.Logger)
 	GetRefName() string
-	GetRepoName() string
+	GetRepoName() string // in the form owner/repo
+}
+
+// Replacer is implemented by jobs that only replace running jobs targeting the same reference under some
+// conditions. Jobs that don't implement it always replace them
+type Replacer interface {
+	Replaces(authUsers []string) bool
+}
+
+// Replaces reports whether j replaces, and thus cancels, running jobs targeting the same reference
+func Replaces(j Job, authUsers []string) bool {
+	if r, ok := j.(Replacer); ok {
+		return r.Replaces(authUsers)
+	}
+	return true
+}
+
+// Canceler is implemented by jobs that cancel the running and queued jobs targeting the same reference,
+// whatever the concurrency policy of the repository
+type Canceler interface {
+	Cancels(authUsers []string) bool
+}
+
+// Cancels reports whether j cancels all jobs targeting the same reference
+func Cancels(j Job, authUsers []string) bool {
+	if c, ok := j.(Canceler); ok {
+		return c.Cancels(authUsers)
+	}
+	return false
+}
+
+// Discarder is implemented by jobs that report being dropped from the queue without running
+type Discarder interface {
+	Discard(reason string)
+}
+
+// Discard drops queued job j, which will not run
+func Discard(j Job, reason string) {
+	if d, ok := j.(Discarder); ok {
+		d.Discard(reason)
+	}
+}
+
+// Deliverer is implemented by jobs created from a webhook delivery
+type Deliverer interface {
+	Delivery() string
+}
+
+// DeliveryOf retrieves the ID of the webhook delivery j was created from. Empty if j was not created
+// from a delivery
+func DeliveryOf(j Job) string {
+	if d, ok := j.(Deliverer); ok {
+		return d.Delivery()
+	}
+	return ""
+}
+
+// job types
+const (
+	TypePush        = "push"
+	TypePullRequest = "pull_request"
+	TypeComment     = "comment"
+)
+
+// Info describes a job to the scheduler
+type Info struct {
+	Type          string `json:"type"`
+	Repo          string `json:"repository"` // in the form owner/repo
+	Branch        string `json:"branch"`
+	DefaultBranch bool   `json:"default_branch"` // the job targets the default branch of the repository
+	User          string `json:"user"`           // user the job runs for
+}
+
+// Describer is implemented by jobs that describe themselves to the scheduler
+type Describer interface {
+	Info() Info
+}
+
+// Describe retrieves the description of j. Jobs that don't implement Describer are described by their reference
+func Describe(j Job) Info {
+	if d, ok := j.(Describer); ok {
+		return d.Info()
+	}
+	return Info{Repo: j.GetRepoName(), Branch: branchName(j.GetRefName())}
 }
 
 // Factory generate jobs based on event type
-func Factory(event ghclient.Event, client *ghclient.Client, log *logging.Logger) (Job, error) {
+func Factory(event ghclient.Event, client *ghclient.Client, conf *config.Config, log *logging.Logger) (Job, error) {
 	switch e := event.(type) {
 	case *ghclient.Comment:
 		return &CommentJob{
 			event:  e,
 			client: client,
+			config: conf,
 			Log:    log,
 		}, nil
 	case *ghclient.Push:
 		return &PushJob{
 			event:  e,
 			client: client,
+			config: conf,
+			Log:    log,
+		}, nil
+	case *ghclient.PullRequest:
+		return &PullRequestJob{
+			event:  e,
+			client: client,
+			config: conf,
 			Log:    log,
 		}, nil
 	}
@@ -55,6 +147,29 @@ func Factory(event ghclient.Event, client *ghclient.Client, log *logging.Logger)
 }
 
 // --------------------------- helper functions ----------------------------------------
+
+// repositoryConfig retrieves settings for repo. Jobs created without a configuration use defaults
+func repositoryConfig(conf *config.Config, repo ghclient.Repository) config.RepositoryConfig {
+	if conf == nil {
+		return config.RepositoryConfig{Name: repo.FullName()}
+	}
+	return conf.Repository(repo.FullName())
+}
+
+// postStatus reports commit status through the backend configured for the repository. The check run
+// of the job is recorded in commit
+func postStatus(client *ghclient.Client, conf config.RepositoryConfig, repo ghclient.Repository, commit *ghclient.Commit) error {
+	if conf.ReportBackend() == config.ReportChecks {
+		return client.UpdateCheckRun(repo, commit, nil)
+	}
+	return client.UpdateCommitStatus(repo, *commit)
+}
+
+// branchName name of the branch of reference refName, e.g. "refs/heads/master"
+func branchName(refName string) string {
+	return strings.TrimPrefix(strings.Trim(refName, "\""), "refs/heads/")
+}
+
 func sliceContainsString(s []string, e string) bool {
 	for _, a := range s {
 		if a == e {
@@ -63,3 +178,12 @@ func sliceContainsString(s []string, e string) bool {
 	}
 	return false
 }
+
+func indexOfString(s []string, e string) int {
+	for i, a := range s {
+		if a == e {
+			return i
+		}
+	}
+	return -1
+}
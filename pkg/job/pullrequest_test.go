@@ -0,0 +1,57 @@
+package job
+
+import (
+	"context"
+	"testing"
+
+	"github.com/pleimer/ci-server-go/pkg/assert"
+	"github.com/pleimer/ci-server-go/pkg/ghclient"
+)
+
+func TestPullRequestJobSetup(t *testing.T) {
+	tests := []struct {
+		name     string
+		action   string
+		author   string
+		draft    bool
+		fork     bool
+		execute  bool
+		replaces bool
+	}{
+		{"opened by authorized user", ghclient.PullRequestOpened, "testuser", false, false, true, true},
+		{"synchronize from fork", ghclient.PullRequestSynchronize, "testuser", false, true, true, true},
+		{"synchronize run by push job", ghclient.PullRequestSynchronize, "testuser", false, false, false, false},
+		{"ready for review", ghclient.PullRequestReadyForReview, "testuser", false, false, true, true},
+		{"unauthorized author", ghclient.PullRequestOpened, "stranger", false, false, false, true},
+		{"draft", ghclient.PullRequestOpened, "testuser", true, false, false, true},
+		{"closed", ghclient.PullRequestClosed, "testuser", false, false, false, true},
+		{"labeled", "labeled", "testuser", false, false, false, false},
+		{"review requested", "review_requested", "testuser", false, true, false, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, github, repo, _, commit, log, _ := genTestEnvironment([]string{"echo $OCP_PROJECT"}, []string{"echo Done"})
+
+			pj := PullRequestJob{
+				event: &ghclient.PullRequest{
+					Repo:    *repo,
+					Commit:  commit,
+					Action:  test.action,
+					Number:  1,
+					RefName: `"refs/heads/feature"`,
+					Author:  test.author,
+					Draft:   test.draft,
+					Fork:    test.fork,
+				},
+				client: github,
+				Log:    log,
+			}
+
+			pj.Setup(context.Background(), []string{"testuser"})
+			assert.Equals(t, test.execute, pj.execute)
+			assert.Equals(t, test.replaces, Replaces(&pj, []string{"testuser"}))
+			assert.Equals(t, `"refs/heads/feature"`, pj.GetRefName())
+		})
+	}
+}
@@ -0,0 +1,173 @@
+package job
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/pleimer/ci-server-go/pkg/config"
+	"github.com/pleimer/ci-server-go/pkg/ghclient"
+	"github.com/pleimer/ci-server-go/pkg/logging"
+)
+
+// PullRequestJob works on a pull_request webhook event.
+type PullRequestJob struct {
+	// Opening, reopening, marking ready for review or pushing to a pull request runs a core job
+	// on the head of the pull request branch if the author of the pull request is authorized.
+	// Draft pull requests are skipped until they are marked ready for review.
+
+	// Pushes to pull requests opened from a branch of the repository are run by the push job of the
+	// branch, which shares the reference of the pull request, so they are skipped here.
+
+	// Closing a pull request does not run anything. Since the job targets the same reference as the
+	// jobs previously started for the pull request, the JobManager cancels any of them that are still running
+
+	Log    *logging.Logger
+	client *ghclient.Client
+	config *config.Config
+	event  *ghclient.PullRequest
+
+	execute bool
+}
+
+//SetLogger implements Job interface
+func (pj *PullRequestJob) SetLogger(l *logging.Logger) {
+	pj.Log = l
+}
+
+// Setup decides whether the pull request action warrants a job run
+func (pj *PullRequestJob) Setup(ctx context.Context, authUsers []string) {
+	pj.Log.Metadata(map[string]interface{}{"process": "PullRequestJob", "stage": "setup"})
+	pj.Log.Info(fmt.Sprintf("received '%s' action for pull request #%d in repository '%s'", pj.event.Action, pj.event.Number, pj.event.Repo.Name))
+
+	switch pj.event.Action {
+	case ghclient.PullRequestOpened, ghclient.PullRequestReopened, ghclient.PullRequestReadyForReview:
+	case ghclient.PullRequestSynchronize:
+		if !pj.event.Fork {
+			pj.Log.Metadata(map[string]interface{}{"process": "PullRequestJob", "stage": "setup"})
+			pj.Log.Debug(fmt.Sprintf("push to pull request #%d is run by the push job of ref %s", pj.event.Number, pj.event.RefName))
+			return
+		}
+	case ghclient.PullRequestClosed:
+		pj.Log.Metadata(map[string]interface{}{"process": "PullRequestJob", "stage": "setup"})
+		pj.Log.Info(fmt.Sprintf("pull request #%d closed - cancelling jobs running for ref %s", pj.event.Number, pj.event.RefName))
+		return
+	default:
+		pj.Log.Metadata(map[string]interface{}{"process": "PullRequestJob", "stage": "setup"})
+		pj.Log.Debug(fmt.Sprintf("ignoring pull request action '%s'", pj.event.Action))
+		return
+	}
+
+	if pj.event.Draft {
+		pj.Log.Metadata(map[string]interface{}{"process": "PullRequestJob", "stage": "setup"})
+		pj.Log.Info(fmt.Sprintf("pull request #%d is a draft - skipping", pj.event.Number))
+		return
+	}
+
+	if !sliceContainsString(authUsers, pj.event.Author) {
+		pj.Log.Metadata(map[string]interface{}{"process": "PullRequestJob", "stage": "setup"})
+		pj.Log.Info(fmt.Sprintf("author '%s' of pull request #%d not authorized to run jobs, ignoring", pj.event.Author, pj.event.Number))
+		return
+	}
+
+	commit := &pj.event.Commit
+	commit.SetContext("ci-server-go")
+
+	pj.Log.Metadata(map[string]interface{}{"process": "PullRequestJob", "stage": "setup"})
+	pj.Log.Info(fmt.Sprintf("authorized user '%s' opened pull request #%d - queueing job for commit '%s' in repository '%s', ref '%s'",
+		pj.event.Author, pj.event.Number, commit.Sha, pj.event.Repo.Name, pj.event.RefName))
+
+	commit.SetStatus(ghclient.PENDING, "queued", "")
+	err := postStatus(pj.client, repositoryConfig(pj.config, pj.event.Repo), pj.event.Repo, commit)
+	if err != nil {
+		pj.Log.Metadata(map[string]interface{}{"process": "PullRequestJob", "stage": "setup", "error": err.Error()})
+		pj.Log.Error("failed to update commit status to 'queued'")
+	}
+	pj.execute = true
+}
+
+//Run implements Job interface
+func (pj *PullRequestJob) Run(ctx context.Context) {
+	if !pj.execute {
+		return
+	}
+
+	pj.Log.Metadata(map[string]interface{}{"process": "PullRequestJob"})
+	pj.Log.Info(fmt.Sprintf("running pull request job for %s", pj.event.Commit.Sha))
+	RunCoreJob(ctx, pj.client, repositoryConfig(pj.config, pj.event.Repo), pj.event.Repo, pj.GetRefName(), pj.event.Commit, pj.options(), pj.Log)
+}
+
+func (pj *PullRequestJob) options() RunOptions {
+	return RunOptions{
+		PullRequest: pj.event.Number,
+		Trigger:     fmt.Sprintf("%s by @%s", pj.event.Action, pj.event.User),
+	}
+}
+
+//Replaces implements Replacer. Only actions that run a job, or close the pull request, replace the
+//jobs running for it
+func (pj *PullRequestJob) Replaces(authUsers []string) bool {
+	switch pj.event.Action {
+	case ghclient.PullRequestOpened, ghclient.PullRequestReopened, ghclient.PullRequestReadyForReview, ghclient.PullRequestClosed:
+		return true
+	case ghclient.PullRequestSynchronize:
+		// otherwise the push job of the same commit is running
+		return pj.event.Fork
+	}
+	return false
+}
+
+//GetRefName implements Job interface
+func (pj *PullRequestJob) GetRefName() string {
+	return pj.event.RefName
+}
+
+//GetRepoName implements Job interface
+func (pj *PullRequestJob) GetRepoName() string {
+	return pj.event.Repo.FullName()
+}
+
+//Delivery implements Deliverer
+func (pj *PullRequestJob) Delivery() string {
+	return pj.event.Delivery
+}
+
+//Info implements Describer
+func (pj *PullRequestJob) Info() Info {
+	branch := branchName(pj.GetRefName())
+	return Info{
+		Type:          TypePullRequest,
+		Repo:          pj.GetRepoName(),
+		Branch:        branch,
+		DefaultBranch: branch == pj.event.Repo.DefaultBranch,
+		User:          pj.event.User,
+	}
+}
+
+//Discard implements Discarder
+func (pj *PullRequestJob) Discard(reason string) {
+	if !pj.execute {
+		return
+	}
+	pj.execute = false
+	pj.event.Commit.SetStatus(ghclient.ERROR, reason, "")
+	pj.event.Commit.SetConclusion(ghclient.CheckCancelled)
+	err := postStatus(pj.client, repositoryConfig(pj.config, pj.event.Repo), pj.event.Repo, &pj.event.Commit)
+	if err != nil {
+		pj.Log.Metadata(map[string]interface{}{"process": "PullRequestJob", "error": err.Error()})
+		pj.Log.Error("failed to update status of discarded job")
+	}
+}
+
+//Record implements Recorder
+func (pj *PullRequestJob) Record() (Record, bool) {
+	if !pj.execute {
+		return Record{}, false
+	}
+	return Record{
+		Info:    pj.Info(),
+		Repo:    pj.event.Repo,
+		RefName: pj.GetRefName(),
+		Commit:  pj.event.Commit,
+		Options: pj.options(),
+	}, true
+}
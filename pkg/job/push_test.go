@@ -4,6 +4,7 @@ import (
 	"context"
 	"testing"
 
+	"github.com/pleimer/ci-server-go/pkg/assert"
 	"github.com/pleimer/ci-server-go/pkg/ghclient"
 )
 
@@ -31,6 +32,16 @@ func TestPushJob(t *testing.T) {
 		// expGistStr := formatGistOutput(repo.Name, commit.Sha, "t0", "Done")
 		// assert.Equals(t, expGistStr, gistString)
 	})
+
+	t.Run("info", func(t *testing.T) {
+		repo := ghclient.Repository{Name: "example", DefaultBranch: "main"}
+		repo.Owner.Login = "owner"
+		pj := PushJob{event: &ghclient.Push{Repo: repo, RefName: `"refs/heads/main"`, User: "user1"}}
+		assert.Equals(t, Info{Type: TypePush, Repo: "owner/example", Branch: "main", DefaultBranch: true, User: "user1"}, Describe(&pj))
+
+		pj.event.RefName = `"refs/heads/feature"`
+		assert.Equals(t, false, Describe(&pj).DefaultBranch)
+	})
 }
 
 // 	t.Run("script fail", func(t *testing.T) {
@@ -5,7 +5,7 @@ import (
 	"fmt"
 	"strings"
 
-	"github.com/golang-collections/go-datastructures/queue"
+	"github.com/pleimer/ci-server-go/pkg/config"
 	"github.com/pleimer/ci-server-go/pkg/ghclient"
 	"github.com/pleimer/ci-server-go/pkg/logging"
 )
@@ -14,6 +14,7 @@ import (
 type PushJob struct {
 	event             *ghclient.Push
 	client            *ghclient.Client
+	config            *config.Config
 	scriptOutput      []byte
 	afterScriptOutput []byte
 	execute           bool
@@ -33,14 +34,9 @@ func (p *PushJob) GetRefName() string {
 	return p.event.RefName
 }
 
-// GetRepoName get reference name from event that triggered job
+// GetRepoName get repository name, in the form owner/repo, from event that triggered job
 func (p *PushJob) GetRepoName() string {
-	return p.event.Repo.Name
-}
-
-// Compare implements queue.Item
-func (p *PushJob) Compare(other queue.Item) int {
-	return 0
+	return p.event.Repo.FullName()
 }
 
 //Setup ..
@@ -60,7 +56,7 @@ func (p *PushJob) Setup(ctx context.Context, authUsers []string) {
 				p.event.User, commit.Sha, p.event.Repo.Name))
 
 			commit.SetStatus(ghclient.PENDING, "queued", "")
-			err := p.client.UpdateCommitStatus(p.event.Repo, *commit)
+			err := postStatus(p.client, repositoryConfig(p.config, p.event.Repo), p.event.Repo, commit)
 			if err != nil {
 				p.Log.Metadata(map[string]interface{}{"process": "CommentJob", "stage": "setup", "error": err.Error()})
 				p.Log.Error("failed to update commit status to 'queued'")
@@ -94,5 +90,52 @@ func (p *PushJob) Run(ctx context.Context) {
 
 	p.Log.Metadata(map[string]interface{}{"process": "PushJob"})
 	p.Log.Info(fmt.Sprintf("proceeding with job sequence on master branch for commit %s", commit.Sha))
-	RunCoreJob(ctx, p.client, p.event.Repo, p.GetRefName(), *commit, p.Log)
+	RunCoreJob(ctx, p.client, repositoryConfig(p.config, p.event.Repo), p.event.Repo, p.GetRefName(), *commit, RunOptions{}, p.Log)
+}
+
+//Delivery implements Deliverer
+func (p *PushJob) Delivery() string {
+	return p.event.Delivery
+}
+
+//Info implements Describer
+func (p *PushJob) Info() Info {
+	branch := branchName(p.GetRefName())
+	return Info{
+		Type:          TypePush,
+		Repo:          p.GetRepoName(),
+		Branch:        branch,
+		DefaultBranch: branch == p.event.Repo.DefaultBranch,
+		User:          p.event.User,
+	}
+}
+
+//Discard implements Discarder
+func (p *PushJob) Discard(reason string) {
+	if !p.execute {
+		return
+	}
+	p.execute = false
+	commit := p.event.Ref.GetHead()
+	commit.SetStatus(ghclient.ERROR, reason, "")
+	commit.SetConclusion(ghclient.CheckCancelled)
+	err := postStatus(p.client, repositoryConfig(p.config, p.event.Repo), p.event.Repo, commit)
+	if err != nil {
+		p.Log.Metadata(map[string]interface{}{"process": "PushJob", "error": err.Error()})
+		p.Log.Error("failed to update status of discarded job")
+	}
+}
+
+//Record implements Recorder
+func (p *PushJob) Record() (Record, bool) {
+	commit := p.event.Ref.GetHead()
+	if !p.execute || commit == nil {
+		return Record{}, false
+	}
+	return Record{
+		Info:    p.Info(),
+		Repo:    p.event.Repo,
+		RefName: p.GetRefName(),
+		Commit:  *commit,
+	}, true
 }
@@ -0,0 +1,139 @@
+package job
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/pleimer/ci-server-go/pkg/config"
+	"github.com/pleimer/ci-server-go/pkg/ghclient"
+	"github.com/pleimer/ci-server-go/pkg/logging"
+)
+
+// Record persistent description of a job that is set up to run, from which the job can be restored
+type Record struct {
+	Info     Info                `json:"info"`
+	Repo     ghclient.Repository `json:"repository"`
+	RefName  string              `json:"ref"`
+	Commit   ghclient.Commit     `json:"commit"`
+	Options  RunOptions          `json:"options"`
+	Comment  int64               `json:"comment,omitempty"`  // ID of the comment that requested the run
+	Reaction int64               `json:"reaction,omitempty"` // ID of the reaction acknowledging the comment
+}
+
+// Recorder is implemented by jobs that can be persisted and restored after a restart
+type Recorder interface {
+	// Record returns false if the job will not run, in which case there is nothing to restore
+	Record() (Record, bool)
+}
+
+// RecordOf retrieves the record of j. Returns false if j can't be restored or will not run
+func RecordOf(j Job) (Record, bool) {
+	if r, ok := j.(Recorder); ok {
+		return r.Record()
+	}
+	return Record{}, false
+}
+
+// RestoredJob runs the core job described by a record, typically of a job that was queued or
+// running when the server stopped
+type RestoredJob struct {
+	Log    *logging.Logger
+	client *ghclient.Client
+	config *config.Config
+	record Record
+
+	execute bool
+}
+
+// Restore creates the job described by rec
+func Restore(rec Record, client *ghclient.Client, conf *config.Config, log *logging.Logger) *RestoredJob {
+	return &RestoredJob{
+		Log:     log,
+		client:  client,
+		config:  conf,
+		record:  rec,
+		execute: true,
+	}
+}
+
+//SetLogger implements Job interface
+func (r *RestoredJob) SetLogger(l *logging.Logger) {
+	r.Log = l
+}
+
+// Setup reports the job as queued again, replacing the pending status left by the interrupted job
+func (r *RestoredJob) Setup(ctx context.Context, authUsers []string) {
+	if !r.execute {
+		return
+	}
+	r.prepare()
+	r.Log.Metadata(map[string]interface{}{"process": "RestoredJob", "stage": "setup"})
+	r.Log.Info(fmt.Sprintf("restoring job for commit '%s' in repository '%s', ref '%s'", r.record.Commit.Sha, r.GetRepoName(), r.GetRefName()))
+
+	r.record.Commit.SetStatus(ghclient.PENDING, "queued", "")
+	if err := r.postStatus(); err != nil {
+		r.Log.Metadata(map[string]interface{}{"process": "RestoredJob", "stage": "setup", "error": err.Error()})
+		r.Log.Error("failed to update commit status to 'queued'")
+	}
+}
+
+//Run implements Job interface
+func (r *RestoredJob) Run(ctx context.Context) {
+	if !r.execute {
+		return
+	}
+	r.Log.Metadata(map[string]interface{}{"process": "RestoredJob"})
+	r.Log.Info(fmt.Sprintf("running restored job for %s", r.record.Commit.Sha))
+	result := RunCoreJob(ctx, r.client, repositoryConfig(r.config, r.record.Repo), r.record.Repo, r.GetRefName(), r.record.Commit, r.record.Options, r.Log)
+	concludeComment(r.client, r.record.Repo, r.record.Comment, r.record.Reaction, result.Succeeded(), r.Log)
+}
+
+//GetRefName implements Job interface
+func (r *RestoredJob) GetRefName() string {
+	return r.record.RefName
+}
+
+//GetRepoName implements Job interface
+func (r *RestoredJob) GetRepoName() string {
+	return r.record.Repo.FullName()
+}
+
+//Info implements Describer
+func (r *RestoredJob) Info() Info {
+	return r.record.Info
+}
+
+//Record implements Recorder
+func (r *RestoredJob) Record() (Record, bool) {
+	return r.record, r.execute
+}
+
+//Discard implements Discarder
+func (r *RestoredJob) Discard(reason string) {
+	if !r.execute {
+		return
+	}
+	r.execute = false
+	r.prepare()
+	r.record.Commit.SetStatus(ghclient.ERROR, reason, "")
+	r.record.Commit.SetConclusion(ghclient.CheckCancelled)
+	if err := r.postStatus(); err != nil {
+		r.Log.Metadata(map[string]interface{}{"process": "RestoredJob", "error": err.Error()})
+		r.Log.Error("failed to update status of discarded job")
+	}
+	concludeComment(r.client, r.record.Repo, r.record.Comment, r.record.Reaction, false, r.Log)
+}
+
+// prepare picks up the current metadata of the repository and indexes the commit, which statuses
+// reported through check runs require
+func (r *RestoredJob) prepare() {
+	if repo, ok := r.client.Repositories.Get(r.record.Repo.FullName()); ok {
+		r.record.Repo = repo
+	}
+	r.record.Commit.SetContext(ghclient.StatusContext)
+	r.client.Cache.WriteCommits(&r.record.Commit)
+}
+
+func (r *RestoredJob) postStatus() error {
+	return postStatus(r.client, repositoryConfig(r.config, r.record.Repo), r.record.Repo, &r.record.Commit)
+}
@@ -0,0 +1,152 @@
+package job
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/pleimer/ci-server-go/pkg/assert"
+	"github.com/pleimer/ci-server-go/pkg/config"
+	"github.com/pleimer/ci-server-go/pkg/ghclient"
+)
+
+func TestRestoredJob(t *testing.T) {
+	_, github, repo, _, commit, log, _ := genTestEnvironment([]string{"echo $OCP_PROJECT"}, []string{"echo Done"})
+	github.User = "ci-bot"
+
+	statuses := []ghclient.Status{}
+	reactions := []string{}
+	handler := func(req *http.Request) *http.Response {
+		path := strings.TrimPrefix(req.URL.String(), "https://api.github.com/repos/owner/example/")
+		respond := func(code int, body string) *http.Response {
+			return &http.Response{
+				StatusCode: code,
+				Status:     http.StatusText(code),
+				Body:       ioutil.NopCloser(strings.NewReader(body)),
+				Header:     make(http.Header),
+			}
+		}
+
+		switch {
+		case path == "statuses/t0":
+			status := ghclient.Status{}
+			assert.Ok(t, json.NewDecoder(req.Body).Decode(&status))
+			statuses = append(statuses, status)
+			return respond(201, `{}`)
+		case req.Method == "POST" && path == "issues/comments/7/reactions":
+			reaction := map[string]string{}
+			assert.Ok(t, json.NewDecoder(req.Body).Decode(&reaction))
+			reactions = append(reactions, reaction["content"])
+			return respond(201, `{"id": 3}`)
+		case req.Method == "DELETE" && path == "issues/comments/7/reactions/3":
+			reactions = append(reactions, "-"+ghclient.ReactionEyes)
+			return respond(204, "")
+		}
+		return respond(404, "not found")
+	}
+	github.Api.Client = ghclient.NewTestClient(handler)
+
+	cj := &CommentJob{
+		event: &ghclient.Comment{
+			Repo:    *repo,
+			Commit:  commit,
+			ID:      7,
+			Number:  1,
+			Action:  ghclient.CommentCreated,
+			RefName: `"refs/heads/feature"`,
+			Body:    "/runtest timeout=900",
+			User:    "testuser",
+		},
+		client: github,
+		Log:    log,
+	}
+	cj.Setup(context.Background(), []string{"testuser"})
+	rec, ok := RecordOf(cj)
+	assert.Assert(t, ok, "job set up to run should have a record")
+
+	// the record survives a restart of the server, which starts with an empty client
+	data, err := json.Marshal(rec)
+	assert.Ok(t, err)
+	restored := Record{}
+	assert.Ok(t, json.Unmarshal(data, &restored))
+	assert.Equals(t, rec.Options, restored.Options)
+	assert.Equals(t, "owner/example", restored.Repo.FullName())
+
+	restarted := ghclient.NewClient(nil, "ci-bot")
+	restarted.Api.Client = ghclient.NewTestClient(handler)
+
+	t.Run("requeue", func(t *testing.T) {
+		statuses = statuses[:0]
+		rj := Restore(restored, restarted, nil, log)
+		rj.Setup(context.Background(), []string{"testuser"})
+		assert.Equals(t, 1, len(statuses))
+		assert.Equals(t, "pending", statuses[0].State)
+		assert.Equals(t, "queued", statuses[0].Description)
+		assert.Equals(t, ghclient.StatusContext, statuses[0].Context)
+		assert.Equals(t, cj.Info(), rj.Info())
+		assert.Equals(t, `"refs/heads/feature"`, rj.GetRefName())
+	})
+
+	t.Run("error", func(t *testing.T) {
+		statuses = statuses[:0]
+		reactions = reactions[:0]
+		rj := Restore(restored, restarted, nil, log)
+		rj.Discard("interrupted by a server restart")
+		assert.Equals(t, 1, len(statuses))
+		assert.Equals(t, "error", statuses[0].State)
+		assert.Equals(t, "interrupted by a server restart", statuses[0].Description)
+		assert.Equals(t, []string{"-" + ghclient.ReactionEyes, ghclient.ReactionThumbsDown}, reactions)
+
+		_, ok := RecordOf(rj)
+		assert.Assert(t, !ok, "discarded job should not be recorded")
+	})
+
+	t.Run("check run kept", func(t *testing.T) {
+		conf := config.New()
+		conf.Repositories = []config.RepositoryConfig{{Name: "owner/example", Reporter: config.ReportChecks}}
+		checkRuns := []string{}
+		client := ghclient.NewClient(nil, "ci-bot")
+		client.Api.Client = ghclient.NewTestClient(func(req *http.Request) *http.Response {
+			path := strings.TrimPrefix(req.URL.String(), "https://api.github.com/repos/owner/example/")
+			if strings.HasPrefix(path, "check-runs") {
+				checkRuns = append(checkRuns, req.Method+" "+path)
+				return &http.Response{
+					StatusCode: 201,
+					Status:     http.StatusText(201),
+					Body:       ioutil.NopCloser(strings.NewReader(`{"id": 12}`)),
+					Header:     make(http.Header),
+				}
+			}
+			return handler(req)
+		})
+
+		checked := &CommentJob{event: &ghclient.Comment{
+			Repo:    *repo,
+			Commit:  commit,
+			Action:  ghclient.CommentCreated,
+			RefName: `"refs/heads/feature"`,
+			Body:    "/runtest",
+			User:    "testuser",
+		}, client: client, config: conf, Log: log}
+		checked.Setup(context.Background(), []string{"testuser"})
+		rec, ok := RecordOf(checked)
+		assert.Assert(t, ok, "job set up to run should have a record")
+		assert.Equals(t, int64(12), rec.Commit.CheckRun)
+
+		data, err := json.Marshal(rec)
+		assert.Ok(t, err)
+		restored := Record{}
+		assert.Ok(t, json.Unmarshal(data, &restored))
+		rj := Restore(restored, client, conf, log)
+		rj.Setup(context.Background(), []string{"testuser"})
+		assert.Equals(t, []string{"POST check-runs", "PATCH check-runs/12"}, checkRuns)
+	})
+
+	t.Run("not running", func(t *testing.T) {
+		_, ok := RecordOf(&CommentJob{event: &ghclient.Comment{Body: "looks good"}, client: github, Log: log})
+		assert.Assert(t, !ok, "job that won't run should not be recorded")
+	})
+}
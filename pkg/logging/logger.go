@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"os"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -37,13 +38,15 @@ func (l LogLevel) String() string {
 
 type writeFn func(string) error
 
-// Logger implements a simple logger with 4 levels
+// Logger implements a simple logger with 4 levels. It is safe for concurrent use, though
+// metadata set by one goroutine may end up on a record written by another
 type Logger struct {
 	Level     LogLevel
 	Timestamp bool
 	metadata  map[string]interface{}
 	logfile   *os.File
 	write     writeFn
+	lock      sync.Mutex
 }
 
 // NewLogger logger factory
@@ -87,6 +90,8 @@ func (l *Logger) Destroy() error {
 
 // Metadata set metadata to include in message
 func (l *Logger) Metadata(metadata map[string]interface{}) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
 	l.metadata = metadata
 }
 
@@ -112,6 +117,8 @@ func (l *Logger) formatMetadata() (string, error) {
 }
 
 func (l *Logger) writeRecord(level LogLevel, message string) error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
 	metadata, err := l.formatMetadata()
 	if err != nil {
 		return err
@@ -0,0 +1,212 @@
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// metric types
+const (
+	counterType = "counter"
+	gaugeType   = "gauge"
+)
+
+var registry = struct {
+	lock    sync.Mutex
+	metrics map[string]*Vec
+}{
+	metrics: make(map[string]*Vec),
+}
+
+// Vec collection of time series of a metric distinguished by the value of a single label.
+// Metrics without a label hold a single time series
+type Vec struct {
+	name       string
+	help       string
+	metricType string
+	label      string
+
+	lock   sync.Mutex
+	values map[string]float64
+}
+
+// Counter monotonically increasing value
+type Counter struct {
+	vec   *Vec
+	label string
+}
+
+// Gauge value that can go up and down
+type Gauge struct {
+	vec   *Vec
+	label string
+}
+
+// NewCounter registers counter. Registering the same name twice returns the existing metric
+func NewCounter(name, help string) *Counter {
+	return &Counter{vec: register(name, help, counterType, "")}
+}
+
+// NewCounterVec registers counter partitioned by label
+func NewCounterVec(name, help, label string) *Vec {
+	return register(name, help, counterType, label)
+}
+
+// NewGauge registers gauge. Registering the same name twice returns the existing metric
+func NewGauge(name, help string) *Gauge {
+	return &Gauge{vec: register(name, help, gaugeType, "")}
+}
+
+// NewGaugeVec registers gauge partitioned by label
+func NewGaugeVec(name, help, label string) *Vec {
+	return register(name, help, gaugeType, label)
+}
+
+func register(name, help, metricType, label string) *Vec {
+	registry.lock.Lock()
+	defer registry.lock.Unlock()
+	if v, ok := registry.metrics[name]; ok {
+		return v
+	}
+	v := &Vec{
+		name:       name,
+		help:       help,
+		metricType: metricType,
+		label:      label,
+		values:     make(map[string]float64),
+	}
+	registry.metrics[name] = v
+	return v
+}
+
+// Counter retrieve counter for label value
+func (v *Vec) Counter(value string) *Counter {
+	return &Counter{vec: v, label: value}
+}
+
+// Gauge retrieve gauge for label value
+func (v *Vec) Gauge(value string) *Gauge {
+	return &Gauge{vec: v, label: value}
+}
+
+func (v *Vec) add(label string, delta float64) {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	v.values[label] += delta
+}
+
+func (v *Vec) set(label string, value float64) {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	v.values[label] = value
+}
+
+func (v *Vec) get(label string) float64 {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	return v.values[label]
+}
+
+// Inc increments counter by 1
+func (c *Counter) Inc() {
+	c.vec.add(c.label, 1)
+}
+
+// Add increments counter by delta. Negative values are ignored
+func (c *Counter) Add(delta float64) {
+	if delta > 0 {
+		c.vec.add(c.label, delta)
+	}
+}
+
+// Value current value of counter
+func (c *Counter) Value() float64 {
+	return c.vec.get(c.label)
+}
+
+// Set sets gauge to value
+func (g *Gauge) Set(value float64) {
+	g.vec.set(g.label, value)
+}
+
+// Add adds delta to gauge
+func (g *Gauge) Add(delta float64) {
+	g.vec.add(g.label, delta)
+}
+
+// Value current value of gauge
+func (g *Gauge) Value() float64 {
+	return g.vec.get(g.label)
+}
+
+// Write writes all registered metrics in prometheus text exposition format
+func Write(w io.Writer) error {
+	registry.lock.Lock()
+	names := make([]string, 0, len(registry.metrics))
+	for name := range registry.metrics {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	vecs := make([]*Vec, 0, len(names))
+	for _, name := range names {
+		vecs = append(vecs, registry.metrics[name])
+	}
+	registry.lock.Unlock()
+
+	for _, v := range vecs {
+		if err := v.write(w); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (v *Vec) write(w io.Writer) error {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	var sb strings.Builder
+	sb.WriteString(fmt.Sprintf("# HELP %s %s\n# TYPE %s %s\n", v.name, v.help, v.name, v.metricType))
+
+	labels := make([]string, 0, len(v.values))
+	for label := range v.values {
+		labels = append(labels, label)
+	}
+	sort.Strings(labels)
+
+	if v.label == "" && len(labels) == 0 {
+		labels = append(labels, "")
+	}
+	for _, label := range labels {
+		sb.WriteString(v.name)
+		if v.label != "" {
+			sb.WriteString(fmt.Sprintf("{%s=%q}", v.label, label))
+		}
+		sb.WriteString(" ")
+		sb.WriteString(formatValue(v.values[label]))
+		sb.WriteString("\n")
+	}
+
+	_, err := io.WriteString(w, sb.String())
+	return err
+}
+
+func formatValue(value float64) string {
+	if value == math.Trunc(value) && math.Abs(value) < 1e15 {
+		return fmt.Sprintf("%d", int64(value))
+	}
+	return fmt.Sprintf("%g", value)
+}
+
+// Handler serves registered metrics
+func Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		Write(w)
+	})
+}
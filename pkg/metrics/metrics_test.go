@@ -0,0 +1,34 @@
+package metrics
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/pleimer/ci-server-go/pkg/assert"
+)
+
+func TestWrite(t *testing.T) {
+	counter := NewCounter("test_events_total", "Events seen")
+	counter.Inc()
+	counter.Add(2)
+	counter.Add(-1)
+	assert.Equals(t, float64(3), counter.Value())
+	assert.Equals(t, counter.vec, NewCounter("test_events_total", "Events seen").vec)
+
+	vec := NewGaugeVec("test_queue_length", "Jobs in queue", "state")
+	vec.Gauge("running").Set(1.5)
+	vec.Gauge("pending").Add(4)
+
+	buf := &bytes.Buffer{}
+	assert.Ok(t, Write(buf))
+	out := buf.String()
+
+	expected := []string{
+		"# HELP test_events_total Events seen\n# TYPE test_events_total counter\ntest_events_total 3\n",
+		"# TYPE test_queue_length gauge\ntest_queue_length{state=\"pending\"} 4\ntest_queue_length{state=\"running\"} 1.5\n",
+	}
+	for _, e := range expected {
+		assert.Assert(t, strings.Contains(out, e), "missing from output: "+e)
+	}
+}
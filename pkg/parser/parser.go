@@ -30,10 +30,29 @@ type Spec struct {
 	Global      *Global  `yaml:"global"`
 	Script      []string `yaml:"script"`
 	AfterScript []string `yaml:"after_script"`
+	RunsOn      Labels   `yaml:"runs_on,omitempty"` // labels of the agent running the scripts. Scripts run on the server if empty
 
 	metaVars map[string]string
 }
 
+// Labels list of labels, written in yaml either as a list or as a single label
+type Labels []string
+
+// UnmarshalYAML implements yaml.Unmarshaler
+func (l *Labels) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var label string
+	if err := unmarshal(&label); err == nil {
+		*l = Labels{label}
+		return nil
+	}
+	var labels []string
+	if err := unmarshal(&labels); err != nil {
+		return err
+	}
+	*l = labels
+	return nil
+}
+
 func (s *Spec) SetMetaVar(key, val string) {
 	s.metaVars[key] = val
 }
@@ -51,8 +70,18 @@ func (s *Spec) AfterScriptCmd(ctx context.Context, basePath string) *exec.Cmd {
 }
 
 func (s *Spec) genEnv(ctx context.Context, comList []string) *exec.Cmd {
-	cmdString := strings.Join(comList, ";")
-	cmd := exec.CommandContext(ctx, "bash", "-ce", cmdString)
+	cmd := exec.CommandContext(ctx, "bash", "-ce", JoinCommands(comList))
+	cmd.Env = append(os.Environ(), s.Env()...)
+	return cmd
+}
+
+// JoinCommands bash script running the commands of comList in order
+func JoinCommands(comList []string) string {
+	return strings.Join(comList, ";")
+}
+
+// Env variables of the spec in the form key=value, with magic variables resolved
+func (s *Spec) Env() []string {
 	var newEnv []string
 	for key, val := range s.Global.Env {
 		switch v := val.(type) {
@@ -66,9 +95,7 @@ func (s *Spec) genEnv(ctx context.Context, comList []string) *exec.Cmd {
 			}
 		}
 	}
-
-	cmd.Env = append(os.Environ(), newEnv...)
-	return cmd
+	return newEnv
 }
 
 func NewSpecFromYAML(yamlSpec io.Reader) (*Spec, error) {
@@ -34,3 +34,18 @@ func TestScriptCmd(t *testing.T) {
 
 	assert.Equals(t, "stf\n", string(out))
 }
+
+func TestRunsOn(t *testing.T) {
+	for yamlSpec, expected := range map[string]Labels{
+		"script: [make]\n":                        nil,
+		"script: [make]\nruns_on: ocp\n":          {"ocp"},
+		"script: [make]\nruns_on: [ocp, large]\n": {"ocp", "large"},
+	} {
+		spec, err := NewSpecFromYAML(bytes.NewBufferString(yamlSpec))
+		assert.Ok(t, err)
+		assert.Equals(t, expected, spec.RunsOn)
+	}
+
+	_, err := NewSpecFromYAML(bytes.NewBufferString("runs_on: {os: linux}\n"))
+	assert.Assert(t, err != nil, "runs_on should be a label or a list of labels")
+}
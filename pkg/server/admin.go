@@ -0,0 +1,184 @@
+package server
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/pleimer/ci-server-go/pkg/agent"
+	"github.com/pleimer/ci-server-go/pkg/config"
+	"github.com/pleimer/ci-server-go/pkg/ghclient"
+	"github.com/pleimer/ci-server-go/pkg/job"
+)
+
+// registerAdmin registers admin endpoints on the webhook server. Admin endpoints are
+// disabled unless an admin token is configured
+func registerAdmin() {
+	if serverConfig.Admin.Token == "" {
+		return
+	}
+	github.Handle("/admin/deliveries", adminHandler(http.HandlerFunc(listDeliveries)))
+	github.Handle("/admin/deliveries/", adminHandler(http.HandlerFunc(delivery)))
+	github.Handle("/admin/queue", adminHandler(http.HandlerFunc(listQueue)))
+	github.Handle("/admin/drain", adminHandler(http.HandlerFunc(drainServer)))
+	github.Handle("/admin/agents", adminHandler(http.HandlerFunc(listAgents)))
+}
+
+// registerAgents serves the coordinator of remote agents on the webhook server. Remote agents are
+// disabled unless an agents token is configured
+func registerAgents() {
+	if serverConfig.Agents.Token == "" {
+		coordinator = nil
+		job.SetDispatcher(nil)
+		return
+	}
+	coordinator = agent.NewCoordinator(serverConfig.Agents.Token, logger)
+	github.Handle("/agents/", coordinator)
+	job.SetDispatcher(coordinator)
+}
+
+// adminHandler rejects requests without the admin token
+func adminHandler(next http.Handler) http.Handler {
+	expected := []byte("Bearer " + serverConfig.Admin.Token)
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if subtle.ConstantTimeCompare([]byte(req.Header.Get("Authorization")), expected) != 1 {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, req)
+	})
+}
+
+// GET /admin/deliveries
+func listDeliveries(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	writeJSON(w, http.StatusOK, github.Journal.List())
+}
+
+// GET /admin/queue
+func listQueue(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	writeJSON(w, http.StatusOK, jobManager.Queue())
+}
+
+// GET /admin/agents
+func listAgents(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	agents := []agent.AgentInfo{}
+	if coordinator != nil {
+		agents = coordinator.Agents()
+	}
+	writeJSON(w, http.StatusOK, agents)
+}
+
+// POST /admin/drain
+func drainServer(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	Drain()
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// GET /admin/deliveries/<id>
+// POST /admin/deliveries/<id>/replay
+func delivery(w http.ResponseWriter, req *http.Request) {
+	path := strings.TrimPrefix(req.URL.Path, "/admin/deliveries/")
+	id := strings.TrimSuffix(path, "/replay")
+
+	switch {
+	case req.Method == http.MethodGet && id == path:
+		entry, ok := github.Journal.Get(id)
+		if !ok {
+			http.Error(w, ghclient.ErrDeliveryNotFound.Error(), http.StatusNotFound)
+			return
+		}
+		writeJSON(w, http.StatusOK, entry)
+
+	case req.Method == http.MethodPost && id != path:
+		err := github.Replay(id, logger)
+		switch {
+		case err == ghclient.ErrDeliveryNotFound:
+			http.Error(w, err.Error(), http.StatusNotFound)
+		case err != nil:
+			http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		default:
+			w.WriteHeader(http.StatusAccepted)
+		}
+
+	default:
+		http.Error(w, "not found", http.StatusNotFound)
+	}
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(v)
+}
+
+// Replay asks the server running with the configuration at configPath to replay delivery
+func Replay(configPath string, delivery string) error {
+	return postAdmin(configPath, "replay", "deliveries", delivery, "replay")
+}
+
+// RequestDrain asks the server running with the configuration at configPath to drain, see Drain
+func RequestDrain(configPath string) error {
+	return postAdmin(configPath, "drain", "drain")
+}
+
+// postAdmin posts to the admin endpoint made of items on the server running with the configuration at configPath
+func postAdmin(configPath, action string, items ...string) error {
+	conf, err := loadConfig(configPath)
+	if err != nil {
+		return err
+	}
+	if conf.Admin.Token == "" {
+		return fmt.Errorf("admin.token must be configured to %s", action)
+	}
+
+	req, err := http.NewRequest(http.MethodPost, adminURL(conf, items...), nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+conf.Admin.Token)
+
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return errors.Wrap(err, "failed contacting server")
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusAccepted {
+		body, _ := ioutil.ReadAll(res.Body)
+		return fmt.Errorf("%s failed with %s: %s", action, res.Status, strings.TrimSpace(string(body)))
+	}
+	return nil
+}
+
+// adminURL url of admin endpoint on the local listener
+func adminURL(conf *config.Config, items ...string) string {
+	host, port, err := net.SplitHostPort(conf.Listener.Address)
+	if err != nil {
+		host, port = conf.Listener.Address, "80"
+	}
+	if host == "" || host == "0.0.0.0" || host == "::" {
+		host = "localhost"
+	}
+	return fmt.Sprintf("http://%s/admin/%s", net.JoinHostPort(host, port), strings.Join(items, "/"))
+}
@@ -0,0 +1,132 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/pleimer/ci-server-go/pkg/agent"
+	"github.com/pleimer/ci-server-go/pkg/assert"
+	"github.com/pleimer/ci-server-go/pkg/config"
+	"github.com/pleimer/ci-server-go/pkg/ghclient"
+	"github.com/pleimer/ci-server-go/pkg/job"
+	"github.com/pleimer/ci-server-go/pkg/logging"
+)
+
+func TestAdmin(t *testing.T) {
+	var err error
+	serverConfig = config.New()
+	serverConfig.Admin.Token = "admin-token"
+	logger, err = logging.NewLogger(logging.NONE, "console")
+	assert.Ok(t, err)
+	github = ghclient.NewClient(make(chan ghclient.Event, 1), "testuser")
+	github.Journal, err = ghclient.NewJournal("", ghclient.DefaultJournalCapacity)
+	assert.Ok(t, err)
+	assert.Ok(t, github.Journal.Record(ghclient.JournalEntry{Delivery: "known", Event: "ping", Body: "{}"}))
+
+	handler := adminHandler(http.HandlerFunc(delivery))
+	request := func(method, path, token string) int {
+		req := httptest.NewRequest(method, path, nil)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	t.Run("token required", func(t *testing.T) {
+		assert.Equals(t, http.StatusUnauthorized, request("GET", "/admin/deliveries/known", ""))
+		assert.Equals(t, http.StatusUnauthorized, request("GET", "/admin/deliveries/known", "wrong"))
+	})
+
+	t.Run("get delivery", func(t *testing.T) {
+		assert.Equals(t, http.StatusOK, request("GET", "/admin/deliveries/known", "admin-token"))
+		assert.Equals(t, http.StatusNotFound, request("GET", "/admin/deliveries/unknown", "admin-token"))
+	})
+
+	t.Run("replay", func(t *testing.T) {
+		assert.Equals(t, http.StatusNotFound, request("POST", "/admin/deliveries/unknown/replay", "admin-token"))
+		// ping events are not supported
+		assert.Equals(t, http.StatusUnprocessableEntity, request("POST", "/admin/deliveries/known/replay", "admin-token"))
+	})
+
+	t.Run("queue", func(t *testing.T) {
+		var err error
+		jobManager, err = NewJobManager(config.New(), logger)
+		assert.Ok(t, err)
+		_, err = jobManager.jobQueue.Put(&TestJob{Ref: "master", Repo: "owner/example", Type: "push"})
+		assert.Ok(t, err)
+
+		req := httptest.NewRequest("GET", "/admin/queue", nil)
+		req.Header.Set("Authorization", "Bearer admin-token")
+		rec := httptest.NewRecorder()
+		adminHandler(http.HandlerFunc(listQueue)).ServeHTTP(rec, req)
+		assert.Equals(t, http.StatusOK, rec.Code)
+
+		entries := []QueueEntry{}
+		assert.Ok(t, json.NewDecoder(rec.Body).Decode(&entries))
+		assert.Equals(t, 1, len(entries))
+		assert.Equals(t, 1, entries[0].Position)
+		assert.Equals(t, "owner/example", entries[0].Repo)
+		assert.Equals(t, "push", entries[0].Type)
+	})
+
+	t.Run("drain", func(t *testing.T) {
+		req := httptest.NewRequest("GET", "/admin/drain", nil)
+		req.Header.Set("Authorization", "Bearer admin-token")
+		rec := httptest.NewRecorder()
+		adminHandler(http.HandlerFunc(drainServer)).ServeHTTP(rec, req)
+		assert.Equals(t, http.StatusMethodNotAllowed, rec.Code)
+
+		req = httptest.NewRequest("POST", "/admin/drain", nil)
+		req.Header.Set("Authorization", "Bearer admin-token")
+		rec = httptest.NewRecorder()
+		adminHandler(http.HandlerFunc(drainServer)).ServeHTTP(rec, req)
+		assert.Equals(t, http.StatusAccepted, rec.Code)
+		select {
+		case <-drainRequests:
+		default:
+			t.Error("server should have been asked to drain")
+		}
+	})
+
+	t.Run("agents", func(t *testing.T) {
+		list := func() []agent.AgentInfo {
+			req := httptest.NewRequest("GET", "/admin/agents", nil)
+			req.Header.Set("Authorization", "Bearer admin-token")
+			rec := httptest.NewRecorder()
+			adminHandler(http.HandlerFunc(listAgents)).ServeHTTP(rec, req)
+			assert.Equals(t, http.StatusOK, rec.Code)
+			agents := []agent.AgentInfo{}
+			assert.Ok(t, json.NewDecoder(rec.Body).Decode(&agents))
+			return agents
+		}
+
+		registerAgents()
+		assert.Equals(t, 0, len(list()))
+
+		serverConfig.Agents.Token = "agent-token"
+		defer job.SetDispatcher(nil)
+		registerAgents()
+		req := httptest.NewRequest("POST", "/agents/register", strings.NewReader(`{"name": "agent-1", "labels": ["ocp"]}`))
+		req.Header.Set("Authorization", "Bearer agent-token")
+		rec := httptest.NewRecorder()
+		coordinator.ServeHTTP(rec, req)
+		assert.Equals(t, http.StatusOK, rec.Code)
+
+		agents := list()
+		assert.Equals(t, 1, len(agents))
+		assert.Equals(t, "agent-1", agents[0].Name)
+		assert.Equals(t, []string{"ocp"}, agents[0].Labels)
+	})
+
+	t.Run("admin url", func(t *testing.T) {
+		conf := config.New()
+		assert.Equals(t, "http://localhost:3000/admin/deliveries/x/replay", adminURL(conf, "deliveries", "x", "replay"))
+		conf.Listener.Address = "10.0.0.1:8080"
+		assert.Equals(t, "http://10.0.0.1:8080/admin/queue", adminURL(conf, "queue"))
+	})
+}
@@ -6,7 +6,8 @@ import (
 	"sync"
 	"time"
 
-	cmap "github.com/orcaman/concurrent-map"
+	"github.com/pleimer/ci-server-go/pkg/config"
+	"github.com/pleimer/ci-server-go/pkg/ghclient"
 	"github.com/pleimer/ci-server-go/pkg/job"
 	"github.com/pleimer/ci-server-go/pkg/logging"
 )
@@ -17,100 +18,154 @@ type jobContext struct {
 	cancel context.CancelFunc
 }
 
-type tracker struct {
-	jobContexts cmap.ConcurrentMap
+// JobManager manages set number of parallel running jobs and queues up extra
+// incoming jobs by priority.
+type JobManager struct {
+	// Jobs targeting the same reference of a repository share a conflict key. How they interact is
+	// decided by the concurrency policy of the repository:
+	// 1) cancel-in-progress: a new job cancels the running jobs of its key
+	// 2) queue: a new job waits until the running job of its key finishes
+	// 3) coalesce: as queue, but a new job drops the jobs of its key that are still waiting
+	// 4) parallel: jobs run independently
+	// Jobs that neither replace running jobs (see job.Replaces) nor run (see job.RecordOf) are not subject to
+	// the policy, and jobs that cancel all jobs of their key (see job.Cancels) do so whatever the policy.
+	// Running jobs are also cancelled when the parent context is cancelled, or when they run longer than jobTime
+	// (runner.jobTimeout), if set.
+	// Jobs that are queued or running are kept in the job store until they finish, so that jobs interrupted
+	// by a restart can be recovered. Their commits stay pinned in the cache meanwhile, so that their statuses can
+	// be updated. When draining, queued jobs are left in the job store and only the running jobs are waited for
+	lock    sync.Mutex
+	running map[string][]*jobContext // by conflict key
+	held    map[string][]*queuedJob  // by conflict key, jobs waiting for the running job of their key
+	// by conflict key, jobs cancelling their key that are not set up yet. Held jobs of the key stay
+	// held until those jobs drop them
+	cancelling map[string]int
+	pinned     map[job.Job]string // commits pinned in the cache for queued and running jobs
+
+	arrivals   chan job.Job // jobs waiting for setup
+	recovered  []job.Job    // jobs restored from the job store, set up before any arrival
+	jobQueue   *jobQueue
+	store      *jobStore
+	deliveries *ghclient.DeliveryLog // confirms the deliveries of stored jobs, if set
+	commits    *ghclient.Cache       // pins the commits of queued and running jobs, if set
+	workers    sync.WaitGroup
+	config     *config.Config
+	log        *logging.Logger
+	numWorkers int
+	jobTime    time.Duration
 }
 
-func (t *tracker) Get(repo string, ref string) (*jobContext, bool) {
-	ret, ok := t.jobContexts.Get(fmt.Sprintf("%s.%s", repo, ref))
-	if ret == nil {
-		return nil, ok
+// NewJobManager job manager factory. Jobs are stored in the "jobs" storage directory of conf, if set
+func NewJobManager(conf *config.Config, log *logging.Logger) (*JobManager, error) {
+	store, err := newJobStore(conf.StoragePath("jobs"))
+	if err != nil {
+		return nil, err
 	}
-	return ret.(*jobContext), ok
+	return &JobManager{
+		running:    make(map[string][]*jobContext),
+		held:       make(map[string][]*queuedJob),
+		cancelling: make(map[string]int),
+		pinned:     make(map[job.Job]string),
+		arrivals:   make(chan job.Job, 100),
+		jobQueue:   newJobQueue(conf.Runner.Priorities),
+		store:      store,
+		config:     conf,
+		log:        log,
+		numWorkers: conf.Runner.NumWorkers,
+		jobTime:    conf.Runner.JobTimeout,
+	}, nil
 }
 
-func (t *tracker) Set(repo string, ref string, jobContext *jobContext) {
-	t.jobContexts.Set(fmt.Sprintf("%s.%s", repo, ref), jobContext)
+// ConfirmDeliveries has the webhook deliveries of jobs confirmed in dl once the jobs are stored, so that
+// deliveries whose jobs were waiting for setup when the server stopped are accepted again. Must be called before Run
+func (jb *JobManager) ConfirmDeliveries(dl *ghclient.DeliveryLog) {
+	jb.deliveries = dl
 }
 
-func (t *tracker) Remove(repo string, ref string) {
-	t.jobContexts.Remove(fmt.Sprintf("%s.%s", repo, ref))
+// PinCommits keeps the commits of queued and running jobs indexed in cache, so that their statuses
+// can still be updated when many other commits are indexed meanwhile. Must be called before Run
+func (jb *JobManager) PinCommits(cache *ghclient.Cache) {
+	jb.commits = cache
 }
 
-// JobManager manages set number of parallel running jobs and queues up extra
-// incoming jobs.
-type JobManager struct {
-	// once a job begins running, it is subject to cancellation on the following events:
-	// 1) if a job targeted at the same github Ref arrives (in this case, it is replaced)
-	// 2) if the parent context cancel function is called
-	runningJobs tracker
-	jobQueue    chan job.Job
-	log         *logging.Logger
-	numWorkers  int
-	jobTime     time.Duration
-}
-
-// NewJobManager job manager factory
-func NewJobManager(numWorkers int, log *logging.Logger) *JobManager {
-	return &JobManager{
-		runningJobs: tracker{jobContexts: cmap.New()},
-		jobQueue:    make(chan job.Job, 100),
-		log:         log,
-		numWorkers:  numWorkers,
+// Recover restores the jobs left in the job store when the server stopped, using restore to create
+// them from their records. Depending on the recovery policy, the jobs are queued again once the job
+// manager runs, or their commits are marked errored. Must be called before Run
+func (jb *JobManager) Recover(restore func(job.Record) job.Job) error {
+	stored, err := jb.store.Load()
+	if err != nil {
+		return err
+	}
+
+	policy := jb.config.RecoveryPolicy()
+	for _, s := range stored {
+		j := restore(s.Record)
+		jb.store.Adopt(j, s)
+		if policy == config.RecoveryRequeue {
+			jb.recovered = append(jb.recovered, j)
+			jb.log.Metadata(map[string]interface{}{"process": "JobManager", "state": s.State})
+			jb.log.Info(fmt.Sprintf("recovered %s job", describe(s.Record.Info)))
+			continue
+		}
+		job.Discard(j, "interrupted by a server restart")
+		jb.logStore(jb.store.Remove(j))
+		jb.log.Metadata(map[string]interface{}{"process": "JobManager", "state": s.State})
+		jb.log.Info(fmt.Sprintf("marked interrupted %s job errored", describe(s.Record.Info)))
 	}
+	return nil
+}
+
+// Queue entries of the queued jobs, in the order they will run. Held jobs come last
+func (jb *JobManager) Queue() []QueueEntry {
+	entries := jb.jobQueue.List()
+
+	jb.lock.Lock()
+	defer jb.lock.Unlock()
+	for _, held := range jb.held {
+		for _, qj := range held {
+			entry := jb.jobQueue.entryAt(qj, len(entries)+1)
+			entry.Held = true
+			entries = append(entries, entry)
+		}
+	}
+	return entries
 }
 
 // Run main job manager process
 func (jb *JobManager) Run(ctx context.Context, wg *sync.WaitGroup, jobChan <-chan job.Job, authUsers []string) {
 	defer wg.Done()
 
-	workChan := make(chan func())
 	for w := 0; w < jb.numWorkers; w++ {
 		jb.log.Metadata(map[string]interface{}{"process": "JobManager"})
 		jb.log.Debug(fmt.Sprintf("created worker #%d", w))
 		wg.Add(1)
-		go jb.worker(ctx, wg, w, workChan)
+		jb.workers.Add(1)
+		go jb.worker(ctx, wg, w, authUsers)
 	}
 
+	// jobs are set up in order of arrival, so that they report being queued, then wait in the queue
 	wg.Add(1)
 	go func() {
 		defer wg.Done()
-		for {
-			select {
-			case <-ctx.Done():
-				return
-			case j, ok := <-jb.jobQueue:
-				if !ok {
-					jb.log.Metadata(map[string]interface{}{"process": "JobManager"})
-					jb.log.Debug("job queue disposed")
-					return
-				}
-
-				jCtx, jCancel := context.WithCancel(ctx)
-				jb.runningJobs.Set(j.GetRepoName(), j.GetRefName(), &jobContext{
-					job:    j,
-					cancel: jCancel,
-				})
-				j.Setup(jCtx, authUsers)
-				workChan <- func() {
-					j.Run(jCtx)
-					jb.runningJobs.Remove(j.GetRepoName(), j.GetRefName())
-				}
-			}
+		for _, j := range jb.recovered {
+			jb.enqueue(ctx, j, authUsers)
+		}
+		jb.recovered = nil
+		for j := range jb.arrivals {
+			jb.enqueue(ctx, j, authUsers)
 		}
 	}()
 
 	for {
 		select {
 		case j := <-jobChan:
-			if runningJob, ok := jb.runningJobs.Get(j.GetRepoName(), j.GetRefName()); ok {
-				runningJob.cancel()
-				jb.log.Metadata(map[string]interface{}{"process": "JobManager"})
-				jb.log.Info(fmt.Sprintf("conflicting job for repository %s, ref %s - cancelled running job", j.GetRepoName(), j.GetRefName()))
+			if job.Replaces(j, authUsers) && (job.Cancels(j, authUsers) || jb.policy(j) == config.ConcurrencyCancel) {
+				jb.cancelRunning(j, authUsers)
 			}
-			jb.jobQueue <- j
+			jb.arrivals <- j
 		case <-ctx.Done():
-			close(jb.jobQueue)
+			close(jb.arrivals)
+			jb.jobQueue.Dispose()
 			jb.log.Metadata(map[string]interface{}{"process": "JobManager"})
 			jb.log.Info("exited")
 			return
@@ -118,21 +173,270 @@ func (jb *JobManager) Run(ctx context.Context, wg *sync.WaitGroup, jobChan <-cha
 	}
 }
 
-func (jb *JobManager) worker(ctx context.Context, wg *sync.WaitGroup, num int, workerChan <-chan func()) {
+// enqueue sets up j and queues it
+func (jb *JobManager) enqueue(ctx context.Context, j job.Job, authUsers []string) {
+	j.Setup(ctx, authUsers)
+	jb.supersede(j, authUsers)
+	// stored before it is queued, so that a worker never marks it running before it is stored
+	err := jb.store.Put(j, time.Now())
+	jb.logStore(err)
+	jb.pin(j)
+	if err == nil && jb.deliveries != nil {
+		if delivery := job.DeliveryOf(j); delivery != "" {
+			jb.deliveries.Confirm(delivery)
+		}
+	}
+	entry, err := jb.jobQueue.Put(j)
+	if err != nil {
+		jb.log.Metadata(map[string]interface{}{"process": "JobManager", "error": err})
+		jb.log.Debug("job queue disposed")
+		if !jb.store.persistent() {
+			jb.drop(j, job.Describe(j))
+		}
+		return
+	}
+	jb.log.Metadata(map[string]interface{}{"process": "JobManager", "position": entry.Position, "priority": entry.Priority})
+	jb.log.Info(fmt.Sprintf("queued %s job", describe(entry.Info)))
+}
+
+// Drain stops running queued jobs and waits for the running jobs to finish, or for ctx to be done.
+// Jobs that did not start stay in the job store, to be recovered when the server starts again. Without
+// a storage directory they could not be recovered, so they are discarded instead
+func (jb *JobManager) Drain(ctx context.Context) error {
+	dropped := jb.jobQueue.Dispose()
+	if !jb.store.persistent() {
+		jb.lock.Lock()
+		for _, held := range jb.held {
+			dropped = append(dropped, held...)
+		}
+		jb.held = make(map[string][]*queuedJob)
+		jb.lock.Unlock()
+
+		for _, qj := range dropped {
+			jb.drop(qj.job, qj.info)
+		}
+	}
+	jb.log.Metadata(map[string]interface{}{"process": "JobManager"})
+	jb.log.Info("draining - waiting for running jobs to finish")
+
+	done := make(chan struct{})
+	go func() {
+		jb.workers.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (jb *JobManager) worker(ctx context.Context, wg *sync.WaitGroup, num int, authUsers []string) {
 	// worker will not immediately exit when context is cancelled until the job completes its cancel sequence
 	defer wg.Done()
+	defer jb.workers.Done()
 	for {
-		select {
-		case <-ctx.Done():
+		qj, err := jb.jobQueue.Get()
+		if err != nil || ctx.Err() != nil {
 			jb.log.Metadata(map[string]interface{}{"process": "JobManager"})
 			jb.log.Debug(fmt.Sprintf("worker #%d exited", num))
 			return
-		case j := <-workerChan:
-			jb.log.Metadata(map[string]interface{}{"process": "JobManager"})
-			jb.log.Info(fmt.Sprintf("worker #%d running job", num))
-			j()
+		}
+
+		jCtx, jc := jb.start(ctx, qj, authUsers)
+		if jc == nil {
+			continue
+		}
+		jb.log.Metadata(map[string]interface{}{"process": "JobManager"})
+		jb.log.Info(fmt.Sprintf("worker #%d running %s job", num, describe(qj.info)))
+		jb.logStore(jb.store.SetState(qj.job, jobRunning))
+		qj.job.Run(jCtx)
+		jc.cancel()
+		if ctx.Err() != nil {
+			// interrupted by the server stopping, the job runs again once recovered
+			jb.logStore(jb.store.SetState(qj.job, jobQueued))
+		} else {
+			jb.logStore(jb.store.Remove(qj.job))
+			jb.unpin(qj.job)
+		}
+		jb.finish(qj, jc)
+		jb.log.Metadata(map[string]interface{}{"process": "JobManager"})
+		jb.log.Info(fmt.Sprintf("worker #%d completed job", num))
+	}
+}
+
+// start tracks qj as running. Returns a nil job context if qj must wait for the running job of its key,
+// in which case it is held until that job finishes
+func (jb *JobManager) start(ctx context.Context, qj *queuedJob, authUsers []string) (context.Context, *jobContext) {
+	jb.lock.Lock()
+	defer jb.lock.Unlock()
+
+	// jobs that neither replace running jobs nor run must neither wait for them nor be tracked
+	_, runs := job.RecordOf(qj.job)
+	tracked := runs || job.Replaces(qj.job, authUsers)
+	if tracked && len(jb.running[qj.key]) > 0 {
+		switch jb.policy(qj.job) {
+		case config.ConcurrencyQueue, config.ConcurrencyCoalesce:
+			jb.held[qj.key] = append(jb.held[qj.key], qj)
 			jb.log.Metadata(map[string]interface{}{"process": "JobManager"})
-			jb.log.Info(fmt.Sprintf("worker #%d completed job", num))
+			jb.log.Info(fmt.Sprintf("holding %s job until the running job of its reference finishes", describe(qj.info)))
+			return nil, nil
 		}
 	}
+
+	var jCtx context.Context
+	var jCancel context.CancelFunc
+	if jb.jobTime > 0 {
+		jCtx, jCancel = context.WithTimeout(ctx, jb.jobTime)
+	} else {
+		jCtx, jCancel = context.WithCancel(ctx)
+	}
+	jc := &jobContext{job: qj.job, cancel: jCancel}
+	if tracked {
+		jb.running[qj.key] = append(jb.running[qj.key], jc)
+	}
+	return jCtx, jc
+}
+
+// finish stops tracking jc and queues the next held job of its key
+func (jb *JobManager) finish(qj *queuedJob, jc *jobContext) {
+	jb.lock.Lock()
+	defer jb.lock.Unlock()
+
+	running := jb.running[qj.key]
+	for i, r := range running {
+		if r == jc {
+			running = append(running[:i], running[i+1:]...)
+			break
+		}
+	}
+	if len(running) > 0 {
+		jb.running[qj.key] = running
+		return
+	}
+	delete(jb.running, qj.key)
+	if jb.cancelling[qj.key] > 0 {
+		return
+	}
+
+	held := jb.held[qj.key]
+	if len(held) == 0 {
+		return
+	}
+	if len(held) == 1 {
+		delete(jb.held, qj.key)
+	} else {
+		jb.held[qj.key] = held[1:]
+	}
+	if err := jb.jobQueue.Requeue(held[0]); err != nil {
+		jb.log.Metadata(map[string]interface{}{"process": "JobManager", "error": err})
+		jb.log.Debug("job queue disposed")
+	}
+}
+
+// cancelRunning cancels the running jobs with the conflict key of j
+func (jb *JobManager) cancelRunning(j job.Job, authUsers []string) {
+	jb.lock.Lock()
+	defer jb.lock.Unlock()
+
+	key := conflictKey(j)
+	if job.Cancels(j, authUsers) {
+		// otherwise a held job would start once the running job stops, before j drops it
+		jb.cancelling[key]++
+	}
+	running := jb.running[key]
+	for _, jc := range running {
+		jc.cancel()
+	}
+	if len(running) > 0 {
+		jb.log.Metadata(map[string]interface{}{"process": "JobManager"})
+		jb.log.Info(fmt.Sprintf("conflicting job for repository %s, ref %s - cancelled running job", j.GetRepoName(), j.GetRefName()))
+	}
+}
+
+// supersede drops the jobs waiting with the conflict key of j if j replaces them. Under cancel-in-progress
+// these are queued jobs that did not start before j arrived, which would otherwise run alongside j
+func (jb *JobManager) supersede(j job.Job, authUsers []string) {
+	if !job.Replaces(j, authUsers) {
+		return
+	}
+	cancels := job.Cancels(j, authUsers)
+	reason := "superseded by a newer job"
+	switch policy := jb.policy(j); {
+	case cancels:
+		reason = "canceled"
+	case policy != config.ConcurrencyCoalesce && policy != config.ConcurrencyCancel:
+		return
+	}
+
+	key := conflictKey(j)
+	jb.lock.Lock()
+	dropped := jb.held[key]
+	delete(jb.held, key)
+	if cancels && jb.cancelling[key] > 0 {
+		jb.cancelling[key]--
+		if jb.cancelling[key] == 0 {
+			delete(jb.cancelling, key)
+		}
+	}
+	jb.lock.Unlock()
+	dropped = append(dropped, jb.jobQueue.Discard(key)...)
+
+	for _, qj := range dropped {
+		job.Discard(qj.job, reason)
+		jb.logStore(jb.store.Remove(qj.job))
+		jb.unpin(qj.job)
+		jb.log.Metadata(map[string]interface{}{"process": "JobManager"})
+		jb.log.Info(fmt.Sprintf("dropped queued %s job: %s", describe(qj.info), reason))
+	}
+}
+
+// drop discards j, which did not run and cannot be recovered once the server stops
+func (jb *JobManager) drop(j job.Job, info job.Info) {
+	if _, ok := job.RecordOf(j); !ok {
+		return
+	}
+	job.Discard(j, "server stopped")
+	jb.logStore(jb.store.Remove(j))
+	jb.unpin(j)
+	jb.log.Metadata(map[string]interface{}{"process": "JobManager"})
+	jb.log.Warn(fmt.Sprintf("dropped queued %s job: storage.dir is not set, so it cannot be recovered after the server stops", describe(info)))
+}
+
+// pin keeps the commit of j indexed while j is queued or running. Jobs that will not run are not pinned
+func (jb *JobManager) pin(j job.Job) {
+	rec, ok := job.RecordOf(j)
+	if !ok || jb.commits == nil {
+		return
+	}
+	jb.lock.Lock()
+	jb.pinned[j] = rec.Commit.Sha
+	jb.lock.Unlock()
+	jb.commits.PinCommit(rec.Commit.Sha)
+}
+
+// unpin releases the commit of j once j finished or was dropped, after its final status was posted
+func (jb *JobManager) unpin(j job.Job) {
+	jb.lock.Lock()
+	sha, ok := jb.pinned[j]
+	delete(jb.pinned, j)
+	jb.lock.Unlock()
+	if ok {
+		jb.commits.UnpinCommit(sha)
+	}
+}
+
+// policy concurrency policy of the repository of j
+func (jb *JobManager) policy(j job.Job) string {
+	return jb.config.Repository(j.GetRepoName()).ConcurrencyPolicy()
+}
+
+// logStore logs failures to update the job store, which only matter if the server restarts
+func (jb *JobManager) logStore(err error) {
+	if err == nil {
+		return
+	}
+	jb.log.Metadata(map[string]interface{}{"process": "JobManager", "error": err})
+	jb.log.Warn("failed to update job store")
 }
@@ -0,0 +1,256 @@
+package server
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-collections/go-datastructures/queue"
+	"github.com/pleimer/ci-server-go/pkg/config"
+	"github.com/pleimer/ci-server-go/pkg/job"
+)
+
+// queuedJob job waiting in the job queue
+type queuedJob struct {
+	job      job.Job
+	info     job.Info
+	key      string // conflict key of the job
+	priority int
+	queued   time.Time
+	seq      uint64 // arrival order, breaks ties
+
+	// priority less the aging accumulated since the queue was created. With aging at the same rate
+	// for all jobs, ordering by rank is ordering by current priority, so that entries never need resorting
+	rank float64
+
+	discarded bool // dropped from the queue, skipped by Get
+}
+
+// Compare implements queue.Item. Jobs of higher rank come first, then jobs that arrived first.
+// Distinct jobs never compare equal, as the queue drops duplicates
+func (qj *queuedJob) Compare(other queue.Item) int {
+	o := other.(*queuedJob)
+	switch {
+	case qj.rank > o.rank:
+		return -1
+	case qj.rank < o.rank:
+		return 1
+	case qj.seq < o.seq:
+		return -1
+	case qj.seq > o.seq:
+		return 1
+	}
+	return 0
+}
+
+// QueueEntry state of a queued job
+type QueueEntry struct {
+	job.Info
+	Position int       `json:"position"` // starting at 1 for the next job to run
+	Priority int       `json:"priority"` // including aging
+	Queued   time.Time `json:"queued"`
+	Held     bool      `json:"held"` // waits for the running job of its reference
+}
+
+// jobQueue priority queue of jobs. Priorities are computed from the configuration when jobs are queued
+type jobQueue struct {
+	items      *queue.PriorityQueue
+	priorities config.Priorities
+
+	lock    sync.Mutex
+	waiting map[uint64]*queuedJob
+	seq     uint64
+	start   time.Time
+	now     func() time.Time
+}
+
+func newJobQueue(priorities config.Priorities) *jobQueue {
+	return &jobQueue{
+		items:      queue.NewPriorityQueue(100),
+		priorities: priorities,
+		waiting:    make(map[uint64]*queuedJob),
+		start:      time.Now(),
+		now:        time.Now,
+	}
+}
+
+// Put queues j. Returns the entry of j in the queue
+func (q *jobQueue) Put(j job.Job) (QueueEntry, error) {
+	q.lock.Lock()
+	q.seq++
+	now := q.now()
+	info := job.Describe(j)
+	qj := &queuedJob{
+		job:      j,
+		info:     info,
+		key:      conflictKey(j),
+		priority: q.priority(info),
+		queued:   now,
+		seq:      q.seq,
+	}
+	qj.rank = float64(qj.priority) - q.aging(now.Sub(q.start))
+	q.waiting[qj.seq] = qj
+	entry := q.entry(qj)
+	q.lock.Unlock()
+
+	if err := q.items.Put(qj); err != nil {
+		q.remove(qj)
+		return QueueEntry{}, err
+	}
+	return entry, nil
+}
+
+// Get removes the job of highest priority from the queue, waiting for one if the queue is empty.
+// Fails once the queue is disposed
+func (q *jobQueue) Get() (*queuedJob, error) {
+	for {
+		items, err := q.items.Get(1)
+		if err != nil {
+			return nil, err
+		}
+		qj := items[0].(*queuedJob)
+
+		q.lock.Lock()
+		discarded := qj.discarded
+		delete(q.waiting, qj.seq)
+		q.lock.Unlock()
+		if !discarded {
+			return qj, nil
+		}
+	}
+}
+
+// Requeue puts back job qj retrieved with Get, at the position it had
+func (q *jobQueue) Requeue(qj *queuedJob) error {
+	q.lock.Lock()
+	q.waiting[qj.seq] = qj
+	q.lock.Unlock()
+
+	if err := q.items.Put(qj); err != nil {
+		q.remove(qj)
+		return err
+	}
+	return nil
+}
+
+// Discard drops the queued jobs with conflict key. Returns the dropped jobs
+func (q *jobQueue) Discard(key string) []*queuedJob {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	dropped := []*queuedJob{}
+	for seq, qj := range q.waiting {
+		if qj.key == key {
+			qj.discarded = true
+			delete(q.waiting, seq)
+			dropped = append(dropped, qj)
+		}
+	}
+	sort.Slice(dropped, func(i, j int) bool {
+		return dropped[i].seq < dropped[j].seq
+	})
+	return dropped
+}
+
+// List entries of the queued jobs, in the order they will run
+func (q *jobQueue) List() []QueueEntry {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	ordered := q.ordered()
+	entries := make([]QueueEntry, 0, len(ordered))
+	for i, qj := range ordered {
+		entries = append(entries, q.entryAt(qj, i+1))
+	}
+	return entries
+}
+
+// Len number of queued jobs
+func (q *jobQueue) Len() int {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	return len(q.waiting)
+}
+
+// Dispose drops the queued jobs and releases waiting calls to Get. Returns the dropped jobs, in the
+// order they would have run
+func (q *jobQueue) Dispose() []*queuedJob {
+	q.items.Dispose()
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	dropped := q.ordered()
+	q.waiting = make(map[uint64]*queuedJob)
+	return dropped
+}
+
+func (q *jobQueue) remove(qj *queuedJob) {
+	q.lock.Lock()
+	delete(q.waiting, qj.seq)
+	q.lock.Unlock()
+}
+
+// entry of qj at its current position. Must be called with lock held
+func (q *jobQueue) entry(qj *queuedJob) QueueEntry {
+	for i, o := range q.ordered() {
+		if o == qj {
+			return q.entryAt(qj, i+1)
+		}
+	}
+	return q.entryAt(qj, 0)
+}
+
+// must be called with lock held
+func (q *jobQueue) ordered() []*queuedJob {
+	ordered := make([]*queuedJob, 0, len(q.waiting))
+	for _, qj := range q.waiting {
+		ordered = append(ordered, qj)
+	}
+	sort.Slice(ordered, func(i, j int) bool {
+		return ordered[i].Compare(ordered[j]) < 0
+	})
+	return ordered
+}
+
+func (q *jobQueue) entryAt(qj *queuedJob, position int) QueueEntry {
+	return QueueEntry{
+		Info:     qj.info,
+		Position: position,
+		Priority: qj.priority + int(q.aging(q.now().Sub(qj.queued))),
+		Queued:   qj.queued,
+	}
+}
+
+// aging priority gained by waiting for d
+func (q *jobQueue) aging(d time.Duration) float64 {
+	if q.priorities.Aging <= 0 {
+		return 0
+	}
+	return float64(d) / float64(q.priorities.Aging)
+}
+
+// priority of a job described by info when it is queued
+func (q *jobQueue) priority(info job.Info) int {
+	p := q.priorities.Types[info.Type] + q.priorities.Repository(info.Repo) + q.priorities.Users[info.User]
+	if info.DefaultBranch {
+		p += q.priorities.DefaultBranch
+	}
+	return p
+}
+
+// describe short description of a job for logs
+func describe(info job.Info) string {
+	parts := []string{}
+	for _, part := range []string{info.Type, info.Repo, info.Branch} {
+		if part != "" {
+			parts = append(parts, part)
+		}
+	}
+	return strings.Join(parts, " ")
+}
+
+// conflictKey jobs with the same key target the same reference of the same repository
+func conflictKey(j job.Job) string {
+	// ':' is valid neither in repository nor in reference names
+	return strings.ToLower(j.GetRepoName()) + ":" + j.GetRefName()
+}
@@ -0,0 +1,70 @@
+package server
+
+import (
+	"testing"
+	"time"
+
+	"github.com/pleimer/ci-server-go/pkg/assert"
+	"github.com/pleimer/ci-server-go/pkg/config"
+)
+
+func TestJobQueue(t *testing.T) {
+	priorities := config.Priorities{
+		Types:         map[string]int{"comment": 4, "push": 0},
+		DefaultBranch: 1,
+		Repositories:  map[string]int{"owner/important": 2},
+		Users:         map[string]int{"alice": 1},
+		Aging:         time.Minute,
+	}
+
+	now := time.Now()
+	q := newJobQueue(priorities)
+	q.start = now
+	q.now = func() time.Time { return now }
+
+	put := func(ref, jobType, repo string, wait time.Duration) {
+		now = now.Add(wait)
+		_, err := q.Put(&TestJob{Ref: ref, Repo: repo, Type: jobType})
+		assert.Ok(t, err)
+	}
+	branches := func() []string {
+		names := []string{}
+		for _, entry := range q.List() {
+			names = append(names, entry.Branch)
+		}
+		return names
+	}
+
+	put("old push", "push", "owner/example", 0)
+	put("important push", "push", "owner/important", time.Minute)
+	put("comment", "comment", "owner/example", time.Minute)
+	put("same comment", "comment", "owner/example", 0)
+
+	// waiting raised the old push to 2 and the important push to 3, comments keep their priority of 4
+	assert.Equals(t, []string{"comment", "same comment", "important push", "old push"}, branches())
+	entries := q.List()
+	assert.Equals(t, 2, entries[3].Priority)
+	assert.Equals(t, 3, entries[2].Priority)
+
+	t.Run("aging", func(t *testing.T) {
+		now = now.Add(2 * time.Minute)
+		put("new comment", "comment", "owner/example", 0)
+		// old push reached 4 like the new comment, and arrived first
+		assert.Equals(t, []string{"comment", "same comment", "important push", "old push", "new comment"}, branches())
+	})
+
+	t.Run("get", func(t *testing.T) {
+		j, err := q.Get()
+		assert.Ok(t, err)
+		assert.Equals(t, "comment", j.job.GetRefName())
+		assert.Equals(t, 4, len(q.List()))
+		assert.Equals(t, 1, q.List()[0].Position)
+	})
+
+	t.Run("dispose", func(t *testing.T) {
+		q.Dispose()
+		_, err := q.Get()
+		assert.Assert(t, err != nil, "disposed queue should fail")
+		assert.Equals(t, 0, len(q.List()))
+	})
+}
@@ -0,0 +1,191 @@
+package server
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pleimer/ci-server-go/pkg/job"
+)
+
+// states of stored jobs
+const (
+	jobQueued  = "queued"
+	jobRunning = "running"
+)
+
+// storedJob job persisted by the job store
+type storedJob struct {
+	ID     string     `json:"id"`
+	State  string     `json:"state"`
+	Queued time.Time  `json:"queued"`
+	Record job.Record `json:"record"`
+}
+
+// jobStore keeps the jobs that are queued or running, so that they can be restored when the server
+// restarts. Only jobs implementing job.Recorder are kept. If dir is set, each job is written to its own
+// file in dir, otherwise the jobs are kept in memory only
+type jobStore struct {
+	dir string
+
+	lock sync.Mutex
+	jobs map[job.Job]*storedJob
+}
+
+func newJobStore(dir string) (*jobStore, error) {
+	s := &jobStore{
+		dir:  dir,
+		jobs: make(map[job.Job]*storedJob),
+	}
+	if dir == "" {
+		return s, nil
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Put stores j as queued if it is set up to run, and forgets it otherwise. Jobs that are already
+// stored keep their ID and queue time
+func (s *jobStore) Put(j job.Job, queued time.Time) error {
+	rec, ok := job.RecordOf(j)
+	if !ok {
+		return s.Remove(j)
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	stored, ok := s.jobs[j]
+	if !ok {
+		ID, err := newJobID()
+		if err != nil {
+			return err
+		}
+		stored = &storedJob{ID: ID, Queued: queued}
+		s.jobs[j] = stored
+	}
+	stored.State = jobQueued
+	stored.Record = rec
+	return s.write(stored)
+}
+
+// persistent returns true if the stored jobs survive a restart of the server
+func (s *jobStore) persistent() bool {
+	return s.dir != ""
+}
+
+// Adopt keeps j, restored from stored, under the ID of stored
+func (s *jobStore) Adopt(j job.Job, stored storedJob) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.jobs[j] = &stored
+}
+
+// SetState updates the state of j, if stored
+func (s *jobStore) SetState(j job.Job, state string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	stored, ok := s.jobs[j]
+	if !ok || stored.State == state {
+		return nil
+	}
+	stored.State = state
+	return s.write(stored)
+}
+
+// Remove forgets j
+func (s *jobStore) Remove(j job.Job) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	stored, ok := s.jobs[j]
+	if !ok {
+		return nil
+	}
+	delete(s.jobs, j)
+	if s.dir == "" {
+		return nil
+	}
+	if err := os.Remove(s.path(stored.ID)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// Load reads the jobs left in dir by a previous run of the server, oldest first. Unreadable files are skipped
+func (s *jobStore) Load() ([]storedJob, error) {
+	if s.dir == "" {
+		return nil, nil
+	}
+	files, err := ioutil.ReadDir(s.dir)
+	if err != nil {
+		return nil, err
+	}
+
+	jobs := []storedJob{}
+	for _, f := range files {
+		if f.IsDir() || !strings.HasSuffix(f.Name(), ".json") {
+			continue
+		}
+		data, err := ioutil.ReadFile(filepath.Join(s.dir, f.Name()))
+		if err != nil {
+			continue
+		}
+		stored := storedJob{}
+		if err := json.Unmarshal(data, &stored); err != nil || stored.ID != strings.TrimSuffix(f.Name(), ".json") {
+			continue
+		}
+		jobs = append(jobs, stored)
+	}
+	sort.Slice(jobs, func(a, b int) bool {
+		return jobs[a].Queued.Before(jobs[b].Queued)
+	})
+	return jobs, nil
+}
+
+// must be called with lock held
+func (s *jobStore) write(stored *storedJob) error {
+	if s.dir == "" {
+		return nil
+	}
+	data, err := json.Marshal(stored)
+	if err != nil {
+		return err
+	}
+
+	path := s.path(stored.ID)
+	tmp, err := ioutil.TempFile(s.dir, filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+func (s *jobStore) path(ID string) string {
+	return filepath.Join(s.dir, ID+".json")
+}
+
+func newJobID() (string, error) {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
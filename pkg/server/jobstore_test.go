@@ -0,0 +1,209 @@
+package server
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pleimer/ci-server-go/pkg/assert"
+	"github.com/pleimer/ci-server-go/pkg/config"
+	"github.com/pleimer/ci-server-go/pkg/ghclient"
+	"github.com/pleimer/ci-server-go/pkg/job"
+	"github.com/pleimer/ci-server-go/pkg/logging"
+)
+
+func TestJobStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "jobs")
+	assert.Ok(t, err)
+	defer os.RemoveAll(dir)
+
+	store, err := newJobStore(dir)
+	assert.Ok(t, err)
+
+	rec := job.Record{Info: job.Info{Type: job.TypePush, Repo: "owner/example", Branch: "master"}, RefName: "refs/heads/master"}
+	a := &TestJob{record: &rec}
+	b := &TestJob{}
+	queued := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	assert.Ok(t, store.Put(a, queued))
+	assert.Ok(t, store.Put(b, queued))
+	assert.Ok(t, store.SetState(a, jobRunning))
+
+	t.Run("load", func(t *testing.T) {
+		restarted, err := newJobStore(dir)
+		assert.Ok(t, err)
+		stored, err := restarted.Load()
+		assert.Ok(t, err)
+		assert.Equals(t, 1, len(stored))
+		assert.Equals(t, jobRunning, stored[0].State)
+		assert.Equals(t, queued, stored[0].Queued.UTC())
+		assert.Equals(t, rec.Info, stored[0].Record.Info)
+	})
+
+	t.Run("adopted jobs keep their ID", func(t *testing.T) {
+		restarted, err := newJobStore(dir)
+		assert.Ok(t, err)
+		stored, err := restarted.Load()
+		assert.Ok(t, err)
+
+		c := &TestJob{record: &rec}
+		restarted.Adopt(c, stored[0])
+		assert.Ok(t, restarted.Put(c, time.Now()))
+		reloaded, err := restarted.Load()
+		assert.Ok(t, err)
+		assert.Equals(t, 1, len(reloaded))
+		assert.Equals(t, stored[0].ID, reloaded[0].ID)
+		assert.Equals(t, jobQueued, reloaded[0].State)
+		assert.Equals(t, queued, reloaded[0].Queued.UTC())
+	})
+
+	t.Run("remove", func(t *testing.T) {
+		assert.Ok(t, store.Remove(a))
+		assert.Ok(t, store.Remove(b))
+		stored, err := store.Load()
+		assert.Ok(t, err)
+		assert.Equals(t, 0, len(stored))
+	})
+
+	t.Run("in memory", func(t *testing.T) {
+		memory, err := newJobStore("")
+		assert.Ok(t, err)
+		assert.Ok(t, memory.Put(a, queued))
+		assert.Equals(t, 1, len(memory.jobs))
+		stored, err := memory.Load()
+		assert.Ok(t, err)
+		assert.Equals(t, 0, len(stored))
+	})
+}
+
+func TestJobRecovery(t *testing.T) {
+	l, err := logging.NewLogger(logging.NONE, "console")
+	assert.Ok(t, err)
+
+	newManager := func(dir, policy string) *JobManager {
+		conf := config.New()
+		conf.Runner.NumWorkers = 1
+		conf.Runner.Recovery = policy
+		conf.Storage.Dir = dir
+		jm, err := NewJobManager(conf, l)
+		assert.Ok(t, err)
+		return jm
+	}
+
+	// runs a job manager until the server stops, leaving an interrupted job behind
+	interrupt := func(t *testing.T, dir string) {
+		jm := newManager(dir, "")
+		var wg sync.WaitGroup
+		jobChan := make(chan job.Job)
+		ctx, cancel := context.WithCancel(context.Background())
+		wg.Add(1)
+		go jm.Run(ctx, &wg, jobChan, nil)
+
+		rec := job.Record{Info: job.Info{Type: job.TypePush, Repo: "owner/example", Branch: "master"}, RefName: "refs/heads/master"}
+		running := &TestJob{Ref: "refs/heads/master", Repo: "owner/example", started: make(chan struct{}), record: &rec}
+		jobChan <- running
+		<-running.started
+		cancel()
+		wg.Wait()
+		assert.Equals(t, job.CANCELED, running.status())
+	}
+
+	restore := func(restored *[]*TestJob) func(job.Record) job.Job {
+		return func(rec job.Record) job.Job {
+			tj := &TestJob{Ref: rec.RefName, Repo: rec.Info.Repo, started: make(chan struct{}), run: func() {}, record: &rec}
+			*restored = append(*restored, tj)
+			return tj
+		}
+	}
+
+	t.Run("requeue", func(t *testing.T) {
+		dir, err := ioutil.TempDir("", "jobs")
+		assert.Ok(t, err)
+		defer os.RemoveAll(dir)
+		interrupt(t, dir)
+
+		restored := []*TestJob{}
+		jm := newManager(dir, config.RecoveryRequeue)
+		assert.Ok(t, jm.Recover(restore(&restored)))
+		assert.Equals(t, 1, len(restored))
+
+		var wg sync.WaitGroup
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		wg.Add(1)
+		go jm.Run(ctx, &wg, make(chan job.Job), nil)
+
+		// the job is forgotten once it completes, so it is not recovered again
+		for {
+			stored, err := jm.store.Load()
+			assert.Ok(t, err)
+			if len(stored) == 0 {
+				break
+			}
+			if ctx.Err() != nil {
+				t.Fatal("recovered job did not complete")
+			}
+			time.Sleep(time.Millisecond)
+		}
+		cancel()
+		wg.Wait()
+		assert.Equals(t, job.COMPLETE, restored[0].status())
+	})
+
+	t.Run("deliveries confirmed once stored", func(t *testing.T) {
+		dir, err := ioutil.TempDir("", "jobs")
+		assert.Ok(t, err)
+		defer os.RemoveAll(dir)
+		path := filepath.Join(dir, "deliveries")
+		newLog := func() *ghclient.DeliveryLog {
+			dl, err := ghclient.NewDeliveryLog(path, time.Hour, 10)
+			assert.Ok(t, err)
+			return dl
+		}
+
+		dl := newLog()
+		assert.Assert(t, dl.Record("stored"), "delivery should be accepted")
+		assert.Assert(t, dl.Record("lost"), "delivery should be accepted")
+
+		jm := newManager(dir, "")
+		jm.ConfirmDeliveries(dl)
+		var wg sync.WaitGroup
+		jobChan := make(chan job.Job)
+		ctx, cancel := context.WithCancel(context.Background())
+		wg.Add(1)
+		go jm.Run(ctx, &wg, jobChan, nil)
+
+		rec := job.Record{Info: job.Info{Type: job.TypePush, Repo: "owner/example", Branch: "master"}, RefName: "refs/heads/master"}
+		stored := &TestJob{Ref: "refs/heads/master", Repo: "owner/example", started: make(chan struct{}), record: &rec, delivery: "stored"}
+		jobChan <- stored
+		<-stored.started
+		cancel()
+		wg.Wait()
+
+		// the job of the lost delivery never reached the job store, so a redelivery runs it after a restart
+		restarted := newLog()
+		assert.Assert(t, !restarted.Record("stored"), "delivery of a stored job should be dropped after restart")
+		assert.Assert(t, restarted.Record("lost"), "delivery without a stored job should be accepted after restart")
+	})
+
+	t.Run("error", func(t *testing.T) {
+		dir, err := ioutil.TempDir("", "jobs")
+		assert.Ok(t, err)
+		defer os.RemoveAll(dir)
+		interrupt(t, dir)
+
+		restored := []*TestJob{}
+		jm := newManager(dir, config.RecoveryError)
+		assert.Ok(t, jm.Recover(restore(&restored)))
+		assert.Equals(t, 1, len(restored))
+		assert.Equals(t, "interrupted by a server restart", restored[0].discardReason())
+		assert.Equals(t, 0, len(jm.recovered))
+
+		stored, err := jm.store.Load()
+		assert.Ok(t, err)
+		assert.Equals(t, 0, len(stored))
+	})
+}
@@ -3,11 +3,15 @@ package server
 import (
 	"context"
 	"fmt"
+	"io/ioutil"
+	"net/http"
 	"os"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/pkg/errors"
+	"github.com/pleimer/ci-server-go/pkg/agent"
 	"github.com/pleimer/ci-server-go/pkg/config"
 	"github.com/pleimer/ci-server-go/pkg/ghclient"
 	"github.com/pleimer/ci-server-go/pkg/job"
@@ -19,23 +23,23 @@ var (
 	logger       *logging.Logger
 	github       *ghclient.Client
 	jobManager   *JobManager
+	coordinator  *agent.Coordinator
 	eventChan    chan ghclient.Event
 	jobChan      chan job.Job
+
+	drainRequests = make(chan struct{})
+	drainOnce     sync.Once
 )
 
+// shutdownTimeout time given to open webhook connections when the server shuts down
+const shutdownTimeout = 5 * time.Second
+
 // Init initialize server resources
 func Init(configPath string) error {
-	serverConfig = config.New()
-
-	file, err := os.Open(configPath)
-	if err != nil {
-		return errors.Wrap(err, "failed opening configuration file")
-	}
-	defer file.Close()
-
-	err = serverConfig.Parse(file)
+	var err error
+	serverConfig, err = loadConfig(configPath)
 	if err != nil {
-		return errors.Wrap(err, "failed parsing configuration file")
+		return err
 	}
 
 	logger, err = logging.NewLogger(logging.FromString(serverConfig.Logger.Level), serverConfig.Logger.Target)
@@ -47,17 +51,86 @@ func Init(configPath string) error {
 
 	eventChan = make(chan ghclient.Event)
 	github = ghclient.NewClient(eventChan, serverConfig.Github.User)
-	err = github.Api.Authenticate(strings.NewReader(serverConfig.Github.Oauth))
+	github.Api.Log = logger
+	err = configureAPI()
 	if err != nil {
+		return errors.Wrap(err, "failed configuring github api")
+	}
+	github.Cache = ghclient.NewCacheWithLimits(ghclient.CacheLimits{
+		BlobBytes: int64(serverConfig.Cache.BlobMemory) << 20,
+		TreeBytes: int64(serverConfig.Cache.TreeMemory) << 20,
+		Commits:   serverConfig.Cache.Commits,
+	})
+	if blobDir := serverConfig.StoragePath("blobs"); blobDir != "" {
+		if err = github.Cache.SetBlobStore(blobDir); err != nil {
+			return errors.Wrap(err, "failed creating blob store")
+		}
+	}
+	github.Api.Responses, err = ghclient.NewResponseCache(serverConfig.StoragePath("http-cache"),
+		int64(serverConfig.Cache.Responses)<<20)
+	if err != nil {
+		return errors.Wrap(err, "failed creating response cache")
+	}
+	github.Deliveries, err = ghclient.NewDeliveryLog(serverConfig.StoragePath("deliveries"),
+		ghclient.DefaultDeliveryWindow, ghclient.DefaultDeliveryCapacity)
+	if err != nil {
+		return errors.Wrap(err, "failed loading delivery log")
+	}
+	github.Journal, err = ghclient.NewJournal(serverConfig.StoragePath("journal"), ghclient.DefaultJournalCapacity)
+	if err != nil {
+		return errors.Wrap(err, "failed loading delivery journal")
+	}
+	registerAgents()
+	registerAdmin()
+	github.Secrets = ghclient.WebhookSecrets{
+		Default:      serverConfig.Github.WebhookSecret,
+		Repositories: serverConfig.WebhookSecrets(),
+	}
+	if !github.Secrets.Enabled() {
+		logger.Metadata(map[string]interface{}{"module": "server"})
+		logger.Warn("no webhook secret configured - deliveries will not be verified")
+	}
+	if serverConfig.Github.Oauth != "" {
+		err = github.Api.Authenticate(strings.NewReader(serverConfig.Github.Oauth))
+		if err != nil {
+			logger.Metadata(map[string]interface{}{"module": "server", "error": err})
+			logger.Error("failed to authenticate github with oauth")
+			return err
+		}
+		logger.Metadata(map[string]interface{}{"module": "server"})
+		logger.Info("successfully authenticated github with oauth token")
+	}
+
+	if serverConfig.UseApp() {
+		err = authenticateApp()
+		if err != nil {
+			logger.Metadata(map[string]interface{}{"module": "server", "error": err})
+			logger.Error("failed to authenticate github app")
+			return err
+		}
+		logger.Metadata(map[string]interface{}{"module": "server", "app": serverConfig.Github.App.ID})
+		logger.Info("successfully authenticated as github app")
+	}
+
+	// events referencing configured repositories can be handled before any push for them arrives
+	if err = github.LoadRepositories(serverConfig.RepositoryNames(), logger); err != nil {
 		logger.Metadata(map[string]interface{}{"module": "server", "error": err})
-		logger.Error("failed to authenticate github with oauth")
-		return err
+		logger.Warn("not all repositories could be loaded, retrying on next refresh")
 	}
-	logger.Metadata(map[string]interface{}{"module": "server"})
-	logger.Info("successfully authenticated github with oauth token")
 
 	jobChan = make(chan job.Job)
-	jobManager = NewJobManager(serverConfig.Runner.NumWorkers, logger)
+	jobManager, err = NewJobManager(serverConfig, logger)
+	if err != nil {
+		return errors.Wrap(err, "failed creating job store")
+	}
+	jobManager.ConfirmDeliveries(github.Deliveries)
+	jobManager.PinCommits(&github.Cache)
+	err = jobManager.Recover(func(rec job.Record) job.Job {
+		return job.Restore(rec, github, serverConfig, logger)
+	})
+	if err != nil {
+		return errors.Wrap(err, "failed recovering jobs")
+	}
 
 	return nil
 }
@@ -78,13 +151,28 @@ func Run(ctx context.Context, wg *sync.WaitGroup) {
 	server := github.Listen(wg, serverConfig.Listener.Address, logger)
 	logger.Info(fmt.Sprintf("listening on %s for webhooks", serverConfig.Listener.Address))
 
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		github.RefreshRepositories(ctx, serverConfig.RepositoryNames(), serverConfig.Github.RefreshInterval, logger)
+	}()
+
 	wg.Add(1)
 	go jobManager.Run(ctx, wg, jobChan, serverConfig.Runner.AuthorizedUsers)
 
+	drainRequested := drainRequests
 	for {
 		select {
+		case <-drainRequested:
+			// events keep being turned into jobs while draining, so that deliveries that were already
+			// accepted end up in the job store
+			drainRequested = nil
+			go func() {
+				drain()
+				cancel()
+			}()
 		case ev := <-eventChan:
-			j, err := job.Factory(ev, github, logger)
+			j, err := job.Factory(ev, github, serverConfig, logger)
 			if err != nil {
 				logger.Metadata(map[string]interface{}{"process": "server", "error": err})
 				logger.Error("failed creating job from event")
@@ -92,15 +180,46 @@ func Run(ctx context.Context, wg *sync.WaitGroup) {
 			}
 			jobChan <- j
 		case <-ctx.Done():
-			if err := server.Shutdown(ctx); err != nil {
-				logger.Metadata(map[string]interface{}{"process": "server", "error": err})
-				logger.Error("failed shutting down server gracefully")
-			}
+			shutdown(server)
 			return
 		}
 	}
 }
 
+// Drain asks the running server to stop accepting webhooks, let the running jobs finish within
+// runner.drainTimeout, then shut down. Queued jobs are kept in the job store for the next start, if
+// storage.dir is set
+func Drain() {
+	drainOnce.Do(func() {
+		close(drainRequests)
+	})
+}
+
+func drain() {
+	logger.Metadata(map[string]interface{}{"process": "server", "timeout": serverConfig.Runner.DrainTimeout.String()})
+	logger.Info("draining - no longer accepting webhooks")
+	github.Drain()
+
+	ctx, cancel := context.WithTimeout(context.Background(), serverConfig.Runner.DrainTimeout)
+	defer cancel()
+	if err := jobManager.Drain(ctx); err != nil {
+		logger.Metadata(map[string]interface{}{"process": "server", "error": err})
+		logger.Warn("running jobs did not finish in time - cancelling them, they are recovered on the next start")
+		return
+	}
+	logger.Metadata(map[string]interface{}{"process": "server"})
+	logger.Info("drained")
+}
+
+func shutdown(server *http.Server) {
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		logger.Metadata(map[string]interface{}{"process": "server", "error": err})
+		logger.Error("failed shutting down server gracefully")
+	}
+}
+
 //Close cleanup server resources
 func Close() {
 	if err := checkResources(); err != nil {
@@ -120,6 +239,66 @@ func Close() {
 	fmt.Println("server exited cleanly")
 }
 
+func loadConfig(configPath string) (*config.Config, error) {
+	conf := config.New()
+
+	file, err := os.Open(configPath)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed opening configuration file")
+	}
+	defer file.Close()
+
+	err = conf.Parse(file)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed parsing configuration file")
+	}
+	return conf, nil
+}
+
+// configureAPI points the api client at the configured github instance
+func configureAPI() error {
+	gh := serverConfig.Github
+	endpoints := ghclient.GithubEndpoints
+	if gh.APIURL != "" {
+		endpoints = ghclient.EnterpriseEndpoints(gh.APIURL)
+	}
+	for _, override := range []struct {
+		value    string
+		endpoint *string
+	}{
+		{gh.UploadURL, &endpoints.Upload},
+		{gh.GistURL, &endpoints.Gist},
+		{gh.WebURL, &endpoints.Web},
+	} {
+		if override.value != "" {
+			*override.endpoint = override.value
+		}
+	}
+	github.Api.SetEndpoints(endpoints)
+
+	if gh.TLS.CAFile == "" && gh.TLS.CertFile == "" {
+		return nil
+	}
+	return github.Api.SetTLS(ghclient.TLSFiles{
+		CAFile:   gh.TLS.CAFile,
+		CertFile: gh.TLS.CertFile,
+		KeyFile:  gh.TLS.KeyFile,
+	})
+}
+
+func authenticateApp() error {
+	key, err := ioutil.ReadFile(serverConfig.Github.App.PrivateKey)
+	if err != nil {
+		return errors.Wrap(err, "failed reading app private key")
+	}
+
+	app, err := ghclient.NewAppAuth(serverConfig.Github.App.ID, key)
+	if err != nil {
+		return err
+	}
+	return github.Api.AuthenticateApp(app)
+}
+
 func checkResources() error {
 	if serverConfig == nil ||
 		logger == nil ||
@@ -2,12 +2,15 @@ package server
 
 import (
 	"context"
+	"io/ioutil"
+	"os"
 	"sync"
 	"testing"
 	"time"
 
-	"github.com/golang-collections/go-datastructures/queue"
 	"github.com/pleimer/ci-server-go/pkg/assert"
+	"github.com/pleimer/ci-server-go/pkg/config"
+	"github.com/pleimer/ci-server-go/pkg/ghclient"
 	"github.com/pleimer/ci-server-go/pkg/job"
 	"github.com/pleimer/ci-server-go/pkg/logging"
 )
@@ -16,8 +19,16 @@ type TestJob struct {
 	Status job.Status
 	Ref    string
 	Repo   string
+	Type   string
 
-	cancel context.CancelFunc
+	cancel    context.CancelFunc
+	started   chan struct{} // closed when the job starts running, if set
+	run       func()        // replaces waiting for the context, if set
+	cancels   bool
+	discarded string
+	record    *job.Record // persisted by the job store, if set
+	delivery  string
+	lock      sync.Mutex // guards Status and discarded, set by workers
 }
 
 func (tj *TestJob) GetRefName() string {
@@ -30,61 +41,160 @@ func (tj *TestJob) GetRepoName() string {
 
 func (tj *TestJob) Setup(ctx context.Context, authUsers []string) {}
 
+func (tj *TestJob) Info() job.Info {
+	return job.Info{Type: tj.Type, Repo: tj.Repo, Branch: tj.Ref}
+}
+
 func (tj *TestJob) Run(ctx context.Context) {
-	tj.Status = job.RUNNING
+	tj.setStatus(job.RUNNING)
+	if tj.started != nil {
+		close(tj.started)
+	}
+	if tj.run != nil {
+		tj.run()
+		tj.setStatus(job.COMPLETE)
+		return
+	}
 	<-ctx.Done()
 	if ctx.Err() == context.Canceled {
-		tj.Status = job.CANCELED
+		tj.setStatus(job.CANCELED)
 		return
 	}
-	tj.Status = job.COMPLETE
+	tj.setStatus(job.COMPLETE)
 }
 
-func (tj *TestJob) Compare(q queue.Item) int {
-	return 0
+func (tj *TestJob) setStatus(status job.Status) {
+	tj.lock.Lock()
+	defer tj.lock.Unlock()
+	tj.Status = status
+}
+
+func (tj *TestJob) status() job.Status {
+	tj.lock.Lock()
+	defer tj.lock.Unlock()
+	return tj.Status
 }
 
 func (tj *TestJob) SetLogger(l *logging.Logger) {
 
 }
 
-func TestJobManager(t *testing.T) {
-	l, err := logging.NewLogger(logging.DEBUG, "console")
-	assert.Ok(t, err)
+func (tj *TestJob) Cancels(authUsers []string) bool {
+	return tj.cancels
+}
 
+func (tj *TestJob) Discard(reason string) {
+	tj.lock.Lock()
+	defer tj.lock.Unlock()
+	tj.discarded = reason
+}
+
+func (tj *TestJob) discardReason() string {
+	tj.lock.Lock()
+	defer tj.lock.Unlock()
+	return tj.discarded
+}
+
+func (tj *TestJob) Delivery() string {
+	return tj.delivery
+}
+
+func (tj *TestJob) Record() (job.Record, bool) {
+	if tj.record == nil {
+		return job.Record{}, false
+	}
+	return *tj.record, true
+}
+
+func newTestJobManager(numWorkers int, priorities config.Priorities, repos ...config.RepositoryConfig) *JobManager {
+	l, err := logging.NewLogger(logging.NONE, "console")
+	if err != nil {
+		panic(err)
+	}
+	conf := config.New()
+	conf.Runner.NumWorkers = numWorkers
+	conf.Runner.Priorities = priorities
+	conf.Repositories = repos
+	jm, err := NewJobManager(conf, l)
+	if err != nil {
+		panic(err)
+	}
+	return jm
+}
+
+func TestJobManager(t *testing.T) {
 	t.Run("interfering jobs", func(t *testing.T) {
 
-		jmUT := NewJobManager(1, l)
+		jmUT := newTestJobManager(1, config.Priorities{})
 
 		var wg sync.WaitGroup
 		jobChan := make(chan job.Job)
-		ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*10)
+		ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*100)
 		defer cancel()
 
 		wg.Add(1)
 		go jmUT.Run(ctx, &wg, jobChan, nil)
 
 		original := &TestJob{
-			Ref:  "refs/head/master",
-			Repo: "github.com/haha/exa",
+			Ref:     "refs/head/master",
+			Repo:    "github.com/haha/exa",
+			started: make(chan struct{}),
 		}
 		jobChan <- original
+		<-original.started
 		jobChan <- &TestJob{
 			Ref:  "refs/head/master",
 			Repo: "github.com/haha/exa",
 		}
 		wg.Wait()
-		assert.Equals(t, job.CANCELED, original.Status)
+		assert.Equals(t, job.CANCELED, original.status())
+	})
+
+	t.Run("pull request actions that don't run a job", func(t *testing.T) {
+		jmUT := newTestJobManager(2, config.Priorities{})
+
+		var wg sync.WaitGroup
+		jobChan := make(chan job.Job)
+		ctx, cancel := context.WithCancel(context.Background())
+
+		wg.Add(1)
+		go jmUT.Run(ctx, &wg, jobChan, nil)
+
+		running := &TestJob{
+			Ref:     `"refs/heads/feature"`,
+			Repo:    "owner/example",
+			started: make(chan struct{}),
+		}
+		jobChan <- running
+		<-running.started
+
+		repo := ghclient.Repository{Name: "example"}
+		repo.Owner.Login = "owner"
+		labeled, err := job.Factory(&ghclient.PullRequest{
+			Repo:    repo,
+			Action:  "labeled",
+			Number:  1,
+			RefName: `"refs/heads/feature"`,
+		}, nil, config.New(), jmUT.log)
+		assert.Ok(t, err)
+		jobChan <- labeled
+		// the job manager handles arrivals in order, so the labeled event has been handled once this is received
+		jobChan <- &TestJob{Ref: "refs/heads/other", Repo: "owner/example", run: func() {}}
+		time.Sleep(50 * time.Millisecond)
+		assert.Equals(t, job.RUNNING, running.status())
+
+		cancel()
+		wg.Wait()
 	})
 
 	t.Run("more jobs than workers", func(t *testing.T) {
 
-		jmUT := NewJobManager(2, l)
+		jmUT := newTestJobManager(2, config.Priorities{})
 		jmUT.jobTime = time.Millisecond * 4
 
 		var wg sync.WaitGroup
 		jobChan := make(chan job.Job)
-		ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*10)
+		ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*100)
 		defer cancel()
 
 		wg.Add(1)
@@ -106,8 +216,375 @@ func TestJobManager(t *testing.T) {
 		jobChan <- b
 		jobChan <- c
 		wg.Wait()
-		assert.Equals(t, job.COMPLETE, a.Status)
-		assert.Equals(t, job.COMPLETE, b.Status)
-		assert.Equals(t, job.COMPLETE, c.Status)
+		assert.Equals(t, job.COMPLETE, a.status())
+		assert.Equals(t, job.COMPLETE, b.status())
+		assert.Equals(t, job.COMPLETE, c.status())
+	})
+
+	t.Run("priorities", func(t *testing.T) {
+		jmUT := newTestJobManager(1, config.Priorities{Types: map[string]int{"comment": 2, "push": 1}})
+
+		var wg sync.WaitGroup
+		jobChan := make(chan job.Job)
+		ctx, cancel := context.WithCancel(context.Background())
+
+		wg.Add(1)
+		go jmUT.Run(ctx, &wg, jobChan, nil)
+
+		var lock sync.Mutex
+		order := []string{}
+		done := make(chan struct{})
+		newJob := func(ref, jobType string) *TestJob {
+			return &TestJob{Ref: ref, Repo: "owner/exa", Type: jobType, run: func() {
+				lock.Lock()
+				defer lock.Unlock()
+				order = append(order, ref)
+				if len(order) == 4 {
+					close(done)
+				}
+			}}
+		}
+
+		// the blocker keeps the worker busy until the other jobs are queued
+		release := make(chan struct{})
+		blocker := newJob("blocker", "")
+		blocker.started = make(chan struct{})
+		run := blocker.run
+		blocker.run = func() {
+			<-release
+			run()
+		}
+		jobChan <- blocker
+		<-blocker.started
+
+		jobChan <- newJob("low", "")
+		jobChan <- newJob("push", "push")
+		jobChan <- newJob("comment", "comment")
+		for jmUT.jobQueue.Len() < 3 {
+			time.Sleep(time.Millisecond)
+		}
+
+		queued := jmUT.Queue()
+		assert.Equals(t, 3, len(queued))
+		assert.Equals(t, "comment", queued[0].Branch)
+		assert.Equals(t, 1, queued[0].Position)
+		assert.Equals(t, 2, queued[0].Priority)
+
+		close(release)
+		<-done
+		cancel()
+		wg.Wait()
+		assert.Equals(t, []string{"blocker", "comment", "push", "low"}, order)
+	})
+
+	t.Run("commits pinned while running", func(t *testing.T) {
+		jmUT := newTestJobManager(1, config.Priorities{})
+		cache := ghclient.NewCacheWithLimits(ghclient.CacheLimits{Commits: 1})
+		jmUT.PinCommits(&cache)
+
+		var wg sync.WaitGroup
+		jobChan := make(chan job.Job)
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		wg.Add(1)
+		go jmUT.Run(ctx, &wg, jobChan, nil)
+
+		cache.WriteCommits(&ghclient.Commit{Sha: "running"})
+		rec := job.Record{Info: job.Info{Repo: "owner/exa", Branch: "master"}, RefName: "refs/heads/master", Commit: ghclient.Commit{Sha: "running"}}
+		done := make(chan struct{})
+		running := &TestJob{Ref: "refs/heads/master", Repo: "owner/exa", record: &rec, run: func() {
+			cache.WriteCommits(&ghclient.Commit{Sha: "other"})
+			assert.Assert(t, cache.GetCommit("running") != nil, "commit of running job should stay indexed")
+			close(done)
+		}}
+		jobChan <- running
+		<-done
+
+		for {
+			jmUT.lock.Lock()
+			pinned := len(jmUT.pinned)
+			jmUT.lock.Unlock()
+			if pinned == 0 {
+				break
+			}
+			time.Sleep(time.Millisecond)
+		}
+		cache.WriteCommits(&ghclient.Commit{Sha: "next"})
+		assert.Assert(t, cache.GetCommit("running") == nil, "commit of finished job should be evictable")
+		cancel()
+		wg.Wait()
+	})
+}
+
+func TestConcurrencyPolicies(t *testing.T) {
+	repos := []config.RepositoryConfig{
+		{Name: "owner/cancel"},
+		{Name: "owner/queue", Concurrency: config.ConcurrencyQueue},
+		{Name: "owner/coalesce", Concurrency: config.ConcurrencyCoalesce},
+		{Name: "owner/parallel", Concurrency: config.ConcurrencyParallel},
+	}
+
+	// blocking job running until released
+	newJob := func(repo, name string, release chan struct{}) *TestJob {
+		tj := &TestJob{Ref: "refs/heads/master", Repo: repo, Type: name, started: make(chan struct{})}
+		tj.run = func() { <-release }
+		return tj
+	}
+	start := func() (*JobManager, chan<- job.Job, func()) {
+		jmUT := newTestJobManager(2, config.Priorities{}, repos...)
+		var wg sync.WaitGroup
+		jobChan := make(chan job.Job)
+		ctx, cancel := context.WithCancel(context.Background())
+		wg.Add(1)
+		go jmUT.Run(ctx, &wg, jobChan, nil)
+		return jmUT, jobChan, func() {
+			cancel()
+			wg.Wait()
+		}
+	}
+	waitFor := func(t *testing.T, condition func() bool) {
+		for deadline := time.Now().Add(time.Second); !condition(); time.Sleep(time.Millisecond) {
+			if time.Now().After(deadline) {
+				t.Fatal("timed out")
+			}
+		}
+	}
+	held := func(jmUT *JobManager) int {
+		count := 0
+		for _, entry := range jmUT.Queue() {
+			if entry.Held {
+				count++
+			}
+		}
+		return count
+	}
+
+	t.Run("conflict key includes owner", func(t *testing.T) {
+		jmUT, jobChan, stop := start()
+		first := &TestJob{Ref: "refs/heads/master", Repo: "alice/example", started: make(chan struct{})}
+		jobChan <- first
+		<-first.started
+		second := &TestJob{Ref: "refs/heads/master", Repo: "bob/example", started: make(chan struct{})}
+		jobChan <- second
+		<-second.started
+		assert.Equals(t, job.RUNNING, first.status())
+		assert.Equals(t, 0, len(jmUT.Queue()))
+		stop()
+	})
+
+	t.Run("queue", func(t *testing.T) {
+		jmUT, jobChan, stop := start()
+		release := make(chan struct{})
+		first, second := newJob("owner/queue", "first", release), newJob("owner/queue", "second", release)
+		jobChan <- first
+		<-first.started
+		jobChan <- second
+		waitFor(t, func() bool { return held(jmUT) == 1 })
+		assert.Equals(t, job.RUNNING, first.status())
+
+		close(release)
+		<-second.started
+		stop()
+		assert.Equals(t, job.COMPLETE, first.status())
+		assert.Equals(t, job.COMPLETE, second.status())
+	})
+
+	t.Run("coalesce", func(t *testing.T) {
+		jmUT, jobChan, stop := start()
+		release := make(chan struct{})
+		first := newJob("owner/coalesce", "first", release)
+		second := newJob("owner/coalesce", "second", release)
+		third := newJob("owner/coalesce", "third", release)
+		jobChan <- first
+		<-first.started
+		jobChan <- second
+		waitFor(t, func() bool { return held(jmUT) == 1 })
+		jobChan <- third
+		waitFor(t, func() bool { return second.discardReason() != "" && held(jmUT) == 1 })
+		assert.Equals(t, "superseded by a newer job", second.discardReason())
+
+		close(release)
+		<-third.started
+		stop()
+		assert.Equals(t, job.COMPLETE, first.status())
+		assert.Equals(t, job.COMPLETE, third.status())
+	})
+
+	t.Run("cancel-in-progress drops queued jobs", func(t *testing.T) {
+		jmUT, jobChan, stop := start()
+		release := make(chan struct{})
+		// keep all workers busy, so that the jobs of owner/cancel wait in the queue
+		busy := []*TestJob{newJob("owner/parallel", "busy", release), newJob("owner/parallel", "busy", release)}
+		for _, tj := range busy {
+			jobChan <- tj
+			<-tj.started
+		}
+		first, second := newJob("owner/cancel", "first", release), newJob("owner/cancel", "second", release)
+		jobChan <- first
+		waitFor(t, func() bool { return len(jmUT.Queue()) == 1 })
+		jobChan <- second
+		waitFor(t, func() bool { return first.discardReason() != "" })
+		assert.Equals(t, "superseded by a newer job", first.discardReason())
+		assert.Equals(t, 1, len(jmUT.Queue()))
+
+		close(release)
+		<-second.started
+		stop()
+		select {
+		case <-first.started:
+			t.Error("superseded job ran")
+		default:
+		}
+		assert.Equals(t, job.COMPLETE, second.status())
+	})
+
+	t.Run("cancel whatever the policy", func(t *testing.T) {
+		jmUT, jobChan, stop := start()
+		first := &TestJob{Ref: "refs/heads/master", Repo: "owner/queue", started: make(chan struct{})}
+		jobChan <- first
+		<-first.started
+		second := newJob("owner/queue", "second", make(chan struct{}))
+		jobChan <- second
+		waitFor(t, func() bool { return held(jmUT) == 1 })
+
+		jobChan <- &TestJob{Ref: "refs/heads/master", Repo: "owner/queue", cancels: true, run: func() {}}
+		waitFor(t, func() bool { return second.discardReason() != "" })
+		stop()
+		assert.Equals(t, job.CANCELED, first.status())
+		assert.Equals(t, "canceled", second.discardReason())
+	})
+
+	t.Run("parallel", func(t *testing.T) {
+		_, jobChan, stop := start()
+		release := make(chan struct{})
+		first, second := newJob("owner/parallel", "first", release), newJob("owner/parallel", "second", release)
+		jobChan <- first
+		jobChan <- second
+		<-first.started
+		<-second.started
+		close(release)
+		stop()
+	})
+}
+
+func TestJobManagerDrain(t *testing.T) {
+	rec := job.Record{Info: job.Info{Type: job.TypePush, Repo: "owner/example", Branch: "master"}}
+	stored := func(jm *JobManager, j job.Job) (string, bool) {
+		jm.store.lock.Lock()
+		defer jm.store.lock.Unlock()
+		s, ok := jm.store.jobs[j]
+		if !ok {
+			return "", false
+		}
+		return s.State, true
+	}
+	start := func(t *testing.T, storage bool) (*JobManager, chan<- job.Job, func()) {
+		jmUT := newTestJobManager(1, config.Priorities{})
+		if storage {
+			dir, err := ioutil.TempDir("", "jobs")
+			assert.Ok(t, err)
+			t.Cleanup(func() { os.RemoveAll(dir) })
+			jmUT.store, err = newJobStore(dir)
+			assert.Ok(t, err)
+		}
+		var wg sync.WaitGroup
+		jobChan := make(chan job.Job)
+		ctx, cancel := context.WithCancel(context.Background())
+		wg.Add(1)
+		go jmUT.Run(ctx, &wg, jobChan, nil)
+		return jmUT, jobChan, func() {
+			cancel()
+			wg.Wait()
+		}
+	}
+
+	t.Run("running jobs finish", func(t *testing.T) {
+		jmUT, jobChan, stop := start(t, true)
+		release := make(chan struct{})
+		running := &TestJob{Ref: "refs/heads/a", Repo: "owner/example", started: make(chan struct{}), record: &rec}
+		running.run = func() { <-release }
+		queued := &TestJob{Ref: "refs/heads/b", Repo: "owner/example", started: make(chan struct{}), record: &rec}
+		jobChan <- running
+		<-running.started
+		jobChan <- queued
+		for len(jmUT.Queue()) == 0 {
+			time.Sleep(time.Millisecond)
+		}
+
+		drained := make(chan error)
+		go func() {
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+			defer cancel()
+			drained <- jmUT.Drain(ctx)
+		}()
+		select {
+		case <-drained:
+			t.Fatal("drain should wait for the running job")
+		case <-time.After(10 * time.Millisecond):
+		}
+		close(release)
+		assert.Ok(t, <-drained)
+		stop()
+
+		assert.Equals(t, job.COMPLETE, running.status())
+		select {
+		case <-queued.started:
+			t.Error("queued job should not start while draining")
+		default:
+		}
+		_, ok := stored(jmUT, running)
+		assert.Assert(t, !ok, "completed job should be forgotten")
+		state, ok := stored(jmUT, queued)
+		assert.Assert(t, ok, "queued job should be kept for the next start")
+		assert.Equals(t, jobQueued, state)
+	})
+
+	t.Run("deadline", func(t *testing.T) {
+		jmUT, jobChan, stop := start(t, true)
+		running := &TestJob{Ref: "refs/heads/a", Repo: "owner/example", started: make(chan struct{}), record: &rec}
+		jobChan <- running
+		<-running.started
+
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+		defer cancel()
+		assert.Equals(t, context.DeadlineExceeded, jmUT.Drain(ctx))
+		stop()
+
+		assert.Equals(t, job.CANCELED, running.status())
+		state, ok := stored(jmUT, running)
+		assert.Assert(t, ok, "interrupted job should be kept for the next start")
+		assert.Equals(t, jobQueued, state)
+	})
+
+	t.Run("queued jobs dropped without storage", func(t *testing.T) {
+		jmUT, jobChan, stop := start(t, false)
+		release := make(chan struct{})
+		running := &TestJob{Ref: "refs/heads/a", Repo: "owner/example", started: make(chan struct{}), record: &rec}
+		running.run = func() { <-release }
+		queued := &TestJob{Ref: "refs/heads/b", Repo: "owner/example", started: make(chan struct{}), record: &rec}
+		jobChan <- running
+		<-running.started
+		jobChan <- queued
+		for len(jmUT.Queue()) == 0 {
+			time.Sleep(time.Millisecond)
+		}
+
+		drained := make(chan error)
+		go func() {
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+			defer cancel()
+			drained <- jmUT.Drain(ctx)
+		}()
+		for queued.discardReason() == "" {
+			time.Sleep(time.Millisecond)
+		}
+		close(release)
+		assert.Ok(t, <-drained)
+		stop()
+
+		assert.Equals(t, "server stopped", queued.discardReason())
+		_, ok := stored(jmUT, queued)
+		assert.Assert(t, !ok, "dropped job should be forgotten")
 	})
 }